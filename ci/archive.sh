@@ -19,6 +19,7 @@ cd $root
 cp $GOPATH/bin/$APP .
 tar cvzf $APP.$EXT \
     $APP \
+    system-eventtypes.json \
     workflow.cov \
     workflow.cov.txt \
     glide.lock \
@@ -1,5 +1,5 @@
 #!/bin/bash
-INDEX_NAME=alerts004
+INDEX_NAME=alerts010
 ALIAS_NAME=$1
 ES_IP=$2
 TESTING=$3
@@ -20,10 +20,83 @@ AlertMapping='
 				"type": "string",
 				"index": "not_analyzed"
 			},
+			"jobStatus": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"jobDataId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"jobEventId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"incidentId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"jobCompletedOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			},
 			"eventId": {
 				"type": "string",
 				"index": "not_analyzed"
 			},
+			"correlationId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"parentEventId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"status": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"assignee": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"notes": {
+				"type": "string"
+			},
+			"history": {
+				"properties": {
+					"from": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"to": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"assignee": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"note": {
+						"type": "string"
+					},
+					"changedBy": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"changedOn": {
+						"type": "date",
+						"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+					}
+				}
+			},
+			"revision": {
+				"type": "long"
+			},
+			"updatedOn": {
+				"type": "date",
+				
+			},
 			"createdBy": {
 				"type": "string",
 				"index": "not_analyzed"
@@ -0,0 +1,43 @@
+#!/bin/bash
+INDEX_NAME=areas001
+ALIAS_NAME=$1
+ES_IP=$2
+TESTING=$3
+
+AreaOfInterestMapping='
+	"AreaOfInterest": {
+		"dynamic": "strict",
+		"properties": {
+			"areaId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"name": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"description": {
+				"type": "string"
+			},
+			"geometry": {
+				"type": "geo_shape"
+			},
+			"createdBy": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"createdOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			}
+		}
+	}'
+IndexSettings="
+{
+	"\""mappings"\"": {
+		$AreaOfInterestMapping
+	}
+}"
+
+
+bash db/CreateIndex.sh $INDEX_NAME $ALIAS_NAME $ES_IP "$IndexSettings" "$AreaOfInterestMapping" $TESTING
\ No newline at end of file
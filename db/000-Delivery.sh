@@ -0,0 +1,64 @@
+#!/bin/bash
+INDEX_NAME=deliveries001
+ALIAS_NAME=$1
+ES_IP=$2
+TESTING=$3
+
+DeliveryMapping='
+	"Delivery": {
+		"dynamic": "strict",
+		"properties": {
+			"deliveryId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"alertId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"subscriptionId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"channel": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"status": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"attempts": {
+				"properties": {
+					"attemptedOn": {
+						"type": "date",
+						"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+					},
+					"error": {
+						"type": "string"
+					}
+				}
+			},
+			"nextAttemptOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			},
+			"createdOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			},
+			"deliveredOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			}
+		}
+	}'
+IndexSettings="
+{
+	"\""mappings"\"": {
+		$DeliveryMapping
+	}
+}"
+
+
+bash db/CreateIndex.sh $INDEX_NAME $ALIAS_NAME $ES_IP "$IndexSettings" "$DeliveryMapping" $TESTING
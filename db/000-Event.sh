@@ -1,5 +1,5 @@
 #!/bin/bash
-INDEX_NAME=events005
+INDEX_NAME=events008
 ALIAS_NAME=$1
 ES_IP=$2
 TESTING=$3
@@ -28,6 +28,20 @@ EventMapping='
 				"type": "date",
 				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
 			},
+			"correlationId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"parentEventId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"revision": {
+				"type": "long"
+			},
+			"eventTypeVersion": {
+				"type": "integer"
+			},
 			"cronSchedule": {
 				"type": "string",
 				"index": "not_analyzed"
@@ -1,5 +1,5 @@
 #!/bin/bash
-INDEX_NAME=eventtypes004
+INDEX_NAME=eventtypes007
 ALIAS_NAME=$1
 ES_IP=$2
 TESTING=$3
@@ -24,9 +24,23 @@ EventTypeMapping='
 				"type": "string",
 				"index": "not_analyzed"
 			},
+			"revision": {
+				"type": "long"
+			},
+			"version": {
+				"type": "integer"
+			},
+			"history": {
+				"dynamic": "false",
+				"type": "object"
+			},
 			"mapping": {
 				"dynamic": "false",
 				"type": "object"
+			},
+			"fields": {
+				"dynamic": "false",
+				"type": "object"
 			}
 		}
 	}'
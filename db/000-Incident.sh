@@ -0,0 +1,56 @@
+#!/bin/bash
+INDEX_NAME=incidents001
+ALIAS_NAME=$1
+ES_IP=$2
+TESTING=$3
+
+IncidentMapping='
+	"Incident": {
+		"dynamic": "strict",
+		"properties": {
+			"incidentId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"triggerId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"groupField": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"groupValue": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"alertCount": {
+				"type": "long"
+			},
+			"firstSeen": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			},
+			"lastSeen": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			},
+			"representativeEventId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"createdBy": {
+				"type": "string",
+				"index": "not_analyzed"
+			}
+		}
+	}'
+IndexSettings="
+{
+	"\""mappings"\"": {
+		$IncidentMapping
+	}
+}"
+
+
+bash db/CreateIndex.sh $INDEX_NAME $ALIAS_NAME $ES_IP "$IndexSettings" "$IncidentMapping" $TESTING
@@ -0,0 +1,67 @@
+#!/bin/bash
+INDEX_NAME=replays001
+ALIAS_NAME=$1
+ES_IP=$2
+TESTING=$3
+
+ReplayMapping='
+	"Replay": {
+		"dynamic": "strict",
+		"properties": {
+			"replayId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"request": {
+				"type": "object",
+				"enabled": false
+			},
+			"status": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"message": {
+				"type": "string"
+			},
+			"totalEvents": {
+				"type": "long"
+			},
+			"eventsProcessed": {
+				"type": "long"
+			},
+			"jobsSubmitted": {
+				"type": "long"
+			},
+			"alertsSkipped": {
+				"type": "long"
+			},
+			"matches": {
+				"type": "object",
+				"enabled": false
+			},
+			"errors": {
+				"type": "string",
+				"index": "no"
+			},
+			"cancelRequested": {
+				"type": "boolean"
+			},
+			"createdOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			},
+			"completedOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			}
+		}
+	}'
+IndexSettings="
+{
+	"\""mappings"\"": {
+		$ReplayMapping
+	}
+}"
+
+
+bash db/CreateIndex.sh $INDEX_NAME $ALIAS_NAME $ES_IP "$IndexSettings" "$ReplayMapping" $TESTING
@@ -0,0 +1,61 @@
+#!/bin/bash
+INDEX_NAME=subscriptions001
+ALIAS_NAME=$1
+ES_IP=$2
+TESTING=$3
+
+SubscriptionMapping='
+	"Subscription": {
+		"dynamic": "strict",
+		"properties": {
+			"subscriptionId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"triggerId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"eventTypeId": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"alertCreatedBy": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"channel": {
+				"properties": {
+					"type": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"url": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"to": {
+						"type": "string",
+						"index": "not_analyzed"
+					}
+				}
+			},
+			"createdBy": {
+				"type": "string",
+				"index": "not_analyzed"
+			},
+			"createdOn": {
+				"type": "date",
+				"format": "yyyy-MM-dd'\''T'\''HH:mm:ssZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSZZ||yyyy-MM-dd'\''T'\''HH:mm:ss.SSSSSSSZZ"
+			}
+		}
+	}'
+IndexSettings="
+{
+	"\""mappings"\"": {
+		$SubscriptionMapping
+	}
+}"
+
+
+bash db/CreateIndex.sh $INDEX_NAME $ALIAS_NAME $ES_IP "$IndexSettings" "$SubscriptionMapping" $TESTING
@@ -1,5 +1,5 @@
 #!/bin/bash
-INDEX_NAME=triggers004
+INDEX_NAME=triggers007
 ALIAS_NAME=$1
 ES_IP=$2
 TESTING=$3
@@ -28,6 +28,9 @@ TriggerMapping='
 				"type": "string",
 				"index": "not_analyzed"
 			},
+			"eventTypeVersion": {
+				"type": "integer"
+			},
 			"enabled": {
 				"type": "boolean"
 			},
@@ -47,6 +50,34 @@ TriggerMapping='
 					}
 				}
 			},
+			"geofence": {
+				"properties": {
+					"field": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"relation": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"areaId": {
+						"type": "string",
+						"index": "not_analyzed"
+					}
+				}
+			},
+			"grouping": {
+				"properties": {
+					"field": {
+						"type": "string",
+						"index": "not_analyzed"
+					},
+					"window": {
+						"type": "string",
+						"index": "not_analyzed"
+					}
+				}
+			},
 			"percolationId": {
 				"type": "string",
 				"index": "not_analyzed"
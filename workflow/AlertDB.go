@@ -48,6 +48,32 @@ func (db *AlertDB) PostData(alert *Alert) error {
 	return nil
 }
 
+// GetOneVersioned is GetOne in real time, with the version PutVersioned needs
+func (db *AlertDB) GetOneVersioned(id piazza.Ident) (*Alert, int64, bool, error) {
+	src, version, found, err := db.raw.GetVersioned(db.mapping, id.String())
+	if err != nil {
+		return nil, 0, false, LoggedError("AlertDB.GetOneVersioned failed: %s", err)
+	}
+	if !found {
+		return nil, 0, false, fmt.Errorf("alert %s could not be found", id)
+	}
+	var alert Alert
+	if err = json.Unmarshal(*src, &alert); err != nil {
+		return nil, 0, true, err
+	}
+	return &alert, version, true, nil
+}
+
+// PutVersioned replaces a stored alert, unless it has been written since it was read at
+// version, when it returns errVersionConflict
+func (db *AlertDB) PutVersioned(alert *Alert, version int64) error {
+	err := db.raw.PutVersioned(db.mapping, alert.AlertID.String(), alert, version)
+	if err != nil && err != errVersionConflict {
+		return LoggedError("AlertDB.PutVersioned failed: %s", err)
+	}
+	return err
+}
+
 func (db *AlertDB) GetAll(format *piazza.JsonPagination, actor string) ([]Alert, int64, error) {
 	alerts := []Alert{}
 
@@ -91,25 +117,25 @@ func (db *AlertDB) GetAlertsByDslQuery(dslString string, actor string) ([]Alert,
 		return alerts, 0, nil
 	}
 
-	searchResult, err := db.Esi.SearchByJSON(db.mapping, dslString)
-	if err != nil {
+	// searched raw, so that mock indices honor the query too
+	var dsl map[string]interface{}
+	if err = json.Unmarshal([]byte(dslString), &dsl); err != nil {
 		return nil, 0, LoggedError("AlertDB.GetAlertsByDslQuery failed: %s", err)
 	}
-	if searchResult == nil {
-		return nil, 0, LoggedError("AlertDB.GetAlertsByDslQuery failed: no searchResult")
+	searchResult, err := db.raw.Search(db.mapping, dsl)
+	if err != nil {
+		return nil, 0, LoggedError("AlertDB.GetAlertsByDslQuery failed: %s", err)
 	}
 
-	if searchResult != nil && searchResult.GetHits() != nil {
-		for _, hit := range *searchResult.GetHits() {
-			var alert Alert
-			if err := json.Unmarshal(*hit.Source, &alert); err != nil {
-				return nil, 0, err
-			}
-			alerts = append(alerts, alert)
+	for _, hit := range searchResult.Hits.Hits {
+		var alert Alert
+		if err := json.Unmarshal(*hit.Source, &alert); err != nil {
+			return nil, 0, err
 		}
+		alerts = append(alerts, alert)
 	}
 
-	return alerts, searchResult.TotalHits(), nil
+	return alerts, searchResult.Hits.Total, nil
 }
 
 func (db *AlertDB) GetAllByTrigger(format *piazza.JsonPagination, triggerID piazza.Ident, actor string) ([]Alert, int64, error) {
@@ -170,6 +196,60 @@ func (db *AlertDB) GetOne(id piazza.Ident, actor string) (*Alert, bool, error) {
 	return &alert, getResult.Found, nil
 }
 
+// GetTriggerIDsByEventID returns the triggers that have an alert for the event
+func (db *AlertDB) GetTriggerIDsByEventID(eventID piazza.Ident, actor string) (map[piazza.Ident]bool, error) {
+	result, err := db.raw.Search(db.mapping, map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventId": eventID.String()}},
+		"size":  0,
+		"aggs": map[string]interface{}{
+			"byTrigger": map[string]interface{}{"terms": map[string]interface{}{"field": "triggerId", "size": 0}},
+		},
+	})
+	if err != nil {
+		return nil, LoggedError("AlertDB.GetTriggerIDsByEventID failed: %s", err)
+	}
+	agg, err := result.Aggregation("byTrigger")
+	if err != nil {
+		return nil, err
+	}
+	triggerIDs := map[piazza.Ident]bool{}
+	for _, bucket := range agg.Buckets {
+		triggerIDs[piazza.Ident(fmt.Sprint(bucket.Key))] = true
+	}
+	return triggerIDs, nil
+}
+
+// GetOneByJobID returns the alert that started the job, or nil if there is none
+func (db *AlertDB) GetOneByJobID(jobID piazza.Ident, actor string) (*Alert, error) {
+	dsl := fmt.Sprintf(`{"query":{"term":{"jobId":%q}},"size":1}`, jobID.String())
+	alerts, _, err := db.GetAlertsByDslQuery(dsl, actor)
+	if err != nil {
+		return nil, err
+	}
+	if len(alerts) == 0 || alerts[0].JobID != jobID {
+		return nil, nil
+	}
+	return &alerts[0], nil
+}
+
+// GetAllByCorrelationID returns up to size of the alerts in a chain of events, oldest first
+func (db *AlertDB) GetAllByCorrelationID(correlationID piazza.Ident, size int, actor string) ([]Alert, int64, error) {
+	dsl := fmt.Sprintf(`{"query":{"term":{"correlationId":%q}},"sort":[{"createdOn":"asc"}],"size":%d}`, correlationID.String(), size)
+	return db.GetAlertsByDslQuery(dsl, actor)
+}
+
+// DeleteByIDs deletes the alerts in one request; alerts already gone are skipped
+func (db *AlertDB) DeleteByIDs(ids []piazza.Ident, actor string) error {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	if err := db.raw.BulkDelete(db.mapping, strs); err != nil {
+		return fmt.Errorf("AlertDB.DeleteByIDs failed: %s", err)
+	}
+	return nil
+}
+
 func (db *AlertDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
 	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
 	if err != nil {
@@ -0,0 +1,348 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// a feed holds this many of the newest alerts unless asked otherwise, and at most
+// maxAlertFeedSize
+const defaultAlertFeedSize = 50
+
+const maxAlertFeedSize = 200
+
+// an entry lists at most this many of its event's fields
+const maxAlertFeedFields = 10
+
+// AlertFeedNamespace holds the Atom extension elements that carry an entry's ids,
+// as named in atomEntry's tags
+const AlertFeedNamespace = "urn:venicegeo:pz-workflow:alert"
+
+// alertFeedIDPrefix starts the id of every alert feed
+const alertFeedIDPrefix = "urn:venicegeo:pz-workflow:alert-feed"
+
+// alertFeed is a prepared GET /alert/feed.atom: the newest alerts have been found,
+// which is enough to answer a conditional GET, but their triggers and events are
+// only fetched when the feed is rendered
+type alertFeed struct {
+	service      *Service
+	id           string
+	title        string
+	alerts       []Alert
+	etag         string
+	lastModified time.Time
+}
+
+// NewAlertFeed reads the feed's triggerId or createdBy, at least one of which is
+// needed, and its size, and finds the newest alerts
+func (service *Service) NewAlertFeed(params *piazza.HttpQueryParams) (*alertFeed, *piazza.JsonResponse) {
+	triggerID, err := params.GetAsID("triggerId", "")
+	if err != nil {
+		return nil, service.statusBadRequest(err)
+	}
+	createdBy, err := params.GetAsString("createdBy", "")
+	if err != nil {
+		return nil, service.statusBadRequest(err)
+	}
+	if triggerID == "" && createdBy == "" {
+		return nil, service.statusBadRequest(errors.New("an alert feed needs a triggerId or createdBy"))
+	}
+	sizeString, err := params.GetAsString("size", strconv.Itoa(defaultAlertFeedSize))
+	if err != nil {
+		return nil, service.statusBadRequest(err)
+	}
+	size, err := strconv.Atoi(sizeString)
+	if err != nil || size < 1 || size > maxAlertFeedSize {
+		return nil, service.statusBadRequest(fmt.Errorf("size must be a number from 1 to %d", maxAlertFeedSize))
+	}
+
+	must := []interface{}{}
+	titles := []string{}
+	if triggerID != "" {
+		trigger, found, err := service.triggerDB.GetOne(triggerID, "pz-workflow")
+		if !found {
+			return nil, service.statusNotFound(err)
+		}
+		if err != nil {
+			return nil, service.statusBadRequest(err)
+		}
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"triggerId": triggerID.String()}})
+		titles = append(titles, "trigger "+trigger.Name)
+	}
+	if createdBy != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"createdBy": createdBy}})
+		titles = append(titles, "user "+createdBy)
+	}
+	byts, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+		"sort":  []interface{}{map[string]interface{}{"createdOn": "desc"}, map[string]interface{}{"alertId": "desc"}},
+		"size":  size,
+	})
+	if err != nil {
+		return nil, service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAlertFeed", service.alertDB.mapping, "Service.NewAlertFeed: User is getting the alert feed of %s", strings.Join(titles, " and "))
+
+	alerts, _, err := service.alertDB.GetAlertsByDslQuery(string(byts), "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAlertFeedFailure", service.alertDB.mapping, "Service.NewAlertFeed: User failed to get the alert feed of %s", strings.Join(titles, " and "))
+		return nil, service.statusInternalError(err)
+	}
+
+	feed := &alertFeed{
+		service: service,
+		id:      alertFeedID(triggerID, createdBy),
+		title:   "Alerts of " + strings.Join(titles, " and "),
+		alerts:  alerts,
+	}
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\n%s\n%d\n", triggerID, createdBy, size)
+	for _, alert := range alerts {
+		fmt.Fprintf(hash, "%s %d\n", alert.AlertID, alert.Revision)
+		if updated := alertUpdated(&alert); updated.After(feed.lastModified) {
+			feed.lastModified = updated
+		}
+	}
+	feed.etag = `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	return feed, nil
+}
+
+// alertFeedID is the feed's atom:id, which depends only on what the feed follows so
+// that it stays the same however and wherever the feed is fetched
+func alertFeedID(triggerID piazza.Ident, createdBy string) string {
+	id := alertFeedIDPrefix
+	if triggerID != "" {
+		id += ":trigger:" + url.QueryEscape(triggerID.String())
+	}
+	if createdBy != "" {
+		id += ":user:" + url.QueryEscape(createdBy)
+	}
+	return id
+}
+
+// alertUpdated is when the alert last changed: its latest revision, or for alerts
+// stored before revisions were timed, its creation, its job's completion or its
+// latest change of state
+func alertUpdated(alert *Alert) time.Time {
+	updated := time.Time(alert.CreatedOn)
+	if alert.UpdatedOn != nil && time.Time(*alert.UpdatedOn).After(updated) {
+		updated = time.Time(*alert.UpdatedOn)
+	}
+	if alert.JobCompletedOn != nil && time.Time(*alert.JobCompletedOn).After(updated) {
+		updated = time.Time(*alert.JobCompletedOn)
+	}
+	for _, change := range alert.History {
+		if time.Time(change.ChangedOn).After(updated) {
+			updated = time.Time(change.ChangedOn)
+		}
+	}
+	return updated.UTC()
+}
+
+// ETag identifies the feed's content: the alerts and their revisions
+func (f *alertFeed) ETag() string {
+	return f.etag
+}
+
+// LastModified is when the newest change to the feed's alerts was made, or zero if
+// there are none
+func (f *alertFeed) LastModified() time.Time {
+	return f.lastModified
+}
+
+// NotModified is true if the conditional request headers show the client already
+// has the feed. As HTTP prescribes, If-Modified-Since is ignored when If-None-Match
+// is given.
+func (f *alertFeed) NotModified(ifNoneMatch string, ifModifiedSince string) bool {
+	if ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == f.etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ifModifiedSince == "" || f.lastModified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have whole seconds
+	return !f.lastModified.Truncate(time.Second).After(since)
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID          string           `xml:"id"`
+	Title       string           `xml:"title"`
+	Updated     string           `xml:"updated"`
+	Published   string           `xml:"published"`
+	Author      atomAuthor       `xml:"author"`
+	Summary     string           `xml:"summary"`
+	AlertID     piazza.Ident     `xml:"urn:venicegeo:pz-workflow:alert alertId"`
+	TriggerID   piazza.Ident     `xml:"urn:venicegeo:pz-workflow:alert triggerId"`
+	TriggerName string           `xml:"urn:venicegeo:pz-workflow:alert triggerName,omitempty"`
+	EventID     piazza.Ident     `xml:"urn:venicegeo:pz-workflow:alert eventId"`
+	JobID       piazza.Ident     `xml:"urn:venicegeo:pz-workflow:alert jobId,omitempty"`
+	JobStatus   string           `xml:"urn:venicegeo:pz-workflow:alert jobStatus,omitempty"`
+	Status      string           `xml:"urn:venicegeo:pz-workflow:alert status,omitempty"`
+	Fields      []atomEventField `xml:"urn:venicegeo:pz-workflow:alert field"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEventField struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Render fetches the alerts' triggers and events and writes the feed as Atom. selfURL
+// is where the feed was requested, given as its self link.
+func (f *alertFeed) Render(selfURL string) ([]byte, error) {
+	cache := newInflationCache(f.service)
+	triggerIDs := make([]piazza.Ident, len(f.alerts))
+	eventIDs := make([]piazza.Ident, len(f.alerts))
+	for i, alert := range f.alerts {
+		triggerIDs[i] = alert.TriggerID
+		eventIDs[i] = alert.EventID
+	}
+	if err := cache.loadTriggers(triggerIDs); err != nil {
+		return nil, err
+	}
+	if err := cache.loadEvents(eventIDs); err != nil {
+		return nil, err
+	}
+
+	updated := f.lastModified
+	if updated.IsZero() {
+		updated = time.Now().UTC()
+	}
+	feed := atomFeed{
+		ID:      f.id,
+		Title:   f.title,
+		Updated: updated.Format(time.RFC3339),
+		Links:   []atomLink{{Rel: "self", Href: selfURL}},
+		Entries: make([]atomEntry, len(f.alerts)),
+	}
+	for i, alert := range f.alerts {
+		feed.Entries[i] = alertFeedEntry(&alert, cache.trigger(alert.TriggerID), cache.events[alert.EventID])
+	}
+
+	byts, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), byts...), nil
+}
+
+// alertFeedEntry describes the alert; event is nil if it could not be found
+func alertFeedEntry(alert *Alert, trigger *Trigger, event *Event) atomEntry {
+	name := trigger.Name
+	if name == "" {
+		name = trigger.TriggerID.String()
+	}
+	entry := atomEntry{
+		ID:          "urn:uuid:" + alert.AlertID.String(),
+		Title:       fmt.Sprintf("Alert from trigger %s", name),
+		Updated:     alertUpdated(alert).Format(time.RFC3339),
+		Published:   time.Time(alert.CreatedOn).UTC().Format(time.RFC3339),
+		Author:      atomAuthor{Name: alert.CreatedBy},
+		AlertID:     alert.AlertID,
+		TriggerID:   alert.TriggerID,
+		TriggerName: trigger.Name,
+		EventID:     alert.EventID,
+		JobID:       alert.JobID,
+		JobStatus:   alert.JobStatus,
+		Status:      alert.Status,
+		Fields:      []atomEventField{},
+	}
+	if event != nil {
+		if data, ok := event.Data[storedEventTypeName(event)].(map[string]interface{}); ok {
+			entry.Fields = alertFeedFields(data)
+		}
+	}
+
+	lines := []string{fmt.Sprintf("Trigger %s fired on event %s.", name, alert.EventID)}
+	if alert.JobID != "" {
+		job := "Job " + alert.JobID.String()
+		if alert.JobStatus != "" {
+			job += " is " + alert.JobStatus
+		}
+		lines = append(lines, job+".")
+	}
+	for _, field := range entry.Fields {
+		lines = append(lines, field.Name+": "+field.Value)
+	}
+	entry.Summary = strings.Join(lines, "\n")
+	return entry
+}
+
+// alertFeedFields picks the event's key fields: its top-level strings, numbers and
+// booleans, in name order
+func alertFeedFields(data map[string]interface{}) []atomEventField {
+	names := []string{}
+	for name, value := range data {
+		switch value.(type) {
+		case string, float64, bool:
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxAlertFeedFields {
+		names = names[:maxAlertFeedFields]
+	}
+	fields := make([]atomEventField, len(names))
+	for i, name := range names {
+		value := fmt.Sprint(data[name])
+		if n, ok := data[name].(float64); ok {
+			value = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		fields[i] = atomEventField{Name: name, Value: value}
+	}
+	return fields
+}
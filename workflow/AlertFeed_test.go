@@ -0,0 +1,154 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestAlertUpdated(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	alert := &Alert{CreatedOn: piazza.TimeStamp(created)}
+	assert.Equal(created, alertUpdated(alert))
+
+	completed := piazza.TimeStamp(created.Add(time.Minute))
+	alert.JobCompletedOn = &completed
+	alert.History = []AlertStateChange{{ChangedOn: piazza.TimeStamp(created.Add(time.Hour))}}
+	assert.Equal(created.Add(time.Hour), alertUpdated(alert))
+
+	updated := piazza.TimeStamp(created.Add(2 * time.Hour))
+	alert.UpdatedOn = &updated
+	assert.Equal(created.Add(2*time.Hour), alertUpdated(alert))
+}
+
+func TestAlertFeedLastModified(t *testing.T) {
+	assert := assert.New(t)
+	service := newTestService(t, nil)
+
+	resp := service.PostAlert(&Alert{TriggerID: "t1", EventID: "e1", CreatedBy: "someone"})
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	alert := resp.Data.(*Alert)
+	assert.Nil(alert.UpdatedOn)
+
+	feed, errResp := service.NewAlertFeed(testQueryParams(t, "/alert/feed?createdBy=someone"))
+	assert.Nil(errResp)
+	// stored times have milliseconds
+	assert.Equal(time.Time(alert.CreatedOn).UTC().Truncate(time.Millisecond), feed.LastModified())
+
+	// a change with no history, such as to the notes, still moves the feed on
+	time.Sleep(5 * time.Millisecond)
+	notes := "looked at"
+	resp = service.PutAlert(alert.AlertID, &AlertUpdate{Notes: &notes, Revision: alert.Revision})
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	updated := resp.Data.(*Alert)
+	assert.NotNil(updated.UpdatedOn)
+	assert.Empty(updated.History)
+
+	changed, errResp := service.NewAlertFeed(testQueryParams(t, "/alert/feed?createdBy=someone"))
+	assert.Nil(errResp)
+	assert.Equal(time.Time(*updated.UpdatedOn).UTC().Truncate(time.Millisecond), changed.LastModified())
+	assert.True(changed.LastModified().After(feed.LastModified()))
+	assert.NotEqual(feed.ETag(), changed.ETag())
+}
+
+func TestAlertFeedID(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("urn:venicegeo:pz-workflow:alert-feed:trigger:t1", alertFeedID("t1", ""))
+	assert.Equal("urn:venicegeo:pz-workflow:alert-feed:user:jo+smith", alertFeedID("", "jo smith"))
+	assert.Equal("urn:venicegeo:pz-workflow:alert-feed:trigger:t1:user:jo", alertFeedID("t1", "jo"))
+}
+
+func TestAlertFeedNotModified(t *testing.T) {
+	assert := assert.New(t)
+
+	modified := time.Date(2016, 8, 1, 12, 0, 0, 500, time.UTC)
+	feed := &alertFeed{etag: `"abc"`, lastModified: modified}
+
+	assert.True(feed.NotModified(`"abc"`, ""))
+	assert.True(feed.NotModified(`"xyz", W/"abc"`, ""))
+	assert.True(feed.NotModified("*", ""))
+	assert.False(feed.NotModified(`"xyz"`, ""))
+	assert.False(feed.NotModified("", ""))
+
+	assert.True(feed.NotModified("", modified.Format(http.TimeFormat)))
+	assert.True(feed.NotModified("", modified.Add(time.Hour).Format(http.TimeFormat)))
+	assert.False(feed.NotModified("", modified.Add(-time.Second).Format(http.TimeFormat)))
+	assert.False(feed.NotModified("", "yesterday"))
+
+	// If-None-Match wins over If-Modified-Since
+	assert.False(feed.NotModified(`"xyz"`, modified.Format(http.TimeFormat)))
+
+	// an empty feed has no modification time to compare
+	assert.False((&alertFeed{etag: `"abc"`}).NotModified("", modified.Format(http.TimeFormat)))
+}
+
+func TestAlertFeedEntry(t *testing.T) {
+	assert := assert.New(t)
+
+	created := time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC)
+	alert := &Alert{
+		AlertID:   "a1",
+		TriggerID: "t1",
+		EventID:   "e1",
+		JobID:     "j1",
+		JobStatus: JobStatusSucceeded,
+		Status:    AlertStatusOpen,
+		CreatedBy: "someone",
+		CreatedOn: piazza.TimeStamp(created),
+	}
+	event := &Event{EventID: "e1", Data: map[string]interface{}{
+		"quake": map[string]interface{}{
+			"magnitude": 6.5,
+			"place":     "offshore",
+			"depth":     1000000.0,
+			"where":     map[string]interface{}{"lat": 1.0, "lon": 2.0},
+		},
+	}}
+
+	entry := alertFeedEntry(alert, &Trigger{TriggerID: "t1", Name: "big quakes"}, event)
+	assert.Equal("urn:uuid:a1", entry.ID)
+	assert.Equal("Alert from trigger big quakes", entry.Title)
+	assert.Equal("2016-08-01T12:00:00Z", entry.Published)
+	assert.Equal("big quakes", entry.TriggerName)
+	assert.Equal(piazza.Ident("j1"), entry.JobID)
+	assert.Equal([]atomEventField{
+		{Name: "depth", Value: "1000000"},
+		{Name: "magnitude", Value: "6.5"},
+		{Name: "place", Value: "offshore"},
+	}, entry.Fields)
+	assert.Contains(entry.Summary, "Job j1 is succeeded.")
+	assert.Contains(entry.Summary, "place: offshore")
+
+	// a trigger or event that is gone still gives an entry
+	entry = alertFeedEntry(alert, &Trigger{TriggerID: "t1"}, nil)
+	assert.Equal("Alert from trigger t1", entry.Title)
+	assert.Empty(entry.Fields)
+
+	byts, err := xml.Marshal(atomFeed{ID: "urn:feed", Entries: []atomEntry{entry}})
+	assert.NoError(err)
+	xmlString := string(byts)
+	assert.True(strings.HasPrefix(xmlString, `<feed xmlns="http://www.w3.org/2005/Atom">`))
+	assert.Contains(xmlString, `<jobId xmlns="`+AlertFeedNamespace+`">j1</jobId>`)
+}
@@ -0,0 +1,274 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// alertTransitions are the statuses an alert may move to from each status. An
+// alert's assignee and notes can be changed whatever its status.
+var alertTransitions = map[string][]string{
+	AlertStatusOpen:         {AlertStatusAcknowledged, AlertStatusResolved, AlertStatusSuppressed},
+	AlertStatusAcknowledged: {AlertStatusOpen, AlertStatusResolved, AlertStatusSuppressed},
+	AlertStatusResolved:     {AlertStatusOpen},
+	AlertStatusSuppressed:   {AlertStatusOpen},
+}
+
+func isAlertStatus(s string) bool {
+	_, ok := alertTransitions[s]
+	return ok
+}
+
+// alertStatus is the alert's status. Alerts stored before they had a lifecycle have
+// none, and are open.
+func alertStatus(alert *Alert) string {
+	if alert.Status == "" {
+		return AlertStatusOpen
+	}
+	return alert.Status
+}
+
+// changeAlertState moves the alert to the status, which may be its current one, and
+// records the change in its history. A nil assignee leaves the assignee as it is.
+func changeAlertState(alert *Alert, status string, assignee *string, note string, changedBy string) error {
+	if !isAlertStatus(status) {
+		return fmt.Errorf("%q is not an alert status", status)
+	}
+	from := alertStatus(alert)
+	if status != from {
+		allowed := false
+		for _, s := range alertTransitions[from] {
+			allowed = allowed || s == status
+		}
+		if !allowed {
+			return fmt.Errorf("an alert cannot go from %s to %s", from, status)
+		}
+	}
+
+	change := AlertStateChange{
+		From:      from,
+		To:        status,
+		Note:      note,
+		ChangedBy: changedBy,
+		ChangedOn: piazza.NewTimeStamp(),
+	}
+	alert.Status = status
+	if assignee != nil {
+		alert.Assignee = *assignee
+	}
+	change.Assignee = alert.Assignee
+	alert.History = append(alert.History, change)
+	return nil
+}
+
+// reviseAlert marks a change to the alert, which is about to be written: its
+// revision goes up and it records when
+func reviseAlert(alert *Alert) {
+	now := piazza.NewTimeStamp()
+	alert.Revision++
+	alert.UpdatedOn = &now
+}
+
+// PutAlertState moves an alert through its lifecycle, e.g. acknowledging it and
+// assigning it to whoever will handle it
+func (service *Service) PutAlertState(id piazza.Ident, update *AlertStateUpdate) *piazza.JsonResponse {
+	defer service.handlePanic()
+	alert, version, found, err := service.alertDB.GetOneVersioned(id)
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if alert.Revision != update.Revision {
+		return service.statusConflict(fmt.Errorf("alert %s is at revision %d, not %d", id, alert.Revision, update.Revision))
+	}
+	if err = changeAlertState(alert, update.Status, update.Assignee, update.Note, update.ChangedBy); err != nil {
+		return service.statusBadRequest(err)
+	}
+	reviseAlert(alert)
+
+	service.syslogger.Audit(update.ChangedBy, "updatingAlertState", id, "Service.PutAlertState: User [%s] is moving alert [%s] to %s", update.ChangedBy, id, alert.Status)
+
+	if err = service.alertDB.PutVersioned(alert, version); err != nil {
+		service.syslogger.Audit(update.ChangedBy, "updatingAlertStateFailure", id, "Service.PutAlertState: User [%s] failed to move alert [%s] to %s", update.ChangedBy, id, alert.Status)
+		return service.statusWriteFailed(err)
+	}
+
+	service.syslogger.Audit(update.ChangedBy, "updatedAlertState", id, "Service.PutAlertState: User [%s] successfully moved alert [%s] to %s, assigned to [%s]", update.ChangedBy, id, alert.Status, alert.Assignee)
+
+	return service.statusOK(alert)
+}
+
+// AlertFilter narrows an alert listing or query by lifecycle. On the query string:
+//
+//	status=open,acknowledged   alerts in any of the statuses
+//	assignee=someone           alerts assigned to someone
+//	unassigned=true            alerts assigned to no one
+//	jobStatus=failed,cancelled alerts whose job is in any of the statuses
+//	incidentId=...             alerts grouped into the incident
+type AlertFilter struct {
+	Statuses    []string
+	Assignee    string
+	Unassigned  bool
+	JobStatuses []string
+	IncidentID  piazza.Ident
+}
+
+// IsEmpty is true if the filter does nothing
+func (f *AlertFilter) IsEmpty() bool {
+	return len(f.Statuses) == 0 && f.Assignee == "" && !f.Unassigned && len(f.JobStatuses) == 0 && f.IncidentID == ""
+}
+
+// Values encodes the filter as query parameters for GET /alert
+func (f *AlertFilter) Values() url.Values {
+	v := url.Values{}
+	if len(f.Statuses) > 0 {
+		v.Set("status", strings.Join(f.Statuses, ","))
+	}
+	if f.Assignee != "" {
+		v.Set("assignee", f.Assignee)
+	}
+	if f.Unassigned {
+		v.Set("unassigned", "true")
+	}
+	if len(f.JobStatuses) > 0 {
+		v.Set("jobStatus", strings.Join(f.JobStatuses, ","))
+	}
+	if f.IncidentID != "" {
+		v.Set("incidentId", f.IncidentID.String())
+	}
+	return v
+}
+
+func parseAlertFilter(params *piazza.HttpQueryParams) (*AlertFilter, error) {
+	f := &AlertFilter{}
+
+	var err error
+	if f.Statuses, err = alertFilterList(params, "status", isAlertStatus); err != nil {
+		return nil, err
+	}
+	if f.JobStatuses, err = alertFilterList(params, "jobStatus", isJobStatus); err != nil {
+		return nil, err
+	}
+
+	if f.Assignee, err = params.GetAsString("assignee", ""); err != nil {
+		return nil, err
+	}
+	if f.IncidentID, err = params.GetAsID("incidentId", ""); err != nil {
+		return nil, err
+	}
+	unassigned, err := params.GetAsString("unassigned", "false")
+	if err != nil {
+		return nil, err
+	}
+	f.Unassigned = unassigned == "true"
+	if f.Unassigned && f.Assignee != "" {
+		return nil, errors.New("assignee and unassigned cannot both be given")
+	}
+	return f, nil
+}
+
+// alertFilterList reads a comma-separated list of statuses
+func alertFilterList(params *piazza.HttpQueryParams, name string, valid func(string) bool) ([]string, error) {
+	list, err := params.GetAsString(name, "")
+	if err != nil {
+		return nil, err
+	}
+	var statuses []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !valid(s) {
+			return nil, fmt.Errorf("%s: %q is not a valid status", name, s)
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// clauses returns the filter as query clauses, all of which must match
+func (f *AlertFilter) clauses() []interface{} {
+	must := []interface{}{}
+	if len(f.Statuses) > 0 {
+		must = append(must, statusClause(f.Statuses))
+	}
+	if f.Assignee != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"assignee": f.Assignee}})
+	}
+	if len(f.JobStatuses) > 0 {
+		must = append(must, map[string]interface{}{"terms": map[string]interface{}{"jobStatus": f.JobStatuses}})
+	}
+	if f.IncidentID != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"incidentId": f.IncidentID.String()}})
+	}
+	if f.Unassigned {
+		must = append(must, map[string]interface{}{"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "assignee"}},
+		}})
+	}
+	return must
+}
+
+// statusClause matches alerts in any of the statuses. Alerts stored without a status
+// are open.
+func statusClause(statuses []string) map[string]interface{} {
+	clause := map[string]interface{}{"terms": map[string]interface{}{"status": statuses}}
+	for _, status := range statuses {
+		if status != AlertStatusOpen {
+			continue
+		}
+		return map[string]interface{}{"bool": map[string]interface{}{
+			"should": []interface{}{
+				clause,
+				map[string]interface{}{"bool": map[string]interface{}{
+					"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": "status"}},
+				}},
+			},
+			"minimum_should_match": 1,
+		}}
+	}
+	return clause
+}
+
+// filterAlertQuery restricts the query of a DSL string to the alerts the filter
+// lets through
+func filterAlertQuery(dslString string, f *AlertFilter) (string, error) {
+	if f.IsEmpty() {
+		return dslString, nil
+	}
+	var dsl map[string]interface{}
+	if err := json.Unmarshal([]byte(dslString), &dsl); err != nil {
+		return "", err
+	}
+	must := f.clauses()
+	if query, ok := dsl["query"]; ok {
+		must = append([]interface{}{query}, must...)
+	}
+	dsl["query"] = map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+	byts, err := json.Marshal(dsl)
+	if err != nil {
+		return "", err
+	}
+	return string(byts), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	alert := &Alert{Status: AlertStatusOpen}
+	bob := "bob"
+	assert.NoError(changeAlertState(alert, AlertStatusAcknowledged, &bob, "mine", "alice"))
+	assert.Equal(AlertStatusAcknowledged, alert.Status)
+	assert.Equal("bob", alert.Assignee)
+
+	// reassigning keeps the status
+	carol := "carol"
+	assert.NoError(changeAlertState(alert, AlertStatusAcknowledged, &carol, "", "bob"))
+	assert.NoError(changeAlertState(alert, AlertStatusResolved, nil, "fixed", "carol"))
+	assert.Equal("carol", alert.Assignee)
+
+	assert.Error(changeAlertState(alert, AlertStatusSuppressed, nil, "", "carol"))
+	assert.Error(changeAlertState(alert, "closed", nil, "", "carol"))
+	assert.NoError(changeAlertState(alert, AlertStatusOpen, nil, "again", "dave"))
+
+	assert.Len(alert.History, 4)
+	first := alert.History[0]
+	assert.Equal(AlertStatusOpen, first.From)
+	assert.Equal(AlertStatusAcknowledged, first.To)
+	assert.Equal("bob", first.Assignee)
+	assert.Equal("mine", first.Note)
+	assert.Equal("alice", first.ChangedBy)
+	assert.Equal(AlertStatusResolved, alert.History[3].From)
+}
+
+func TestAlertLifecycleNoStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	// alerts stored before they had a lifecycle are open
+	alert := &Alert{}
+	assert.Equal(AlertStatusOpen, alertStatus(alert))
+	assert.NoError(changeAlertState(alert, AlertStatusAcknowledged, nil, "", "alice"))
+	assert.Equal(AlertStatusAcknowledged, alert.Status)
+	assert.Equal(AlertStatusOpen, alert.History[0].From)
+
+	alert = &Alert{}
+	assert.NoError(changeAlertState(alert, AlertStatusOpen, nil, "", "alice"))
+	assert.Equal(AlertStatusOpen, alert.Status)
+}
+
+func TestFilterAlertQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	dsl, err := filterAlertQuery(`{"query":{"match_all":{}},"size":5}`, &AlertFilter{})
+	assert.NoError(err)
+	assert.Equal(`{"query":{"match_all":{}},"size":5}`, dsl)
+
+	f := &AlertFilter{Statuses: []string{AlertStatusOpen, AlertStatusAcknowledged}, Assignee: "bob"}
+	assert.Equal("assignee=bob&status=open%2Cacknowledged", f.Values().Encode())
+	dsl, err = filterAlertQuery(`{"query":{"match_all":{}},"size":5}`, f)
+	assert.NoError(err)
+	var parsed map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(dsl), &parsed))
+	assert.Equal(5.0, parsed["size"])
+	must := parsed["query"].(map[string]interface{})["bool"].(map[string]interface{})["must"].([]interface{})
+	assert.Len(must, 3)
+	assert.Equal(map[string]interface{}{"match_all": map[string]interface{}{}}, must[0])
+	should := must[1].(map[string]interface{})["bool"].(map[string]interface{})["should"].([]interface{})
+	assert.Len(should, 2)
+	assert.Equal(map[string]interface{}{"terms": map[string]interface{}{"status": []interface{}{"open", "acknowledged"}}}, should[0])
+	assert.Contains(should[1], "bool")
+
+	// alerts without a status are only open ones
+	assert.Equal(map[string]interface{}{"terms": map[string]interface{}{"status": []string{AlertStatusResolved}}},
+		statusClause([]string{AlertStatusResolved}))
+
+	dsl, err = filterAlertQuery(`{}`, &AlertFilter{Unassigned: true})
+	assert.NoError(err)
+	assert.NoError(json.Unmarshal([]byte(dsl), &parsed))
+	must = parsed["query"].(map[string]interface{})["bool"].(map[string]interface{})["must"].([]interface{})
+	assert.Len(must, 1)
+}
@@ -0,0 +1,232 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// a summary covers the last week unless asked otherwise, and at most maxSummaryDays
+const defaultSummarySpan = 7 * 24 * time.Hour
+
+const maxSummaryDays = 366
+
+// GetAlertSummary counts the alerts created in [since, until), by trigger, by the
+// triggers' EventTypes and by createdBy, with a histogram at the given interval.
+// The alert filter parameters of GET /alert narrow what is counted. The counts come
+// from one search, with terms aggregations for the groups and a date_histogram.
+func (service *Service) GetAlertSummary(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	now := time.Now().UTC()
+	until, err := summaryTime(params, "until", now)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	since, err := summaryTime(params, "since", until.Add(-defaultSummarySpan))
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if !since.Before(until) {
+		return service.statusBadRequest(errors.New("since must be before until"))
+	}
+	if until.Sub(since) > maxSummaryDays*24*time.Hour {
+		return service.statusBadRequest(fmt.Errorf("since and until can be at most %d days apart", maxSummaryDays))
+	}
+	intervalString, err := params.GetAsString("interval", "day")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	interval, err := parseInterval(intervalString)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if interval%time.Millisecond != 0 {
+		return service.statusBadRequest(errors.New("interval must be a whole number of milliseconds"))
+	}
+	hist, err := newHistogram(since, until, interval)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	filter, err := parseAlertFilter(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	triggerID, err := params.GetAsID("triggerId", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	from, err := esTime(since)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	to, err := esTime(until)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	must := append([]interface{}{
+		map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gte": from, "lt": to}}},
+	}, filter.clauses()...)
+	if triggerID != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"triggerId": triggerID.String()}})
+	}
+	query := map[string]interface{}{"bool": map[string]interface{}{"must": must}}
+
+	service.syslogger.Audit("pz-workflow", "summarizingAlerts", service.alertDB.mapping, "Service.GetAlertSummary: User is summarizing alerts")
+
+	summary := &AlertSummary{
+		Since:    since,
+		Until:    until,
+		Interval: interval.String(),
+	}
+	byTrigger, byCreatedBy, err := service.aggregateAlerts(query, hist)
+	if err == nil {
+		err = service.summarizeByTrigger(summary, byTrigger)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "summarizingAlertsFailure", service.alertDB.mapping, "Service.GetAlertSummary: User failed to summarize alerts")
+		return service.statusInternalError(err)
+	}
+	summary.ByCreatedBy = alertGroupCounts(byCreatedBy, nil)
+	summary.Histogram = hist.Buckets
+	for _, count := range byTrigger {
+		summary.Total += count
+	}
+
+	service.syslogger.Audit("pz-workflow", "summarizedAlerts", service.alertDB.mapping, "Service.GetAlertSummary: User summarized %d alerts", summary.Total)
+
+	return service.statusOK(summary)
+}
+
+// aggregateAlerts counts the alerts matching the query by trigger and by createdBy,
+// and fills in the histogram
+func (service *Service) aggregateAlerts(query map[string]interface{}, hist *histogram) (map[string]int64, map[string]int64, error) {
+	last := hist.since
+	if n := len(hist.Buckets); n > 0 {
+		last = hist.Buckets[n-1].Start
+	}
+	result, err := service.alertDB.raw.Search(service.alertDB.mapping, map[string]interface{}{
+		"query": query,
+		"size":  0,
+		"aggs": map[string]interface{}{
+			"byTrigger":   map[string]interface{}{"terms": map[string]interface{}{"field": "triggerId", "size": 0}},
+			"byCreatedBy": map[string]interface{}{"terms": map[string]interface{}{"field": "createdBy", "size": 0}},
+			"histogram":   dateHistogramAgg("createdOn", hist.interval, hist.since, last),
+		},
+	})
+	if err != nil {
+		return nil, nil, LoggedError("AlertSummary failed to aggregate alerts: %s", err)
+	}
+
+	counts := make([]map[string]int64, 2)
+	for i, name := range []string{"byTrigger", "byCreatedBy"} {
+		agg, err := result.Aggregation(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		counts[i] = map[string]int64{}
+		for _, bucket := range agg.Buckets {
+			counts[i][fmt.Sprint(bucket.Key)] += bucket.DocCount
+		}
+	}
+	agg, err := result.Aggregation("histogram")
+	if err != nil {
+		return nil, nil, err
+	}
+	hist.fill(agg.bucketCounts())
+	return counts[0], counts[1], nil
+}
+
+// summarizeByTrigger fills in the per-trigger and per-EventType counts, naming each.
+// Alerts whose trigger no longer exists are counted under an EventType of "".
+func (service *Service) summarizeByTrigger(summary *AlertSummary, byTrigger map[string]int64) error {
+	cache := newInflationCache(service)
+	ids := make([]piazza.Ident, 0, len(byTrigger))
+	for id := range byTrigger {
+		ids = append(ids, piazza.Ident(id))
+	}
+	if err := cache.loadTriggers(ids); err != nil {
+		return err
+	}
+
+	triggerNames := map[string]string{}
+	byEventType := map[string]int64{}
+	for id, count := range byTrigger {
+		eventTypeID := ""
+		if trigger := cache.triggers[piazza.Ident(id)]; trigger != nil {
+			triggerNames[id] = trigger.Name
+			eventTypeID = trigger.EventTypeID.String()
+		}
+		byEventType[eventTypeID] += count
+	}
+
+	eventTypeNames := map[string]string{}
+	for id := range byEventType {
+		if id == "" {
+			continue
+		}
+		eventType, found, err := service.eventTypeDB.GetOne(piazza.Ident(id), "pz-workflow")
+		if err == nil && found {
+			eventTypeNames[id] = eventType.Name
+		}
+	}
+
+	summary.ByTrigger = alertGroupCounts(byTrigger, triggerNames)
+	summary.ByEventType = alertGroupCounts(byEventType, eventTypeNames)
+	return nil
+}
+
+// alertGroupCounts lists the counts, largest first
+func alertGroupCounts(counts map[string]int64, names map[string]string) []AlertGroupCount {
+	groups := make([]AlertGroupCount, 0, len(counts))
+	for key, count := range counts {
+		groups = append(groups, AlertGroupCount{Key: key, Name: names[key], Count: count})
+	}
+	sort.Sort(byAlertCount(groups))
+	return groups
+}
+
+type byAlertCount []AlertGroupCount
+
+func (s byAlertCount) Len() int      { return len(s) }
+func (s byAlertCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byAlertCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Key < s[j].Key
+}
+
+// summaryTime reads an RFC 3339 time parameter
+func summaryTime(params *piazza.HttpQueryParams, name string, def time.Time) (time.Time, error) {
+	s, err := params.GetAsString(name, "")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if s == "" {
+		return def, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time: %s", name, err)
+	}
+	return t.UTC(), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertGroupCounts(t *testing.T) {
+	assert := assert.New(t)
+
+	counts := map[string]int64{"t1": 2, "t2": 5, "t3": 2, "": 1}
+	names := map[string]string{"t2": "busy trigger"}
+	assert.Equal([]AlertGroupCount{
+		{Key: "t2", Name: "busy trigger", Count: 5},
+		{Key: "t1", Count: 2},
+		{Key: "t3", Count: 2},
+		{Key: "", Count: 1},
+	}, alertGroupCounts(counts, names))
+
+	assert.Equal([]AlertGroupCount{}, alertGroupCounts(map[string]int64{}, nil))
+}
@@ -0,0 +1,115 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+type AreaOfInterestDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewAreaOfInterestDB(service *Service, esi elasticsearch.IIndex) (*AreaOfInterestDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	adb := AreaOfInterestDB{ResourceDB: rdb, mapping: AreaOfInterestDBMapping}
+	return &adb, nil
+}
+
+func (db *AreaOfInterestDB) PostData(area *AreaOfInterest) error {
+	indexResult, err := db.Esi.PostData(db.mapping, area.AreaID.String(), area)
+	if err != nil {
+		return LoggedError("AreaOfInterestDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("AreaOfInterestDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+func (db *AreaOfInterestDB) GetAll(format *piazza.JsonPagination, actor string) ([]AreaOfInterest, int64, error) {
+	areas := []AreaOfInterest{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return areas, 0, err
+	}
+	if !exists {
+		return areas, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("AreaOfInterestDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("AreaOfInterestDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult != nil && searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var area AreaOfInterest
+			if err := json.Unmarshal(*hit.Source, &area); err != nil {
+				return nil, 0, err
+			}
+			areas = append(areas, area)
+		}
+	}
+
+	return areas, searchResult.TotalHits(), nil
+}
+
+func (db *AreaOfInterestDB) GetOne(id piazza.Ident, actor string) (*AreaOfInterest, bool, error) {
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("AreaOfInterestDB.GetOne failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, true, fmt.Errorf("AreaOfInterestDB.GetOne failed: %s no getResult", id.String())
+	}
+
+	src := getResult.Source
+	var area AreaOfInterest
+	if err = json.Unmarshal(*src, &area); err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &area, getResult.Found, nil
+}
+
+func (db *AreaOfInterestDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	if err != nil {
+		return deleteResult.Found, fmt.Errorf("AreaOfInterestDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("AreaOfInterestDB.DeleteById failed: no deleteResult")
+	}
+
+	if !deleteResult.Found {
+		return false, fmt.Errorf("AreaOfInterestDB.DeleteById failed: not found")
+	}
+
+	return deleteResult.Found, nil
+}
@@ -16,7 +16,11 @@ package workflow
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"fmt"
 
@@ -186,9 +190,45 @@ func (c *Client) QueryEventTypes(query map[string]interface{}) (*[]EventType, er
 	return out, err
 }
 
-func (c *Client) PutEventType(eventType *EventType) (*EventType, error) {
+func (c *Client) PutEventType(id piazza.Ident, update *EventTypeUpdate) (*EventType, error) {
 	out := &EventType{}
-	err := c.putObject(eventType, "/eventType", out)
+	err := c.putObject(update, "/eventType/"+id.String(), out)
+	return out, err
+}
+
+// ImportEventType creates an EventType from a JSON Schema of its data
+func (c *Client) ImportEventType(name string, schema JsonSchema) (*EventType, error) {
+	out := &EventType{}
+	err := c.postObject(schema, "/eventType/import?name="+url.QueryEscape(name), out)
+	return out, err
+}
+
+// InferEventType proposes a mapping for the samples, creating the EventType if asked
+func (c *Client) InferEventType(req *EventTypeInferenceRequest) (*EventTypeInference, error) {
+	out := &EventTypeInference{}
+	err := c.postObject(req, "/eventType/infer", out)
+	return out, err
+}
+
+// GetEventTypeSchema returns a JSON Schema of the EventType's data
+func (c *Client) GetEventTypeSchema(id piazza.Ident) (JsonSchema, error) {
+	out := JsonSchema{}
+	err := c.getObject("/eventType/"+id.String()+"/schema", &out)
+	return out, err
+}
+
+// GetEventTypeStats reports how much the EventType is used, with a daily histogram
+// covering the given number of days
+func (c *Client) GetEventTypeStats(id piazza.Ident, days int) (*EventTypeStats, error) {
+	out := &EventTypeStats{}
+	err := c.getObject(fmt.Sprintf("/eventType/%s/stats?days=%d", id.String(), days), out)
+	return out, err
+}
+
+// GetEventTypeVersions returns every version of the EventType's schema, oldest first
+func (c *Client) GetEventTypeVersions(id piazza.Ident) (*[]EventTypeSchema, error) {
+	out := &[]EventTypeSchema{}
+	err := c.getObject("/eventType/"+id.String()+"/versions", out)
 	return out, err
 }
 
@@ -197,6 +237,22 @@ func (c *Client) DeleteEventType(id piazza.Ident) error {
 	return err
 }
 
+// CascadeDeleteEventType deletes an EventType and its triggers, events and repeating
+// events, and its triggers' alerts if alerts is set. With dryRun, nothing is deleted.
+func (c *Client) CascadeDeleteEventType(id piazza.Ident, dryRun bool, alerts bool) (*EventTypeCascade, error) {
+	path := fmt.Sprintf("/eventType/%s?cascade=true&dryRun=%t&alerts=%t", id.String(), dryRun, alerts)
+	resp := c.h.PzDelete(path)
+	if resp.IsError() {
+		return nil, resp.ToError()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.ToError()
+	}
+	out := &EventTypeCascade{}
+	err := resp.ExtractData(out)
+	return out, err
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetEvent(id piazza.Ident) (*Event, error) {
@@ -222,6 +278,53 @@ func (c *Client) GetAllEventsByEventType(eventTypeID piazza.Ident) (*[]Event, er
 	return out, err
 }
 
+// GetEventsByFilter lists the events matching the filter
+func (c *Client) GetEventsByFilter(filter *EventFilter, perPage int, page int) (*[]Event, error) {
+	out := &[]Event{}
+	values := filter.Values()
+	values.Set("perPage", strconv.Itoa(perPage))
+	values.Set("page", strconv.Itoa(page))
+	err := c.getObject("/event?"+values.Encode(), out)
+	return out, err
+}
+
+// ExportEvents writes the events matching the filter to w, in the EventExportNDJSON
+// or EventExportGeoJSON format
+func (c *Client) ExportEvents(filter *EventFilter, format string, w io.Writer) error {
+	values := filter.Values()
+	values.Set("format", format)
+	req, err := http.NewRequest("GET", c.url+"/event/export?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.h.ApiKey, "")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		jresp := &piazza.JsonResponse{}
+		if err = json.NewDecoder(resp.Body).Decode(jresp); err != nil {
+			return fmt.Errorf("event export failed: %s", resp.Status)
+		}
+		return jresp.ToError()
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// GetTrace returns the causal tree that the event, alert or correlationId belongs to
+func (c *Client) GetTrace(id piazza.Ident) (*Trace, error) {
+	out := &Trace{}
+	err := c.getObject("/trace/"+id.String(), out)
+	return out, err
+}
+
 func (c *Client) PostEvent(event *Event) (*Event, error) {
 	out := &Event{}
 	err := c.postObject(event, "/event", out)
@@ -234,9 +337,9 @@ func (c *Client) QueryEvents(query map[string]interface{}) (*[]Event, error) {
 	return out, err
 }
 
-func (c *Client) PutEvent(event *Event) (*Event, error) {
+func (c *Client) PutEvent(id piazza.Ident, update *EventUpdate) (*Event, error) {
 	out := &Event{}
-	err := c.putObject(event, "/event", out)
+	err := c.putObject(update, "/event/"+id.String(), out)
 	return out, err
 }
 
@@ -245,6 +348,22 @@ func (c *Client) DeleteEvent(id piazza.Ident) error {
 	return err
 }
 
+func (c *Client) PostReplay(req *ReplayRequest) (*ReplayJob, error) {
+	out := &ReplayJob{}
+	err := c.postObject(req, "/event/replay", out)
+	return out, err
+}
+
+func (c *Client) GetReplay(id piazza.Ident) (*ReplayJob, error) {
+	out := &ReplayJob{}
+	err := c.getObject("/replay/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) CancelReplay(id piazza.Ident) error {
+	return c.deleteObject("/replay/" + id.String())
+}
+
 //------------------------------------------------------------------------------
 
 func (c *Client) GetTrigger(id piazza.Ident) (*Trigger, error) {
@@ -277,6 +396,12 @@ func (c *Client) QueryTriggers(query map[string]interface{}) (*[]Trigger, error)
 	return out, err
 }
 
+func (c *Client) BacktestTrigger(req *BacktestRequest) (*BacktestResult, error) {
+	out := &BacktestResult{}
+	err := c.postObject(req, "/trigger/backtest", out)
+	return out, err
+}
+
 func (c *Client) PutTrigger(id piazza.Ident, triggerUpdate *TriggerUpdate) error {
 	out := &TriggerUpdate{}
 	err := c.putObject(triggerUpdate, "/trigger/"+id.String(), out)
@@ -314,6 +439,60 @@ func (c *Client) GetAllAlerts(perPage int, page int) (*[]Alert, error) {
 	return out, err
 }
 
+// GetAlertFeed writes the Atom feed of the trigger's or user's alerts to w, unless it
+// still has the ETag given, and returns the feed's ETag and whether it was written
+func (c *Client) GetAlertFeed(triggerID piazza.Ident, createdBy string, etag string, w io.Writer) (string, bool, error) {
+	values := url.Values{}
+	if triggerID != "" {
+		values.Set("triggerId", triggerID.String())
+	}
+	if createdBy != "" {
+		values.Set("createdBy", createdBy)
+	}
+	req, err := http.NewRequest("GET", c.url+"/alert/feed.atom?"+values.Encode(), nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.SetBasicAuth(c.h.ApiKey, "")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return resp.Header.Get("ETag"), false, nil
+	case http.StatusOK:
+	default:
+		jresp := &piazza.JsonResponse{}
+		if err = json.NewDecoder(resp.Body).Decode(jresp); err != nil {
+			return "", false, fmt.Errorf("alert feed failed: %s", resp.Status)
+		}
+		return "", false, jresp.ToError()
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return resp.Header.Get("ETag"), err == nil, err
+}
+
+// GetAlertSummary counts the alerts created in [since, until) by trigger, EventType
+// and creator, with a histogram at the interval, e.g. "day"
+func (c *Client) GetAlertSummary(since time.Time, until time.Time, interval string) (*AlertSummary, error) {
+	out := &AlertSummary{}
+	v := url.Values{}
+	v.Set("since", since.Format(time.RFC3339Nano))
+	v.Set("until", until.Format(time.RFC3339Nano))
+	v.Set("interval", interval)
+	err := c.getObject("/alert/summary?"+v.Encode(), out)
+	return out, err
+}
+
 func (c *Client) PostAlert(alert *Alert) (*Alert, error) {
 	out := &Alert{}
 	err := c.postObject(alert, "/alert", out)
@@ -326,9 +505,26 @@ func (c *Client) QueryAlerts(query map[string]interface{}) (*[]Alert, error) {
 	return out, err
 }
 
-func (c *Client) PutAlert(alert *Alert) (*Alert, error) {
+func (c *Client) PutAlert(id piazza.Ident, update *AlertUpdate) (*Alert, error) {
+	out := &Alert{}
+	err := c.putObject(update, "/alert/"+id.String(), out)
+	return out, err
+}
+
+// PutAlertState moves an alert to another status, or reassigns it
+func (c *Client) PutAlertState(id piazza.Ident, update *AlertStateUpdate) (*Alert, error) {
 	out := &Alert{}
-	err := c.putObject(alert, "/alert", out)
+	err := c.putObject(update, "/alert/"+id.String()+"/state", out)
+	return out, err
+}
+
+// GetAlertsByFilter returns the alerts in the filter's statuses and assignment
+func (c *Client) GetAlertsByFilter(filter *AlertFilter, perPage int, page int) (*[]Alert, error) {
+	values := filter.Values()
+	values.Set("perPage", strconv.Itoa(perPage))
+	values.Set("page", strconv.Itoa(page))
+	out := &[]Alert{}
+	err := c.getObject("/alert?"+values.Encode(), out)
 	return out, err
 }
 
@@ -338,6 +534,84 @@ func (c *Client) DeleteAlert(id piazza.Ident) error {
 
 //------------------------------------------------------------------------------
 
+func (c *Client) GetAreaOfInterest(id piazza.Ident) (*AreaOfInterest, error) {
+	out := &AreaOfInterest{}
+	err := c.getObject("/areaOfInterest/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) GetAllAreasOfInterest(perPage int, page int) (*[]AreaOfInterest, error) {
+	out := &[]AreaOfInterest{}
+	path := fmt.Sprintf("/areaOfInterest?perPage=%d&page=%d", perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) PostAreaOfInterest(area *AreaOfInterest) (*AreaOfInterest, error) {
+	out := &AreaOfInterest{}
+	err := c.postObject(area, "/areaOfInterest", out)
+	return out, err
+}
+
+func (c *Client) DeleteAreaOfInterest(id piazza.Ident) error {
+	return c.deleteObject("/areaOfInterest/" + id.String())
+}
+
+//------------------------------------------------------------------------------
+
+func (c *Client) GetIncident(id piazza.Ident) (*Incident, error) {
+	out := &Incident{}
+	err := c.getObject("/incident/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) GetIncidentsByTrigger(id piazza.Ident, perPage int, page int) (*[]Incident, error) {
+	out := &[]Incident{}
+	path := fmt.Sprintf("/incident?triggerId=%s&perPage=%d&page=%d", id.String(), perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) QueryIncidents(query map[string]interface{}) (*[]Incident, error) {
+	out := &[]Incident{}
+	err := c.postObject(query, "/incident/query", out)
+	return out, err
+}
+
+//------------------------------------------------------------------------------
+
+func (c *Client) GetSubscription(id piazza.Ident) (*Subscription, error) {
+	out := &Subscription{}
+	err := c.getObject("/subscription/"+id.String(), out)
+	return out, err
+}
+
+func (c *Client) GetAllSubscriptions(perPage int, page int) (*[]Subscription, error) {
+	out := &[]Subscription{}
+	path := fmt.Sprintf("/subscription?perPage=%d&page=%d", perPage, page)
+	err := c.getObject(path, out)
+	return out, err
+}
+
+func (c *Client) PostSubscription(subscription *Subscription) (*Subscription, error) {
+	out := &Subscription{}
+	err := c.postObject(subscription, "/subscription", out)
+	return out, err
+}
+
+func (c *Client) DeleteSubscription(id piazza.Ident) error {
+	return c.deleteObject("/subscription/" + id.String())
+}
+
+// GetAlertDeliveries returns the log of the alert's deliveries to its subscriptions
+func (c *Client) GetAlertDeliveries(id piazza.Ident) (*[]Delivery, error) {
+	out := &[]Delivery{}
+	err := c.getObject("/alert/"+id.String()+"/deliveries", out)
+	return out, err
+}
+
+//------------------------------------------------------------------------------
+
 func (c *Client) TestElasticsearchGetVersion() (*string, error) {
 	ss := ""
 	s := &ss
@@ -365,3 +639,10 @@ func (c *Client) GetStats() (*Stats, error) {
 	return out, err
 
 }
+
+// GetSystemEventTypes reports how the system EventTypes were reconciled at startup
+func (c *Client) GetSystemEventTypes() (*[]SystemEventTypeStatus, error) {
+	out := &[]SystemEventTypeStatus{}
+	err := c.getObject("/admin/systemEventTypes", out)
+	return out, err
+}
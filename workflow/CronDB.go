@@ -49,6 +49,15 @@ func (db *CronDB) PostData(event *Event) error {
 	return nil
 }
 
+// PutData replaces the stored copy of a repeating event
+func (db *CronDB) PutData(event *Event) error {
+	if _, err := db.Esi.PutData(db.mapping, event.EventID.String(), event); err != nil {
+		return LoggedError("CronDB.PutData failed: %s", err)
+	}
+
+	return nil
+}
+
 // GetAll TODO
 func (db *CronDB) GetAll(actor string) (*[]Event, error) {
 	var events []Event
@@ -0,0 +1,100 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+type DeliveryDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewDeliveryDB(service *Service, esi elasticsearch.IIndex) (*DeliveryDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	ddb := DeliveryDB{ResourceDB: rdb, mapping: DeliveryDBMapping}
+	return &ddb, nil
+}
+
+func (db *DeliveryDB) PostData(delivery *Delivery) error {
+	indexResult, err := db.Esi.PostData(db.mapping, delivery.DeliveryID.String(), delivery)
+	if err != nil {
+		return LoggedError("DeliveryDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("DeliveryDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+// PutData replaces a stored delivery
+func (db *DeliveryDB) PutData(delivery *Delivery) error {
+	if _, err := db.Esi.PutData(db.mapping, delivery.DeliveryID.String(), delivery); err != nil {
+		return LoggedError("DeliveryDB.PutData failed: %s", err)
+	}
+
+	return nil
+}
+
+func (db *DeliveryDB) itemExists(id piazza.Ident, actor string) (bool, error) {
+	return db.Esi.ItemExists(db.mapping, id.String())
+}
+
+func (db *DeliveryDB) GetDeliveriesByDslQuery(dslString string, actor string) ([]Delivery, int64, error) {
+	deliveries := []Delivery{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return deliveries, 0, err
+	}
+	if !exists {
+		return deliveries, 0, nil
+	}
+
+	// searched raw, so that mock indices honor the query too
+	var dsl map[string]interface{}
+	if err = json.Unmarshal([]byte(dslString), &dsl); err != nil {
+		return nil, 0, LoggedError("DeliveryDB.GetDeliveriesByDslQuery failed: %s", err)
+	}
+	searchResult, err := db.raw.Search(db.mapping, dsl)
+	if err != nil {
+		return nil, 0, LoggedError("DeliveryDB.GetDeliveriesByDslQuery failed: %s", err)
+	}
+
+	for _, hit := range searchResult.Hits.Hits {
+		var delivery Delivery
+		if err := json.Unmarshal(*hit.Source, &delivery); err != nil {
+			return nil, 0, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, searchResult.Hits.Total, nil
+}
+
+// GetAllByAlert returns up to size of the alert's deliveries, oldest first
+func (db *DeliveryDB) GetAllByAlert(alertID piazza.Ident, size int, actor string) ([]Delivery, int64, error) {
+	dsl := fmt.Sprintf(`{"query":{"term":{"alertId":%q}},"sort":[{"createdOn":"asc"}],"size":%d}`, alertID.String(), size)
+	return db.GetDeliveriesByDslQuery(dsl, actor)
+}
@@ -17,6 +17,8 @@ package workflow
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
 	"github.com/venicegeo/dg-pz-gocommon/gocommon"
@@ -24,6 +26,45 @@ import (
 
 type EventDB struct {
 	*ResourceDB
+	typeNames *eventTypeNameCache
+}
+
+// at most this many eventId -> EventType name entries are kept
+const eventTypeNameCacheSize = 100000
+
+// eventTypeNameCache remembers which EventType (and so which mapping of the events
+// index) each event was posted under. It is filled on post and emptied on delete;
+// a miss falls back to a search, so another instance's events are still found.
+type eventTypeNameCache struct {
+	sync.Mutex
+	names map[piazza.Ident]string
+}
+
+func newEventTypeNameCache() *eventTypeNameCache {
+	return &eventTypeNameCache{names: map[piazza.Ident]string{}}
+}
+
+func (c *eventTypeNameCache) get(id piazza.Ident) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	name, ok := c.names[id]
+	return name, ok
+}
+
+func (c *eventTypeNameCache) put(id piazza.Ident, name string) {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.names) >= eventTypeNameCacheSize {
+		// cheaper than tracking use, and a miss costs only one search
+		c.names = map[piazza.Ident]string{}
+	}
+	c.names[id] = name
+}
+
+func (c *eventTypeNameCache) remove(id piazza.Ident) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.names, id)
 }
 
 func NewEventDB(service *Service, esi elasticsearch.IIndex) (*EventDB, error) {
@@ -31,7 +72,7 @@ func NewEventDB(service *Service, esi elasticsearch.IIndex) (*EventDB, error) {
 	if err != nil {
 		return nil, err
 	}
-	erdb := EventDB{ResourceDB: rdb}
+	erdb := EventDB{ResourceDB: rdb, typeNames: newEventTypeNameCache()}
 	return &erdb, nil
 }
 
@@ -47,10 +88,43 @@ func (db *EventDB) PostData(event *Event, typ string) error {
 	if !indexResult.Created {
 		return LoggedError("EventDB.PostData failed: not created")
 	}
+	db.typeNames.put(event.EventID, typ)
 
 	return nil
 }
 
+// GetOneVersioned is GetOne in real time, with the version PutVersioned needs
+func (db *EventDB) GetOneVersioned(mapping string, id piazza.Ident) (*Event, int64, bool, error) {
+	src, version, found, err := db.raw.GetVersioned(mapping, id.String())
+	if err != nil {
+		return nil, 0, false, LoggedError("EventDB.GetOneVersioned failed: %s", err)
+	}
+	if !found {
+		return nil, 0, false, fmt.Errorf("event %s could not be found", id)
+	}
+	var event Event
+	if err = json.Unmarshal(*src, &event); err != nil {
+		return nil, 0, true, err
+	}
+	return &event, version, true, nil
+}
+
+// PutVersioned replaces a stored event, unless it has been written since it was read at
+// version, when it returns errVersionConflict
+func (db *EventDB) PutVersioned(event *Event, typ string, version int64) error {
+	err := db.raw.PutVersioned(typ, event.EventID.String(), event, version)
+	if err != nil {
+		if err != errVersionConflict {
+			err = LoggedError("EventDB.PutVersioned failed: %s", err)
+		}
+		return err
+	}
+	db.typeNames.put(event.EventID, typ)
+	return nil
+}
+
+// verifyEventReadyToPost checks the event's data against its EventType's mapping.
+// All violations are reported together in a *ValidationError.
 func (db *EventDB) verifyEventReadyToPost(event *Event) error {
 	eventTypeJson := db.service.GetEventType(event.EventTypeID, event.CreatedBy)
 	eventTypeObj := eventTypeJson.Data
@@ -58,38 +132,11 @@ func (db *EventDB) verifyEventReadyToPost(event *Event) error {
 	if !ok {
 		return LoggedError("EventDB.PostData failed: unable to obtain specified eventtype")
 	}
-	eventTypeMappingVars, err := piazza.GetVarsFromStruct(eventType.Mapping)
-	if err != nil {
-		return LoggedError("EventDB.PostData failed: %s", err)
-	}
-	eventDataVars, err := piazza.GetVarsFromStruct(db.service.removeUniqueParams(eventType.Name, event.Data))
-	if err != nil {
-		return LoggedError("EventDB.PostData failed: %s", err)
-	}
-	notFound := []string{}
-	for k, v := range eventTypeMappingVars {
-		found := false
-		for k2, v2 := range eventDataVars {
-			if k2 == k {
-				found = true
-				if !elasticsearch.IsValidArrayTypeMapping(v) {
-					if piazza.ValueIsValidArray(v2) {
-						return LoggedError("EventDB.PostData failed: an array was passed into the non-array field %s", k)
-					}
-				} else {
-					if !piazza.ValueIsValidArray(v2) {
-						return LoggedError("EventDB.PostData failed: a non-array was pasted into the array field %s", k)
-					}
-				}
-				break
-			}
-		}
-		if !found {
-			notFound = append(notFound, k)
-		}
-	}
-	if len(notFound) > 0 {
-		return LoggedError("EventDB.PostData failed: the variables %s were specified in the EventType but were not found in the Event", notFound)
+	data := db.service.removeUniqueParams(eventType.Name, event.Data)
+	if violations := validateEventData(eventType.Mapping, fieldSpecsByPath(eventType.Fields), data); len(violations) > 0 {
+		err := &ValidationError{Violations: violations}
+		LoggedError("EventDB.PostData failed: %s", err)
+		return err
 	}
 	return nil
 }
@@ -200,30 +247,171 @@ func (db *EventDB) GetEventsByEventTypeID(format *piazza.JsonPagination, mapping
 	return events, searchResult.TotalHits(), nil
 }
 
-func (db *EventDB) lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error) {
-	var mapping string
-
-	types, err := db.Esi.GetTypes()
+// CountEvents returns the number of events of the given mapping ("" for all) matching the query.
+func (db *EventDB) CountEvents(mapping string, query map[string]interface{}, actor string) (int64, error) {
+	result, err := db.raw.Search(mapping, map[string]interface{}{
+		"query": query,
+		"size":  0,
+	})
 	if err != nil {
-		return "", err
+		return 0, LoggedError("EventDB.CountEvents failed: %s", err)
+	}
+	return result.Hits.Total, nil
+}
+
+// ScanEvents calls fn for every event of the given mapping ("" for all) matching the query,
+// oldest first. Events are fetched a page at a time, keyed on (createdOn, eventId) rather
+// than from/size, so that it is not limited by the size of the result window and never
+// holds more than one page in memory. Returning an error from fn stops the scan.
+func (db *EventDB) ScanEvents(mapping string, query map[string]interface{}, pageSize int, actor string, fn func(*Event) error) error {
+	var lastCreatedOn interface{}
+	var lastID string
+
+	for {
+		must := []interface{}{query}
+		if lastCreatedOn != nil {
+			must = append(must, map[string]interface{}{
+				"bool": map[string]interface{}{
+					"should": []interface{}{
+						map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gt": lastCreatedOn}}},
+						map[string]interface{}{"bool": map[string]interface{}{
+							"must": []interface{}{
+								map[string]interface{}{"term": map[string]interface{}{"createdOn": lastCreatedOn}},
+								map[string]interface{}{"range": map[string]interface{}{"eventId": map[string]interface{}{"gt": lastID}}},
+							},
+						}},
+					},
+					"minimum_should_match": 1,
+				},
+			})
+		}
+		dsl := map[string]interface{}{
+			"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+			"sort": []interface{}{
+				map[string]interface{}{"createdOn": "asc"},
+				map[string]interface{}{"eventId": "asc"},
+			},
+			"size": pageSize,
+		}
+		jsn, err := json.Marshal(dsl)
+		if err != nil {
+			return err
+		}
+
+		searchResult, err := db.Esi.SearchByJSON(mapping, string(jsn))
+		if err != nil {
+			return LoggedError("EventDB.ScanEvents failed: %s", err)
+		}
+		if searchResult == nil {
+			return LoggedError("EventDB.ScanEvents failed: no searchResult")
+		}
+		if searchResult.GetHits() == nil || len(*searchResult.GetHits()) == 0 {
+			return nil
+		}
+
+		hits := *searchResult.GetHits()
+		for _, hit := range hits {
+			var event Event
+			if err = json.Unmarshal(*hit.Source, &event); err != nil {
+				return err
+			}
+			// keep the stored form of createdOn so the next page's query matches it exactly
+			var key struct {
+				CreatedOn interface{} `json:"createdOn"`
+			}
+			if err = json.Unmarshal(*hit.Source, &key); err != nil {
+				return err
+			}
+			lastCreatedOn = key.CreatedOn
+			lastID = event.EventID.String()
+
+			if err = fn(&event); err != nil {
+				return err
+			}
+		}
+
+		if len(hits) < pageSize {
+			return nil
+		}
 	}
-	for _, typ := range types {
-		ok, err := db.Esi.ItemExists(typ, id.String())
+}
+
+// eventTimeRangeQuery matches the events of one EventType (or of all, if eventTypeID
+// is empty) created in [since, until). A zero since or until means no bound.
+func eventTimeRangeQuery(eventTypeID piazza.Ident, since time.Time, until time.Time) (map[string]interface{}, error) {
+	rng := map[string]interface{}{}
+	if !since.IsZero() {
+		s, err := esTime(since)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if ok {
-			mapping = typ
-			break
+		rng["gte"] = s
+	}
+	if !until.IsZero() {
+		u, err := esTime(until)
+		if err != nil {
+			return nil, err
 		}
+		rng["lt"] = u
 	}
-	if mapping == "" {
-		return "", LoggedError("EventDB.lookupEventTypeNameByEventID failed: [Item %s in index events does not exist]", id.String())
+	must := []interface{}{}
+	if eventTypeID != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventTypeID.String()}})
+	}
+	if len(rng) > 0 {
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{"createdOn": rng}})
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"must": must}}, nil
+}
+
+// esTime formats t the same way createdOn fields are stored, so that it parses under
+// the index's date formats.
+func esTime(t time.Time) (string, error) {
+	dat, err := json.Marshal(piazza.TimeStamp(t))
+	if err != nil {
+		return "", err
+	}
+	var s string
+	if err = json.Unmarshal(dat, &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// lookupEventTypeNameByEventID finds the mapping an event is stored under. Events
+// posted through this instance are answered from the cache; any other takes one
+// real-time get across all mappings, since an event's data is keyed by its EventType
+// name.
+func (db *EventDB) lookupEventTypeNameByEventID(id piazza.Ident, actor string) (string, error) {
+	if mapping, ok := db.typeNames.get(id); ok {
+		return mapping, nil
 	}
 
+	events, err := db.GetByIDs([]piazza.Ident{id}, actor)
+	if err != nil {
+		return "", LoggedError("EventDB.lookupEventTypeNameByEventID failed: %s", err)
+	}
+	if len(events) == 0 {
+		return "", LoggedError("EventDB.lookupEventTypeNameByEventID failed: [Item %s in index events does not exist]", id.String())
+	}
+	mapping := storedEventTypeName(&events[0])
+	if mapping == "" || events[0].EventID != id {
+		return "", LoggedError("EventDB.lookupEventTypeNameByEventID failed: event %s has no EventType data", id.String())
+	}
 	return mapping, nil
 }
 
+// storedEventTypeName returns the EventType name that the stored event's data is keyed by
+func storedEventTypeName(event *Event) string {
+	if len(event.Data) != 1 {
+		return ""
+	}
+	for name := range event.Data {
+		return name
+	}
+	return ""
+}
+
 // NameExists checks if an EventType name exists.
 // This is easier to check in EventDB, as the mappings use the EventType.Name.
 func (db *EventDB) NameExists(name string, actor string) (bool, error) {
@@ -248,7 +436,27 @@ func (db *EventDB) GetOne(mapping string, id piazza.Ident, actor string) (*Event
 	return &event, getResult.Found, nil
 }
 
+// GetByIDs returns those of the events that exist, whatever their EventTypes, in no
+// particular order. It is real-time, so it finds events that a search would not yet.
+func (db *EventDB) GetByIDs(ids []piazza.Ident, actor string) ([]Event, error) {
+	sources, err := db.raw.MultiGet("", identStrings(ids))
+	if err != nil {
+		return nil, LoggedError("EventDB.GetByIDs failed: %s", err)
+	}
+	events := make([]Event, len(sources))
+	for i, source := range sources {
+		if err = json.Unmarshal(*source, &events[i]); err != nil {
+			return nil, LoggedError("EventDB.GetByIDs failed: %s", err)
+		}
+		if mapping := storedEventTypeName(&events[i]); mapping != "" {
+			db.typeNames.put(events[i].EventID, mapping)
+		}
+	}
+	return events, nil
+}
+
 func (db *EventDB) DeleteByID(mapping string, id piazza.Ident, actor string) (bool, error) {
+	db.typeNames.remove(id)
 	deleteResult, err := db.Esi.DeleteByID(mapping, string(id))
 	if err != nil {
 		return deleteResult.Found, LoggedError("EventDB.DeleteById failed: %s", err)
@@ -260,6 +468,19 @@ func (db *EventDB) DeleteByID(mapping string, id piazza.Ident, actor string) (bo
 	return deleteResult.Found, nil
 }
 
+// DeleteByIDs deletes the events in one request; events already gone are skipped
+func (db *EventDB) DeleteByIDs(mapping string, ids []piazza.Ident, actor string) error {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		db.typeNames.remove(id)
+		strs[i] = id.String()
+	}
+	if err := db.raw.BulkDelete(mapping, strs); err != nil {
+		return LoggedError("EventDB.DeleteByIDs failed: %s", err)
+	}
+	return nil
+}
+
 func (db *EventDB) AddMapping(name string, mapping map[string]interface{}, actor string) error {
 	jsn, err := ConstructEventMappingSchema(name, mapping)
 	if err != nil {
@@ -314,6 +535,17 @@ func visitNodeE(inputObj map[string]interface{}) (map[string]interface{}, error)
 				return nil, err
 			}
 			outputObj[k] = tree
+		case []interface{}:
+			elem, ok := nestedMapping(t)
+			if !ok {
+				return nil, LoggedError("EventDB.ConstructEventMappingSchema failed: an array must hold the mapping of a single object, not %#v", t)
+			}
+			tree, err := visitTreeE(k, elem)
+			if err != nil {
+				return nil, err
+			}
+			tree["type"] = "nested"
+			outputObj[k] = tree
 		default:
 			return nil, LoggedError("EventDB.ConstructEventMappingSchema failed: unexpected type %T", t)
 		}
@@ -331,12 +563,10 @@ func visitTreeE(k string, v map[string]interface{}) (map[string]interface{}, err
 	return wrapperTree, nil
 }
 func visitLeafE(k string, v interface{}) (map[string]interface{}, error) {
-	if !elasticsearch.IsValidMappingType(v) {
+	if !isValidEventMappingType(v) {
 		return nil, LoggedError("EventDB.ConstructEventMappingSchema failed: \"%#v\" was not recognized as a valid mapping type", v)
 	}
-	if elasticsearch.IsValidArrayTypeMapping(v) {
-		v = v.(string)[1 : len(v.(string))-1]
-	}
+	v = elementType(v.(string))
 	tree := map[string]interface{}{}
 	tree["type"] = v
 	return tree, nil
@@ -0,0 +1,67 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestEventTypeNameCache(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newEventTypeNameCache()
+	_, ok := c.get("e1")
+	assert.False(ok)
+
+	c.put("e1", "T1")
+	name, ok := c.get("e1")
+	assert.True(ok)
+	assert.Equal("T1", name)
+
+	c.remove("e1")
+	_, ok = c.get("e1")
+	assert.False(ok)
+
+	for i := 0; i < eventTypeNameCacheSize; i++ {
+		c.put(piazza.Ident(strconv.Itoa(i)), "T")
+	}
+	assert.True(len(c.names) <= eventTypeNameCacheSize)
+
+	assert.Equal("T1", storedEventTypeName(&Event{Data: map[string]interface{}{"T1": map[string]interface{}{}}}))
+	assert.Equal("", storedEventTypeName(&Event{Data: map[string]interface{}{}}))
+}
+
+func TestLookupEventTypeNameByEventID(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t, nil)
+	eventType := service.PostEventType(makeTestEventType("LookupType")).Data.(*EventType)
+	event := service.PostEvent(makeTestEvent(eventType.EventTypeID)).Data.(*Event)
+
+	// as on an instance that did not post the event
+	service.eventDB.typeNames = newEventTypeNameCache()
+	name, err := service.eventDB.lookupEventTypeNameByEventID(event.EventID, "test")
+	assert.NoError(err)
+	assert.Equal("LookupType", name)
+	_, ok := service.eventDB.typeNames.get(event.EventID)
+	assert.True(ok)
+
+	_, err = service.eventDB.lookupEventTypeNameByEventID("nope", "test")
+	assert.Error(err)
+}
@@ -0,0 +1,480 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// The formats of GET /event/export
+const (
+	EventExportNDJSON  = "ndjson"
+	EventExportGeoJSON = "geojson"
+)
+
+// events are fetched and written this many at a time
+const eventExportPageSize = 500
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// eventExport is a prepared GET /event/export: the query has been checked and, for
+// GeoJSON, the field holding each event's geometry has been found
+type eventExport struct {
+	service   *Service
+	Format    string
+	mapping   string
+	query     map[string]interface{}
+	geometry  string
+	geoType   string
+	typeNames map[piazza.Ident]string
+}
+
+// NewEventExport reads the export format and the same filter parameters as GET /event.
+// GeoJSON needs an EventType with a geo_point or geo_shape field, or a bbox held as a
+// four-number array or as minX, minY, maxX and maxY fields; geometryField picks one if
+// there are several.
+func (service *Service) NewEventExport(params *piazza.HttpQueryParams, dataFilters map[string]string) (*eventExport, *piazza.JsonResponse) {
+	format, err := params.GetAsString("format", EventExportNDJSON)
+	if err != nil {
+		return nil, service.statusBadRequest(err)
+	}
+	format = strings.ToLower(format)
+	if format != EventExportNDJSON && format != EventExportGeoJSON {
+		return nil, service.statusBadRequest(fmt.Errorf("format must be %s or %s", EventExportNDJSON, EventExportGeoJSON))
+	}
+
+	filter, err := parseEventFilter(params, dataFilters)
+	if err != nil {
+		return nil, service.statusBadRequest(err)
+	}
+	mapping, eventType, resp := service.eventTypeFromParams(params, true)
+	if resp != nil {
+		return nil, resp
+	}
+	query, err := service.eventFilterQuery(filter, eventType)
+	if err != nil {
+		return nil, service.statusBadRequest(err)
+	}
+
+	export := &eventExport{
+		service:   service,
+		Format:    format,
+		mapping:   mapping,
+		query:     query,
+		typeNames: map[piazza.Ident]string{},
+	}
+	if eventType != nil {
+		export.typeNames[eventType.EventTypeID] = eventType.Name
+	}
+
+	if format == EventExportGeoJSON {
+		if eventType == nil {
+			return nil, service.statusBadRequest(errors.New("a geojson export needs an eventTypeId or eventTypeName"))
+		}
+		name, err := params.GetAsString("geometryField", "")
+		if err != nil {
+			return nil, service.statusBadRequest(err)
+		}
+		export.geometry, export.geoType, err = geometryField(service.removeUniqueParams(eventType.Name, eventType.Mapping), name)
+		if err != nil {
+			return nil, service.statusBadRequest(err)
+		}
+	}
+
+	service.syslogger.Audit("pz-workflow", "exportingEvents", service.eventDB.Esi.IndexName(), "Service.NewEventExport: User is exporting events as %s", format)
+	return export, nil
+}
+
+// ContentType is the media type of the export
+func (x *eventExport) ContentType() string {
+	if x.Format == EventExportGeoJSON {
+		return "application/geo+json"
+	}
+	return "application/x-ndjson"
+}
+
+// Write scans the matching events, oldest first, and writes them to w, calling flush
+// after each page. Nothing is buffered beyond a page, so an error part way through
+// leaves w holding a truncated export.
+func (x *eventExport) Write(w io.Writer, flush func()) error {
+	count := 0
+	if x.Format == EventExportGeoJSON {
+		if _, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`); err != nil {
+			return err
+		}
+	}
+
+	err := x.service.eventDB.ScanEvents(x.mapping, x.query, eventExportPageSize, "pz-workflow", func(event *Event) error {
+		name, err := x.typeName(event.EventTypeID)
+		if err != nil {
+			return err
+		}
+		event.Data = x.service.removeUniqueParams(name, event.Data)
+
+		var item interface{} = event
+		sep := "\n"
+		if x.Format == EventExportGeoJSON {
+			if item, err = eventFeature(event, x.geometry, x.geoType); err != nil {
+				return err
+			}
+			sep = ""
+			if count > 0 {
+				sep = ","
+			}
+		}
+		byts, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if x.Format == EventExportGeoJSON {
+			_, err = fmt.Fprintf(w, "%s%s", sep, byts)
+		} else {
+			_, err = fmt.Fprintf(w, "%s%s", byts, sep)
+		}
+		if err != nil {
+			return err
+		}
+
+		count++
+		if count%eventExportPageSize == 0 {
+			flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if x.Format == EventExportGeoJSON {
+		if _, err = io.WriteString(w, "]}"); err != nil {
+			return err
+		}
+	}
+	flush()
+	return nil
+}
+
+// typeName remembers the names of the EventTypes seen, since an export of all
+// events would otherwise look one up per event
+func (x *eventExport) typeName(id piazza.Ident) (string, error) {
+	if name, ok := x.typeNames[id]; ok {
+		return name, nil
+	}
+	eventType, found, err := x.service.eventTypeDB.GetOne(id, "pz-workflow")
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("EventType %s does not exist", id)
+	}
+	x.typeNames[id] = eventType.Name
+	return eventType.Name, nil
+}
+
+// bboxScalarsGeoType is the geometry type of an object holding a bbox as the four
+// number fields minX, minY, maxX and maxY, as piazza:ingest events do. The geometry
+// field is the object's path, "" for the top of the event data.
+const bboxScalarsGeoType = "minX,minY,maxX,maxY"
+
+var bboxScalarNames = []string{"minX", "minY", "maxX", "maxY"}
+
+// geometryField picks the field a GeoJSON export takes its geometry from: the named
+// one, else the only geo field, else a field called bbox, else the only object with
+// minX, minY, maxX and maxY fields. An object is named by its path, or "data" for the
+// top of the event data.
+func geometryField(mapping map[string]interface{}, name string) (string, string, error) {
+	if name == "data" {
+		if hasBBoxScalars(mapping, "") {
+			return "", bboxScalarsGeoType, nil
+		}
+		return "", "", errors.New("geojson needs a geometryField: data has no minX, minY, maxX and maxY fields")
+	}
+	name = strings.TrimPrefix(name, "data.")
+	if name != "" && len(nestedPathsOf(mapping, name)) == 0 {
+		if typ, ok := mappingTypeAt(mapping, name); ok && isBBoxMappingType(typ) {
+			return name, typ, nil
+		}
+		if hasBBoxScalars(mapping, name) {
+			return name, bboxScalarsGeoType, nil
+		}
+	}
+	field, typ, err := bboxField(mapping, name)
+	if err == nil {
+		return field, typ, nil
+	}
+	if name == "" {
+		if typ, ok := mappingTypeAt(mapping, "bbox"); ok && isBBoxMappingType(typ) {
+			return "bbox", typ, nil
+		}
+		switch objects := bboxScalarObjects(mapping); len(objects) {
+		case 0:
+		case 1:
+			return objects[0], bboxScalarsGeoType, nil
+		default:
+			for i, object := range objects {
+				objects[i] = "data." + object
+				if object == "" {
+					objects[i] = "data"
+				}
+			}
+			return "", "", fmt.Errorf("geojson needs a geometryField, one of %s", strings.Join(objects, ", "))
+		}
+	}
+	return "", "", fmt.Errorf("geojson needs a geometryField: %s", err)
+}
+
+func isBBoxMappingType(typ string) bool {
+	return strings.HasPrefix(typ, "[") && isBBoxScalarMappingType(elementType(typ))
+}
+
+func isBBoxScalarMappingType(typ string) bool {
+	switch typ {
+	case "double", "float", "half_float", "scaled_float", "integer", "long", "short":
+		return true
+	}
+	return false
+}
+
+// hasBBoxScalars is true if the object at path, outside any array of objects, has
+// number fields minX, minY, maxX and maxY
+func hasBBoxScalars(mapping map[string]interface{}, path string) bool {
+	object := mapping
+	if path != "" {
+		node, nested, ok := mappingNodeAt(mapping, path)
+		if !ok || len(nested) > 0 {
+			return false
+		}
+		if object, ok = node.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	for _, name := range bboxScalarNames {
+		typ, ok := object[name].(string)
+		if !ok || !isBBoxScalarMappingType(typ) {
+			return false
+		}
+	}
+	return true
+}
+
+// bboxScalarObjects lists the paths of the objects holding a four-number bbox, "" for
+// the top of the event data
+func bboxScalarObjects(mapping map[string]interface{}) []string {
+	found := []string{}
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		if hasBBoxScalars(m, "") {
+			found = append(found, strings.TrimSuffix(prefix, "."))
+		}
+		for k, v := range m {
+			if obj, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", obj)
+			}
+		}
+	}
+	walk("", mapping)
+	sort.Strings(found)
+	return found
+}
+
+// eventFeature turns an event, with its data already unwrapped, into a GeoJSON Feature.
+// The geometry field is left out of the properties; an event without one gets a null
+// geometry, which GeoJSON allows.
+func eventFeature(event *Event, field string, typ string) (map[string]interface{}, error) {
+	data := copyData(event.Data)
+	var value interface{}
+	if typ == bboxScalarsGeoType {
+		value = bboxScalarsOf(data, field)
+	} else {
+		value, _ = getPath(data, field)
+		deletePath(data, field)
+	}
+
+	var geometry interface{}
+	if value != nil {
+		var err error
+		if geometry, err = toGeoJSON(typ, value); err != nil {
+			return nil, fmt.Errorf("event %s: data.%s: %s", event.EventID, field, err)
+		}
+	}
+
+	return map[string]interface{}{
+		"type":     "Feature",
+		"id":       event.EventID,
+		"geometry": geometry,
+		"properties": map[string]interface{}{
+			"eventId":     event.EventID,
+			"eventTypeId": event.EventTypeID,
+			"createdOn":   event.CreatedOn,
+			"createdBy":   event.CreatedBy,
+			"data":        data,
+		},
+	}, nil
+}
+
+// toGeoJSON converts a geo_point, geo_shape or bbox value to a GeoJSON geometry.
+// Elasticsearch's envelope becomes a Polygon and its circle becomes the centre Point,
+// since GeoJSON has neither.
+func toGeoJSON(typ string, value interface{}) (map[string]interface{}, error) {
+	switch {
+	case typ == geoPointMappingType:
+		lon, lat, err := geoPointLonLat(value)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "Point", "coordinates": []float64{lon, lat}}, nil
+	case typ == geoShapeMappingType:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("not a geo_shape")
+		}
+		kind, _ := obj["type"].(string)
+		switch strings.ToLower(kind) {
+		case "envelope":
+			corners, _ := geoList(obj["coordinates"])
+			if len(corners) != 2 {
+				return nil, errors.New("an envelope needs two positions")
+			}
+			ul, _ := geoList(corners[0])
+			lr, _ := geoList(corners[1])
+			if len(ul) < 2 || len(lr) < 2 {
+				return nil, errors.New("an envelope needs two positions")
+			}
+			return bboxPolygon(ul[0], lr[1], lr[0], ul[1])
+		case "circle":
+			return map[string]interface{}{"type": "Point", "coordinates": obj["coordinates"]}, nil
+		}
+		return obj, nil
+	case typ == bboxScalarsGeoType:
+		box, ok := value.([]interface{})
+		if !ok || len(box) != 4 {
+			return nil, errors.New("a bbox needs four numbers, minX, minY, maxX, maxY")
+		}
+		return bboxPolygon(box[0], box[1], box[2], box[3])
+	case isBBoxMappingType(typ):
+		box, ok := geoList(value)
+		if !ok || len(box) != 4 {
+			return nil, errors.New("a bbox needs four numbers, minX, minY, maxX, maxY")
+		}
+		return bboxPolygon(box[0], box[1], box[2], box[3])
+	}
+	return nil, fmt.Errorf("%s is not a geometry type", typ)
+}
+
+func bboxPolygon(minXv, minYv, maxXv, maxYv interface{}) (map[string]interface{}, error) {
+	n := make([]float64, 4)
+	for i, v := range []interface{}{minXv, minYv, maxXv, maxYv} {
+		f, ok := numberValue(v)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a number", describeValue(v))
+		}
+		n[i] = f
+	}
+	minX, minY, maxX, maxY := n[0], n[1], n[2], n[3]
+	ring := [][]float64{{minX, minY}, {maxX, minY}, {maxX, maxY}, {minX, maxY}, {minX, minY}}
+	return map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{ring}}, nil
+}
+
+// bboxScalarsOf takes the minX, minY, maxX and maxY fields out of the object at path,
+// returning them in that order, or nil if the object has none of them
+func bboxScalarsOf(data map[string]interface{}, path string) interface{} {
+	object := data
+	if path != "" {
+		v, _ := getPath(data, path)
+		if object, _ = v.(map[string]interface{}); object == nil {
+			return nil
+		}
+	}
+	box := make([]interface{}, 0, len(bboxScalarNames))
+	for _, name := range bboxScalarNames {
+		if v, ok := object[name]; ok {
+			box = append(box, v)
+			delete(object, name)
+		}
+	}
+	if len(box) == 0 {
+		return nil
+	}
+	return box
+}
+
+// geoPointLonLat reads any of the forms accepted by checkGeoPoint
+func geoPointLonLat(value interface{}) (float64, float64, error) {
+	if msg := checkGeoPoint(value); msg != "" {
+		return 0, 0, errors.New(msg)
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		lat, _ := numberValue(v["lat"])
+		lon, _ := numberValue(v["lon"])
+		return lon, lat, nil
+	case string:
+		if parts := strings.Split(v, ","); len(parts) == 2 {
+			lat, _ := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			lon, _ := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			return lon, lat, nil
+		}
+		lon, lat := decodeGeohash(v)
+		return lon, lat, nil
+	}
+	list, _ := geoList(value)
+	lon, _ := numberValue(list[0])
+	lat, _ := numberValue(list[1])
+	return lon, lat, nil
+}
+
+// decodeGeohash returns the centre of the geohash's cell
+func decodeGeohash(hash string) (float64, float64) {
+	lon := [2]float64{-180, 180}
+	lat := [2]float64{-90, 90}
+	even := true
+	for _, c := range hash {
+		bits := strings.IndexRune(geohashAlphabet, c)
+		for mask := 16; mask > 0; mask >>= 1 {
+			r := &lat
+			if even {
+				r = &lon
+			}
+			mid := (r[0] + r[1]) / 2
+			if bits&mask != 0 {
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+	}
+	return (lon[0] + lon[1]) / 2, (lat[0] + lat[1]) / 2
+}
+
+func deletePath(data map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, ok := data[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		data = obj
+	}
+	delete(data, parts[len(parts)-1])
+}
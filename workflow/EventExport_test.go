@@ -0,0 +1,151 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestEventExportGeometry(t *testing.T) {
+	assert := assert.New(t)
+
+	point := map[string]interface{}{"type": "Point", "coordinates": []float64{10, 20}}
+	for _, v := range []interface{}{
+		map[string]interface{}{"lat": 20.0, "lon": 10.0},
+		[]interface{}{10.0, 20.0},
+		"20,10",
+	} {
+		g, err := toGeoJSON(geoPointMappingType, v)
+		assert.NoError(err)
+		assert.Equal(point, g)
+	}
+
+	lon, lat := decodeGeohash("u4pruydqqvj")
+	assert.InDelta(10.40744, lon, 0.0001)
+	assert.InDelta(57.64911, lat, 0.0001)
+
+	envelope := map[string]interface{}{"type": "envelope", "coordinates": []interface{}{[]interface{}{0.0, 2.0}, []interface{}{1.0, 0.0}}}
+	g, err := toGeoJSON(geoShapeMappingType, envelope)
+	assert.NoError(err)
+	assert.Equal("Polygon", g["type"])
+	assert.Equal([][][]float64{{{0, 0}, {1, 0}, {1, 2}, {0, 2}, {0, 0}}}, g["coordinates"])
+
+	g, err = toGeoJSON("[double]", []interface{}{0.0, 0.0, 1.0, 2.0})
+	assert.NoError(err)
+	assert.Equal([][][]float64{{{0, 0}, {1, 0}, {1, 2}, {0, 2}, {0, 0}}}, g["coordinates"])
+
+	_, err = toGeoJSON("[double]", []interface{}{0.0, 0.0, 1.0})
+	assert.Error(err)
+}
+
+func TestEventExportFeature(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping := map[string]interface{}{
+		"name": "string",
+		"where": map[string]interface{}{
+			"point": "geo_point",
+		},
+		"bbox": "[double]",
+	}
+	field, typ, err := geometryField(mapping, "")
+	assert.NoError(err)
+	assert.Equal("where.point", field)
+	assert.Equal(geoPointMappingType, typ)
+	field, _, err = geometryField(mapping, "data.bbox")
+	assert.NoError(err)
+	assert.Equal("bbox", field)
+	_, _, err = geometryField(mapping, "name")
+	assert.Error(err)
+
+	event := &Event{
+		EventID:     piazza.Ident("e1"),
+		EventTypeID: piazza.Ident("t1"),
+		Data: map[string]interface{}{
+			"name":  "x",
+			"where": map[string]interface{}{"point": "20,10"},
+		},
+	}
+	f, err := eventFeature(event, "where.point", geoPointMappingType)
+	assert.NoError(err)
+	assert.Equal("Feature", f["type"])
+	assert.Equal(piazza.Ident("e1"), f["id"])
+	assert.Equal(map[string]interface{}{"type": "Point", "coordinates": []float64{10, 20}}, f["geometry"])
+	props := f["properties"].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"name": "x", "where": map[string]interface{}{}}, props["data"])
+	// the event itself is left alone
+	assert.Equal("20,10", event.Data["where"].(map[string]interface{})["point"])
+
+	delete(event.Data, "where")
+	f, err = eventFeature(event, "where.point", geoPointMappingType)
+	assert.NoError(err)
+	assert.Nil(f["geometry"])
+}
+
+func TestEventExportBBoxScalars(t *testing.T) {
+	assert := assert.New(t)
+
+	ingest := map[string]interface{}{
+		"dataId": "string",
+		"minX":   "double",
+		"minY":   "double",
+		"maxX":   "double",
+		"maxY":   "double",
+	}
+	field, typ, err := geometryField(ingest, "")
+	assert.NoError(err)
+	assert.Equal("", field)
+	assert.Equal(bboxScalarsGeoType, typ)
+	field, typ, err = geometryField(ingest, "data")
+	assert.NoError(err)
+	assert.Equal("", field)
+	assert.Equal(bboxScalarsGeoType, typ)
+
+	both := map[string]interface{}{
+		"minX": "double", "minY": "double", "maxX": "double", "maxY": "double",
+		"extent": map[string]interface{}{"minX": "float", "minY": "float", "maxX": "float", "maxY": "float"},
+	}
+	_, _, err = geometryField(both, "")
+	assert.Error(err)
+	assert.Contains(err.Error(), "one of data, data.extent")
+	field, typ, err = geometryField(both, "data.extent")
+	assert.NoError(err)
+	assert.Equal("extent", field)
+	assert.Equal(bboxScalarsGeoType, typ)
+
+	_, _, err = geometryField(map[string]interface{}{"minX": "double", "minY": "double", "maxX": "string", "maxY": "double"}, "")
+	assert.Error(err)
+
+	event := &Event{
+		EventID: piazza.Ident("e1"),
+		Data:    map[string]interface{}{"dataId": "d1", "minX": 0.0, "minY": 1.0, "maxX": 2.0, "maxY": 3.0},
+	}
+	f, err := eventFeature(event, "", bboxScalarsGeoType)
+	assert.NoError(err)
+	ring := [][]float64{{0, 1}, {2, 1}, {2, 3}, {0, 3}, {0, 1}}
+	assert.Equal(map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{ring}}, f["geometry"])
+	props := f["properties"].(map[string]interface{})
+	assert.Equal(map[string]interface{}{"dataId": "d1"}, props["data"])
+	assert.Equal(0.0, event.Data["minX"])
+
+	_, err = eventFeature(&Event{Data: map[string]interface{}{"minX": 0.0}}, "", bboxScalarsGeoType)
+	assert.Error(err)
+	f, err = eventFeature(&Event{Data: map[string]interface{}{}}, "", bboxScalarsGeoType)
+	assert.NoError(err)
+	assert.Nil(f["geometry"])
+}
@@ -0,0 +1,338 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// EventFilter narrows an event listing without hand-written DSL. On the query string:
+//
+//	bbox=minX,minY,maxX,maxY   events whose geo field lies in the box
+//	bboxField=data.where       which geo field; needed only if the type has several
+//	since=2016-08-01T00:00:00Z createdOn >= since
+//	until=2016-08-02T00:00:00Z createdOn < until
+//	createdBy=someone
+//	data.<field>=value         equality
+//	data.<field>=from..to      inclusive range; either end may be left empty
+//
+// bbox and data.* filters need an eventTypeId or eventTypeName, since the
+// field's type decides how the value is interpreted.
+type EventFilter struct {
+	EventTypeID   piazza.Ident
+	EventTypeName string
+	BBox          []float64
+	BBoxField     string
+	Since         time.Time
+	Until         time.Time
+	CreatedBy     string
+	Data          map[string]string
+}
+
+const eventFilterRangeSeparator = ".."
+
+// IsEmpty is true if the filter does nothing beyond selecting an EventType
+func (f *EventFilter) IsEmpty() bool {
+	return len(f.BBox) == 0 && f.Since.IsZero() && f.Until.IsZero() && f.CreatedBy == "" && len(f.Data) == 0
+}
+
+// Values encodes the filter as query parameters for GET /event
+func (f *EventFilter) Values() url.Values {
+	v := url.Values{}
+	if f.EventTypeID != "" {
+		v.Set("eventTypeId", f.EventTypeID.String())
+	}
+	if f.EventTypeName != "" {
+		v.Set("eventTypeName", f.EventTypeName)
+	}
+	if len(f.BBox) > 0 {
+		parts := make([]string, len(f.BBox))
+		for i, n := range f.BBox {
+			parts[i] = strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		v.Set("bbox", strings.Join(parts, ","))
+	}
+	if f.BBoxField != "" {
+		v.Set("bboxField", f.BBoxField)
+	}
+	if !f.Since.IsZero() {
+		v.Set("since", f.Since.Format(time.RFC3339Nano))
+	}
+	if !f.Until.IsZero() {
+		v.Set("until", f.Until.Format(time.RFC3339Nano))
+	}
+	if f.CreatedBy != "" {
+		v.Set("createdBy", f.CreatedBy)
+	}
+	for k, val := range f.Data {
+		v.Set("data."+k, val)
+	}
+	return v
+}
+
+// parseEventFilter reads the filter from the query parameters; data holds the
+// data.* parameters, with the prefix removed
+func parseEventFilter(params *piazza.HttpQueryParams, data map[string]string) (*EventFilter, error) {
+	f := &EventFilter{Data: data}
+
+	eventTypeID, err := params.GetAsString("eventTypeId", "")
+	if err != nil {
+		return nil, err
+	}
+	f.EventTypeID = piazza.Ident(eventTypeID)
+	if f.EventTypeName, err = params.GetAsString("eventTypeName", ""); err != nil {
+		return nil, err
+	}
+	if f.CreatedBy, err = params.GetAsString("createdBy", ""); err != nil {
+		return nil, err
+	}
+	if f.BBoxField, err = params.GetAsString("bboxField", ""); err != nil {
+		return nil, err
+	}
+
+	bbox, err := params.GetAsString("bbox", "")
+	if err != nil {
+		return nil, err
+	}
+	if bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("bbox must be minX,minY,maxX,maxY")
+		}
+		for _, p := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("bbox value %q is not a number", p)
+			}
+			f.BBox = append(f.BBox, n)
+		}
+		if msg := checkLonLat(f.BBox[0], f.BBox[1]); msg != "" {
+			return nil, fmt.Errorf("bbox: %s", msg)
+		}
+		if msg := checkLonLat(f.BBox[2], f.BBox[3]); msg != "" {
+			return nil, fmt.Errorf("bbox: %s", msg)
+		}
+		if f.BBox[0] > f.BBox[2] || f.BBox[1] > f.BBox[3] {
+			return nil, errors.New("bbox must be minX,minY,maxX,maxY")
+		}
+	}
+
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		s, err := params.GetAsString(name, "")
+		if err != nil {
+			return nil, err
+		}
+		if s == "" {
+			continue
+		}
+		if *dst, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time: %s", name, err)
+		}
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return nil, errors.New("since must be before until")
+	}
+
+	return f, nil
+}
+
+// eventFilterQuery turns the filter into a bool query over the events index.
+// eventType may be nil only if the filter has no bbox or data.* filters.
+func (service *Service) eventFilterQuery(f *EventFilter, eventType *EventType) (map[string]interface{}, error) {
+	var eventTypeID piazza.Ident
+	if eventType != nil {
+		eventTypeID = eventType.EventTypeID
+	}
+	timeQuery, err := eventTimeRangeQuery(eventTypeID, f.Since, f.Until)
+	if err != nil {
+		return nil, err
+	}
+	must := timeQuery["bool"].(map[string]interface{})["must"].([]interface{})
+
+	if f.CreatedBy != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"createdBy": f.CreatedBy}})
+	}
+
+	if (len(f.BBox) > 0 || len(f.Data) > 0) && eventType == nil {
+		return nil, errors.New("bbox and data filters need an eventTypeId or eventTypeName")
+	}
+	if eventType == nil {
+		return map[string]interface{}{"bool": map[string]interface{}{"must": must}}, nil
+	}
+	mapping := service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	storedField := func(field string) string {
+		return "data." + eventType.Name + "." + field
+	}
+
+	if len(f.BBox) > 0 {
+		field, typ, err := bboxField(mapping, f.BBoxField)
+		if err != nil {
+			return nil, err
+		}
+		minX, minY, maxX, maxY := f.BBox[0], f.BBox[1], f.BBox[2], f.BBox[3]
+		if typ == geoPointMappingType {
+			must = append(must, map[string]interface{}{
+				"geo_bounding_box": map[string]interface{}{
+					storedField(field): map[string]interface{}{
+						"top_left":     map[string]interface{}{"lat": maxY, "lon": minX},
+						"bottom_right": map[string]interface{}{"lat": minY, "lon": maxX},
+					},
+				},
+			})
+		} else {
+			envelope := map[string]interface{}{
+				"type":        "envelope",
+				"coordinates": [][]float64{{minX, maxY}, {maxX, minY}},
+			}
+			must = append(must, geofenceQuery(storedField(field), GeofenceIntersects, envelope))
+		}
+	}
+
+	names := make([]string, 0, len(f.Data))
+	for name := range f.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		typ, ok := mappingTypeAt(mapping, name)
+		if !ok {
+			return nil, fmt.Errorf("data.%s is not a field of eventType %s", name, eventType.EventTypeID)
+		}
+		clause, err := dataFilterClause(storedField(name), elementType(typ), f.Data[name])
+		if err != nil {
+			return nil, fmt.Errorf("data.%s: %s", name, err)
+		}
+		must = append(must, nestedQuery(clause, nestedPathsOf(mapping, name), storedField))
+	}
+
+	return map[string]interface{}{"bool": map[string]interface{}{"must": must}}, nil
+}
+
+// bboxField picks the geo field a bbox applies to: the named one, or the only one
+func bboxField(mapping map[string]interface{}, name string) (string, string, error) {
+	if name != "" {
+		name = strings.TrimPrefix(name, "data.")
+		typ, ok := mappingTypeAt(mapping, name)
+		typ = elementType(typ)
+		if !ok || (typ != geoPointMappingType && typ != geoShapeMappingType) {
+			return "", "", fmt.Errorf("bboxField data.%s is not a geo field", name)
+		}
+		if len(nestedPathsOf(mapping, name)) > 0 {
+			return "", "", fmt.Errorf("bboxField data.%s is inside an array of objects", name)
+		}
+		return name, typ, nil
+	}
+
+	found := []string{}
+	var foundType string
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			switch t := v.(type) {
+			case map[string]interface{}:
+				walk(prefix+k+".", t)
+			case string:
+				if typ := elementType(t); typ == geoPointMappingType || typ == geoShapeMappingType {
+					found = append(found, prefix+k)
+					foundType = typ
+				}
+			}
+		}
+	}
+	walk("", mapping)
+
+	switch len(found) {
+	case 0:
+		return "", "", errors.New("bbox needs an eventType with a geo_point or geo_shape field")
+	case 1:
+		return found[0], foundType, nil
+	}
+	sort.Strings(found)
+	return "", "", fmt.Errorf("bbox needs a bboxField, one of data.%s", strings.Join(found, ", data."))
+}
+
+// dataFilterClause builds an equality or range clause on a stored data field. Strings
+// are matched as phrases, since string fields in event mappings are analyzed.
+func dataFilterClause(field string, typ string, value string) (map[string]interface{}, error) {
+	if typ == geoPointMappingType || typ == geoShapeMappingType {
+		return nil, errors.New("geo fields are filtered with bbox")
+	}
+
+	if strings.Contains(value, eventFilterRangeSeparator) {
+		parts := strings.SplitN(value, eventFilterRangeSeparator, 2)
+		rng := map[string]interface{}{}
+		for i, op := range []string{"gte", "lte"} {
+			if parts[i] == "" {
+				continue
+			}
+			v, err := typedFilterValue(typ, parts[i])
+			if err != nil {
+				return nil, err
+			}
+			rng[op] = v
+		}
+		if len(rng) == 0 {
+			return nil, errors.New("a range needs at least one end")
+		}
+		return map[string]interface{}{"range": map[string]interface{}{field: rng}}, nil
+	}
+
+	v, err := typedFilterValue(typ, value)
+	if err != nil {
+		return nil, err
+	}
+	if isStringMappingType(typ) {
+		return map[string]interface{}{"match_phrase": map[string]interface{}{field: v}}, nil
+	}
+	return map[string]interface{}{"term": map[string]interface{}{field: v}}, nil
+}
+
+func typedFilterValue(typ string, s string) (interface{}, error) {
+	switch typ {
+	case "integer", "long", "short", "byte":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not %s %s", s, article(typ), typ)
+		}
+		return n, nil
+	case "double", "float", "half_float", "scaled_float":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return n, nil
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", s)
+		}
+		return b, nil
+	case "date":
+		if !isEventDate(s) {
+			if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+				return nil, fmt.Errorf("%q is not a date", s)
+			}
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventFilterQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &Service{}
+	eventType := &EventType{
+		EventTypeID: "et1",
+		Name:        "T",
+		Mapping: map[string]interface{}{
+			"T": map[string]interface{}{
+				"num":   "integer",
+				"name":  "string",
+				"where": "geo_point",
+			},
+		},
+	}
+
+	toJSON := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		assert.NoError(err)
+		return string(b)
+	}
+
+	filter := &EventFilter{
+		BBox:      []float64{-10, -5, 10, 5},
+		Since:     time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC),
+		CreatedBy: "me",
+		Data:      map[string]string{"num": "3..", "name": "big dog"},
+	}
+	assert.False(filter.IsEmpty())
+	q, err := service.eventFilterQuery(filter, eventType)
+	assert.NoError(err)
+	s := toJSON(q)
+	assert.Contains(s, `{"term":{"eventTypeId":"et1"}}`)
+	assert.Contains(s, `"range":{"createdOn":{"gte":`)
+	assert.Contains(s, `{"term":{"createdBy":"me"}}`)
+	assert.Contains(s, `"geo_bounding_box":{"data.T.where":{"bottom_right":{"lat":-5,"lon":10},"top_left":{"lat":5,"lon":-10}}}`)
+	assert.Contains(s, `{"range":{"data.T.num":{"gte":3}}}`)
+	assert.Contains(s, `{"match_phrase":{"data.T.name":"big dog"}}`)
+
+	for _, bad := range []map[string]string{
+		{"nope": "1"},
+		{"num": "three"},
+		{"num": ".."},
+		{"where": "1,2"},
+	} {
+		_, err = service.eventFilterQuery(&EventFilter{Data: bad}, eventType)
+		assert.Error(err, "%v", bad)
+	}
+	_, err = service.eventFilterQuery(&EventFilter{Data: map[string]string{"num": "1"}}, nil)
+	assert.Error(err)
+
+	// a plain time filter works across all types
+	q, err = service.eventFilterQuery(&EventFilter{Until: filter.Since}, nil)
+	assert.NoError(err)
+	assert.NotContains(toJSON(q), "eventTypeId")
+
+	v := (&EventFilter{EventTypeID: "et1", BBox: []float64{1, 2, 3.5, 4}, Data: map[string]string{"num": "7"}}).Values()
+	assert.Equal("et1", v.Get("eventTypeId"))
+	assert.Equal("1,2,3.5,4", v.Get("bbox"))
+	assert.Equal("7", v.Get("data.num"))
+}
@@ -0,0 +1,281 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// dependents are looked up and deleted this many at a time
+const cascadePageSize = 500
+
+// a dry run lists at most this many triggers, the Elasticsearch result window
+const cascadeDryRunLimit = 10000
+
+// CascadeDeleteEventType deletes an EventType along with everything that depends on
+// it: its repeating events' schedules, its triggers and their percolators, its events
+// and, with alerts=true, the alerts of its triggers. With dryRun=true nothing is
+// deleted and the response says what would be.
+//
+// The schedules go first, so that no new events appear, and the EventType last, so
+// that a cascade which fails part way can be resumed by repeating the request.
+func (service *Service) CascadeDeleteEventType(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	dryRun, err := params.GetAsString("dryRun", "false")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	alerts, err := params.GetAsString("alerts", "false")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if system := service.systemEventType(eventType.Name); system != nil {
+		if system.ProtectDelete {
+			return service.statusBadRequest(errors.New("Deleting system eventTypes is prohibited"))
+		}
+		if system.ProtectEvents {
+			return service.statusBadRequest(fmt.Errorf("Deleting events of system eventType %s is prohibited", eventType.Name))
+		}
+	}
+
+	cascade := &EventTypeCascade{
+		EventTypeID:   id,
+		DryRun:        dryRun == "true",
+		IncludeAlerts: alerts == "true",
+		TriggerIDs:    []piazza.Ident{},
+		CronIDs:       []piazza.Ident{},
+	}
+	if cascade.DryRun {
+		if err = service.planCascade(eventType, cascade); err != nil {
+			return service.statusInternalError(err)
+		}
+		return service.statusOK(cascade)
+	}
+
+	service.syslogger.Audit("pz-workflow", "cascadeDeletingEventType", id, "Service.CascadeDeleteEventType: User is deleting eventType [%s] and its dependents (alerts=%t)", id, cascade.IncludeAlerts)
+
+	if err = service.runCascade(eventType, cascade); err != nil {
+		service.syslogger.Audit("pz-workflow", "cascadeDeletingEventTypeFailure", id, "Service.CascadeDeleteEventType: User failed to delete eventType [%s] and its dependents", id)
+		return service.statusInternalError(fmt.Errorf("the cascade stopped after deleting %d schedules, %d alerts, %d triggers and %d events; repeat the request to resume it: %s",
+			len(cascade.CronIDs), cascade.Alerts, len(cascade.TriggerIDs), cascade.Events, err))
+	}
+
+	service.syslogger.Audit("pz-workflow", "cascadeDeletedEventType", id, "Service.CascadeDeleteEventType: User successfully deleted eventType [%s] and its dependents", id)
+
+	cascade.Complete = true
+	return service.statusOK(cascade)
+}
+
+// planCascade fills in what a cascade would delete
+func (service *Service) planCascade(eventType *EventType, cascade *EventTypeCascade) error {
+	crons, err := service.cronsOfEventType(eventType.EventTypeID)
+	if err != nil {
+		return err
+	}
+	for _, cron := range crons {
+		cascade.CronIDs = append(cascade.CronIDs, cron.EventID)
+	}
+
+	triggers, hits, err := service.triggerDB.GetTriggersByDslQuery(termPageQuery("eventTypeId", eventType.EventTypeID, "triggerId", "", cascadeDryRunLimit), "pz-workflow")
+	if err != nil {
+		return err
+	}
+	if hits > int64(len(triggers)) {
+		return fmt.Errorf("eventType %s has %d triggers, more than a dry run can list", eventType.EventTypeID, hits)
+	}
+	for _, trigger := range triggers {
+		cascade.TriggerIDs = append(cascade.TriggerIDs, trigger.TriggerID)
+		if cascade.IncludeAlerts {
+			_, hits, err := service.alertDB.GetAlertsByDslQuery(termPageQuery("triggerId", trigger.TriggerID, "alertId", "", 0), "pz-workflow")
+			if err != nil {
+				return err
+			}
+			cascade.Alerts += hits
+		}
+	}
+
+	cascade.Events, err = service.eventDB.CountEvents(eventType.Name, eventTypeIDQuery(eventType.EventTypeID), "pz-workflow")
+	return err
+}
+
+// runCascade deletes the dependents and then the EventType, counting them off in
+// cascade as it goes
+func (service *Service) runCascade(eventType *EventType, cascade *EventTypeCascade) error {
+	id := eventType.EventTypeID
+
+	crons, err := service.cronsOfEventType(id)
+	if err != nil {
+		return err
+	}
+	for _, cron := range crons {
+		service.syslogger.Audit("pz-workflow", "deletingCronEvent", cron.EventID, "Service.CascadeDeleteEventType: User is deleting cron event [%s] of eventType [%s]", cron.EventID, id)
+		if _, err = service.cronDB.DeleteByID(cron.EventID, "pz-workflow"); err != nil {
+			return err
+		}
+		service.cron.Remove(cron.EventID.String())
+		service.syslogger.Audit("pz-workflow", "deletedCronEvent", cron.EventID, "Service.CascadeDeleteEventType: User successfully deleted cron event [%s] of eventType [%s]", cron.EventID, id)
+		cascade.CronIDs = append(cascade.CronIDs, cron.EventID)
+	}
+
+	// the pages are keyed on the id rather than taken from the front, since a deleted
+	// trigger can still be found until the index is refreshed
+	after := ""
+	for {
+		triggers, _, err := service.triggerDB.GetTriggersByDslQuery(termPageQuery("eventTypeId", id, "triggerId", after, cascadePageSize), "pz-workflow")
+		if err != nil {
+			return err
+		}
+		if len(triggers) == 0 {
+			break
+		}
+		after = triggers[len(triggers)-1].TriggerID.String()
+		for _, trigger := range triggers {
+			if cascade.IncludeAlerts {
+				if err = service.cascadeAlerts(trigger.TriggerID, cascade); err != nil {
+					return err
+				}
+			}
+			service.syslogger.Audit("pz-workflow", "deletingTrigger", trigger.TriggerID, "Service.CascadeDeleteEventType: User is deleting trigger [%s] of eventType [%s]", trigger.TriggerID, id)
+			if _, err = service.triggerDB.DeleteTrigger(trigger.TriggerID, "pz-workflow"); err != nil {
+				return err
+			}
+			service.syslogger.Audit("pz-workflow", "deletedTrigger", trigger.TriggerID, "Service.CascadeDeleteEventType: User successfully deleted trigger [%s] of eventType [%s]", trigger.TriggerID, id)
+			cascade.TriggerIDs = append(cascade.TriggerIDs, trigger.TriggerID)
+		}
+	}
+
+	// the scan is keyed on createdOn and eventId, so deleting a page as it goes does
+	// not move the pages after it
+	batch := make([]piazza.Ident, 0, cascadePageSize)
+	deleteBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := service.eventDB.DeleteByIDs(eventType.Name, batch, "pz-workflow"); err != nil {
+			service.syslogger.Audit("pz-workflow", "deletingEventsFailure", id, "Service.CascadeDeleteEventType: User failed to delete events [%s] of eventType [%s]", joinIdents(batch), id)
+			return err
+		}
+		service.syslogger.Audit("pz-workflow", "deletedEvents", id, "Service.CascadeDeleteEventType: User successfully deleted events [%s] of eventType [%s]", joinIdents(batch), id)
+		cascade.Events += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	err = service.eventDB.ScanEvents(eventType.Name, eventTypeIDQuery(id), cascadePageSize, "pz-workflow", func(event *Event) error {
+		batch = append(batch, event.EventID)
+		if len(batch) < cascadePageSize {
+			return nil
+		}
+		return deleteBatch()
+	})
+	if err == nil {
+		err = deleteBatch()
+	}
+	if err != nil {
+		return err
+	}
+
+	service.syslogger.Audit("pz-workflow", "deletingEventType", id, "Service.CascadeDeleteEventType: User is deleting eventType [%s]", id)
+	if _, err = service.eventTypeDB.DeleteByID(id, "pz-workflow"); err != nil {
+		return err
+	}
+	service.syslogger.Audit("pz-workflow", "deletedEventType", id, "Service.CascadeDeleteEventType: User successfully deleted eventType [%s]", id)
+	return nil
+}
+
+func (service *Service) cascadeAlerts(triggerID piazza.Ident, cascade *EventTypeCascade) error {
+	after := ""
+	for {
+		alerts, _, err := service.alertDB.GetAlertsByDslQuery(termPageQuery("triggerId", triggerID, "alertId", after, cascadePageSize), "pz-workflow")
+		if err != nil {
+			return err
+		}
+		if len(alerts) == 0 {
+			return nil
+		}
+		after = alerts[len(alerts)-1].AlertID.String()
+		ids := make([]piazza.Ident, len(alerts))
+		for i, alert := range alerts {
+			ids[i] = alert.AlertID
+		}
+		if err = service.alertDB.DeleteByIDs(ids, "pz-workflow"); err != nil {
+			service.syslogger.Audit("pz-workflow", "deletingAlertsFailure", triggerID, "Service.CascadeDeleteEventType: User failed to delete alerts [%s] of trigger [%s]", joinIdents(ids), triggerID)
+			return err
+		}
+		service.syslogger.Audit("pz-workflow", "deletedAlerts", triggerID, "Service.CascadeDeleteEventType: User successfully deleted alerts [%s] of trigger [%s]", joinIdents(ids), triggerID)
+		cascade.Alerts += int64(len(ids))
+	}
+}
+
+func joinIdents(ids []piazza.Ident) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+// cronsOfEventType returns the repeating events of the EventType
+func (service *Service) cronsOfEventType(id piazza.Ident) ([]Event, error) {
+	exists, err := service.cronDB.Exists("pz-workflow")
+	if err != nil || !exists {
+		return nil, err
+	}
+	all, err := service.cronDB.GetAll("pz-workflow")
+	if err != nil {
+		return nil, err
+	}
+	crons := []Event{}
+	for _, event := range *all {
+		if event.EventTypeID == id {
+			crons = append(crons, event)
+		}
+	}
+	return crons, nil
+}
+
+// termPageQuery finds the documents whose field holds the value, ordered by key and
+// starting after the key given
+func termPageQuery(field string, value piazza.Ident, key string, after string, size int) string {
+	must := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{field: value.String()}},
+	}
+	if after != "" {
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{key: map[string]interface{}{"gt": after}}})
+	}
+	dsl := map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+		"sort":  []interface{}{map[string]interface{}{key: "asc"}},
+		"size":  size,
+	}
+	byts, _ := json.Marshal(dsl)
+	return string(byts)
+}
+
+func eventTypeIDQuery(id piazza.Ident) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{"eventTypeId": id.String()}}
+}
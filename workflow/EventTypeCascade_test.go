@@ -0,0 +1,210 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestTermPageQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	var dsl map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(termPageQuery("eventTypeId", "et1", "triggerId", "", 10)), &dsl))
+	assert.Equal(10.0, dsl["size"])
+	assert.Equal([]interface{}{map[string]interface{}{"triggerId": "asc"}}, dsl["sort"])
+	must := dsl["query"].(map[string]interface{})["bool"].(map[string]interface{})["must"].([]interface{})
+	assert.Len(must, 1)
+	assert.Equal(map[string]interface{}{"term": map[string]interface{}{"eventTypeId": "et1"}}, must[0])
+
+	assert.NoError(json.Unmarshal([]byte(termPageQuery("triggerId", "t1", "alertId", "a9", 5)), &dsl))
+	must = dsl["query"].(map[string]interface{})["bool"].(map[string]interface{})["must"].([]interface{})
+	assert.Len(must, 2)
+	assert.Equal(map[string]interface{}{"range": map[string]interface{}{"alertId": map[string]interface{}{"gt": "a9"}}}, must[1])
+}
+
+// deleteRecorder notes the index of each document deleted from it
+type deleteRecorder struct {
+	elasticsearch.IIndex
+	deletes *[]string
+}
+
+func (r *deleteRecorder) DeleteByID(typ string, id string) (*elasticsearch.DeleteResponse, error) {
+	*r.deletes = append(*r.deletes, r.IndexName())
+	return r.IIndex.DeleteByID(typ, id)
+}
+
+// newCascadeTestService starts a service on mock indices and
+// returns it with the list of indices documents were deleted from, in order
+func newCascadeTestService(t *testing.T) (*Service, *[]string) {
+	deletes := &[]string{}
+	service := newTestService(t, func(esi elasticsearch.IIndex) elasticsearch.IIndex {
+		return &deleteRecorder{IIndex: esi, deletes: deletes}
+	})
+	return service, deletes
+}
+
+type cascadeSeed struct {
+	eventType  *EventType
+	triggerIDs []piazza.Ident
+	cronID     piazza.Ident
+	alertIDs   []piazza.Ident
+}
+
+// seedCascade makes an EventType with the triggers asked for, an alert on each, two
+// events and a repeating event
+func seedCascade(t *testing.T, service *Service, triggers int) *cascadeSeed {
+	created := func(resp *piazza.JsonResponse) interface{} {
+		if resp.IsError() {
+			t.Fatal(resp.Message)
+		}
+		return resp.Data
+	}
+	seed := &cascadeSeed{}
+	seed.eventType = created(service.PostEventType(makeTestEventType(makeTestEventTypeName()))).(*EventType)
+	for i := 0; i < triggers; i++ {
+		trigger := created(service.PostTrigger(makeTestTrigger([]piazza.Ident{seed.eventType.EventTypeID}))).(*Trigger)
+		seed.triggerIDs = append(seed.triggerIDs, trigger.TriggerID)
+		alert := created(service.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: "e0"})).(*Alert)
+		seed.alertIDs = append(seed.alertIDs, alert.AlertID)
+	}
+	for i := 0; i < 2; i++ {
+		created(service.PostEvent(makeTestEvent(seed.eventType.EventTypeID)))
+	}
+	seed.cronID = created(service.PostRepeatingEvent(makeTestCronEvent(seed.eventType.EventTypeID))).(*Event).EventID
+	return seed
+}
+
+func cascadeParams(t *testing.T, query string) *piazza.HttpQueryParams {
+	return testQueryParams(t, "/eventType/x?cascade=true&"+query)
+}
+
+// squeeze drops the repeats of each run of equal strings
+func squeeze(list []string) []string {
+	out := []string{}
+	for _, s := range list {
+		if len(out) == 0 || out[len(out)-1] != s {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestCascadeDeleteEventTypeDryRun(t *testing.T) {
+	assert := assert.New(t)
+	service, deletes := newCascadeTestService(t)
+	seed := seedCascade(t, service, 1)
+
+	resp := service.CascadeDeleteEventType(seed.eventType.EventTypeID, cascadeParams(t, "dryRun=true&alerts=true"))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	cascade := resp.Data.(*EventTypeCascade)
+	assert.True(cascade.DryRun)
+	assert.False(cascade.Complete)
+	assert.Equal([]piazza.Ident{seed.cronID}, cascade.CronIDs)
+	assert.Equal(seed.triggerIDs, cascade.TriggerIDs)
+	assert.EqualValues(3, cascade.Events)
+	assert.EqualValues(1, cascade.Alerts)
+
+	// nothing was deleted
+	assert.Empty(*deletes)
+	_, found, err := service.eventTypeDB.GetOne(seed.eventType.EventTypeID, "pz-workflow")
+	assert.NoError(err)
+	assert.True(found)
+
+	// without alerts=true they are not counted
+	resp = service.CascadeDeleteEventType(seed.eventType.EventTypeID, cascadeParams(t, "dryRun=true"))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.EqualValues(0, resp.Data.(*EventTypeCascade).Alerts)
+}
+
+func TestCascadeDeleteEventTypeOrder(t *testing.T) {
+	assert := assert.New(t)
+	service, deletes := newCascadeTestService(t)
+	seed := seedCascade(t, service, 1)
+
+	resp := service.CascadeDeleteEventType(seed.eventType.EventTypeID, cascadeParams(t, "alerts=true"))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	cascade := resp.Data.(*EventTypeCascade)
+	assert.True(cascade.Complete)
+	assert.Equal([]piazza.Ident{seed.cronID}, cascade.CronIDs)
+	assert.Equal(seed.triggerIDs, cascade.TriggerIDs)
+	assert.EqualValues(3, cascade.Events)
+	assert.EqualValues(1, cascade.Alerts)
+
+	// schedules first so that no new events appear, the EventType last so that a
+	// failed cascade can be repeated
+	assert.Equal([]string{keyCrons, keyAlerts, keyTriggers, keyEvents, keyEventTypes}, squeeze(*deletes))
+
+	_, found, _ := service.eventTypeDB.GetOne(seed.eventType.EventTypeID, "pz-workflow")
+	assert.False(found)
+	count, err := service.eventDB.CountEvents(seed.eventType.Name, eventTypeIDQuery(seed.eventType.EventTypeID), "pz-workflow")
+	assert.NoError(err)
+	assert.EqualValues(0, count)
+}
+
+func TestCascadeDeleteEventTypeResume(t *testing.T) {
+	assert := assert.New(t)
+	service, deletes := newCascadeTestService(t)
+	seed := seedCascade(t, service, 2)
+
+	// a cascade that stopped part way, after the schedule, one trigger and its alert
+	_, err := service.cronDB.DeleteByID(seed.cronID, "pz-workflow")
+	assert.NoError(err)
+	_, err = service.alertDB.DeleteByID(seed.alertIDs[0], "pz-workflow")
+	assert.NoError(err)
+	_, err = service.triggerDB.DeleteTrigger(seed.triggerIDs[0], "pz-workflow")
+	assert.NoError(err)
+	*deletes = nil
+
+	resp := service.CascadeDeleteEventType(seed.eventType.EventTypeID, cascadeParams(t, "alerts=true"))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	cascade := resp.Data.(*EventTypeCascade)
+	assert.True(cascade.Complete)
+	assert.Empty(cascade.CronIDs)
+	assert.Equal(seed.triggerIDs[1:], cascade.TriggerIDs)
+	assert.EqualValues(1, cascade.Alerts)
+	assert.EqualValues(3, cascade.Events)
+	assert.Equal([]string{keyAlerts, keyTriggers, keyEvents, keyEventTypes}, squeeze(*deletes))
+
+	_, found, _ := service.eventTypeDB.GetOne(seed.eventType.EventTypeID, "pz-workflow")
+	assert.False(found)
+}
+
+func TestCascadeDeleteEventTypeProtected(t *testing.T) {
+	assert := assert.New(t)
+	service, deletes := newCascadeTestService(t)
+	seed := seedCascade(t, service, 1)
+	name := seed.eventType.Name
+
+	service.systemEventTypes[name] = &SystemEventType{Name: name, ProtectDelete: true}
+	resp := service.CascadeDeleteEventType(seed.eventType.EventTypeID, cascadeParams(t, "alerts=true"))
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(resp.Message, "Deleting system eventTypes is prohibited")
+
+	service.systemEventTypes[name] = &SystemEventType{Name: name, ProtectEvents: true}
+	resp = service.CascadeDeleteEventType(seed.eventType.EventTypeID, cascadeParams(t, "dryRun=true"))
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(resp.Message, "Deleting events of system eventType "+name+" is prohibited")
+
+	assert.Empty(*deletes)
+	_, found, _ := service.eventTypeDB.GetOne(seed.eventType.EventTypeID, "pz-workflow")
+	assert.True(found)
+}
@@ -16,6 +16,7 @@ package workflow
 
 import (
 	"encoding/json"
+	"fmt"
 
 	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
 	"github.com/venicegeo/dg-pz-gocommon/gocommon"
@@ -36,12 +37,8 @@ func NewEventTypeDB(service *Service, esi elasticsearch.IIndex) (*EventTypeDB, e
 }
 
 func (db *EventTypeDB) PostData(eventType *EventType) error {
-	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
-	if err != nil {
-		return LoggedError("EventTypeDB.PostData failed: %s", err)
-	}
-	for _, v := range vars {
-		if !elasticsearch.IsValidMappingType(v) {
+	for _, v := range mappingVars(eventType.Mapping) {
+		if !isValidEventMappingType(v) {
 			return LoggedError("EventTypeDB.PostData failed: %v was not recognized as a valid mapping type", v)
 		}
 	}
@@ -56,6 +53,37 @@ func (db *EventTypeDB) PostData(eventType *EventType) error {
 	return nil
 }
 
+// GetOneVersioned is GetOne in real time, with the version PutVersioned needs
+func (db *EventTypeDB) GetOneVersioned(id piazza.Ident) (*EventType, int64, bool, error) {
+	src, version, found, err := db.raw.GetVersioned(db.mapping, id.String())
+	if err != nil {
+		return nil, 0, false, LoggedError("EventTypeDB.GetOneVersioned failed: %s", err)
+	}
+	if !found {
+		return nil, 0, false, fmt.Errorf("eventType %s could not be found", id)
+	}
+	var eventType EventType
+	if err = json.Unmarshal(*src, &eventType); err != nil {
+		return nil, 0, true, err
+	}
+	return &eventType, version, true, nil
+}
+
+// PutVersioned replaces a stored EventType, unless it has been written since it was read at
+// version, when it returns errVersionConflict
+func (db *EventTypeDB) PutVersioned(eventType *EventType, version int64) error {
+	for _, v := range mappingVars(eventType.Mapping) {
+		if !isValidEventMappingType(v) {
+			return LoggedError("EventTypeDB.PutVersioned failed: %v was not recognized as a valid mapping type", v)
+		}
+	}
+	err := db.raw.PutVersioned(db.mapping, eventType.EventTypeID.String(), eventType, version)
+	if err != nil && err != errVersionConflict {
+		return LoggedError("EventTypeDB.PutVersioned failed: %s", err)
+	}
+	return err
+}
+
 func (db *EventTypeDB) GetAll(format *piazza.JsonPagination, actor string) ([]EventType, int64, error) {
 	eventTypes := []EventType{}
 
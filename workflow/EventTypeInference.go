@@ -0,0 +1,363 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// at most this many samples are inferred from at once
+const maxInferenceSamples = 1000
+
+// the numeric types inference proposes, narrowest first
+var inferredNumberTypes = []string{"integer", "long", "double"}
+
+// inferredObject marks an object field while the samples are being walked
+const inferredObject = "object"
+
+// inferredArrayOfObjects marks an array of objects while the samples are being walked
+const inferredArrayOfObjects = "[object]"
+
+// inferredEmptyArray is an array with no non-null elements
+const inferredEmptyArray = "[]"
+
+// fieldObservation is what the samples say about one field: how many times it was
+// seen, how many of those were as an object (counting each element of an array of
+// objects), and the samples each type was seen in, in the order first seen
+type fieldObservation struct {
+	count   int
+	objects int
+	types   map[string][]int
+	order   []string
+}
+
+func (o *fieldObservation) see(typ string, sample int) {
+	seen := o.types[typ]
+	if len(seen) > 0 && seen[len(seen)-1] == sample {
+		return
+	}
+	if seen == nil {
+		o.order = append(o.order, typ)
+	}
+	o.types[typ] = append(seen, sample)
+}
+
+// inferEventType proposes a mapping that every sample's data fits. Numbers are
+// widened as needed, from integer to long to double. Any other disagreement about a
+// field's type is a conflict, and the type seen in the most samples is proposed.
+// Arrays of objects are proposed as such, with the union of their elements' fields.
+func inferEventType(samples []map[string]interface{}) *EventTypeInference {
+	inference := &EventTypeInference{
+		Mapping:   map[string]interface{}{},
+		Fields:    []FieldSpec{},
+		Samples:   len(samples),
+		Conflicts: []InferenceConflict{},
+		Warnings:  []string{},
+	}
+
+	observations := map[string]*fieldObservation{}
+	badNames := map[string]bool{}
+	for i, sample := range samples {
+		observeObject("", sample, i, observations, badNames)
+	}
+	for _, path := range sortedBoolKeys(badNames) {
+		inference.Warnings = append(inference.Warnings, fmt.Sprintf("data.%s: field names cannot contain '.' or '~', so the field is left out", path))
+	}
+
+	paths := make([]string, 0, len(observations))
+	for path := range observations {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// the mapping of each object, or of the elements of each array of objects
+	containers := map[string]map[string]interface{}{"": inference.Mapping}
+	for _, path := range paths {
+		parent, name := "", path
+		parentCount := len(samples)
+		if dot := strings.LastIndex(path, "."); dot >= 0 {
+			parent, name = path[:dot], path[dot+1:]
+			if containers[parent] == nil {
+				continue
+			}
+			parentCount = observations[parent].objects
+		}
+
+		obs := observations[path]
+		typ, conflict := resolveInferredType(obs)
+		if conflict {
+			inference.Conflicts = append(inference.Conflicts, InferenceConflict{
+				Field:  "data." + path,
+				Types:  obs.types,
+				Chosen: mappableInferredType(typ),
+			})
+		}
+
+		switch typ {
+		case "":
+			typ = "string"
+			inference.Warnings = append(inference.Warnings, fmt.Sprintf("data.%s: only null was seen, so string is proposed", path))
+		case inferredEmptyArray:
+			typ = "[string]"
+			inference.Warnings = append(inference.Warnings, fmt.Sprintf("data.%s: only empty arrays were seen, so [string] is proposed", path))
+		}
+
+		missing := parentCount - obs.count
+		switch typ {
+		case inferredObject:
+			containers[path] = map[string]interface{}{}
+			containers[parent][name] = containers[path]
+			if missing > 0 {
+				inference.Warnings = append(inference.Warnings, fmt.Sprintf("data.%s: missing %d of %d times, but an object cannot be optional, so those events must send null for it", path, missing, parentCount))
+			}
+			continue
+		case inferredArrayOfObjects:
+			containers[path] = map[string]interface{}{}
+			containers[parent][name] = []interface{}{containers[path]}
+		default:
+			containers[parent][name] = typ
+		}
+		if missing > 0 {
+			inference.Fields = append(inference.Fields, FieldSpec{Name: path, Optional: true})
+		}
+	}
+
+	for path, obj := range containers {
+		if path != "" && len(obj) == 0 {
+			inference.Warnings = append(inference.Warnings, fmt.Sprintf("data.%s: only empty objects were seen", path))
+		}
+	}
+	sort.Strings(inference.Warnings)
+	return inference
+}
+
+func observeObject(prefix string, data map[string]interface{}, sample int, observations map[string]*fieldObservation, badNames map[string]bool) {
+	for k, v := range data {
+		path := prefix + k
+		if strings.ContainsAny(k, ".~") {
+			badNames[path] = true
+			continue
+		}
+		obs, ok := observations[path]
+		if !ok {
+			obs = &fieldObservation{types: map[string][]int{}}
+			observations[path] = obs
+		}
+		obs.count++
+
+		for _, typ := range inferValueTypes(v) {
+			obs.see(typ, sample)
+		}
+		for _, obj := range inferredObjects(v) {
+			obs.objects++
+			observeObject(path+".", obj, sample, observations, badNames)
+		}
+	}
+}
+
+// inferredObjects returns the value if it is an object, or the object elements of
+// the value if it is an array, flattening nested arrays as Elasticsearch does
+func inferredObjects(value interface{}) []map[string]interface{} {
+	if obj, ok := value.(map[string]interface{}); ok {
+		if inferLeafType(obj) == inferredObject {
+			return []map[string]interface{}{obj}
+		}
+		return nil
+	}
+	objs := []map[string]interface{}{}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		for i := 0; i < rv.Len(); i++ {
+			if elem := rv.Index(i).Interface(); elem != nil {
+				objs = append(objs, inferredObjects(elem)...)
+			}
+		}
+	}
+	return objs
+}
+
+// inferValueTypes returns the mapping types a value fits. An array whose elements
+// disagree fits several.
+func inferValueTypes(value interface{}) []string {
+	if value == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []string{inferLeafType(value)}
+	}
+
+	elems := []string{}
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i).Interface()
+		if elem == nil {
+			continue
+		}
+		typ := inferLeafType(elem)
+		if k := reflect.ValueOf(elem).Kind(); k == reflect.Slice || k == reflect.Array {
+			// nested arrays are flattened by Elasticsearch
+			nested := inferValueTypes(elem)
+			if len(nested) == 0 {
+				continue
+			}
+			typ = elementType(nested[0])
+		}
+		merged := false
+		for j, seen := range elems {
+			if w, ok := widenInferredType(seen, typ); ok {
+				elems[j] = w
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			elems = append(elems, typ)
+		}
+	}
+
+	if len(elems) == 0 {
+		return []string{inferredEmptyArray}
+	}
+	types := make([]string, len(elems))
+	for i, elem := range elems {
+		types[i] = "[" + elem + "]"
+	}
+	return types
+}
+
+// inferLeafType returns the mapping type of a value that is not an array. Strings
+// that parse as dates are dates; objects shaped like a geo_point or GeoJSON geometry
+// are geo types.
+func inferLeafType(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return "boolean"
+	case string:
+		if isEventDate(v) {
+			return "date"
+		}
+		return "string"
+	case map[string]interface{}:
+		if _, ok := v["lat"]; ok && checkGeoPoint(v) == "" {
+			return geoPointMappingType
+		}
+		if _, ok := v["coordinates"]; ok && checkGeoShape(v) == "" {
+			return geoShapeMappingType
+		}
+		if _, ok := v["geometries"]; ok && checkGeoShape(v) == "" {
+			return geoShapeMappingType
+		}
+		return inferredObject
+	}
+
+	f, ok := numberValue(value)
+	if !ok {
+		return "string"
+	}
+	if n, ok := value.(json.Number); ok && strings.ContainsAny(n.String(), ".eE") {
+		return "double"
+	}
+	switch {
+	case f != math.Trunc(f) || math.IsInf(f, 0):
+		return "double"
+	case integerInRange("integer", f):
+		return "integer"
+	case integerInRange("long", f):
+		return "long"
+	}
+	return "double"
+}
+
+// widenInferredType returns the narrowest type that holds values of both types
+func widenInferredType(a string, b string) (string, bool) {
+	if a == b {
+		return a, true
+	}
+	if a == inferredEmptyArray && strings.HasPrefix(b, "[") {
+		return b, true
+	}
+	if b == inferredEmptyArray && strings.HasPrefix(a, "[") {
+		return a, true
+	}
+	if elemA, elemB := elementType(a), elementType(b); elemA != a && elemB != b {
+		if w, ok := widenInferredType(elemA, elemB); ok {
+			return "[" + w + "]", true
+		}
+		return "", false
+	}
+
+	rankA, rankB := -1, -1
+	for i, typ := range inferredNumberTypes {
+		if typ == a {
+			rankA = i
+		}
+		if typ == b {
+			rankB = i
+		}
+	}
+	if rankA < 0 || rankB < 0 {
+		return "", false
+	}
+	if rankA > rankB {
+		return a, true
+	}
+	return b, true
+}
+
+// resolveInferredType returns the type proposed for a field and whether its samples
+// conflict. If the types seen cannot all be widened to one, the type seen in the
+// most samples is proposed, the earliest seen winning a tie.
+func resolveInferredType(obs *fieldObservation) (string, bool) {
+	if len(obs.order) == 0 {
+		return "", false
+	}
+	typ := obs.order[0]
+	for _, t := range obs.order[1:] {
+		w, ok := widenInferredType(typ, t)
+		if !ok {
+			best := obs.order[0]
+			for _, t := range obs.order[1:] {
+				if len(obs.types[t]) > len(obs.types[best]) {
+					best = t
+				}
+			}
+			return best, true
+		}
+		typ = w
+	}
+	return typ, false
+}
+
+// mappableInferredType is the type proposed for the type chosen
+func mappableInferredType(typ string) string {
+	if typ == inferredEmptyArray {
+		return "[string]"
+	}
+	return typ
+}
+
+func sortedBoolKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
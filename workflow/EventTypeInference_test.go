@@ -0,0 +1,133 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func inferenceSamples(t *testing.T, js string) []map[string]interface{} {
+	samples := []map[string]interface{}{}
+	if err := json.Unmarshal([]byte(js), &samples); err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+func TestInferEventType(t *testing.T) {
+	assert := assert.New(t)
+
+	samples := inferenceSamples(t, `[
+		{"count": 1, "size": 2, "when": "2016-10-01T12:00:00Z", "name": "a", "tags": ["x"],
+		 "where": {"lat": 1, "lon": 2}, "meta": {"ok": true, "note": null}},
+		{"count": 2, "size": 2.5, "when": "2016-10-02", "name": "b", "tags": [],
+		 "where": {"lat": 3, "lon": 4}, "meta": {"ok": false, "extra": 5000000000}}
+	]`)
+	inference := inferEventType(samples)
+
+	assert.Equal(2, inference.Samples)
+	assert.Empty(inference.Conflicts)
+	assert.Equal(map[string]interface{}{
+		"count": "integer",
+		"size":  "double",
+		"when":  "date",
+		"name":  "string",
+		"tags":  "[string]",
+		"where": "geo_point",
+		"meta": map[string]interface{}{
+			"ok":    "boolean",
+			"note":  "string",
+			"extra": "long",
+		},
+	}, inference.Mapping)
+	assert.Equal([]FieldSpec{
+		{Name: "meta.extra", Optional: true},
+		{Name: "meta.note", Optional: true},
+	}, inference.Fields)
+	assert.Equal([]string{"data.meta.note: only null was seen, so string is proposed"}, inference.Warnings)
+
+	for _, sample := range samples {
+		assert.Empty(validateEventData(inference.Mapping, fieldSpecsByPath(inference.Fields), sample))
+	}
+}
+
+func TestInferEventTypeConflicts(t *testing.T) {
+	assert := assert.New(t)
+
+	samples := inferenceSamples(t, `[
+		{"id": "a", "mixed": [1, "x"], "rows": [{"a": 1}], "obj": {"a": 1}},
+		{"id": 7, "mixed": [2], "rows": [], "obj": "flat"},
+		{"id": "c", "mixed": [3], "rows": [], "obj": {"a": 2}}
+	]`)
+	inference := inferEventType(samples)
+
+	assert.Equal([]InferenceConflict{
+		{Field: "data.id", Types: map[string][]int{"string": {0, 2}, "integer": {1}}, Chosen: "string"},
+		{Field: "data.mixed", Types: map[string][]int{"[integer]": {0, 1, 2}, "[string]": {0}}, Chosen: "[integer]"},
+		{Field: "data.obj", Types: map[string][]int{"object": {0, 2}, "string": {1}}, Chosen: "object"},
+	}, inference.Conflicts)
+	assert.Equal(map[string]interface{}{"a": "integer"}, inference.Mapping["obj"])
+}
+
+func TestInferEventTypeArrayOfObjects(t *testing.T) {
+	assert := assert.New(t)
+
+	samples := inferenceSamples(t, `[
+		{"detections": [{"class": "car", "score": 0.9, "bbox": [1, 2, 3, 4]}, {"class": "boat", "score": 1}]},
+		{"detections": [{"class": "car", "bbox": [5, 6, 7, 8]}]},
+		{}
+	]`)
+	inference := inferEventType(samples)
+
+	assert.Empty(inference.Conflicts)
+	assert.Equal(map[string]interface{}{
+		"detections": []interface{}{map[string]interface{}{
+			"class": "string",
+			"score": "double",
+			"bbox":  "[integer]",
+		}},
+	}, inference.Mapping)
+	assert.Equal([]FieldSpec{
+		{Name: "detections", Optional: true},
+		{Name: "detections.bbox", Optional: true},
+		{Name: "detections.score", Optional: true},
+	}, inference.Fields)
+	assert.NoError(validateFieldSpecs(inference.Mapping, inference.Fields))
+
+	for _, sample := range samples {
+		assert.Empty(validateEventData(inference.Mapping, fieldSpecsByPath(inference.Fields), sample))
+	}
+}
+
+func TestWidenInferredType(t *testing.T) {
+	assert := assert.New(t)
+
+	w, ok := widenInferredType("integer", "double")
+	assert.True(ok)
+	assert.Equal("double", w)
+	w, ok = widenInferredType("[long]", "[integer]")
+	assert.True(ok)
+	assert.Equal("[long]", w)
+	w, ok = widenInferredType("[]", "[date]")
+	assert.True(ok)
+	assert.Equal("[date]", w)
+	_, ok = widenInferredType("date", "string")
+	assert.False(ok)
+	_, ok = widenInferredType("[long]", "long")
+	assert.False(ok)
+}
@@ -0,0 +1,211 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// the daily histogram covers this many days unless asked otherwise, and at most
+// maxStatsDays
+const defaultStatsDays = 30
+
+const maxStatsDays = 90
+
+// the hourly histogram covers the last day
+const statsHours = 24
+
+// trigger ids are sent to Elasticsearch this many at a time when counting alerts
+const statsTriggerBatch = 500
+
+// GetEventTypeStats reports how much an EventType is used: its events, with hourly
+// and daily histograms ending now, its triggers, the alerts they raised and its
+// repeating events. The events and triggers are each counted by one aggregation.
+func (service *Service) GetEventTypeStats(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	daysString, err := params.GetAsString("days", strconv.Itoa(defaultStatsDays))
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	days, err := strconv.Atoi(daysString)
+	if err != nil || days < 1 || days > maxStatsDays {
+		return service.statusBadRequest(fmt.Errorf("days must be a number from 1 to %d", maxStatsDays))
+	}
+
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	now := time.Now().UTC()
+	stats := &EventTypeStats{
+		EventTypeID: id,
+		Name:        eventType.Name,
+		ComputedOn:  piazza.TimeStamp(now),
+	}
+	if err = service.eventTypeEventStats(eventType, now, days, stats); err != nil {
+		return service.statusInternalError(err)
+	}
+	if err = service.eventTypeTriggerStats(id, stats); err != nil {
+		return service.statusInternalError(err)
+	}
+	crons, err := service.cronsOfEventType(id)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	stats.CronSchedules = len(crons)
+
+	return service.statusOK(stats)
+}
+
+// eventTypeEventStats counts the events, finds the latest and builds both histograms
+// in one search
+func (service *Service) eventTypeEventStats(eventType *EventType, now time.Time, days int, stats *EventTypeStats) error {
+	hours := statsBuckets(now, time.Hour, statsHours)
+	daily := statsBuckets(now, 24*time.Hour, days)
+	histogram := func(starts []time.Time, interval time.Duration) (map[string]interface{}, error) {
+		since, err := esTime(starts[0])
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"filter": map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gte": since}}},
+			"aggs":   map[string]interface{}{"histogram": dateHistogramAgg("createdOn", interval, starts[0], starts[len(starts)-1])},
+		}, nil
+	}
+	hourlyAgg, err := histogram(hours, time.Hour)
+	if err != nil {
+		return err
+	}
+	dailyAgg, err := histogram(daily, 24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	result, err := service.eventDB.raw.Search(eventType.Name, map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": eventType.EventTypeID.String()}},
+		"sort":  []interface{}{map[string]interface{}{"createdOn": "desc"}},
+		"size":  1,
+		"aggs":  map[string]interface{}{"hourly": hourlyAgg, "daily": dailyAgg},
+	})
+	if err != nil {
+		return LoggedError("EventTypeStats failed to aggregate events: %s", err)
+	}
+
+	stats.Events = result.Hits.Total
+	if len(result.Hits.Hits) > 0 && result.Hits.Hits[0].Source != nil {
+		var last Event
+		if err = json.Unmarshal(*result.Hits.Hits[0].Source, &last); err != nil {
+			return err
+		}
+		stats.LastEventOn = &last.CreatedOn
+	}
+
+	hourlyCounts, err := result.Aggregation("hourly", "histogram")
+	if err != nil {
+		return err
+	}
+	dailyCounts, err := result.Aggregation("daily", "histogram")
+	if err != nil {
+		return err
+	}
+	stats.Hourly = statsHistogram(hours, hourlyCounts.bucketCounts())
+	stats.Daily = statsHistogram(daily, dailyCounts.bucketCounts())
+	return nil
+}
+
+// eventTypeTriggerStats counts the triggers, enabled or not, and collects their ids in
+// one search, then counts their alerts
+func (service *Service) eventTypeTriggerStats(id piazza.Ident, stats *EventTypeStats) error {
+	result, err := service.triggerDB.raw.Search(service.triggerDB.mapping, map[string]interface{}{
+		"query": map[string]interface{}{"term": map[string]interface{}{"eventTypeId": id.String()}},
+		"size":  0,
+		"aggs": map[string]interface{}{
+			"enabled":    map[string]interface{}{"filter": map[string]interface{}{"term": map[string]interface{}{"enabled": true}}},
+			"triggerIds": map[string]interface{}{"terms": map[string]interface{}{"field": "triggerId", "size": 0}},
+		},
+	})
+	if err != nil {
+		return LoggedError("EventTypeStats failed to aggregate triggers: %s", err)
+	}
+	enabled, err := result.Aggregation("enabled")
+	if err != nil {
+		return err
+	}
+	triggerIDs, err := result.Aggregation("triggerIds")
+	if err != nil {
+		return err
+	}
+	stats.Triggers = result.Hits.Total
+	stats.EnabledTriggers = enabled.DocCount
+	stats.DisabledTriggers = stats.Triggers - stats.EnabledTriggers
+
+	ids := make([]string, 0, len(triggerIDs.Buckets))
+	for _, bucket := range triggerIDs.Buckets {
+		if triggerID, ok := bucket.Key.(string); ok {
+			ids = append(ids, triggerID)
+		}
+	}
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > statsTriggerBatch {
+			batch = batch[:statsTriggerBatch]
+		}
+		ids = ids[len(batch):]
+
+		dsl, err := json.Marshal(map[string]interface{}{
+			"query": map[string]interface{}{"terms": map[string]interface{}{"triggerId": batch}},
+			"size":  0,
+		})
+		if err != nil {
+			return err
+		}
+		_, alerts, err := service.alertDB.GetAlertsByDslQuery(string(dsl), "pz-workflow")
+		if err != nil {
+			return err
+		}
+		stats.Alerts += alerts
+	}
+	return nil
+}
+
+// statsBuckets returns the start of n buckets of the given width, aligned to the
+// width in UTC, the last holding now
+func statsBuckets(now time.Time, width time.Duration, n int) []time.Time {
+	last := now.UTC().Truncate(width)
+	starts := make([]time.Time, n)
+	for i := range starts {
+		starts[i] = last.Add(-time.Duration(n-1-i) * width)
+	}
+	return starts
+}
+
+// statsHistogram fills each bucket from the date_histogram's counts; buckets it has
+// no count for are empty
+func statsHistogram(starts []time.Time, counts map[int64]int64) []EventCountBucket {
+	buckets := make([]EventCountBucket, len(starts))
+	for i, start := range starts {
+		buckets[i] = EventCountBucket{Start: piazza.TimeStamp(start), Count: counts[epochMillis(start)]}
+	}
+	return buckets
+}
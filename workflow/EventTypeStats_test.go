@@ -0,0 +1,48 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestEventTypeStatsHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2016, 8, 10, 13, 45, 0, 0, time.UTC)
+	hours := statsBuckets(now, time.Hour, 3)
+	assert.Equal([]time.Time{
+		time.Date(2016, 8, 10, 11, 0, 0, 0, time.UTC),
+		time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC),
+		time.Date(2016, 8, 10, 13, 0, 0, 0, time.UTC),
+	}, hours)
+	days := statsBuckets(now, 24*time.Hour, 2)
+	assert.Equal(time.Date(2016, 8, 9, 0, 0, 0, 0, time.UTC), days[0])
+	assert.Equal(time.Date(2016, 8, 10, 0, 0, 0, 0, time.UTC), days[1])
+
+	var agg aggregation
+	assert.NoError(json.Unmarshal([]byte(`{"buckets": [
+		{"key": 1470826800000, "key_as_string": "2016-08-10T11:00:00.000Z", "doc_count": 4},
+		{"key": 1470834000000, "key_as_string": "2016-08-10T13:00:00.000Z", "doc_count": 2}]}`), &agg))
+	buckets := statsHistogram(hours, agg.bucketCounts())
+	assert.Len(buckets, 3)
+	assert.Equal(piazza.TimeStamp(hours[0]), buckets[0].Start)
+	assert.Equal([]int64{4, 0, 2}, []int64{buckets[0].Count, buckets[1].Count, buckets[2].Count})
+}
@@ -0,0 +1,278 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationError collects every way in which an event's data disagrees with its
+// EventType's mapping, so that the caller can fix them all at once.
+type ValidationError struct {
+	Violations []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("event data does not match the eventType mapping: %s", strings.Join(e.Violations, "; "))
+}
+
+// the date formats accepted by Elasticsearch's default strict_date_optional_time
+var eventDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// validateEventData checks data against an EventType mapping and returns one message
+// per violation, each prefixed with the JSON path of the offending value. Mapped fields
+// must be present (null is allowed) unless their spec makes them optional, and fields
+// not in the mapping are rejected, as the strict Elasticsearch mapping would reject
+// them anyway. Specs may be nil.
+func validateEventData(mapping map[string]interface{}, specs map[string]*FieldSpec, data map[string]interface{}) []string {
+	violations := []string{}
+	validateObject("data", mapping, specs, data, &violations)
+	return violations
+}
+
+func validateObject(path string, mapping map[string]interface{}, specs map[string]*FieldSpec, data map[string]interface{}, violations *[]string) {
+	for _, k := range sortedKeys(mapping) {
+		field := path + "." + k
+		spec := specs[specPath(field)]
+		v, ok := data[k]
+		if !ok {
+			if spec == nil || !(spec.Optional || spec.Default != nil || spec.Computed != nil) {
+				*violations = append(*violations, fmt.Sprintf("%s: field is in the eventType but missing from the event", field))
+			}
+			continue
+		}
+		validateValue(field, mapping[k], specs, v, violations)
+		if spec != nil && len(spec.Enum) > 0 {
+			validateEnum(field, spec.Enum, v, violations)
+		}
+	}
+	for _, k := range sortedKeys(data) {
+		if _, ok := mapping[k]; !ok {
+			*violations = append(*violations, fmt.Sprintf("%s.%s: field is not in the eventType", path, k))
+		}
+	}
+}
+
+func validateEnum(path string, enum []interface{}, value interface{}, violations *[]string) {
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		if value != nil && !enumContains(enum, value) {
+			*violations = append(*violations, fmt.Sprintf("%s: %v is not one of %v", path, value, enum))
+		}
+		return
+	}
+	for i := 0; i < rv.Len(); i++ {
+		elem := rv.Index(i).Interface()
+		if elem != nil && !enumContains(enum, elem) {
+			*violations = append(*violations, fmt.Sprintf("%s[%d]: %v is not one of %v", path, i, elem, enum))
+		}
+	}
+}
+
+func validateValue(path string, mapping interface{}, specs map[string]*FieldSpec, value interface{}, violations *[]string) {
+	if value == nil {
+		return
+	}
+
+	switch m := mapping.(type) {
+	case map[string]interface{}:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			*violations = append(*violations, fmt.Sprintf("%s: expected an object, got %s", path, describeValue(value)))
+			return
+		}
+		validateObject(path, m, specs, obj, violations)
+	case []interface{}:
+		elem, ok := nestedMapping(m)
+		if !ok {
+			*violations = append(*violations, fmt.Sprintf("%s: the eventType mapping is not valid here", path))
+			return
+		}
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			*violations = append(*violations, fmt.Sprintf("%s: expected an array of objects, got %s", path, describeValue(value)))
+			return
+		}
+		for i := 0; i < rv.Len(); i++ {
+			v := rv.Index(i).Interface()
+			if v == nil {
+				continue
+			}
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				*violations = append(*violations, fmt.Sprintf("%s[%d]: expected an object, got %s", path, i, describeValue(v)))
+				continue
+			}
+			validateObject(fmt.Sprintf("%s[%d]", path, i), elem, specs, obj, violations)
+		}
+	case string:
+		if strings.HasPrefix(m, "[") && strings.HasSuffix(m, "]") {
+			rv := reflect.ValueOf(value)
+			if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+				*violations = append(*violations, fmt.Sprintf("%s: expected an array of %s, got %s", path, m[1:len(m)-1], describeValue(value)))
+				return
+			}
+			for i := 0; i < rv.Len(); i++ {
+				elem := rv.Index(i).Interface()
+				if elem == nil {
+					continue
+				}
+				if msg := checkLeaf(m[1:len(m)-1], elem); msg != "" {
+					*violations = append(*violations, fmt.Sprintf("%s[%d]: %s", path, i, msg))
+				}
+			}
+			return
+		}
+		if msg := checkLeaf(m, value); msg != "" {
+			*violations = append(*violations, fmt.Sprintf("%s: %s", path, msg))
+		}
+	default:
+		*violations = append(*violations, fmt.Sprintf("%s: the eventType mapping is not valid here", path))
+	}
+}
+
+// checkLeaf returns "" if value is acceptable for the scalar mapping type typ.
+// Types this service does not know the shape of are passed through to Elasticsearch.
+func checkLeaf(typ string, value interface{}) string {
+	switch typ {
+	case geoPointMappingType:
+		return checkGeoPoint(value)
+	case geoShapeMappingType:
+		return checkGeoShape(value)
+	}
+
+	kind := reflect.ValueOf(value).Kind()
+	if kind == reflect.Slice || kind == reflect.Array {
+		return fmt.Sprintf("expected a single %s, got an array", typ)
+	}
+
+	switch typ {
+	case "string", "text", "keyword":
+		if kind != reflect.String {
+			return fmt.Sprintf("expected a string, got %s", describeValue(value))
+		}
+	case "boolean":
+		if kind != reflect.Bool {
+			return fmt.Sprintf("expected a boolean, got %s", describeValue(value))
+		}
+	case "double", "float", "half_float", "scaled_float":
+		if _, ok := numberValue(value); !ok {
+			return fmt.Sprintf("expected a number, got %s", describeValue(value))
+		}
+	case "integer", "long", "short", "byte":
+		f, ok := numberValue(value)
+		if !ok || f != math.Trunc(f) {
+			return fmt.Sprintf("expected %s %s, got %s", article(typ), typ, describeValue(value))
+		}
+		if !integerInRange(typ, f) {
+			return fmt.Sprintf("%v is out of range for %s %s", value, article(typ), typ)
+		}
+	case "date":
+		if f, ok := numberValue(value); ok && f == math.Trunc(f) {
+			return ""
+		}
+		s, ok := value.(string)
+		if !ok || !isEventDate(s) {
+			return fmt.Sprintf("expected a date (RFC 3339 string or epoch milliseconds), got %s", describeValue(value))
+		}
+	default:
+		if kind == reflect.Map {
+			return fmt.Sprintf("expected %s %s, got an object", article(typ), typ)
+		}
+	}
+	return ""
+}
+
+func numberValue(value interface{}) (float64, bool) {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func integerInRange(typ string, f float64) bool {
+	switch typ {
+	case "byte":
+		return f >= math.MinInt8 && f <= math.MaxInt8
+	case "short":
+		return f >= math.MinInt16 && f <= math.MaxInt16
+	case "integer":
+		return f >= math.MinInt32 && f <= math.MaxInt32
+	}
+	return f >= math.MinInt64 && f <= math.MaxInt64
+}
+
+func isEventDate(s string) bool {
+	for _, layout := range eventDateLayouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func describeValue(value interface{}) string {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.String:
+		return fmt.Sprintf("the string %q", value)
+	case reflect.Bool:
+		return fmt.Sprintf("the boolean %v", value)
+	case reflect.Map:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	if _, ok := numberValue(value); ok {
+		return fmt.Sprintf("the number %v", value)
+	}
+	return fmt.Sprintf("a %T", value)
+}
+
+func article(word string) string {
+	if strings.IndexAny(word[:1], "aeiou") == 0 {
+		return "an"
+	}
+	return "a"
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
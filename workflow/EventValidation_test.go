@@ -0,0 +1,94 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEventData(t *testing.T) {
+	assert := assert.New(t)
+
+	var mapping map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"name": "string",
+		"count": "integer",
+		"score": "double",
+		"ok": "boolean",
+		"when": "date",
+		"tags": "[string]",
+		"where": {
+			"lat": "double",
+			"lon": "double"
+		}
+	}`), &mapping)
+	assert.NoError(err)
+
+	parse := func(s string) map[string]interface{} {
+		var data map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(s), &data))
+		return data
+	}
+
+	good := parse(`{
+		"name": "x", "count": 3, "score": 1.5, "ok": true,
+		"when": "2016-08-01T12:00:00Z", "tags": ["a", "b"],
+		"where": {"lat": 1, "lon": 2}
+	}`)
+	assert.Empty(validateEventData(mapping, nil, good))
+
+	// Go values, as built in-process, are accepted too
+	good["count"] = 17
+	good["tags"] = []string{"c"}
+	assert.Empty(validateEventData(mapping, nil, good))
+
+	bad := parse(`{
+		"name": 7, "count": 2.5, "score": "high", "ok": "yes",
+		"when": "last tuesday", "tags": ["a", 2],
+		"where": {"lat": 1, "alt": 3},
+		"extra": 1
+	}`)
+	violations := validateEventData(mapping, nil, bad)
+	assert.Equal([]string{
+		`data.count: expected an integer, got the number 2.5`,
+		`data.name: expected a string, got the number 7`,
+		`data.ok: expected a boolean, got the string "yes"`,
+		`data.score: expected a number, got the string "high"`,
+		`data.tags[1]: expected a string, got the number 2`,
+		`data.when: expected a date (RFC 3339 string or epoch milliseconds), got the string "last tuesday"`,
+		`data.where.lon: field is in the eventType but missing from the event`,
+		`data.where.alt: field is not in the eventType`,
+		`data.extra: field is not in the eventType`,
+	}, violations)
+
+	shapes := parse(`{
+		"name": ["x"], "count": 1e12, "score": null, "ok": false,
+		"when": 1470052800000, "tags": "a", "where": 5
+	}`)
+	violations = validateEventData(mapping, nil, shapes)
+	assert.Equal([]string{
+		`data.count: 1e+12 is out of range for an integer`,
+		`data.name: expected a single string, got an array`,
+		`data.tags: expected an array of string, got the string "a"`,
+		`data.where: expected an object, got the number 5`,
+	}, violations)
+
+	err = &ValidationError{Violations: violations}
+	assert.Contains(err.Error(), "data.tags")
+	assert.Contains(err.Error(), "data.where")
+}
@@ -0,0 +1,292 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// fieldSpecsByPath indexes field specs by their dotted path
+func fieldSpecsByPath(specs []FieldSpec) map[string]*FieldSpec {
+	out := map[string]*FieldSpec{}
+	for i := range specs {
+		out[specs[i].Name] = &specs[i]
+	}
+	return out
+}
+
+// mappingTypeAt returns the mapping type string of the scalar (or array of scalars)
+// field at the dotted path, which may lead through arrays of objects
+func mappingTypeAt(mapping map[string]interface{}, path string) (string, bool) {
+	node, _, ok := mappingNodeAt(mapping, path)
+	if !ok {
+		return "", false
+	}
+	typ, ok := node.(string)
+	return typ, ok
+}
+
+func isStringMappingType(typ string) bool {
+	return typ == "string" || typ == "text" || typ == "keyword"
+}
+
+func elementType(typ string) string {
+	if strings.HasPrefix(typ, "[") && strings.HasSuffix(typ, "]") {
+		return typ[1 : len(typ)-1]
+	}
+	return typ
+}
+
+// validateFieldSpecs checks that each spec names a field of the mapping and that
+// its default, enum and computed settings suit that field's type
+func validateFieldSpecs(mapping map[string]interface{}, specs []FieldSpec) error {
+	violations := []string{}
+	seen := map[string]bool{}
+
+	for i, spec := range specs {
+		path := fmt.Sprintf("fields[%d]", i)
+		if spec.Name == "" {
+			violations = append(violations, path+": name is required")
+			continue
+		}
+		path = fmt.Sprintf("%s (%s)", path, spec.Name)
+		if seen[spec.Name] {
+			violations = append(violations, path+": field is specified more than once")
+			continue
+		}
+		seen[spec.Name] = true
+
+		// an array of objects may only be made optional
+		if isNestedField(mapping, spec.Name) {
+			if spec.Default != nil || len(spec.Enum) > 0 || spec.Computed != nil {
+				violations = append(violations, path+": an array of objects can only be optional")
+			}
+			continue
+		}
+		typ, ok := mappingTypeAt(mapping, spec.Name)
+		if !ok {
+			violations = append(violations, path+": not a field of the mapping")
+			continue
+		}
+		// defaults and computed values are filled in by path, which cannot reach into
+		// the elements of an array
+		if len(nestedPathsOf(mapping, spec.Name)) > 0 && (spec.Default != nil || spec.Computed != nil) {
+			violations = append(violations, path+": a field inside an array of objects cannot have a default or be computed")
+			continue
+		}
+
+		if spec.Default != nil {
+			validateValue(path+".default", typ, nil, spec.Default, &violations)
+		}
+		for j, v := range spec.Enum {
+			if msg := checkLeaf(elementType(typ), v); msg != "" {
+				violations = append(violations, fmt.Sprintf("%s.enum[%d]: %s", path, j, msg))
+			}
+		}
+
+		if spec.Computed == nil {
+			continue
+		}
+		if spec.Default != nil {
+			violations = append(violations, path+": a computed field cannot also have a default")
+		}
+		switch spec.Computed.Kind {
+		case ComputedIngestTimestamp:
+			if typ != "date" && !isStringMappingType(typ) {
+				violations = append(violations, fmt.Sprintf("%s.computed: %s needs a date or string field, not %s", path, spec.Computed.Kind, typ))
+			}
+		case ComputedConcat:
+			if !isStringMappingType(typ) {
+				violations = append(violations, fmt.Sprintf("%s.computed: %s needs a string field, not %s", path, spec.Computed.Kind, typ))
+			}
+			if len(spec.Computed.Fields) == 0 {
+				violations = append(violations, path+".computed: concat needs at least one field")
+			}
+			for _, name := range spec.Computed.Fields {
+				if name == spec.Name {
+					violations = append(violations, path+".computed: concat cannot use the field itself")
+				} else if _, ok := mappingTypeAt(mapping, name); !ok {
+					violations = append(violations, fmt.Sprintf("%s.computed: %s is not a field of the mapping", path, name))
+				} else if len(nestedPathsOf(mapping, name)) > 0 {
+					violations = append(violations, fmt.Sprintf("%s.computed: %s is inside an array of objects", path, name))
+				}
+			}
+		default:
+			violations = append(violations, fmt.Sprintf("%s.computed: unknown kind %q", path, spec.Computed.Kind))
+		}
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid field specs: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// checkMappingCompatible returns the ways in which replacing the mapping old with updated
+// would invalidate events already posted: a field removed, or a field added that those
+// events lack but which new events must have. Fields whose type would change are
+// returned separately, since Elasticsearch cannot apply that to the existing events.
+func checkMappingCompatible(old map[string]interface{}, updated map[string]interface{}, specs map[string]*FieldSpec) ([]string, []string) {
+	violations := []string{}
+	retyped := []string{}
+	compareMappings("", old, updated, specs, &violations, &retyped)
+	return violations, retyped
+}
+
+func compareMappings(prefix string, old map[string]interface{}, updated map[string]interface{}, specs map[string]*FieldSpec, violations *[]string, retyped *[]string) {
+	for _, k := range sortedKeys(old) {
+		path := prefix + k
+		newValue, ok := updated[k]
+		if !ok {
+			*violations = append(*violations, fmt.Sprintf("%s: fields cannot be removed", path))
+			continue
+		}
+		oldObj, oldIsObj := old[k].(map[string]interface{})
+		newObj, newIsObj := newValue.(map[string]interface{})
+		oldElem, oldIsNested := nestedMapping(old[k])
+		newElem, newIsNested := nestedMapping(newValue)
+		switch {
+		case oldIsObj && newIsObj:
+			compareMappings(path+".", oldObj, newObj, specs, violations, retyped)
+		case oldIsNested && newIsNested:
+			compareMappings(path+".", oldElem, newElem, specs, violations, retyped)
+		case !reflect.DeepEqual(old[k], newValue):
+			*retyped = append(*retyped, fmt.Sprintf("%s: type cannot change from %v to %v", path, describeMapping(old[k]), describeMapping(newValue)))
+		}
+	}
+
+	for _, k := range sortedKeys(updated) {
+		if _, ok := old[k]; ok {
+			continue
+		}
+		path := prefix + k
+		if _, isObj := updated[k].(map[string]interface{}); isObj {
+			*violations = append(*violations, fmt.Sprintf("%s: a new object field would be required of existing events", path))
+			continue
+		}
+		spec := specs[path]
+		if spec == nil || !(spec.Optional || spec.Default != nil || spec.Computed != nil) {
+			*violations = append(*violations, fmt.Sprintf("%s: a new field must be optional, defaulted or computed", path))
+		}
+	}
+}
+
+func describeMapping(v interface{}) string {
+	if _, ok := v.(map[string]interface{}); ok {
+		return "object"
+	}
+	if _, ok := nestedMapping(v); ok {
+		return "array of objects"
+	}
+	return fmt.Sprint(v)
+}
+
+// applyFieldSpecs returns a copy of data in which missing fields with a default
+// are filled in and computed fields are (re)calculated. Computed fields are set
+// after defaults so that a concat can use a defaulted value.
+func applyFieldSpecs(specs []FieldSpec, data map[string]interface{}, createdOn piazza.TimeStamp) (map[string]interface{}, error) {
+	out := copyData(data)
+
+	for _, spec := range specs {
+		if spec.Default == nil {
+			continue
+		}
+		if _, ok := getPath(out, spec.Name); !ok {
+			setPath(out, spec.Name, spec.Default)
+		}
+	}
+
+	for _, spec := range specs {
+		if spec.Computed == nil {
+			continue
+		}
+		switch spec.Computed.Kind {
+		case ComputedIngestTimestamp:
+			s, err := esTime(time.Time(createdOn))
+			if err != nil {
+				return nil, err
+			}
+			setPath(out, spec.Name, s)
+		case ComputedConcat:
+			parts := []string{}
+			for _, name := range spec.Computed.Fields {
+				if v, ok := getPath(out, name); ok && v != nil {
+					parts = append(parts, fmt.Sprint(v))
+				}
+			}
+			setPath(out, spec.Name, strings.Join(parts, spec.Computed.Separator))
+		}
+	}
+
+	return out, nil
+}
+
+// enumContains compares numbers by value, so that 3 and 3.0 are the same
+func enumContains(enum []interface{}, v interface{}) bool {
+	for _, e := range enum {
+		if a, ok := numberValue(e); ok {
+			if b, ok := numberValue(v); ok && a == b {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyData(data map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		if obj, ok := v.(map[string]interface{}); ok {
+			v = copyData(obj)
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func getPath(data map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, ok := data[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		data = obj
+	}
+	v, ok := data[parts[len(parts)-1]]
+	return v, ok
+}
+
+func setPath(data map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		obj, ok := data[part].(map[string]interface{})
+		if !ok {
+			obj = map[string]interface{}{}
+			data[part] = obj
+		}
+		data = obj
+	}
+	data[parts[len(parts)-1]] = value
+}
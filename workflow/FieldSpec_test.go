@@ -0,0 +1,138 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestFieldSpecs(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping := map[string]interface{}{
+		"first":    "string",
+		"last":     "string",
+		"fullName": "string",
+		"level":    "integer",
+		"color":    "string",
+		"received": "date",
+		"where": map[string]interface{}{
+			"site": "string",
+		},
+	}
+	specs := []FieldSpec{
+		{Name: "level", Default: 1},
+		{Name: "color", Enum: []interface{}{"red", "green"}},
+		{Name: "where.site", Optional: true},
+		{Name: "fullName", Computed: &ComputedField{Kind: ComputedConcat, Fields: []string{"first", "last"}, Separator: " "}},
+		{Name: "received", Computed: &ComputedField{Kind: ComputedIngestTimestamp}},
+	}
+	assert.NoError(validateFieldSpecs(mapping, specs))
+
+	bad := []FieldSpec{
+		{Name: "nope"},
+		{Name: "level", Default: "high"},
+		{Name: "color", Enum: []interface{}{3}},
+		{Name: "level", Computed: &ComputedField{Kind: ComputedConcat, Fields: []string{"first"}}},
+		{Name: "first", Computed: &ComputedField{Kind: "random"}},
+	}
+	err := validateFieldSpecs(mapping, bad)
+	assert.Error(err)
+	assert.Contains(err.Error(), "fields[0] (nope): not a field of the mapping")
+	assert.Contains(err.Error(), "fields[1] (level).default: expected an integer")
+	assert.Contains(err.Error(), "fields[2] (color).enum[0]: expected a string")
+	assert.Contains(err.Error(), "fields[3] (level): field is specified more than once")
+	assert.Contains(err.Error(), `fields[4] (first).computed: unknown kind "random"`)
+
+	createdOn := piazza.TimeStamp(time.Date(2016, 8, 1, 12, 0, 0, 0, time.UTC))
+	data := map[string]interface{}{
+		"first":    "Ada",
+		"last":     "Lovelace",
+		"fullName": "ignored",
+		"color":    "red",
+		"where":    map[string]interface{}{},
+	}
+	out, err := applyFieldSpecs(specs, data, createdOn)
+	assert.NoError(err)
+	assert.Equal(1, out["level"])
+	assert.Equal("Ada Lovelace", out["fullName"])
+	assert.NotEmpty(out["received"])
+	// the input is left alone
+	assert.Equal("ignored", data["fullName"])
+	assert.Nil(data["level"])
+
+	byPath := fieldSpecsByPath(specs)
+	assert.Empty(validateEventData(mapping, byPath, out))
+
+	out["color"] = "blue"
+	delete(out, "last")
+	assert.Equal([]string{
+		"data.color: blue is not one of [red green]",
+		"data.last: field is in the eventType but missing from the event",
+	}, validateEventData(mapping, byPath, out))
+}
+
+func TestCheckMappingCompatible(t *testing.T) {
+	assert := assert.New(t)
+
+	old := map[string]interface{}{
+		"name":  "string",
+		"count": "integer",
+		"where": map[string]interface{}{
+			"site": "string",
+		},
+	}
+	specs := fieldSpecsByPath([]FieldSpec{
+		{Name: "color", Optional: true},
+		{Name: "where.floor", Default: 1},
+	})
+
+	updated := map[string]interface{}{
+		"name":  "string",
+		"count": "integer",
+		"color": "string",
+		"where": map[string]interface{}{
+			"site":  "string",
+			"floor": "integer",
+		},
+	}
+	violations, retyped := checkMappingCompatible(old, updated, specs)
+	assert.Empty(violations)
+	assert.Empty(retyped)
+	violations, retyped = checkMappingCompatible(old, old, nil)
+	assert.Empty(violations)
+	assert.Empty(retyped)
+
+	updated = map[string]interface{}{
+		"name":  "integer",
+		"extra": "string",
+		"where": "string",
+		"more":  map[string]interface{}{"x": "string"},
+	}
+	violations, retyped = checkMappingCompatible(old, updated, specs)
+	assert.Equal([]string{
+		"count: fields cannot be removed",
+		"extra: a new field must be optional, defaulted or computed",
+		"more: a new object field would be required of existing events",
+	}, violations)
+	assert.Equal([]string{
+		"name: type cannot change from string to integer",
+		"where: type cannot change from object to string",
+	}, retyped)
+}
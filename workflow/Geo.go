@@ -0,0 +1,302 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+)
+
+const geoPointMappingType = "geo_point"
+const geoShapeMappingType = "geo_shape"
+
+var geohashPattern = regexp.MustCompile(`^[0-9b-hjkmnp-z]{1,12}$`)
+
+// isValidEventMappingType accepts the geo types in addition to the scalar types
+// known to elasticsearch, in both their single and "[array]" forms
+func isValidEventMappingType(v interface{}) bool {
+	if s, ok := v.(string); ok {
+		switch elementType(s) {
+		case geoPointMappingType, geoShapeMappingType:
+			return true
+		}
+	}
+	return elasticsearch.IsValidMappingType(v)
+}
+
+// checkGeoPoint accepts the forms Elasticsearch does: {"lat": y, "lon": x},
+// [x, y], "y,x" or a geohash
+func checkGeoPoint(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		lat, latOK := numberValue(v["lat"])
+		lon, lonOK := numberValue(v["lon"])
+		if !latOK || !lonOK || len(v) != 2 {
+			return "expected a geo_point object with only numeric lat and lon"
+		}
+		return checkLonLat(lon, lat)
+	case string:
+		if parts := strings.Split(v, ","); len(parts) == 2 {
+			lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err1 != nil || err2 != nil {
+				return fmt.Sprintf("%q is not a \"lat,lon\" geo_point", v)
+			}
+			return checkLonLat(lon, lat)
+		}
+		if !geohashPattern.MatchString(v) {
+			return fmt.Sprintf("%q is not a \"lat,lon\" string or geohash", v)
+		}
+		return ""
+	}
+	if _, ok := geoList(value); ok {
+		return checkPosition(value)
+	}
+	return fmt.Sprintf("expected a geo_point, got %s", describeValue(value))
+}
+
+// checkGeoShape accepts a GeoJSON geometry, plus the envelope and circle
+// shapes that Elasticsearch adds
+func checkGeoShape(value interface{}) string {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Sprintf("expected a GeoJSON geometry, got %s", describeValue(value))
+	}
+	typ, _ := obj["type"].(string)
+	switch strings.ToLower(typ) {
+	case "geometrycollection":
+		geometries, ok := geoList(obj["geometries"])
+		if !ok {
+			return "a GeometryCollection needs a geometries array"
+		}
+		for i, g := range geometries {
+			if msg := checkGeoShape(g); msg != "" {
+				return fmt.Sprintf("geometries[%d]: %s", i, msg)
+			}
+		}
+		return ""
+	case "circle":
+		if _, ok := obj["radius"].(string); !ok {
+			return "a circle needs a radius string such as \"100m\""
+		}
+		return checkPosition(obj["coordinates"])
+	case "point":
+		return checkPosition(obj["coordinates"])
+	case "multipoint":
+		return checkPositions(obj["coordinates"], 1)
+	case "linestring":
+		return checkPositions(obj["coordinates"], 2)
+	case "envelope":
+		if msg := checkPositions(obj["coordinates"], 2); msg != "" {
+			return msg
+		}
+		if l, _ := geoList(obj["coordinates"]); len(l) != 2 {
+			return "an envelope needs exactly two positions, upper left and lower right"
+		}
+		return ""
+	case "multilinestring":
+		return checkEach(obj["coordinates"], "line", func(c interface{}) string { return checkPositions(c, 2) })
+	case "polygon":
+		return checkPolygon(obj["coordinates"])
+	case "multipolygon":
+		return checkEach(obj["coordinates"], "polygon", checkPolygon)
+	}
+	return fmt.Sprintf("%q is not a GeoJSON geometry type", typ)
+}
+
+func checkPolygon(coordinates interface{}) string {
+	return checkEach(coordinates, "ring", func(ring interface{}) string {
+		if msg := checkPositions(ring, 4); msg != "" {
+			return msg
+		}
+		positions, _ := geoList(ring)
+		if !reflect.DeepEqual(positions[0], positions[len(positions)-1]) {
+			return "a polygon ring must end at the position it starts from"
+		}
+		return ""
+	})
+}
+
+func checkEach(value interface{}, name string, fn func(interface{}) string) string {
+	list, ok := geoList(value)
+	if !ok || len(list) == 0 {
+		return fmt.Sprintf("expected an array of %ss", name)
+	}
+	for i, item := range list {
+		if msg := fn(item); msg != "" {
+			return fmt.Sprintf("%s %d: %s", name, i, msg)
+		}
+	}
+	return ""
+}
+
+func checkPositions(value interface{}, min int) string {
+	list, ok := geoList(value)
+	if !ok || len(list) < min {
+		return fmt.Sprintf("expected an array of at least %d positions", min)
+	}
+	for i, p := range list {
+		if msg := checkPosition(p); msg != "" {
+			return fmt.Sprintf("position %d: %s", i, msg)
+		}
+	}
+	return ""
+}
+
+// checkPosition checks a GeoJSON [lon, lat] position
+func checkPosition(value interface{}) string {
+	list, ok := geoList(value)
+	if !ok || len(list) < 2 || len(list) > 3 {
+		return "expected a [lon, lat] position"
+	}
+	lon, lonOK := numberValue(list[0])
+	lat, latOK := numberValue(list[1])
+	if !lonOK || !latOK {
+		return "expected a [lon, lat] position of numbers"
+	}
+	return checkLonLat(lon, lat)
+}
+
+func checkLonLat(lon float64, lat float64) string {
+	if lon < -180 || lon > 180 {
+		return fmt.Sprintf("longitude %v is outside [-180, 180]", lon)
+	}
+	if lat < -90 || lat > 90 {
+		return fmt.Sprintf("latitude %v is outside [-90, 90]", lat)
+	}
+	return ""
+}
+
+// geoList reads coordinate arrays whether they came from JSON or were built in Go
+func geoList(value interface{}) ([]interface{}, bool) {
+	if value == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	out := make([]interface{}, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out, true
+}
+
+// geofenceClause is the clause that a Geofence on a field of the given mapping type
+// adds to a trigger's condition
+func geofenceClause(field string, fieldType string, relation string, shape map[string]interface{}) (map[string]interface{}, error) {
+	if fieldType != geoPointMappingType {
+		return geofenceQuery(field, relation, shape), nil
+	}
+	inside, err := geoPointAreaQuery(field, shape)
+	if err != nil {
+		return nil, err
+	}
+	if relation == GeofenceDisjoint {
+		// as with geo_shape, an event without the field is not disjoint from the area
+		return map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must":     map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+				"must_not": inside,
+			},
+		}, nil
+	}
+	return inside, nil
+}
+
+// geoPointAreaQuery matches the geo_point field lying in the area. Elasticsearch has
+// no geo_shape query for points, so each kind of area becomes its own point query.
+func geoPointAreaQuery(field string, shape map[string]interface{}) (map[string]interface{}, error) {
+	typ, _ := shape["type"].(string)
+	switch strings.ToLower(typ) {
+	case "polygon":
+		return geoPointPolygonQuery(field, shape["coordinates"])
+	case "multipolygon":
+		polygons, _ := geoList(shape["coordinates"])
+		should := make([]interface{}, len(polygons))
+		for i, polygon := range polygons {
+			q, err := geoPointPolygonQuery(field, polygon)
+			if err != nil {
+				return nil, err
+			}
+			should[i] = q
+		}
+		return map[string]interface{}{
+			"bool": map[string]interface{}{"should": should, "minimum_should_match": 1},
+		}, nil
+	case "envelope":
+		corners, _ := geoList(shape["coordinates"])
+		if len(corners) != 2 {
+			return nil, errors.New("an envelope needs two positions")
+		}
+		return map[string]interface{}{
+			"geo_bounding_box": map[string]interface{}{
+				field: map[string]interface{}{"top_left": corners[0], "bottom_right": corners[1]},
+			},
+		}, nil
+	case "circle":
+		return map[string]interface{}{
+			"geo_distance": map[string]interface{}{
+				"distance": shape["radius"],
+				field:      shape["coordinates"],
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("an areaOfInterest of type %q cannot fence a geo_point field; use a polygon, multipolygon, envelope or circle", typ)
+}
+
+// geoPointPolygonQuery matches points inside a polygon's outer ring and outside its holes
+func geoPointPolygonQuery(field string, coordinates interface{}) (map[string]interface{}, error) {
+	rings, _ := geoList(coordinates)
+	if len(rings) == 0 {
+		return nil, errors.New("a polygon needs at least one ring")
+	}
+	ringQuery := func(ring interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"geo_polygon": map[string]interface{}{
+				field: map[string]interface{}{"points": ring},
+			},
+		}
+	}
+	if len(rings) == 1 {
+		return ringQuery(rings[0]), nil
+	}
+	holes := make([]interface{}, len(rings)-1)
+	for i, ring := range rings[1:] {
+		holes[i] = ringQuery(ring)
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{"must": ringQuery(rings[0]), "must_not": holes},
+	}, nil
+}
+
+// geofenceQuery is the geo_shape clause that a trigger's Geofence adds to its condition
+func geofenceQuery(field string, relation string, shape map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"geo_shape": map[string]interface{}{
+			field: map[string]interface{}{
+				"shape":    shape,
+				"relation": relation,
+			},
+		},
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeoValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(s string) interface{} {
+		var v interface{}
+		assert.NoError(json.Unmarshal([]byte(s), &v))
+		return v
+	}
+
+	assert.True(isValidEventMappingType("geo_point"))
+	assert.True(isValidEventMappingType("[geo_shape]"))
+
+	for _, ok := range []string{`{"lat": 10, "lon": -20}`, `[-20, 10]`, `"10,-20"`, `"drm3btev3e86"`} {
+		assert.Empty(checkGeoPoint(parse(ok)), ok)
+	}
+	for _, bad := range []string{`{"lat": 100, "lon": 0}`, `[0]`, `"a place"`, `true`, `{"lat": 1}`} {
+		assert.NotEmpty(checkGeoPoint(parse(bad)), bad)
+	}
+
+	square := `{"type": "Polygon", "coordinates": [[[0,0],[1,0],[1,1],[0,1],[0,0]]]}`
+	for _, ok := range []string{
+		`{"type": "Point", "coordinates": [1, 2]}`,
+		`{"type": "LineString", "coordinates": [[1, 2], [3, 4]]}`,
+		square,
+		`{"type": "MultiPolygon", "coordinates": [[[[0,0],[1,0],[1,1],[0,0]]]]}`,
+		`{"type": "envelope", "coordinates": [[-45, 45], [45, -45]]}`,
+		`{"type": "circle", "coordinates": [0, 0], "radius": "100m"}`,
+		`{"type": "GeometryCollection", "geometries": [` + square + `]}`,
+	} {
+		assert.Empty(checkGeoShape(parse(ok)), ok)
+	}
+	for _, bad := range []string{
+		`{"type": "Point", "coordinates": [200, 0]}`,
+		`{"type": "LineString", "coordinates": [[1, 2]]}`,
+		`{"type": "Polygon", "coordinates": [[[0,0],[1,0],[1,1],[0,1]]]}`,
+		`{"type": "Polygon", "coordinates": [[[0,0],[1,0],[1,1],[0,1],[0,2]]]}`,
+		`{"type": "circle", "coordinates": [0, 0]}`,
+		`{"type": "Blob", "coordinates": [0, 0]}`,
+		`[1, 2]`,
+	} {
+		assert.NotEmpty(checkGeoShape(parse(bad)), bad)
+	}
+
+	// geo values go through the event validator like any other type
+	mapping := map[string]interface{}{"where": "geo_point", "footprint": "geo_shape"}
+	data := parse(`{"where": [1, 2], "footprint": ` + square + `}`).(map[string]interface{})
+	assert.Empty(validateEventData(mapping, nil, data))
+	data["where"] = "nowhere"
+	assert.Len(validateEventData(mapping, nil, data), 1)
+
+	q := geofenceQuery("data.T.footprint", GeofenceWithin, map[string]interface{}{"type": "polygon"})
+	assert.Equal(GeofenceWithin, q["geo_shape"].(map[string]interface{})["data.T.footprint"].(map[string]interface{})["relation"])
+}
+
+func TestGeofenceClause(t *testing.T) {
+	assert := assert.New(t)
+
+	parse := func(s string) map[string]interface{} {
+		var v map[string]interface{}
+		assert.NoError(json.Unmarshal([]byte(s), &v))
+		return v
+	}
+	toJSON := func(v interface{}) string {
+		byts, err := json.Marshal(v)
+		assert.NoError(err)
+		return string(byts)
+	}
+	square := `[[0, 0], [4, 0], [4, 4], [0, 4], [0, 0]]`
+	hole := `[[1, 1], [2, 1], [2, 2], [1, 2], [1, 1]]`
+
+	// geo_shape fields keep the geo_shape query and its relation
+	q, err := geofenceClause("data.T.footprint", geoShapeMappingType, GeofenceWithin, parse(`{"type": "point", "coordinates": [1, 1]}`))
+	assert.NoError(err)
+	assert.Equal(toJSON(geofenceQuery("data.T.footprint", GeofenceWithin, parse(`{"type": "point", "coordinates": [1, 1]}`))), toJSON(q))
+
+	q, err = geofenceClause("data.T.where", geoPointMappingType, GeofenceWithin, parse(`{"type": "polygon", "coordinates": [`+square+`]}`))
+	assert.NoError(err)
+	assert.JSONEq(`{"geo_polygon": {"data.T.where": {"points": `+square+`}}}`, toJSON(q))
+
+	q, err = geofenceClause("data.T.where", geoPointMappingType, GeofenceIntersects, parse(`{"type": "Polygon", "coordinates": [`+square+`, `+hole+`]}`))
+	assert.NoError(err)
+	assert.JSONEq(`{"bool": {
+		"must": {"geo_polygon": {"data.T.where": {"points": `+square+`}}},
+		"must_not": [{"geo_polygon": {"data.T.where": {"points": `+hole+`}}}]}}`, toJSON(q))
+
+	q, err = geofenceClause("data.T.where", geoPointMappingType, GeofenceDisjoint, parse(`{"type": "envelope", "coordinates": [[0, 4], [4, 0]]}`))
+	assert.NoError(err)
+	assert.JSONEq(`{"bool": {
+		"must": {"exists": {"field": "data.T.where"}},
+		"must_not": {"geo_bounding_box": {"data.T.where": {"top_left": [0, 4], "bottom_right": [4, 0]}}}}}`, toJSON(q))
+
+	q, err = geofenceClause("data.T.where", geoPointMappingType, GeofenceIntersects, parse(`{"type": "multipolygon", "coordinates": [[`+square+`], [`+hole+`]]}`))
+	assert.NoError(err)
+	assert.JSONEq(`{"bool": {"minimum_should_match": 1, "should": [
+		{"geo_polygon": {"data.T.where": {"points": `+square+`}}},
+		{"geo_polygon": {"data.T.where": {"points": `+hole+`}}}]}}`, toJSON(q))
+
+	q, err = geofenceClause("data.T.where", geoPointMappingType, GeofenceWithin, parse(`{"type": "circle", "coordinates": [1, 2], "radius": "10km"}`))
+	assert.NoError(err)
+	assert.JSONEq(`{"geo_distance": {"distance": "10km", "data.T.where": [1, 2]}}`, toJSON(q))
+
+	for _, shape := range []string{
+		`{"type": "point", "coordinates": [1, 1]}`,
+		`{"type": "linestring", "coordinates": [[1, 1], [2, 2]]}`,
+	} {
+		_, err = geofenceClause("data.T.where", geoPointMappingType, GeofenceIntersects, parse(shape))
+		assert.Error(err, shape)
+	}
+}
@@ -0,0 +1,429 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// the longest a grouping window may be
+const maxGroupingWindow = 7 * 24 * time.Hour
+
+// how often incidents gone quiet are dropped from memory
+const incidentPruneInterval = time.Minute
+
+// how many times counting an alert in an incident is tried when another instance
+// writes the incident at the same time
+const maxIncidentWriteAttempts = 3
+
+// checkGrouping checks that the grouping's field is a single-valued, non-geo field
+// of the EventType's mapping and that its window is a usable duration
+func checkGrouping(grouping *AlertGrouping, mapping map[string]interface{}, eventTypeID piazza.Ident) error {
+	field := strings.TrimPrefix(grouping.Field, "data.")
+	typ, ok := mappingTypeAt(mapping, field)
+	if !ok || !strings.HasPrefix(grouping.Field, "data.") {
+		return fmt.Errorf("Grouping field %s is not a field of eventType %s", grouping.Field, eventTypeID)
+	}
+	if typ != elementType(typ) || len(nestedPathsOf(mapping, field)) > 0 {
+		return fmt.Errorf("Grouping field %s holds an array, so it cannot group alerts", grouping.Field)
+	}
+	if typ == geoPointMappingType || typ == geoShapeMappingType {
+		return fmt.Errorf("Grouping field %s is a geo field, so it cannot group alerts", grouping.Field)
+	}
+	window, err := time.ParseDuration(grouping.Window)
+	if err != nil {
+		return fmt.Errorf("Grouping window %q is not a duration such as \"15m\"", grouping.Window)
+	}
+	if window <= 0 || window > maxGroupingWindow {
+		return fmt.Errorf("Grouping window must be positive and at most %s", maxGroupingWindow)
+	}
+	return nil
+}
+
+// groupValue is the value an event's data holds at the grouping field, as a string;
+// events without the field group together under ""
+func groupValue(data map[string]interface{}, field string) string {
+	value, ok := getPath(data, strings.TrimPrefix(field, "data."))
+	if !ok || value == nil {
+		return ""
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	byts, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(byts)
+}
+
+// incidentGrouper remembers the incidents that alerts may still join, so that alerts
+// arriving faster than the index refreshes are not split between incidents. Incidents
+// that are not in memory, as after a restart, are looked up in the index. Each trigger
+// and group value has its own slot, locked while an alert joins it, so that only alerts
+// of the same group wait on each other's index requests.
+type incidentGrouper struct {
+	sync.Mutex
+	slots  map[string]*incidentSlot
+	pruned time.Time
+}
+
+// incidentSlot holds the open incident of one trigger and group value, if known. users
+// counts the alerts holding or waiting for the slot's lock, and is guarded by the
+// grouper's lock.
+type incidentSlot struct {
+	sync.Mutex
+	open  *openIncident
+	users int
+}
+
+type openIncident struct {
+	incident Incident
+	window   time.Duration
+}
+
+func newIncidentGrouper() *incidentGrouper {
+	return &incidentGrouper{slots: map[string]*incidentSlot{}, pruned: time.Now()}
+}
+
+// acquire locks the key's slot, making it if needed
+func (g *incidentGrouper) acquire(key string) *incidentSlot {
+	g.Lock()
+	g.prune(time.Now())
+	slot, ok := g.slots[key]
+	if !ok {
+		slot = &incidentSlot{}
+		g.slots[key] = slot
+	}
+	slot.users++
+	g.Unlock()
+
+	slot.Lock()
+	return slot
+}
+
+// release unlocks a slot taken with acquire
+func (g *incidentGrouper) release(slot *incidentSlot) {
+	slot.Unlock()
+	g.Lock()
+	slot.users--
+	g.Unlock()
+}
+
+// prune drops the slots that no alert is using and whose incidents have gone quiet;
+// the caller holds the grouper's lock
+func (g *incidentGrouper) prune(now time.Time) {
+	if now.Sub(g.pruned) < incidentPruneInterval {
+		return
+	}
+	for key, slot := range g.slots {
+		if slot.users > 0 {
+			continue
+		}
+		if slot.open == nil || now.Sub(time.Time(slot.open.incident.LastSeen)) > slot.open.window {
+			delete(g.slots, key)
+		}
+	}
+	g.pruned = now
+}
+
+// incidentClaim is an alert's place in an incident, decided before the alert is stored
+// so that the alert can carry the incident's id. The incident is only written, with
+// the alert counted, once the alert has been stored; until then the claim holds the
+// slot, so that later alerts of the group wait for the outcome.
+type incidentClaim struct {
+	slot     *incidentSlot
+	incident Incident
+	version  int64
+	window   time.Duration
+	isNew    bool
+}
+
+// IncidentID is the id of the claimed incident, or "" for no claim
+func (c *incidentClaim) IncidentID() piazza.Ident {
+	if c == nil {
+		return ""
+	}
+	return c.incident.IncidentID
+}
+
+// claimIncident finds the incident that the alert the event raised on the trigger will
+// join: the trigger's last incident for the event's group value, unless it has gone
+// quiet for longer than the window, in which case a new one is started. A trigger
+// without grouping gets a nil claim. Every claim must be passed to settleIncident.
+func (service *Service) claimIncident(trigger *Trigger, event *Event, eventType *EventType) (*incidentClaim, error) {
+	if trigger.Grouping == nil {
+		return nil, nil
+	}
+	window, err := time.ParseDuration(trigger.Grouping.Window)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := event.Data[eventType.Name].(map[string]interface{})
+	value := groupValue(data, trigger.Grouping.Field)
+	key := trigger.TriggerID.String() + "\x00" + value
+
+	slot := service.incidents.acquire(key)
+
+	if slot.open == nil {
+		latest, err := service.incidentDB.GetLatest(trigger.TriggerID, value, "pz-workflow")
+		if err != nil {
+			service.incidents.release(slot)
+			return nil, err
+		}
+		if latest != nil {
+			slot.open = &openIncident{incident: *latest, window: window}
+		}
+	}
+
+	// the slot only keeps out the other alerts of this instance: another instance may
+	// have counted alerts since, so the incident is read again
+	var version int64
+	if slot.open != nil {
+		current, v, found, err := service.incidentDB.GetOneVersioned(slot.open.incident.IncidentID)
+		switch {
+		case found && err == nil:
+			slot.open.incident, version = *current, v
+		case found:
+			service.incidents.release(slot)
+			return nil, err
+		default:
+			// deleted, along with its trigger's other incidents
+			slot.open = nil
+		}
+	}
+
+	seen := piazza.NewTimeStamp()
+	now := time.Time(seen)
+	if slot.open != nil && now.Sub(time.Time(slot.open.incident.LastSeen)) <= window {
+		incident := slot.open.incident
+		incident.AlertCount++
+		incident.LastSeen = seen
+		return &incidentClaim{slot: slot, incident: incident, version: version, window: window}, nil
+	}
+
+	return &incidentClaim{
+		slot: slot,
+		incident: Incident{
+			IncidentID:            service.newIdent(),
+			TriggerID:             trigger.TriggerID,
+			GroupField:            trigger.Grouping.Field,
+			GroupValue:            value,
+			AlertCount:            1,
+			FirstSeen:             seen,
+			LastSeen:              seen,
+			RepresentativeEventID: event.EventID,
+			CreatedBy:             trigger.CreatedBy,
+		},
+		window: window,
+		isNew:  true,
+	}, nil
+}
+
+// settleIncident releases the claim. If the alert was stored, the incident is written
+// with the alert counted; if not, the incident is left as it was.
+func (service *Service) settleIncident(claim *incidentClaim, stored bool) error {
+	if claim == nil {
+		return nil
+	}
+	defer service.incidents.release(claim.slot)
+	if !stored {
+		return nil
+	}
+
+	incident := claim.incident
+	if !claim.isNew {
+		version := claim.version
+		for attempt := 1; ; attempt++ {
+			err := service.incidentDB.PutVersioned(&incident, version)
+			if err == nil {
+				break
+			}
+			if err != errVersionConflict || attempt >= maxIncidentWriteAttempts {
+				return err
+			}
+			// another instance counted an alert first: count this one on top of it
+			current, v, _, err := service.incidentDB.GetOneVersioned(incident.IncidentID)
+			if err != nil {
+				return err
+			}
+			current.AlertCount++
+			if time.Time(claim.incident.LastSeen).After(time.Time(current.LastSeen)) {
+				current.LastSeen = claim.incident.LastSeen
+			}
+			incident, version = *current, v
+		}
+		claim.slot.open = &openIncident{incident: incident, window: claim.window}
+		return nil
+	}
+
+	service.syslogger.Audit(incident.CreatedBy, "creatingIncident", incident.IncidentID, "Service.settleIncident: User [%s] is creating incident [%s] of trigger [%s]", incident.CreatedBy, incident.IncidentID, incident.TriggerID)
+	if err := service.incidentDB.PostData(&incident); err != nil {
+		service.syslogger.Audit(incident.CreatedBy, "creatingIncidentFailure", incident.IncidentID, "Service.settleIncident: User [%s] failed to create incident [%s] of trigger [%s]", incident.CreatedBy, incident.IncidentID, incident.TriggerID)
+		return err
+	}
+	service.syslogger.Audit(incident.CreatedBy, "createdIncident", incident.IncidentID, "Service.settleIncident: User [%s] successfully created incident [%s] of trigger [%s]", incident.CreatedBy, incident.IncidentID, incident.TriggerID)
+
+	claim.slot.open = &openIncident{incident: incident, window: claim.window}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// GetIncident returns an incident, inflated with its trigger and representative event
+// as the inflate parameter asks
+func (service *Service) GetIncident(id piazza.Ident, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit("pz-workflow", "gettingIncident", id, "Service.GetIncident: User is getting incident [%s]", id)
+	incident, found, err := service.incidentDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit("pz-workflow", "gettingIncidentFailure", id, "Service.GetIncident: User failed to get incident [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingIncidentFailure", id, "Service.GetIncident: User failed to get incident [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotIncident", id, "Service.GetIncident: User successfully got incident [%s]", id)
+
+	inflate, err := parseInflateParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if inflate.any() {
+		incidentExts, err := service.inflateIncidents([]Incident{*incident}, inflate)
+		if err != nil {
+			return service.statusInternalError(err)
+		}
+		return service.statusOK(&(*incidentExts)[0])
+	}
+	return service.statusOK(incident)
+}
+
+// GetAllIncidents lists incidents, most recently seen first unless sortBy is given.
+// They can be narrowed by triggerId, groupValue and since, which keeps the incidents
+// seen at or after an RFC 3339 time.
+func (service *Service) GetAllIncidents(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	must := []interface{}{}
+
+	triggerID, err := params.GetAsID("triggerId", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if triggerID != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"triggerId": triggerID.String()}})
+	}
+	value, err := params.GetAsString("groupValue", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if value != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{"groupValue": value}})
+	}
+	since, err := params.GetAsString("since", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if since != "" {
+		t, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return service.statusBadRequest(fmt.Errorf("since must be an RFC 3339 time: %s", err))
+		}
+		ts, err := esTime(t)
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		must = append(must, map[string]interface{}{"range": map[string]interface{}{"lastSeen": map[string]interface{}{"gte": ts}}})
+	}
+
+	dsl := map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+	}
+	return service.queryIncidents(dsl, params, "GetAllIncidents")
+}
+
+// QueryIncidents finds the incidents matching an Elasticsearch DSL query
+func (service *Service) QueryIncidents(dslString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	var dsl map[string]interface{}
+	if err := json.Unmarshal([]byte(dslString), &dsl); err != nil {
+		return service.statusBadRequest(err)
+	}
+	return service.queryIncidents(dsl, params, "QueryIncidents")
+}
+
+func (service *Service) queryIncidents(dsl map[string]interface{}, params *piazza.HttpQueryParams, caller string) *piazza.JsonResponse {
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	inflate, err := parseInflateParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	// incidents have no createdOn, the usual default
+	sortBy, err := params.GetAsString("sortBy", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if sortBy == "" && dsl["sort"] == nil {
+		dsl["sort"] = []interface{}{map[string]interface{}{"lastSeen": "desc"}}
+	}
+	byts, err := json.Marshal(dsl)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	dslString, err := syncPagination(string(byts), *format)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "queryingIncidents", service.incidentDB.mapping, "Service.%s: User is querying incidents", caller)
+
+	incidents, totalHits, err := service.incidentDB.GetIncidentsByDslQuery(dslString, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "queryingIncidentsFailure", service.incidentDB.mapping, "Service.%s: User failed to query incidents", caller)
+		return service.statusBadRequest(err)
+	} else if incidents == nil {
+		service.syslogger.Audit("pz-workflow", "queryingIncidentsFailure", service.incidentDB.mapping, "Service.%s: User failed to query incidents", caller)
+		return service.statusInternalError(errors.New(caller + " returned nil"))
+	}
+
+	var resp *piazza.JsonResponse
+	if inflate.any() {
+		incidentExts, err := service.inflateIncidents(incidents, inflate)
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", "queryingIncidentsFailure", service.incidentDB.mapping, "Service.%s: User failed to query incidents", caller)
+			return service.statusInternalError(err)
+		}
+		resp = service.statusOK(*incidentExts)
+	} else {
+		resp = service.statusOK(incidents)
+	}
+
+	service.syslogger.Audit("pz-workflow", "queriedIncidents", service.incidentDB.mapping, "Service.%s: User successfully queried incidents", caller)
+
+	format.Count = int(totalHits)
+	resp.Pagination = format
+	return resp
+}
@@ -0,0 +1,162 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+type IncidentDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewIncidentDB(service *Service, esi elasticsearch.IIndex) (*IncidentDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	idb := IncidentDB{ResourceDB: rdb, mapping: IncidentDBMapping}
+	return &idb, nil
+}
+
+func (db *IncidentDB) PostData(incident *Incident) error {
+	indexResult, err := db.Esi.PostData(db.mapping, incident.IncidentID.String(), incident)
+	if err != nil {
+		return LoggedError("IncidentDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("IncidentDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+// PutData replaces a stored incident
+// GetOneVersioned is GetOne in real time, with the version PutVersioned needs
+func (db *IncidentDB) GetOneVersioned(id piazza.Ident) (*Incident, int64, bool, error) {
+	src, version, found, err := db.raw.GetVersioned(db.mapping, id.String())
+	if err != nil {
+		return nil, 0, false, LoggedError("IncidentDB.GetOneVersioned failed: %s", err)
+	}
+	if !found {
+		return nil, 0, false, fmt.Errorf("incident %s could not be found", id)
+	}
+	var incident Incident
+	if err = json.Unmarshal(*src, &incident); err != nil {
+		return nil, 0, true, err
+	}
+	return &incident, version, true, nil
+}
+
+// PutVersioned replaces a stored incident, unless it has been written since it was
+// read at version, when it returns errVersionConflict
+func (db *IncidentDB) PutVersioned(incident *Incident, version int64) error {
+	err := db.raw.PutVersioned(db.mapping, incident.IncidentID.String(), incident, version)
+	if err != nil && err != errVersionConflict {
+		return LoggedError("IncidentDB.PutVersioned failed: %s", err)
+	}
+	return err
+}
+
+func (db *IncidentDB) GetIncidentsByDslQuery(dslString string, actor string) ([]Incident, int64, error) {
+	incidents := []Incident{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return incidents, 0, err
+	}
+	if !exists {
+		return incidents, 0, nil
+	}
+
+	searchResult, err := db.Esi.SearchByJSON(db.mapping, dslString)
+	if err != nil {
+		return nil, 0, LoggedError("IncidentDB.GetIncidentsByDslQuery failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("IncidentDB.GetIncidentsByDslQuery failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var incident Incident
+			if err := json.Unmarshal(*hit.Source, &incident); err != nil {
+				return nil, 0, err
+			}
+			incidents = append(incidents, incident)
+		}
+	}
+
+	return incidents, searchResult.TotalHits(), nil
+}
+
+func (db *IncidentDB) GetOne(id piazza.Ident, actor string) (*Incident, bool, error) {
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("IncidentDB.GetOne failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, true, fmt.Errorf("IncidentDB.GetOne failed: %s no getResult", id.String())
+	}
+
+	src := getResult.Source
+	var incident Incident
+	if err = json.Unmarshal(*src, &incident); err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &incident, getResult.Found, nil
+}
+
+// GetByIDs returns those of the incidents that exist, in no particular order. It is
+// real-time, so it finds incidents that a search would not yet.
+func (db *IncidentDB) GetByIDs(ids []piazza.Ident, actor string) ([]Incident, error) {
+	sources, err := db.raw.MultiGet(db.mapping, identStrings(ids))
+	if err != nil {
+		return nil, LoggedError("IncidentDB.GetByIDs failed: %s", err)
+	}
+	incidents := make([]Incident, len(sources))
+	for i, source := range sources {
+		if err = json.Unmarshal(*source, &incidents[i]); err != nil {
+			return nil, LoggedError("IncidentDB.GetByIDs failed: %s", err)
+		}
+	}
+	return incidents, nil
+}
+
+// GetLatest returns the trigger's most recently seen incident for the group value
+func (db *IncidentDB) GetLatest(triggerID piazza.Ident, groupValue string, actor string) (*Incident, error) {
+	dsl, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": []interface{}{
+			map[string]interface{}{"term": map[string]interface{}{"triggerId": triggerID.String()}},
+			map[string]interface{}{"term": map[string]interface{}{"groupValue": groupValue}},
+		}}},
+		"sort": []interface{}{map[string]interface{}{"lastSeen": "desc"}},
+		"size": 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	incidents, _, err := db.GetIncidentsByDslQuery(string(dsl), actor)
+	if err != nil || len(incidents) == 0 {
+		return nil, err
+	}
+	return &incidents[0], nil
+}
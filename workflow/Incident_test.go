@@ -0,0 +1,190 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestCheckGrouping(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping := map[string]interface{}{
+		"host":     "string",
+		"severity": "integer",
+		"where":    "geo_point",
+		"tags":     "[string]",
+		"source": map[string]interface{}{
+			"site": "string",
+		},
+	}
+	check := func(field string, window string) error {
+		return checkGrouping(&AlertGrouping{Field: field, Window: window}, mapping, "et1")
+	}
+
+	assert.NoError(check("data.host", "15m"))
+	assert.NoError(check("data.severity", "1h"))
+	assert.NoError(check("data.source.site", "168h"))
+
+	assert.Error(check("host", "15m"))
+	assert.Error(check("data.nothere", "15m"))
+	assert.Error(check("data.source", "15m"))
+	assert.Error(check("data.where", "15m"))
+	assert.Error(check("data.tags", "15m"))
+	assert.Error(check("data.host", "soon"))
+	assert.Error(check("data.host", "-5m"))
+	assert.Error(check("data.host", "169h"))
+}
+
+func TestGroupValue(t *testing.T) {
+	assert := assert.New(t)
+
+	data := map[string]interface{}{
+		"host":     "web-1",
+		"severity": 3.0,
+		"up":       false,
+		"source":   map[string]interface{}{"site": "east"},
+	}
+	assert.Equal("web-1", groupValue(data, "data.host"))
+	assert.Equal("3", groupValue(data, "data.severity"))
+	assert.Equal("false", groupValue(data, "data.up"))
+	assert.Equal("east", groupValue(data, "data.source.site"))
+	assert.Equal("", groupValue(data, "data.missing"))
+	assert.Equal("", groupValue(nil, "data.host"))
+}
+
+func TestIncidentGrouperPrune(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	g := newIncidentGrouper()
+	g.pruned = now
+	g.slots["quiet"] = &incidentSlot{open: &openIncident{incident: Incident{LastSeen: piazza.TimeStamp(now.Add(-time.Hour))}, window: time.Minute}}
+	g.slots["busy"] = &incidentSlot{open: &openIncident{incident: Incident{LastSeen: piazza.TimeStamp(now.Add(-time.Hour))}, window: 2 * time.Hour}}
+	g.slots["unknown"] = &incidentSlot{}
+	g.slots["claimed"] = &incidentSlot{users: 1}
+
+	// pruning waits for the interval to pass
+	g.prune(now)
+	assert.Len(g.slots, 4)
+
+	// a slot an alert is still using is kept whatever its incident
+	g.prune(now.Add(incidentPruneInterval))
+	assert.Len(g.slots, 2)
+	assert.Contains(g.slots, "busy")
+	assert.Contains(g.slots, "claimed")
+}
+
+func TestIncidentGrouperSlots(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newIncidentGrouper()
+
+	// different groups do not wait on each other
+	a := g.acquire("t1\x00a")
+	b := g.acquire("t1\x00b")
+	assert.Equal(1, a.users)
+	assert.Equal(1, b.users)
+
+	// the same group waits for the slot to be released
+	acquired := make(chan *incidentSlot, 1)
+	go func() { acquired <- g.acquire("t1\x00a") }()
+	time.Sleep(20 * time.Millisecond)
+	assert.Len(acquired, 0)
+	g.release(a)
+	again := <-acquired
+	assert.True(again == a)
+	g.release(again)
+	g.release(b)
+	assert.Equal(0, a.users)
+	assert.Equal(0, b.users)
+}
+
+func TestIncidentClaimNotStored(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &Service{incidents: newIncidentGrouper()}
+	open := &openIncident{incident: Incident{IncidentID: "i1", AlertCount: 3}, window: time.Hour}
+	slot := service.incidents.acquire("t1\x00a")
+	slot.open = open
+	claim := &incidentClaim{slot: slot, incident: Incident{IncidentID: "i1", AlertCount: 4}, window: time.Hour}
+	assert.Equal(piazza.Ident("i1"), claim.IncidentID())
+
+	// an alert that was not stored leaves its incident's count alone
+	assert.NoError(service.settleIncident(claim, false))
+	assert.Equal(int64(3), slot.open.incident.AlertCount)
+	assert.Equal(0, slot.users)
+
+	var none *incidentClaim
+	assert.Equal(piazza.Ident(""), none.IncidentID())
+	assert.NoError(service.settleIncident(none, true))
+}
+
+func TestIncidentClaimConflict(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t, nil)
+	trigger := &Trigger{TriggerID: "t1", Grouping: &AlertGrouping{Field: "host", Window: "1h"}}
+	eventType := &EventType{Name: "et"}
+	event := &Event{EventID: "e1", Data: map[string]interface{}{"et": map[string]interface{}{"host": "a"}}}
+
+	claim, err := service.claimIncident(trigger, event, eventType)
+	assert.NoError(err)
+	assert.True(claim.isNew)
+	assert.NoError(service.settleIncident(claim, true))
+	id := claim.IncidentID()
+
+	claim, err = service.claimIncident(trigger, event, eventType)
+	assert.NoError(err)
+	assert.False(claim.isNew)
+	assert.Equal(id, claim.IncidentID())
+
+	// another instance counts two alerts while this one's is being stored
+	other, version, _, err := service.incidentDB.GetOneVersioned(id)
+	assert.NoError(err)
+	other.AlertCount += 2
+	assert.NoError(service.incidentDB.PutVersioned(other, version))
+
+	assert.NoError(service.settleIncident(claim, true))
+	stored, _, _, err := service.incidentDB.GetOneVersioned(id)
+	assert.NoError(err)
+	assert.EqualValues(4, stored.AlertCount)
+
+	// a claim reads the incident again rather than trusting what it last wrote
+	other, version, _, err = service.incidentDB.GetOneVersioned(id)
+	assert.NoError(err)
+	other.AlertCount = 10
+	assert.NoError(service.incidentDB.PutVersioned(other, version))
+	claim, err = service.claimIncident(trigger, event, eventType)
+	assert.NoError(err)
+	assert.EqualValues(11, claim.incident.AlertCount)
+	assert.NoError(service.settleIncident(claim, true))
+	stored, _, _, err = service.incidentDB.GetOneVersioned(id)
+	assert.NoError(err)
+	assert.EqualValues(11, stored.AlertCount)
+}
+
+func TestAlertFilterIncident(t *testing.T) {
+	assert := assert.New(t)
+
+	f := &AlertFilter{IncidentID: "i1"}
+	assert.False(f.IsEmpty())
+	assert.Equal("incidentId=i1", f.Values().Encode())
+	assert.Equal([]interface{}{map[string]interface{}{"term": map[string]interface{}{"incidentId": "i1"}}}, f.clauses())
+}
@@ -0,0 +1,273 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// ids are looked up this many at a time when inflating
+const inflateBatchSize = 1000
+
+// inflateOptions says what inflate= asks to be added to alerts and incidents.
+// inflate=true adds everything; otherwise it is a list such as "trigger,event".
+type inflateOptions struct {
+	Trigger  bool
+	Event    bool
+	Incident bool
+}
+
+// any is true if anything is to be added
+func (o *inflateOptions) any() bool {
+	return o.Trigger || o.Event || o.Incident
+}
+
+func parseInflateParam(params *piazza.HttpQueryParams) (*inflateOptions, error) {
+	s, err := params.GetAsString("inflate", "false")
+	if err != nil {
+		return nil, err
+	}
+	if all, err := strconv.ParseBool(s); err == nil {
+		return &inflateOptions{Trigger: all, Event: all, Incident: all}, nil
+	}
+	o := &inflateOptions{}
+	for _, part := range strings.Split(s, ",") {
+		switch strings.TrimSpace(part) {
+		case "trigger":
+			o.Trigger = true
+		case "event":
+			o.Event = true
+		case "incident":
+			o.Incident = true
+		default:
+			return nil, fmt.Errorf("inflate must be true, false or a list of trigger, event and incident, not %q", s)
+		}
+	}
+	return o, nil
+}
+
+// identStrings converts ids for the requests that take plain strings
+func identStrings(ids []piazza.Ident) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strs
+}
+
+// inflationCache holds the triggers, events and incidents fetched while inflating one
+// response. Each is fetched once, along with the others it is needed with, rather than
+// once per alert; ones that cannot be found are remembered as nil.
+type inflationCache struct {
+	service   *Service
+	triggers  map[piazza.Ident]*Trigger
+	events    map[piazza.Ident]*Event
+	incidents map[piazza.Ident]*Incident
+}
+
+func newInflationCache(service *Service) *inflationCache {
+	return &inflationCache{
+		service:   service,
+		triggers:  map[piazza.Ident]*Trigger{},
+		events:    map[piazza.Ident]*Event{},
+		incidents: map[piazza.Ident]*Incident{},
+	}
+}
+
+// missing returns the distinct non-empty ids that have not been looked up, in the
+// order first given
+func missing(ids []piazza.Ident, have func(piazza.Ident) bool) []piazza.Ident {
+	seen := map[piazza.Ident]bool{}
+	out := []piazza.Ident{}
+	for _, id := range ids {
+		if id == "" || seen[id] || have(id) {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	return out
+}
+
+// inBatches calls fn with the ids, inflateBatchSize at a time
+func inBatches(ids []piazza.Ident, fn func([]piazza.Ident) error) error {
+	for start := 0; start < len(ids); start += inflateBatchSize {
+		end := start + inflateBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := fn(ids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *inflationCache) loadTriggers(ids []piazza.Ident) error {
+	ids = missing(ids, func(id piazza.Ident) bool { _, ok := c.triggers[id]; return ok })
+	return inBatches(ids, func(batch []piazza.Ident) error {
+		triggers, err := c.service.triggerDB.GetByIDs(batch, "pz-workflow")
+		if err != nil {
+			return err
+		}
+		for _, id := range batch {
+			c.triggers[id] = nil
+		}
+		for i := range triggers {
+			c.triggers[triggers[i].TriggerID] = &triggers[i]
+		}
+		return nil
+	})
+}
+
+func (c *inflationCache) loadEvents(ids []piazza.Ident) error {
+	ids = missing(ids, func(id piazza.Ident) bool { _, ok := c.events[id]; return ok })
+	return inBatches(ids, func(batch []piazza.Ident) error {
+		events, err := c.service.eventDB.GetByIDs(batch, "pz-workflow")
+		if err != nil {
+			return err
+		}
+		for _, id := range batch {
+			c.events[id] = nil
+		}
+		for i := range events {
+			c.events[events[i].EventID] = &events[i]
+		}
+		return nil
+	})
+}
+
+func (c *inflationCache) loadIncidents(ids []piazza.Ident) error {
+	ids = missing(ids, func(id piazza.Ident) bool { _, ok := c.incidents[id]; return ok })
+	return inBatches(ids, func(batch []piazza.Ident) error {
+		incidents, err := c.service.incidentDB.GetByIDs(batch, "pz-workflow")
+		if err != nil {
+			return err
+		}
+		for _, id := range batch {
+			c.incidents[id] = nil
+		}
+		for i := range incidents {
+			c.incidents[incidents[i].IncidentID] = &incidents[i]
+		}
+		return nil
+	})
+}
+
+// trigger returns the trigger, or one holding just its id if it could not be found
+func (c *inflationCache) trigger(id piazza.Ident) *Trigger {
+	if trigger := c.triggers[id]; trigger != nil {
+		return trigger
+	}
+	return &Trigger{TriggerID: id}
+}
+
+// event returns the event, or one holding just its id if it could not be found
+func (c *inflationCache) event(id piazza.Ident) *Event {
+	if event := c.events[id]; event != nil {
+		return event
+	}
+	return &Event{EventID: id}
+}
+
+// inflateAlerts adds to the alerts what the options ask for, fetching the triggers,
+// events and incidents of the whole list together
+func (service *Service) inflateAlerts(alerts []Alert, options *inflateOptions) (*[]AlertExt, error) {
+	cache := newInflationCache(service)
+	if options.Trigger {
+		ids := make([]piazza.Ident, len(alerts))
+		for i, alert := range alerts {
+			ids[i] = alert.TriggerID
+		}
+		if err := cache.loadTriggers(ids); err != nil {
+			return nil, err
+		}
+	}
+	if options.Event {
+		ids := make([]piazza.Ident, 0, 2*len(alerts))
+		for _, alert := range alerts {
+			ids = append(ids, alert.EventID, alert.JobEventID)
+		}
+		if err := cache.loadEvents(ids); err != nil {
+			return nil, err
+		}
+	}
+	if options.Incident {
+		ids := make([]piazza.Ident, len(alerts))
+		for i, alert := range alerts {
+			ids[i] = alert.IncidentID
+		}
+		if err := cache.loadIncidents(ids); err != nil {
+			return nil, err
+		}
+	}
+
+	alertExts := make([]AlertExt, len(alerts))
+	for i, alert := range alerts {
+		alertExt := AlertExt{Alert: alert}
+		if options.Trigger {
+			alertExt.Trigger = cache.trigger(alert.TriggerID)
+		}
+		if options.Event {
+			alertExt.Event = cache.event(alert.EventID)
+			if alert.JobEventID != "" {
+				alertExt.JobResult = cache.events[alert.JobEventID]
+			}
+		}
+		if options.Incident && alert.IncidentID != "" {
+			alertExt.Incident = cache.incidents[alert.IncidentID]
+		}
+		alertExts[i] = alertExt
+	}
+	return &alertExts, nil
+}
+
+// inflateIncidents adds to the incidents their triggers and representative events,
+// as the options ask
+func (service *Service) inflateIncidents(incidents []Incident, options *inflateOptions) (*[]IncidentExt, error) {
+	cache := newInflationCache(service)
+	triggerIDs := make([]piazza.Ident, len(incidents))
+	eventIDs := make([]piazza.Ident, len(incidents))
+	for i, incident := range incidents {
+		triggerIDs[i] = incident.TriggerID
+		eventIDs[i] = incident.RepresentativeEventID
+	}
+	if options.Trigger {
+		if err := cache.loadTriggers(triggerIDs); err != nil {
+			return nil, err
+		}
+	}
+	if options.Event {
+		if err := cache.loadEvents(eventIDs); err != nil {
+			return nil, err
+		}
+	}
+
+	incidentExts := make([]IncidentExt, len(incidents))
+	for i, incident := range incidents {
+		incidentExts[i] = IncidentExt{Incident: incident}
+		if options.Trigger {
+			incidentExts[i].Trigger = cache.trigger(incident.TriggerID)
+		}
+		if options.Event {
+			incidentExts[i].RepresentativeEvent = cache.event(incident.RepresentativeEventID)
+		}
+	}
+	return &incidentExts, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestIdentStrings(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"e1", "e2"}, identStrings([]piazza.Ident{"e1", "e2"}))
+	assert.Equal([]string{}, identStrings(nil))
+}
+
+func TestInflateMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	have := map[piazza.Ident]bool{"t2": true}
+	ids := missing([]piazza.Ident{"t1", "", "t2", "t3", "t1"}, func(id piazza.Ident) bool { return have[id] })
+	assert.Equal([]piazza.Ident{"t1", "t3"}, ids)
+}
+
+func TestInflateBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	ids := make([]piazza.Ident, 2*inflateBatchSize+1)
+	sizes := []int{}
+	err := inBatches(ids, func(batch []piazza.Ident) error {
+		sizes = append(sizes, len(batch))
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal([]int{inflateBatchSize, inflateBatchSize, 1}, sizes)
+
+	calls := 0
+	err = inBatches(ids, func(batch []piazza.Ident) error {
+		calls++
+		return errors.New("down")
+	})
+	assert.Error(err)
+	assert.Equal(1, calls)
+}
+
+func TestInflationCacheStubs(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newInflationCache(nil)
+	cache.triggers["t1"] = &Trigger{TriggerID: "t1", Name: "found"}
+	cache.triggers["t2"] = nil
+
+	assert.Equal("found", cache.trigger("t1").Name)
+	assert.Equal(&Trigger{TriggerID: "t2"}, cache.trigger("t2"))
+	assert.Equal(&Event{EventID: "e1"}, cache.event("e1"))
+
+	assert.False((&inflateOptions{}).any())
+	assert.True((&inflateOptions{Event: true}).any())
+}
+
+func TestInflateAlertsKeepFields(t *testing.T) {
+	assert := assert.New(t)
+
+	service := &Service{}
+	alerts := []Alert{{AlertID: "a1", Status: AlertStatusAcknowledged, Assignee: "bob", Notes: "mine", Revision: 3, CorrelationID: "c1"}}
+	exts, err := service.inflateAlerts(alerts, &inflateOptions{})
+	assert.NoError(err)
+	assert.Len(*exts, 1)
+	assert.Equal(alerts[0], (*exts)[0].Alert)
+}
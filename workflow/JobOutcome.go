@@ -0,0 +1,142 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"strings"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// a job's outcome is written at most this many times when updates race it
+const maxJobOutcomeAttempts = 3
+
+// a job's alert is looked for at most this many times, the first retry after
+// jobOutcomeRetryBase and each later one after twice as long as the one before
+const maxJobOutcomeLookups = 8
+
+// a var, so that tests need not wait
+var jobOutcomeRetryBase = 2 * time.Second
+
+// the job statuses Piazza reports, by the job status an alert records
+var jobStatusesByPiazzaStatus = map[string]string{
+	"submitted": JobStatusPending,
+	"pending":   JobStatusPending,
+	"running":   JobStatusRunning,
+	"success":   JobStatusSucceeded,
+	"error":     JobStatusFailed,
+	"fail":      JobStatusFailed,
+	"cancelled": JobStatusCancelled,
+}
+
+// alertJobStatus is the job status an alert records for a status Piazza reports.
+// Statuses it does not know are kept, lower-cased.
+func alertJobStatus(piazzaStatus string) string {
+	s := strings.ToLower(strings.TrimSpace(piazzaStatus))
+	if status, ok := jobStatusesByPiazzaStatus[s]; ok {
+		return status
+	}
+	return s
+}
+
+func isJobStatus(s string) bool {
+	switch s {
+	case JobStatusPending, JobStatusRunning, JobStatusSucceeded, JobStatusFailed, JobStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// pendingJobOutcome is a job's outcome, from an executionComplete event, that is yet
+// to be recorded on the alert that started the job
+type pendingJobOutcome struct {
+	event    *Event
+	data     map[string]interface{}
+	attempts int
+}
+
+// jobOutcomeRetryDelay is how long to wait before looking for a job's alert again
+// after the given number of lookups: the alert may be too new for searches to find
+func jobOutcomeRetryDelay(attempts int) time.Duration {
+	return jobOutcomeRetryBase << uint(attempts-1)
+}
+
+// recordJobOutcome updates the alert that started a job with its outcome, as
+// reported by an executionComplete event. An outcome whose alert cannot be found yet
+// is kept and looked up again, with backoff, up to maxJobOutcomeLookups times, so
+// that a job finishing before its alert is searchable is still recorded. Failures
+// are logged rather than failing the event, which has already been stored.
+func (service *Service) recordJobOutcome(event *Event, data map[string]interface{}) {
+	service.applyJobOutcome(&pendingJobOutcome{event: event, data: data})
+}
+
+func (service *Service) applyJobOutcome(pending *pendingJobOutcome) {
+	event, data := pending.event, pending.data
+	jobID, _ := data["jobId"].(string)
+	if jobID == "" {
+		return
+	}
+
+	pending.attempts++
+	found, err := service.alertDB.GetOneByJobID(piazza.Ident(jobID), "pz-workflow")
+	if err != nil || found == nil {
+		if pending.attempts < maxJobOutcomeLookups {
+			delay := jobOutcomeRetryDelay(pending.attempts)
+			if err != nil {
+				service.syslogger.Warning("Service.recordJobOutcome: could not look up the alert of job %s, will look again in %v: %s", jobID, delay, err)
+			} else {
+				service.syslogger.Info("Service.recordJobOutcome: no alert found for job %s yet, will look again in %v", jobID, delay)
+			}
+			time.AfterFunc(delay, func() { service.applyJobOutcome(pending) })
+			return
+		}
+		service.syslogger.Warning("Service.recordJobOutcome: gave up on job %s after %d lookups: no alert started it", jobID, pending.attempts)
+		return
+	}
+
+	status, _ := data["status"].(string)
+	dataID, _ := data["dataId"].(string)
+	completedOn := event.CreatedOn
+
+	// the write is versioned, so an update racing it makes it read the alert again
+	for attempt := 1; ; attempt++ {
+		alert, version, _, err := service.alertDB.GetOneVersioned(found.AlertID)
+		if err != nil {
+			service.syslogger.Warning("Service.recordJobOutcome: could not read alert %s: %s", found.AlertID, err)
+			return
+		}
+		alert.JobStatus = alertJobStatus(status)
+		alert.JobDataID = piazza.Ident(dataID)
+		alert.JobEventID = event.EventID
+		alert.JobCompletedOn = &completedOn
+		reviseAlert(alert)
+
+		service.syslogger.Audit("pz-workflow", "updatingAlertJob", alert.AlertID, "Service.recordJobOutcome: User is recording job [%s] as %s on alert [%s]", jobID, alert.JobStatus, alert.AlertID)
+
+		err = service.alertDB.PutVersioned(alert, version)
+		if err == errVersionConflict && attempt < maxJobOutcomeAttempts {
+			continue
+		}
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", "updatingAlertJobFailure", alert.AlertID, "Service.recordJobOutcome: User failed to record job [%s] on alert [%s]", jobID, alert.AlertID)
+			service.syslogger.Warning("Service.recordJobOutcome: could not update alert %s: %s", alert.AlertID, err)
+			return
+		}
+
+		service.syslogger.Audit("pz-workflow", "updatedAlertJob", alert.AlertID, "Service.recordJobOutcome: User successfully recorded job [%s] as %s on alert [%s]", jobID, alert.JobStatus, alert.AlertID)
+		return
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestAlertJobStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(JobStatusSucceeded, alertJobStatus("Success"))
+	assert.Equal(JobStatusFailed, alertJobStatus("Error"))
+	assert.Equal(JobStatusFailed, alertJobStatus("Fail"))
+	assert.Equal(JobStatusCancelled, alertJobStatus("Cancelled"))
+	assert.Equal(JobStatusPending, alertJobStatus("Submitted"))
+	assert.Equal("unknown", alertJobStatus(" Unknown "))
+
+	assert.True(isJobStatus(JobStatusFailed))
+	assert.False(isJobStatus("Error"))
+
+	f := &AlertFilter{JobStatuses: []string{JobStatusFailed}}
+	assert.False(f.IsEmpty())
+	assert.Equal("jobStatus=failed", f.Values().Encode())
+	assert.Equal([]interface{}{map[string]interface{}{"terms": map[string]interface{}{"jobStatus": []string{"failed"}}}}, f.clauses())
+}
+
+func TestJobOutcomeRetryDelay(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(jobOutcomeRetryBase, jobOutcomeRetryDelay(1))
+	assert.Equal(4*jobOutcomeRetryBase, jobOutcomeRetryDelay(3))
+
+	// every lookup but the last is followed by a retry, all within a few minutes
+	var total time.Duration
+	for attempts := 1; attempts < maxJobOutcomeLookups; attempts++ {
+		total += jobOutcomeRetryDelay(attempts)
+	}
+	assert.True(total < 5*time.Minute)
+}
+
+// racingReads runs race after each of the next races reads of a document, as if
+// another instance wrote it just after it was read
+type racingReads struct {
+	elasticsearch.IIndex
+	sync.Mutex
+	races  int
+	racing bool
+	race   func()
+}
+
+func (r *racingReads) GetByID(typ string, id string) (*elasticsearch.GetResult, error) {
+	result, err := r.IIndex.GetByID(typ, id)
+	r.Lock()
+	run := r.races > 0 && !r.racing
+	if run {
+		r.races--
+		r.racing = true
+	}
+	r.Unlock()
+	if run {
+		r.race()
+		r.Lock()
+		r.racing = false
+		r.Unlock()
+	}
+	return result, err
+}
+
+type jobOutcomeFixture struct {
+	service       *Service
+	alerts        *racingReads
+	executeTypeID piazza.Ident
+	eventID       piazza.Ident
+}
+
+func newJobOutcomeFixture(t *testing.T) *jobOutcomeFixture {
+	fx := &jobOutcomeFixture{}
+	fx.service = newTestService(t, func(esi elasticsearch.IIndex) elasticsearch.IIndex {
+		if esi.IndexName() != keyAlerts {
+			return esi
+		}
+		fx.alerts = &racingReads{IIndex: esi}
+		return fx.alerts
+	})
+	id, found, err := fx.service.eventTypeDB.GetIDByName(nil, executeTypeName, "test")
+	if err != nil || !found {
+		t.Fatalf("no %s EventType: %v", executeTypeName, err)
+	}
+	fx.executeTypeID = *id
+
+	// the event whose trigger starts the jobs
+	resp := fx.service.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	if resp.IsError() {
+		t.Fatal(resp.Message)
+	}
+	resp = fx.service.PostEvent(makeTestEvent(resp.Data.(*EventType).EventTypeID))
+	if resp.IsError() {
+		t.Fatal(resp.Message)
+	}
+	fx.eventID = resp.Data.(*Event).EventID
+	return fx
+}
+
+func (fx *jobOutcomeFixture) postAlert(t *testing.T, jobID piazza.Ident) *Alert {
+	resp := fx.service.PostAlert(&Alert{TriggerID: "t1", EventID: fx.eventID, JobID: jobID})
+	if resp.IsError() {
+		t.Fatal(resp.Message)
+	}
+	return resp.Data.(*Alert)
+}
+
+func (fx *jobOutcomeFixture) postOutcome(t *testing.T, jobID piazza.Ident, status string) *Event {
+	resp := fx.service.PostEvent(&Event{
+		EventTypeID: fx.executeTypeID,
+		CreatedOn:   piazza.NewTimeStamp(),
+		Data:        map[string]interface{}{"jobId": jobID.String(), "status": status, "dataId": "d-" + jobID.String()},
+	})
+	if resp.IsError() {
+		t.Fatal(resp.Message)
+	}
+	return resp.Data.(*Event)
+}
+
+func (fx *jobOutcomeFixture) storedAlert(t *testing.T, id piazza.Ident) *Alert {
+	alert, _, _, err := fx.service.alertDB.GetOneVersioned(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alert
+}
+
+func TestRecordJobOutcome(t *testing.T) {
+	assert := assert.New(t)
+	fx := newJobOutcomeFixture(t)
+
+	alert := fx.postAlert(t, "j1")
+	other := fx.postAlert(t, "j2")
+	event := fx.postOutcome(t, "j1", "Error")
+
+	stored := fx.storedAlert(t, alert.AlertID)
+	assert.Equal(JobStatusFailed, stored.JobStatus)
+	assert.Equal(piazza.Ident("d-j1"), stored.JobDataID)
+	assert.Equal(event.EventID, stored.JobEventID)
+	assert.NotNil(stored.JobCompletedOn)
+	assert.Equal(alert.Revision+1, stored.Revision)
+
+	// the outcome is only recorded on the alert that started the job
+	assert.Empty(fx.storedAlert(t, other.AlertID).JobStatus)
+
+	// and the event is a child of the alert's
+	assert.Equal(alert.EventID, event.ParentEventID)
+}
+
+func TestRecordJobOutcomeBeforeAlert(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(base time.Duration) { jobOutcomeRetryBase = base }(jobOutcomeRetryBase)
+	jobOutcomeRetryBase = 10 * time.Millisecond
+
+	fx := newJobOutcomeFixture(t)
+
+	// the job finishes before its alert is stored, so the outcome waits for it
+	fx.postOutcome(t, "j1", "Success")
+	alert := fx.postAlert(t, "j1")
+
+	for i := 0; i < 100 && fx.storedAlert(t, alert.AlertID).JobStatus != JobStatusSucceeded; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stored := fx.storedAlert(t, alert.AlertID)
+	assert.Equal(JobStatusSucceeded, stored.JobStatus)
+	assert.Equal(piazza.Ident("d-j1"), stored.JobDataID)
+}
+
+func TestRecordJobOutcomeConflict(t *testing.T) {
+	assert := assert.New(t)
+	fx := newJobOutcomeFixture(t)
+
+	alert := fx.postAlert(t, "j1")
+
+	// someone acknowledges the alert while the outcome is being written
+	fx.alerts.race = func() {
+		current := fx.storedAlert(t, alert.AlertID)
+		resp := fx.service.PutAlertState(alert.AlertID, &AlertStateUpdate{
+			Status:    AlertStatusAcknowledged,
+			Revision:  current.Revision,
+			ChangedBy: "someone",
+		})
+		assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	}
+	fx.alerts.races = 1
+	fx.postOutcome(t, "j1", "Success")
+
+	// the outcome is written again over the acknowledgment, not instead of it
+	stored := fx.storedAlert(t, alert.AlertID)
+	assert.Equal(JobStatusSucceeded, stored.JobStatus)
+	assert.Equal(AlertStatusAcknowledged, stored.Status)
+	assert.Equal(alert.Revision+2, stored.Revision)
+
+	// an outcome that loses every race is given up on
+	other := fx.postAlert(t, "j2")
+	fx.alerts.race = func() {
+		current := fx.storedAlert(t, other.AlertID)
+		resp := fx.service.PutAlertState(other.AlertID, &AlertStateUpdate{
+			Status:    AlertStatusAcknowledged,
+			Revision:  current.Revision,
+			Note:      "again",
+			ChangedBy: "someone",
+		})
+		assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	}
+	fx.alerts.races = maxJobOutcomeAttempts
+	fx.postOutcome(t, "j2", "Success")
+
+	stored = fx.storedAlert(t, other.AlertID)
+	assert.Empty(stored.JobStatus)
+	assert.Equal(other.Revision+maxJobOutcomeAttempts, stored.Revision)
+}
+
+func TestGetAlertsByJobStatus(t *testing.T) {
+	assert := assert.New(t)
+	fx := newJobOutcomeFixture(t)
+
+	failed := fx.postAlert(t, "j1")
+	fx.postAlert(t, "j2")
+	succeeded := fx.postAlert(t, "j3")
+	fx.postOutcome(t, "j1", "Error")
+	fx.postOutcome(t, "j3", "Success")
+
+	resp := fx.service.GetAllAlerts(testQueryParams(t, "/alert?jobStatus=failed"))
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	alerts := resp.Data.([]Alert)
+	assert.Len(alerts, 1)
+	assert.Equal(failed.AlertID, alerts[0].AlertID)
+	assert.Equal(1, resp.Pagination.Count)
+
+	resp = fx.service.GetAllAlerts(testQueryParams(t, "/alert?jobStatus=failed,succeeded&perPage=10&sortBy=alertId"))
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	ids := map[piazza.Ident]bool{}
+	for _, alert := range resp.Data.([]Alert) {
+		ids[alert.AlertID] = true
+	}
+	assert.Equal(map[piazza.Ident]bool{failed.AlertID: true, succeeded.AlertID: true}, ids)
+
+	resp = fx.service.GetAllAlerts(testQueryParams(t, "/alert?jobStatus=exploded"))
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,359 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// JsonSchema is a JSON Schema (draft-07) document
+type JsonSchema map[string]interface{}
+
+const jsonSchemaDraft07 = "http://json-schema.org/draft-07/schema#"
+
+// jsonSchemaMappingTypeKey names the mapping type where JSON Schema has no equivalent,
+// so that an exported schema imports to the same mapping
+const jsonSchemaMappingTypeKey = "x-mappingType"
+
+// the keywords that constrain nothing, and so are ignored on import
+var jsonSchemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"examples": true, "readOnly": true, "writeOnly": true, "default": true, "enum": true,
+	jsonSchemaMappingTypeKey: true,
+}
+
+// the integer mapping types, smallest first, with the ranges that export writes
+var jsonSchemaIntegerTypes = []struct {
+	typ      string
+	min, max float64
+}{
+	{"byte", math.MinInt8, math.MaxInt8},
+	{"short", math.MinInt16, math.MaxInt16},
+	{"integer", math.MinInt32, math.MaxInt32},
+}
+
+// eventTypeFromJSONSchema converts an object schema into an EventType mapping and the
+// field specs carrying its required, default and enum keywords. Properties not listed
+// in required become optional fields. Every unsupported construct is reported, each
+// with the JSON pointer of where it was found.
+func eventTypeFromJSONSchema(schema map[string]interface{}) (map[string]interface{}, []FieldSpec, error) {
+	if s, ok := schema["$schema"]; ok {
+		if str, _ := s.(string); !strings.Contains(str, "draft-07") {
+			return nil, nil, fmt.Errorf("only JSON Schema draft-07 is supported, not %v", s)
+		}
+	}
+
+	violations := []string{}
+	specs := []FieldSpec{}
+	mapping := importObject("#", "", schema, &specs, &violations)
+	if len(violations) > 0 {
+		return nil, nil, fmt.Errorf("unsupported JSON Schema: %s", strings.Join(violations, "; "))
+	}
+	return mapping, specs, nil
+}
+
+func importObject(pointer string, prefix string, schema map[string]interface{}, specs *[]FieldSpec, violations *[]string) map[string]interface{} {
+	if typ, _ := jsonSchemaType(schema); typ != "object" {
+		*violations = append(*violations, pointer+": expected an object schema")
+		return nil
+	}
+	checkJSONSchemaKeywords(pointer, schema, []string{"type", "properties", "required", "additionalProperties"}, violations)
+	if ap, ok := schema["additionalProperties"]; ok && ap != false {
+		*violations = append(*violations, pointer+": additionalProperties must be false, since event data is checked strictly")
+	}
+
+	properties, ok := schema["properties"].(map[string]interface{})
+	if !ok || len(properties) == 0 {
+		*violations = append(*violations, pointer+": an object needs properties")
+		return nil
+	}
+
+	required := map[string]bool{}
+	if list, ok := schema["required"].([]interface{}); ok {
+		for _, r := range list {
+			if name, ok := r.(string); ok {
+				required[name] = true
+			}
+		}
+	} else if _, ok := schema["required"]; ok {
+		*violations = append(*violations, pointer+"/required: expected an array of property names")
+	}
+	for name := range required {
+		if _, ok := properties[name]; !ok {
+			*violations = append(*violations, fmt.Sprintf("%s/required: %s is not a property", pointer, name))
+		}
+	}
+
+	mapping := map[string]interface{}{}
+	for _, name := range sortedKeys(properties) {
+		propPointer := pointer + "/properties/" + name
+		path := prefix + name
+		if strings.ContainsAny(name, ".~") {
+			*violations = append(*violations, propPointer+": property names cannot contain '.' or '~'")
+			continue
+		}
+		prop, ok := properties[name].(map[string]interface{})
+		if !ok {
+			*violations = append(*violations, propPointer+": expected a schema object")
+			continue
+		}
+
+		if typ, _ := jsonSchemaType(prop); typ == "object" && prop[jsonSchemaMappingTypeKey] == nil {
+			if !required[name] {
+				*violations = append(*violations, propPointer+": an object property must be required")
+			}
+			mapping[name] = importObject(propPointer, path+".", prop, specs, violations)
+			continue
+		}
+		if items, ok := prop["items"].(map[string]interface{}); ok {
+			if typ, _ := jsonSchemaType(items); typ == "object" {
+				checkJSONSchemaKeywords(propPointer, prop, []string{"type", "items", "minItems", "maxItems"}, violations)
+				mapping[name] = []interface{}{importObject(propPointer+"/items", path+".", items, specs, violations)}
+				if !required[name] {
+					*specs = append(*specs, FieldSpec{Name: path, Optional: true})
+				}
+				continue
+			}
+		}
+
+		typ, msg := importLeaf(prop)
+		if msg != "" {
+			*violations = append(*violations, propPointer+": "+msg)
+			continue
+		}
+		mapping[name] = typ
+
+		spec := FieldSpec{Name: path, Optional: !required[name], Default: prop["default"]}
+		if enum, ok := prop["enum"].([]interface{}); ok {
+			spec.Enum = enum
+		}
+		if spec.Optional || spec.Default != nil || len(spec.Enum) > 0 {
+			*specs = append(*specs, spec)
+		}
+	}
+	return mapping
+}
+
+// importLeaf returns the mapping type for a scalar or array-of-scalars schema
+func importLeaf(schema map[string]interface{}) (string, string) {
+	if t, ok := schema[jsonSchemaMappingTypeKey].(string); ok {
+		if !isValidEventMappingType(t) {
+			return "", fmt.Sprintf("%s %q is not a mapping type", jsonSchemaMappingTypeKey, t)
+		}
+		return t, ""
+	}
+
+	typ, msg := jsonSchemaType(schema)
+	if msg != "" {
+		return "", msg
+	}
+	if typ == "array" {
+		var unsupported []string
+		checkJSONSchemaKeywords("", schema, []string{"type", "items", "minItems", "maxItems", "uniqueItems"}, &unsupported)
+		if len(unsupported) > 0 {
+			return "", strings.TrimPrefix(unsupported[0], ": ")
+		}
+		items, ok := schema["items"].(map[string]interface{})
+		if !ok {
+			return "", "an array needs a single items schema"
+		}
+		if t, _ := jsonSchemaType(items); t == "array" {
+			return "", "arrays of arrays are not supported"
+		}
+		elem, msg := importLeaf(items)
+		if msg != "" {
+			return "", "items: " + msg
+		}
+		return "[" + elem + "]", ""
+	}
+
+	// nothing checks string lengths, patterns or number ranges in event data, so they
+	// are refused rather than dropped; an integer's range only picks its mapping type
+	allowed := []string{"type"}
+	switch typ {
+	case "string":
+		allowed = append(allowed, "format")
+	case "integer":
+		allowed = append(allowed, "minimum", "maximum")
+	}
+	var unsupported []string
+	checkJSONSchemaKeywords("", schema, allowed, &unsupported)
+	if len(unsupported) > 0 {
+		return "", strings.TrimPrefix(unsupported[0], ": ")
+	}
+
+	switch typ {
+	case "string":
+		switch format := schema["format"]; format {
+		case "date-time", "date":
+			return "date", ""
+		case nil:
+			return "string", ""
+		default:
+			return "", fmt.Sprintf("format %v is not supported; only date and date-time are", format)
+		}
+	case "boolean":
+		return "boolean", ""
+	case "number":
+		return "double", ""
+	case "integer":
+		min, minOK := numberValue(schema["minimum"])
+		max, maxOK := numberValue(schema["maximum"])
+		if minOK && maxOK {
+			for _, it := range jsonSchemaIntegerTypes {
+				if min >= it.min && max <= it.max {
+					return it.typ, ""
+				}
+			}
+		}
+		return "long", ""
+	}
+	return "", fmt.Sprintf("type %s is not supported", typ)
+}
+
+// jsonSchemaType returns the schema's single type, allowing a nullable ["type", "null"]
+// since event fields may always be null
+func jsonSchemaType(schema map[string]interface{}) (string, string) {
+	switch t := schema["type"].(type) {
+	case string:
+		return t, ""
+	case []interface{}:
+		types := []string{}
+		for _, v := range t {
+			if s, ok := v.(string); ok && s != "null" {
+				types = append(types, s)
+			}
+		}
+		if len(types) == 1 {
+			return types[0], ""
+		}
+		return "", fmt.Sprintf("a union of types %v is not supported", t)
+	case nil:
+		return "", "a schema without a type is not supported"
+	}
+	return "", fmt.Sprintf("type %v is not valid", schema["type"])
+}
+
+func checkJSONSchemaKeywords(pointer string, schema map[string]interface{}, allowed []string, violations *[]string) {
+	ok := map[string]bool{}
+	for _, k := range allowed {
+		ok[k] = true
+	}
+	for _, k := range sortedKeys(schema) {
+		if !ok[k] && !jsonSchemaAnnotations[k] && !strings.HasPrefix(k, "x-") {
+			*violations = append(*violations, fmt.Sprintf("%s: the %s keyword is not supported", pointer, k))
+		}
+	}
+}
+
+// jsonSchemaFromEventType describes the data of an EventType's events. The mapping
+// must not be wrapped in the EventType name. Computed fields are filled in by the
+// service, so they are marked readOnly and never required.
+func jsonSchemaFromEventType(name string, mapping map[string]interface{}, fields []FieldSpec) JsonSchema {
+	schema := exportObject("", mapping, fieldSpecsByPath(fields))
+	schema["$schema"] = jsonSchemaDraft07
+	schema["title"] = name
+	return JsonSchema(schema)
+}
+
+func exportObject(prefix string, mapping map[string]interface{}, specs map[string]*FieldSpec) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, name := range sortedKeys(mapping) {
+		path := prefix + name
+		if obj, ok := mapping[name].(map[string]interface{}); ok {
+			properties[name] = exportObject(path+".", obj, specs)
+			required = append(required, name)
+			continue
+		}
+		if elem, ok := nestedMapping(mapping[name]); ok {
+			properties[name] = map[string]interface{}{"type": "array", "items": exportObject(path+".", elem, specs)}
+			if spec := specs[path]; spec == nil || !spec.Optional {
+				required = append(required, name)
+			}
+			continue
+		}
+
+		typ, _ := mapping[name].(string)
+		prop := exportLeaf(typ)
+		spec := specs[path]
+		if spec == nil || !(spec.Optional || spec.Default != nil || spec.Computed != nil) {
+			required = append(required, name)
+		}
+		if spec != nil {
+			if spec.Default != nil {
+				prop["default"] = spec.Default
+			}
+			if len(spec.Enum) > 0 {
+				if items, ok := prop["items"].(map[string]interface{}); ok {
+					items["enum"] = spec.Enum
+				} else {
+					prop["enum"] = spec.Enum
+				}
+			}
+			if spec.Computed != nil {
+				prop["readOnly"] = true
+			}
+		}
+		properties[name] = prop
+	}
+	sort.Strings(required)
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// exportLeaf writes the JSON Schema for a mapping type, naming the mapping type as
+// well if importing the schema would not otherwise give it back
+func exportLeaf(typ string) map[string]interface{} {
+	prop := exportLeafSchema(typ)
+	if t, _ := importLeaf(prop); t != typ {
+		prop[jsonSchemaMappingTypeKey] = typ
+	}
+	return prop
+}
+
+func exportLeafSchema(typ string) map[string]interface{} {
+	if elem := elementType(typ); elem != typ {
+		return map[string]interface{}{"type": "array", "items": exportLeaf(elem)}
+	}
+
+	switch typ {
+	case "string", "text", "keyword":
+		return map[string]interface{}{"type": "string"}
+	case "boolean":
+		return map[string]interface{}{"type": "boolean"}
+	case "double", "float", "half_float", "scaled_float":
+		return map[string]interface{}{"type": "number"}
+	case "long":
+		return map[string]interface{}{"type": "integer"}
+	case "date":
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	for _, it := range jsonSchemaIntegerTypes {
+		if it.typ == typ {
+			return map[string]interface{}{"type": "integer", "minimum": it.min, "maximum": it.max}
+		}
+	}
+	// geo types and anything else without a JSON Schema equivalent
+	return map[string]interface{}{jsonSchemaMappingTypeKey: typ}
+}
@@ -0,0 +1,183 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonSchemaImport(t *testing.T) {
+	assert := assert.New(t)
+
+	var schema map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title": "Detection",
+		"type": "object",
+		"required": ["class", "where"],
+		"properties": {
+			"class": {"type": "string", "enum": ["car", "boat"]},
+			"score": {"type": ["number", "null"]},
+			"seen": {"type": "string", "format": "date-time"},
+			"count": {"type": "integer", "minimum": 0, "maximum": 100},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"level": {"type": "integer", "default": 1},
+			"where": {
+				"type": "object",
+				"required": ["point"],
+				"properties": {
+					"point": {"x-mappingType": "geo_point"}
+				}
+			}
+		}
+	}`), &schema)
+	assert.NoError(err)
+
+	mapping, specs, err := eventTypeFromJSONSchema(schema)
+	assert.NoError(err)
+	assert.Equal(map[string]interface{}{
+		"class": "string",
+		"score": "double",
+		"seen":  "date",
+		"count": "byte",
+		"tags":  "[string]",
+		"level": "long",
+		"where": map[string]interface{}{"point": "geo_point"},
+	}, mapping)
+	byName := fieldSpecsByPath(specs)
+	assert.Equal([]interface{}{"car", "boat"}, byName["class"].Enum)
+	assert.False(byName["class"].Optional)
+	assert.True(byName["score"].Optional)
+	assert.Equal(1.0, byName["level"].Default)
+	assert.Nil(byName["where.point"])
+	assert.NoError(validateFieldSpecs(mapping, specs))
+
+	err = json.Unmarshal([]byte(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type": "object",
+		"additionalProperties": true,
+		"properties": {
+			"a": {"$ref": "#/definitions/a"},
+			"b": {"type": "array", "items": {"type": "object"}},
+			"c": {"anyOf": [{"type": "string"}], "type": "string"},
+			"d": {"type": ["string", "integer"]},
+			"e": {"type": "object", "properties": {"x": {"type": "string"}}}
+		}
+	}`), &schema)
+	assert.NoError(err)
+	_, _, err = eventTypeFromJSONSchema(schema)
+	assert.Error(err)
+	for _, msg := range []string{
+		"#: additionalProperties must be false",
+		"#/properties/a: a schema without a type is not supported",
+		"#/properties/b/items: an object needs properties",
+		"#/properties/c: the anyOf keyword is not supported",
+		"#/properties/d: a union of types",
+		"#/properties/e: an object property must be required",
+	} {
+		assert.Contains(err.Error(), msg)
+	}
+
+	// constraints that event validation would not enforce are refused, not dropped
+	err = json.Unmarshal([]byte(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type": "object",
+		"properties": {
+			"a": {"type": "string", "minLength": 1},
+			"b": {"type": "string", "maxLength": 10},
+			"c": {"type": "string", "pattern": "^[a-z]+$"},
+			"d": {"type": "string", "format": "email"},
+			"e": {"type": "number", "minimum": 0},
+			"f": {"type": "number", "maximum": 1},
+			"g": {"type": "array", "items": {"type": "string", "format": "uri"}},
+			"h": {"type": "boolean", "minimum": 0}
+		}
+	}`), &schema)
+	assert.NoError(err)
+	_, _, err = eventTypeFromJSONSchema(schema)
+	assert.Error(err)
+	for _, msg := range []string{
+		"#/properties/a: the minLength keyword is not supported",
+		"#/properties/b: the maxLength keyword is not supported",
+		"#/properties/c: the pattern keyword is not supported",
+		"#/properties/d: format email is not supported",
+		"#/properties/e: the minimum keyword is not supported",
+		"#/properties/f: the maximum keyword is not supported",
+		"#/properties/g: items: format uri is not supported",
+		"#/properties/h: the minimum keyword is not supported",
+	} {
+		assert.Contains(err.Error(), msg)
+	}
+
+	_, _, err = eventTypeFromJSONSchema(map[string]interface{}{"$schema": "http://json-schema.org/draft-04/schema#"})
+	assert.Error(err)
+}
+
+func TestJsonSchemaRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	mapping := map[string]interface{}{
+		"name":    "string",
+		"count":   "integer",
+		"big":     "long",
+		"ratio":   "double",
+		"ok":      "boolean",
+		"when":    "date",
+		"scores":  "[float]",
+		"area":    "geo_shape",
+		"created": "date",
+		"where": map[string]interface{}{
+			"site": "string",
+		},
+		"detections": []interface{}{map[string]interface{}{
+			"class": "string",
+			"score": "double",
+		}},
+	}
+	fields := []FieldSpec{
+		{Name: "ok", Optional: true},
+		{Name: "detections", Optional: true},
+		{Name: "detections.score", Optional: true},
+		{Name: "where.site", Enum: []interface{}{"a", "b"}},
+		{Name: "created", Computed: &ComputedField{Kind: ComputedIngestTimestamp}},
+	}
+
+	schema := jsonSchemaFromEventType("Thing", mapping, fields)
+	assert.Equal(jsonSchemaDraft07, schema["$schema"])
+	assert.Equal("Thing", schema["title"])
+	assert.Equal([]string{"area", "big", "count", "name", "ratio", "scores", "when", "where"}, schema["required"])
+	props := schema["properties"].(map[string]interface{})
+	assert.Equal(true, props["created"].(map[string]interface{})["readOnly"])
+	assert.Equal(map[string]interface{}{"x-mappingType": "geo_shape"}, props["area"])
+
+	// through JSON, as a client would see it
+	byts, err := json.Marshal(schema)
+	assert.NoError(err)
+	var decoded map[string]interface{}
+	assert.NoError(json.Unmarshal(byts, &decoded))
+
+	imported, specs, err := eventTypeFromJSONSchema(decoded)
+	assert.NoError(err)
+	assert.Equal(mapping, imported)
+	byName := fieldSpecsByPath(specs)
+	assert.True(byName["ok"].Optional)
+	assert.True(byName["created"].Optional)
+	assert.True(byName["detections"].Optional)
+	assert.True(byName["detections.score"].Optional)
+	assert.Equal([]interface{}{"a", "b"}, byName["where.site"].Enum)
+}
@@ -140,6 +140,31 @@ func (kit *Kit) Stop() error {
 		if err != nil {
 			return err
 		}
+
+		err = indices[keyAreas].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keySubscriptions].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyDeliveries].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyIncidents].Delete()
+		if err != nil {
+			return err
+		}
+
+		err = indices[keyReplays].Delete()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -153,6 +178,11 @@ func (kit *Kit) makeMockIndices() *map[string]elasticsearch.IIndex {
 		keyTriggers:          elasticsearch.NewMockIndex(keyTriggers),
 		keyAlerts:            elasticsearch.NewMockIndex(keyAlerts),
 		keyCrons:             elasticsearch.NewMockIndex(keyCrons),
+		keyAreas:             elasticsearch.NewMockIndex(keyAreas),
+		keySubscriptions:     elasticsearch.NewMockIndex(keySubscriptions),
+		keyDeliveries:        elasticsearch.NewMockIndex(keyDeliveries),
+		keyIncidents:         elasticsearch.NewMockIndex(keyIncidents),
+		keyReplays:           elasticsearch.NewMockIndex(keyReplays),
 		keyTestElasticsearch: elasticsearch.NewMockIndex(keyTestElasticsearch),
 	}
 	(*indices)[keyEventTypes].SetMapping(EventTypeDBMapping, "{}")
@@ -160,6 +190,11 @@ func (kit *Kit) makeMockIndices() *map[string]elasticsearch.IIndex {
 	(*indices)[keyTriggers].SetMapping(TriggerDBMapping, "{}")
 	(*indices)[keyAlerts].SetMapping(AlertDBMapping, "{}")
 	(*indices)[keyCrons].SetMapping(CronDBMapping, "{}")
+	(*indices)[keyAreas].SetMapping(AreaOfInterestDBMapping, "{}")
+	(*indices)[keySubscriptions].SetMapping(SubscriptionDBMapping, "{}")
+	(*indices)[keyDeliveries].SetMapping(DeliveryDBMapping, "{}")
+	(*indices)[keyIncidents].SetMapping(IncidentDBMapping, "{}")
+	(*indices)[keyReplays].SetMapping(ReplayDBMapping, "{}")
 	(*indices)[keyTestElasticsearch].SetMapping(TestElasticsearchMapping, "{}")
 	return indices
 }
@@ -184,6 +219,11 @@ func (kit *Kit) makeIndices(sys *piazza.SystemConfig) *map[string]elasticsearch.
 		keyTriggers:          "Trigger",
 		keyAlerts:            "Alert",
 		keyCrons:             "Cron",
+		keyAreas:             "AreaOfInterest",
+		keySubscriptions:     "Subscription",
+		keyDeliveries:        "Delivery",
+		keyIncidents:         "Incident",
+		keyReplays:           "Replay",
 		keyTestElasticsearch: "TestES",
 	}
 	keyToScripts := map[string][]string{
@@ -192,6 +232,11 @@ func (kit *Kit) makeIndices(sys *piazza.SystemConfig) *map[string]elasticsearch.
 		keyTriggers:          []string{},
 		keyAlerts:            []string{},
 		keyCrons:             []string{},
+		keyAreas:             []string{},
+		keySubscriptions:     []string{},
+		keyDeliveries:        []string{},
+		keyIncidents:         []string{},
+		keyReplays:           []string{},
 		keyTestElasticsearch: []string{},
 	}
 	keyToType := map[string]string{
@@ -200,6 +245,11 @@ func (kit *Kit) makeIndices(sys *piazza.SystemConfig) *map[string]elasticsearch.
 		keyTriggers:          TriggerDBMapping,
 		keyAlerts:            AlertDBMapping,
 		keyCrons:             CronDBMapping,
+		keyAreas:             AreaOfInterestDBMapping,
+		keySubscriptions:     SubscriptionDBMapping,
+		keyDeliveries:        DeliveryDBMapping,
+		keyIncidents:         IncidentDBMapping,
+		keyReplays:           ReplayDBMapping,
 		keyTestElasticsearch: TestElasticsearchMapping,
 	}
 	indices := make(map[string]elasticsearch.IIndex)
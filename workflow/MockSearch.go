@@ -0,0 +1,530 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mockDoc is a document of a mock index, decoded for matching
+type mockDoc struct {
+	id     string
+	source *json.RawMessage
+	fields map[string]interface{}
+}
+
+// mockSearch answers a search on mock indices, which cannot search with a query or
+// aggregate, by running the query and aggregations over every document of the type.
+// It knows the queries and aggregations that the workflow sends: match_all, term,
+// terms, match, range, exists, ids and bool queries; terms, filter and
+// date_histogram aggregations.
+func (raw *rawIndex) mockSearch(typ string, body map[string]interface{}) (*rawSearchResult, error) {
+	types := []string{typ}
+	if typ == "" {
+		var err error
+		if types, err = raw.esi.GetTypes(); err != nil {
+			return nil, err
+		}
+	}
+
+	docs := []*mockDoc{}
+	for _, t := range types {
+		if ok, err := raw.esi.TypeExists(t); err != nil || !ok {
+			continue
+		}
+		searchResult, err := raw.esi.GetAllElements(t)
+		if err != nil {
+			return nil, err
+		}
+		if searchResult == nil || searchResult.GetHits() == nil {
+			continue
+		}
+		for _, hit := range *searchResult.GetHits() {
+			doc := &mockDoc{id: hit.ID, source: hit.Source}
+			if err = json.Unmarshal(*hit.Source, &doc.fields); err != nil {
+				return nil, err
+			}
+			if query, ok := body["query"]; ok {
+				if ok, err = mockMatches(query, doc); err != nil {
+					return nil, err
+				} else if !ok {
+					continue
+				}
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	if sorts, ok := body["sort"]; ok {
+		if err := mockSort(docs, sorts); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &rawSearchResult{}
+	result.Hits.Total = int64(len(docs))
+	from, size := mockInt(body["from"], 0), mockInt(body["size"], 10)
+	for i := from; i < len(docs) && i < from+size; i++ {
+		result.Hits.Hits = append(result.Hits.Hits, struct {
+			Source *json.RawMessage `json:"_source"`
+		}{docs[i].source})
+	}
+
+	aggs, err := mockAggregations(body, docs)
+	if err != nil {
+		return nil, err
+	}
+	if len(aggs) > 0 {
+		result.Aggregations = map[string]*json.RawMessage{}
+		for name, agg := range aggs {
+			byts, err := json.Marshal(agg)
+			if err != nil {
+				return nil, err
+			}
+			msg := json.RawMessage(byts)
+			result.Aggregations[name] = &msg
+		}
+	}
+	return result, nil
+}
+
+// mockMatches is whether the document matches the query
+func mockMatches(query interface{}, doc *mockDoc) (bool, error) {
+	q, ok := query.(map[string]interface{})
+	if !ok || len(q) != 1 {
+		return false, fmt.Errorf("the mock indices cannot run the query %v", query)
+	}
+	for kind, arg := range q {
+		params, _ := arg.(map[string]interface{})
+		switch kind {
+		case "match_all":
+			return true, nil
+		case "term", "match":
+			for field, value := range params {
+				if m, ok := value.(map[string]interface{}); ok {
+					if value, ok = m["value"]; !ok {
+						value = m["query"]
+					}
+				}
+				return mockHasValue(doc, field, []interface{}{value}), nil
+			}
+		case "terms":
+			for field, values := range params {
+				return mockHasValue(doc, field, mockList(values)), nil
+			}
+		case "ids":
+			for _, id := range mockList(params["values"]) {
+				if fmt.Sprint(id) == doc.id {
+					return true, nil
+				}
+			}
+			return false, nil
+		case "exists":
+			field, _ := params["field"].(string)
+			return len(mockValues(doc.fields, field)) > 0, nil
+		case "range":
+			for field, bounds := range params {
+				b, _ := bounds.(map[string]interface{})
+				return mockInRange(mockValues(doc.fields, field), b)
+			}
+		case "constant_score":
+			return mockMatches(params["filter"], doc)
+		case "bool":
+			return mockBool(params, doc)
+		}
+		return false, fmt.Errorf("the mock indices cannot run a %s query", kind)
+	}
+	return false, nil
+}
+
+func mockBool(params map[string]interface{}, doc *mockDoc) (bool, error) {
+	for _, occur := range []string{"must", "filter"} {
+		for _, clause := range mockList(params[occur]) {
+			if ok, err := mockMatches(clause, doc); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	for _, clause := range mockList(params["must_not"]) {
+		if ok, err := mockMatches(clause, doc); err != nil || ok {
+			return false, err
+		}
+	}
+	should := mockList(params["should"])
+	minimum := 0
+	if params["must"] == nil && params["filter"] == nil && len(should) > 0 {
+		minimum = 1
+	}
+	minimum = mockInt(params["minimum_should_match"], minimum)
+	matched := 0
+	for _, clause := range should {
+		ok, err := mockMatches(clause, doc)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+	return matched >= minimum, nil
+}
+
+// mockValues returns the values of a dotted field, looking through arrays
+func mockValues(fields map[string]interface{}, field string) []interface{} {
+	values := []interface{}{fields}
+	for _, name := range strings.Split(field, ".") {
+		next := []interface{}{}
+		for _, value := range values {
+			if m, ok := value.(map[string]interface{}); ok {
+				if v, ok := m[name]; ok && v != nil {
+					next = append(next, mockList(v)...)
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func mockHasValue(doc *mockDoc, field string, wanted []interface{}) bool {
+	values := mockValues(doc.fields, field)
+	if field == "_id" {
+		values = []interface{}{doc.id}
+	}
+	for _, value := range values {
+		for _, want := range wanted {
+			if fmt.Sprint(value) == fmt.Sprint(want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mockInRange(values []interface{}, bounds map[string]interface{}) (bool, error) {
+	for _, value := range values {
+		in := true
+		for op, bound := range bounds {
+			if op == "format" || op == "time_zone" {
+				continue
+			}
+			c, ok := mockCompare(value, bound)
+			if !ok {
+				return false, fmt.Errorf("the mock indices cannot compare %v to %v", value, bound)
+			}
+			switch op {
+			case "gt":
+				in = in && c > 0
+			case "gte":
+				in = in && c >= 0
+			case "lt":
+				in = in && c < 0
+			case "lte":
+				in = in && c <= 0
+			default:
+				return false, fmt.Errorf("the mock indices cannot run a range with %s", op)
+			}
+		}
+		if in {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mockCompare orders two values as Elasticsearch would: numbers as numbers, dates as
+// dates, and anything else as strings
+func mockCompare(a interface{}, b interface{}) (int, bool) {
+	if x, ok := mockNumber(a); ok {
+		if y, ok := mockNumber(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	x, xok := a.(string)
+	y, yok := b.(string)
+	if !xok || !yok {
+		return 0, false
+	}
+	return strings.Compare(x, y), true
+}
+
+// mockNumber reads numbers, and dates as milliseconds since the epoch
+func mockNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, n); err == nil {
+			return float64(epochMillis(t)), true
+		}
+	}
+	return 0, false
+}
+
+func mockList(v interface{}) []interface{} {
+	switch l := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return l
+	case []string:
+		list := make([]interface{}, len(l))
+		for i, s := range l {
+			list[i] = s
+		}
+		return list
+	}
+	return []interface{}{v}
+}
+
+func mockInt(v interface{}, def int) int {
+	if n, ok := mockNumber(v); ok {
+		return int(n)
+	}
+	return def
+}
+
+// mockSort orders the documents by the sort clauses of a search
+func mockSort(docs []*mockDoc, sorts interface{}) error {
+	type key struct {
+		field string
+		desc  bool
+	}
+	keys := []key{}
+	for _, s := range mockList(sorts) {
+		switch spec := s.(type) {
+		case string:
+			keys = append(keys, key{field: spec})
+		case map[string]interface{}:
+			for field, order := range spec {
+				if m, ok := order.(map[string]interface{}); ok {
+					order = m["order"]
+				}
+				keys = append(keys, key{field: field, desc: order == "desc"})
+			}
+		default:
+			return fmt.Errorf("the mock indices cannot sort by %v", s)
+		}
+	}
+	sort.Stable(mockDocs{docs, func(a *mockDoc, b *mockDoc) bool {
+		for _, k := range keys {
+			x, y := mockValues(a.fields, k.field), mockValues(b.fields, k.field)
+			if len(x) == 0 || len(y) == 0 {
+				if len(x) != len(y) {
+					// missing values sort last
+					return len(y) == 0
+				}
+				continue
+			}
+			c, _ := mockCompare(x[0], y[0])
+			if c != 0 {
+				return (c < 0) != k.desc
+			}
+		}
+		return false
+	}})
+	return nil
+}
+
+type mockDocs struct {
+	docs []*mockDoc
+	less func(*mockDoc, *mockDoc) bool
+}
+
+func (d mockDocs) Len() int           { return len(d.docs) }
+func (d mockDocs) Swap(i, j int)      { d.docs[i], d.docs[j] = d.docs[j], d.docs[i] }
+func (d mockDocs) Less(i, j int) bool { return d.less(d.docs[i], d.docs[j]) }
+
+type mockTermOrder struct {
+	names  []string
+	groups map[string][]*mockDoc
+}
+
+func (o mockTermOrder) Len() int      { return len(o.names) }
+func (o mockTermOrder) Swap(i, j int) { o.names[i], o.names[j] = o.names[j], o.names[i] }
+func (o mockTermOrder) Less(i, j int) bool {
+	return len(o.groups[o.names[i]]) > len(o.groups[o.names[j]])
+}
+
+type mockKeys []int64
+
+func (k mockKeys) Len() int           { return len(k) }
+func (k mockKeys) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
+func (k mockKeys) Less(i, j int) bool { return k[i] < k[j] }
+
+// mockAggregations runs the aggregations of a search, or of an enclosing
+// aggregation, over the documents
+func mockAggregations(body map[string]interface{}, docs []*mockDoc) (map[string]interface{}, error) {
+	specs, ok := body["aggs"].(map[string]interface{})
+	if !ok {
+		specs, _ = body["aggregations"].(map[string]interface{})
+	}
+	results := map[string]interface{}{}
+	for name, s := range specs {
+		spec, _ := s.(map[string]interface{})
+		result, err := mockAggregation(spec, docs)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		results[name] = result
+	}
+	return results, nil
+}
+
+func mockAggregation(spec map[string]interface{}, docs []*mockDoc) (map[string]interface{}, error) {
+	bucket := func(key interface{}, docs []*mockDoc) (map[string]interface{}, error) {
+		b, err := mockAggregations(spec, docs)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			b["key"] = key
+		}
+		b["doc_count"] = len(docs)
+		return b, nil
+	}
+
+	if filter, ok := spec["filter"]; ok {
+		matched := []*mockDoc{}
+		for _, doc := range docs {
+			ok, err := mockMatches(filter, doc)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, doc)
+			}
+		}
+		return bucket(nil, matched)
+	}
+
+	if terms, ok := spec["terms"].(map[string]interface{}); ok {
+		field, _ := terms["field"].(string)
+		groups := map[string][]*mockDoc{}
+		keys := map[string]interface{}{}
+		for _, doc := range docs {
+			seen := map[string]bool{}
+			for _, value := range mockValues(doc.fields, field) {
+				k := fmt.Sprint(value)
+				if !seen[k] {
+					seen[k] = true
+					groups[k] = append(groups[k], doc)
+					keys[k] = value
+				}
+			}
+		}
+		names := make([]string, 0, len(groups))
+		for k := range groups {
+			names = append(names, k)
+		}
+		// largest first, then by key
+		sort.Strings(names)
+		sort.Stable(mockTermOrder{names, groups})
+		if size := mockInt(terms["size"], 10); size > 0 && len(names) > size {
+			names = names[:size]
+		}
+		buckets := []interface{}{}
+		for _, k := range names {
+			b, err := bucket(keys[k], groups[k])
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, b)
+		}
+		return map[string]interface{}{"buckets": buckets}, nil
+	}
+
+	if hist, ok := spec["date_histogram"].(map[string]interface{}); ok {
+		field, _ := hist["field"].(string)
+		width, err := mockMillis(hist["interval"])
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("the mock indices cannot use the interval %v", hist["interval"])
+		}
+		offset, err := mockMillis(hist["offset"])
+		if err != nil {
+			return nil, err
+		}
+		start := func(ms int64) int64 {
+			k := ms - offset
+			k -= (k%width + width) % width
+			return k + offset
+		}
+		groups := map[int64][]*mockDoc{}
+		for _, doc := range docs {
+			for _, value := range mockValues(doc.fields, field) {
+				if ms, ok := mockNumber(value); ok {
+					k := start(int64(ms))
+					groups[k] = append(groups[k], doc)
+					break
+				}
+			}
+		}
+		keys := []int64{}
+		for k := range groups {
+			keys = append(keys, k)
+		}
+		if bounds, ok := hist["extended_bounds"].(map[string]interface{}); ok && mockInt(hist["min_doc_count"], 1) == 0 {
+			min, minOK := mockNumber(bounds["min"])
+			max, maxOK := mockNumber(bounds["max"])
+			if minOK && maxOK {
+				for k := start(int64(min)); k <= int64(max); k += width {
+					if _, ok := groups[k]; !ok {
+						groups[k] = nil
+						keys = append(keys, k)
+					}
+				}
+			}
+		}
+		sort.Sort(mockKeys(keys))
+		buckets := []interface{}{}
+		for _, k := range keys {
+			b, err := bucket(k, groups[k])
+			if err != nil {
+				return nil, err
+			}
+			buckets = append(buckets, b)
+		}
+		return map[string]interface{}{"buckets": buckets}, nil
+	}
+
+	return nil, fmt.Errorf("the mock indices cannot run the aggregation %v", spec)
+}
+
+// mockMillis reads an interval or offset in the form "<n>ms"
+func mockMillis(v interface{}) (int64, error) {
+	if v == nil {
+		return 0, nil
+	}
+	s, _ := v.(string)
+	if !strings.HasSuffix(s, "ms") {
+		return 0, fmt.Errorf("the mock indices cannot use the interval %v", v)
+	}
+	return strconv.ParseInt(strings.TrimSuffix(s, "ms"), 10, 64)
+}
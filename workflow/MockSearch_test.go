@@ -0,0 +1,93 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+)
+
+func TestMockSearch(t *testing.T) {
+	assert := assert.New(t)
+
+	esi := elasticsearch.NewMockIndex("alerts")
+	assert.NoError(esi.SetMapping("Alert", "{}"))
+	base := time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, alert := range []map[string]interface{}{
+		{"alertId": "a1", "triggerId": "t1", "status": "open", "createdOn": base.Add(10 * time.Minute).Format(time.RFC3339)},
+		{"alertId": "a2", "triggerId": "t1", "status": "resolved", "createdOn": base.Add(70 * time.Minute).Format(time.RFC3339)},
+		{"alertId": "a3", "triggerId": "t2", "createdOn": base.Add(80 * time.Minute).Format(time.RFC3339)},
+		{"alertId": "a4", "triggerId": "t3", "status": "open", "createdOn": base.Add(-time.Hour).Format(time.RFC3339)},
+	} {
+		_, err := esi.PostData("Alert", alert["alertId"].(string), alert)
+		assert.NoError(err, i)
+	}
+	raw := newRawIndex(nil, esi)
+
+	since := base.Format(time.RFC3339)
+	result, err := raw.Search("Alert", map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gte": since}}},
+			statusClause([]string{AlertStatusOpen}),
+		}}},
+		"sort": []interface{}{map[string]interface{}{"createdOn": "desc"}},
+		"size": 1,
+		"aggs": map[string]interface{}{
+			"byTrigger": map[string]interface{}{"terms": map[string]interface{}{"field": "triggerId", "size": 0}},
+			"hourly":    dateHistogramAgg("createdOn", time.Hour, base, base.Add(2*time.Hour)),
+			"t1":        map[string]interface{}{"filter": map[string]interface{}{"term": map[string]interface{}{"triggerId": "t1"}}},
+		},
+	})
+	assert.NoError(err)
+
+	// a1, and a3 which has no status
+	assert.Equal(int64(2), result.Hits.Total)
+	assert.Len(result.Hits.Hits, 1)
+	var alert Alert
+	assert.NoError(json.Unmarshal(*result.Hits.Hits[0].Source, &alert))
+	assert.EqualValues("a3", alert.AlertID)
+
+	byTrigger, err := result.Aggregation("byTrigger")
+	assert.NoError(err)
+	assert.Len(byTrigger.Buckets, 2)
+	assert.Equal("t1", byTrigger.Buckets[0].Key)
+
+	hourly, err := result.Aggregation("hourly")
+	assert.NoError(err)
+	assert.Equal(map[int64]int64{
+		epochMillis(base):                    1,
+		epochMillis(base.Add(time.Hour)):     1,
+		epochMillis(base.Add(2 * time.Hour)): 0,
+	}, hourly.bucketCounts())
+
+	t1, err := result.Aggregation("t1")
+	assert.NoError(err)
+	assert.Equal(int64(1), t1.DocCount)
+
+	result, err = raw.Search("Alert", map[string]interface{}{
+		"query": map[string]interface{}{"terms": map[string]interface{}{"triggerId": []string{"t2", "t3"}}},
+		"size":  0,
+	})
+	assert.NoError(err)
+	assert.Equal(int64(2), result.Hits.Total)
+	assert.Len(result.Hits.Hits, 0)
+
+	_, err = raw.Search("Alert", map[string]interface{}{"query": map[string]interface{}{"geo_shape": map[string]interface{}{}}})
+	assert.Error(err)
+}
@@ -0,0 +1,171 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// An array of objects is written in a mapping as an array holding the mapping of its
+// elements, e.g. {"detections": [{"class": "string", "score": "double"}]}. It is stored
+// with the Elasticsearch nested type, so that a query can match several fields of one
+// element, and such a query must then be wrapped in a nested query.
+
+var arrayIndexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// nestedMapping returns the element mapping of an array of objects
+func nestedMapping(v interface{}) (map[string]interface{}, bool) {
+	arr, ok := v.([]interface{})
+	if !ok || len(arr) != 1 {
+		return nil, false
+	}
+	obj, ok := arr[0].(map[string]interface{})
+	return obj, ok
+}
+
+// mappingVars flattens a mapping to the dotted paths of its leaves, as
+// piazza.GetVarsFromStruct does, but looking inside arrays of objects as well. An
+// array that is not a single object is returned as a leaf, to be rejected as a type.
+func mappingVars(mapping map[string]interface{}) map[string]interface{} {
+	vars := map[string]interface{}{}
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if obj, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", obj)
+			} else if elem, ok := nestedMapping(v); ok {
+				walk(prefix+k+".", elem)
+			} else {
+				vars[prefix+k] = v
+			}
+		}
+	}
+	walk("", mapping)
+	return vars
+}
+
+// mappingNodeAt returns the mapping of the field at the dotted path, along with the
+// paths of the arrays of objects holding it, outermost first
+func mappingNodeAt(mapping map[string]interface{}, path string) (interface{}, []string, bool) {
+	var node interface{} = mapping
+	nested := []string{}
+	parts := strings.Split(path, ".")
+	for i, part := range parts {
+		if elem, ok := nestedMapping(node); ok {
+			nested = append(nested, strings.Join(parts[:i], "."))
+			node = elem
+		}
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, nil, false
+		}
+		if node, ok = obj[part]; !ok {
+			return nil, nil, false
+		}
+	}
+	return node, nested, true
+}
+
+// nestedPathsOf returns the paths of the arrays of objects holding the field at
+// the dotted path, outermost first
+func nestedPathsOf(mapping map[string]interface{}, path string) []string {
+	_, nested, _ := mappingNodeAt(mapping, path)
+	return nested
+}
+
+// isNestedField is true for a field that is itself an array of objects
+func isNestedField(mapping map[string]interface{}, path string) bool {
+	node, _, ok := mappingNodeAt(mapping, path)
+	if !ok {
+		return false
+	}
+	_, ok = nestedMapping(node)
+	return ok
+}
+
+// specPath is the field spec name of a data path, "data.a[2].b" becoming "a.b"
+func specPath(field string) string {
+	return strings.TrimPrefix(arrayIndexPattern.ReplaceAllString(field, ""), "data.")
+}
+
+// nestedQuery wraps a clause on a field inside arrays of objects in the nested
+// queries that reach it, innermost first. stored maps a data path to where it is stored.
+func nestedQuery(clause map[string]interface{}, nested []string, stored func(string) string) map[string]interface{} {
+	for i := len(nested) - 1; i >= 0; i-- {
+		clause = map[string]interface{}{
+			"nested": map[string]interface{}{
+				"path":  stored(nested[i]),
+				"query": clause,
+			},
+		}
+	}
+	return clause
+}
+
+// checkNestedCondition finds the fields of a trigger condition that are inside an
+// array of objects but not inside a nested query on that array, which Elasticsearch
+// would quietly never match, and the nested queries whose path is not such an array
+func checkNestedCondition(mapping map[string]interface{}, condition map[string]interface{}) []string {
+	violations := []string{}
+	var walk func(node interface{}, context string)
+	walk = func(node interface{}, context string) {
+		switch t := node.(type) {
+		case []interface{}:
+			for _, v := range t {
+				walk(v, context)
+			}
+		case map[string]interface{}:
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				v := t[k]
+				if nested, ok := v.(map[string]interface{}); ok && k == "nested" {
+					path, _ := nested["path"].(string)
+					if !strings.HasPrefix(path, "data.") || !isNestedField(mapping, strings.TrimPrefix(path, "data.")) {
+						violations = append(violations, fmt.Sprintf("nested path %q is not an array of objects of the eventType", path))
+						continue
+					}
+					walk(nested["query"], strings.TrimPrefix(path, "data."))
+					walk(nested["filter"], strings.TrimPrefix(path, "data."))
+					continue
+				}
+				if strings.HasPrefix(k, "data.") {
+					if _, nested, ok := mappingNodeAt(mapping, strings.TrimPrefix(k, "data.")); ok {
+						innermost := ""
+						if len(nested) > 0 {
+							innermost = nested[len(nested)-1]
+						}
+						if innermost != context {
+							if innermost == "" {
+								violations = append(violations, fmt.Sprintf("%s is not inside the array data.%s, so cannot be used in its nested query", k, context))
+							} else {
+								violations = append(violations, fmt.Sprintf("%s is inside an array of objects, so needs a nested query with path data.%s", k, innermost))
+							}
+						}
+					}
+				}
+				walk(v, context)
+			}
+		}
+	}
+	walk(condition, "")
+	return violations
+}
@@ -0,0 +1,170 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nestedTestMapping(t *testing.T) map[string]interface{} {
+	mapping := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(`{
+		"name": "string",
+		"detections": [{
+			"class": "string",
+			"score": "double",
+			"parts": [{"label": "string"}]
+		}]
+	}`), &mapping); err != nil {
+		t.Fatal(err)
+	}
+	return mapping
+}
+
+func TestNestedMappingPaths(t *testing.T) {
+	assert := assert.New(t)
+	mapping := nestedTestMapping(t)
+
+	assert.Equal(map[string]interface{}{
+		"name":                   "string",
+		"detections.class":       "string",
+		"detections.score":       "double",
+		"detections.parts.label": "string",
+	}, mappingVars(mapping))
+
+	typ, ok := mappingTypeAt(mapping, "detections.parts.label")
+	assert.True(ok)
+	assert.Equal("string", typ)
+	assert.Equal([]string{"detections", "detections.parts"}, nestedPathsOf(mapping, "detections.parts.label"))
+	assert.Empty(nestedPathsOf(mapping, "name"))
+	assert.True(isNestedField(mapping, "detections"))
+	assert.False(isNestedField(mapping, "detections.class"))
+	assert.Equal("detections.parts.label", specPath("data.detections[3].parts[0].label"))
+
+	stored := func(f string) string { return "data.T." + f }
+	clause := map[string]interface{}{"term": "x"}
+	assert.Equal(map[string]interface{}{
+		"nested": map[string]interface{}{
+			"path": "data.T.detections",
+			"query": map[string]interface{}{
+				"nested": map[string]interface{}{"path": "data.T.detections.parts", "query": clause},
+			},
+		},
+	}, nestedQuery(clause, nestedPathsOf(mapping, "detections.parts.label"), stored))
+}
+
+func TestBuildNestedMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	esdsl, err := buildMapping(nestedTestMapping(t))
+	assert.NoError(err)
+	detections := esdsl["detections"].(map[string]interface{})
+	assert.Equal("nested", detections["type"])
+	assert.Equal("strict", detections["dynamic"])
+	parts := detections["properties"].(map[string]interface{})["parts"].(map[string]interface{})
+	assert.Equal("nested", parts["type"])
+
+	_, err = buildMapping(map[string]interface{}{"bad": []interface{}{"string", "long"}})
+	assert.Error(err)
+}
+
+func TestValidateNestedEventData(t *testing.T) {
+	assert := assert.New(t)
+	mapping := nestedTestMapping(t)
+	specs := fieldSpecsByPath([]FieldSpec{
+		{Name: "detections.parts", Optional: true},
+		{Name: "detections.class", Enum: []interface{}{"car", "boat"}},
+	})
+
+	data := map[string]interface{}{}
+	assert.NoError(json.Unmarshal([]byte(`{
+		"name": "a",
+		"detections": [
+			{"class": "car", "score": 0.5, "parts": [{"label": "wheel"}]},
+			{"class": "boat", "score": 1},
+			null
+		]
+	}`), &data))
+	assert.Empty(validateEventData(mapping, specs, data))
+
+	assert.NoError(json.Unmarshal([]byte(`{
+		"name": "a",
+		"detections": [
+			{"class": "plane", "score": "high", "extra": 1},
+			"car"
+		]
+	}`), &data))
+	assert.Equal([]string{
+		"data.detections[0].class: plane is not one of [car boat]",
+		"data.detections[0].score: expected a number, got the string \"high\"",
+		"data.detections[0].extra: field is not in the eventType",
+		"data.detections[1]: expected an object, got the string \"car\"",
+	}, validateEventData(mapping, specs, data))
+}
+
+func TestNestedFieldSpecs(t *testing.T) {
+	assert := assert.New(t)
+	mapping := nestedTestMapping(t)
+
+	assert.NoError(validateFieldSpecs(mapping, []FieldSpec{
+		{Name: "detections", Optional: true},
+		{Name: "detections.score", Optional: true, Enum: []interface{}{1.0}},
+	}))
+	assert.Error(validateFieldSpecs(mapping, []FieldSpec{{Name: "detections", Default: 1}}))
+	assert.Error(validateFieldSpecs(mapping, []FieldSpec{{Name: "detections.class", Default: "car"}}))
+
+	updated := nestedTestMapping(t)
+	updated["detections"].([]interface{})[0].(map[string]interface{})["size"] = "long"
+	violations, retyped := checkMappingCompatible(mapping, updated, nil)
+	assert.Equal([]string{"detections.size: a new field must be optional, defaulted or computed"}, violations)
+	assert.Empty(retyped)
+
+	updated["detections"] = map[string]interface{}{"class": "string"}
+	_, retyped = checkMappingCompatible(mapping, updated, nil)
+	assert.Equal([]string{"detections: type cannot change from array of objects to object"}, retyped)
+}
+
+func TestCheckNestedCondition(t *testing.T) {
+	assert := assert.New(t)
+	mapping := nestedTestMapping(t)
+
+	condition := map[string]interface{}{}
+	assert.NoError(json.Unmarshal([]byte(`{
+		"bool": {"must": [
+			{"match": {"data.name": "a"}},
+			{"nested": {"path": "data.detections", "query": {"bool": {"must": [
+				{"term": {"data.detections.class": "car"}},
+				{"range": {"data.detections.score": {"gte": 0.8}}}
+			]}}}}
+		]}
+	}`), &condition))
+	assert.Empty(checkNestedCondition(mapping, condition))
+
+	assert.NoError(json.Unmarshal([]byte(`{
+		"bool": {"must": [
+			{"term": {"data.detections.class": "car"}},
+			{"nested": {"path": "data.detections", "query": {"match": {"data.name": "a"}}}},
+			{"nested": {"path": "data.name", "query": {"match_all": {}}}}
+		]}
+	}`), &condition))
+	assert.Equal([]string{
+		"data.detections.class is inside an array of objects, so needs a nested query with path data.detections",
+		"data.name is not inside the array data.detections, so cannot be used in its nested query",
+		"nested path \"data.name\" is not an array of objects of the eventType",
+	}, checkNestedCondition(mapping, condition))
+}
@@ -0,0 +1,482 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// The SMTP server alerts are mailed through, as host:port, and who they are from.
+// Without a server, subscriptions cannot use the smtp channel.
+const (
+	notifySMTPAddrEnv = "NOTIFY_SMTP_ADDR"
+	notifySMTPFromEnv = "NOTIFY_SMTP_FROM"
+)
+
+const defaultNotifySMTPFrom = "pz-workflow@localhost"
+
+const (
+	// alerts are matched and deliveries attempted by this many workers
+	notifyWorkers = 4
+
+	// the queues are this long; a full queue makes the sender wait, not the poster
+	notifyQueueSize = 1000
+
+	// a delivery that fails this many times is given up on
+	maxDeliveryAttempts = 10
+
+	// a webhook or mail server that takes longer than this has failed
+	deliveryTimeout = 10 * time.Second
+
+	// at startup, the alerts this recent are matched again, in case this instance
+	// stopped before recording their deliveries
+	notifyRecoveryWindow = 24 * time.Hour
+
+	// an alert is delivered to at most this many subscriptions
+	maxSubscriptionsPerAlert = 1000
+)
+
+// retries wait twice as long each time, from deliveryBackoffBase up to
+// deliveryBackoffMax; vars, so that tests need not wait
+var (
+	deliveryBackoffBase = 5 * time.Second
+	deliveryBackoffMax  = 30 * time.Minute
+)
+
+// notificationSender sends an alert through one kind of channel
+type notificationSender interface {
+	send(subscription *Subscription, alert *Alert, delivery *Delivery) error
+}
+
+// pendingAlert is an alert whose deliveries are yet to be recorded
+type pendingAlert struct {
+	alert    *Alert
+	attempts int
+}
+
+// notifier delivers alerts to their subscriptions, at least once. Alerts are
+// handed to it without waiting, so that posting events is not slowed. Each delivery
+// is stored before it is first attempted, and again after each attempt, so that the
+// pending ones can be resumed when the service restarts.
+type notifier struct {
+	service    *Service
+	alerts     chan *pendingAlert
+	deliveries chan *Delivery
+	senders    map[string]notificationSender
+}
+
+func newNotifier(service *Service) *notifier {
+	n := &notifier{
+		service:    service,
+		alerts:     make(chan *pendingAlert, notifyQueueSize),
+		deliveries: make(chan *Delivery, notifyQueueSize),
+		senders: map[string]notificationSender{
+			ChannelWebhook: &webhookSender{client: &http.Client{Timeout: deliveryTimeout}},
+		},
+	}
+	if addr := os.Getenv(notifySMTPAddrEnv); addr != "" {
+		from := os.Getenv(notifySMTPFromEnv)
+		if from == "" {
+			from = defaultNotifySMTPFrom
+		}
+		n.senders[ChannelSMTP] = &smtpSender{addr: addr, from: from}
+	}
+	return n
+}
+
+// start runs the workers and resumes the deliveries left by an earlier run
+func (n *notifier) start() {
+	for i := 0; i < notifyWorkers; i++ {
+		go n.work()
+	}
+	go n.recover()
+}
+
+func (n *notifier) work() {
+	for {
+		select {
+		case pending := <-n.alerts:
+			n.matchAlert(pending)
+		case delivery := <-n.deliveries:
+			n.attempt(delivery)
+		}
+	}
+}
+
+// alertPosted queues a new alert for delivery without waiting
+func (n *notifier) alertPosted(alert *Alert) {
+	n.queueAlert(&pendingAlert{alert: alert}, 0)
+}
+
+func (n *notifier) queueAlert(pending *pendingAlert, delay time.Duration) {
+	if delay > 0 {
+		time.AfterFunc(delay, func() { n.alerts <- pending })
+		return
+	}
+	select {
+	case n.alerts <- pending:
+	default:
+		go func() { n.alerts <- pending }()
+	}
+}
+
+func (n *notifier) queueDelivery(delivery *Delivery, delay time.Duration) {
+	if delay > 0 {
+		time.AfterFunc(delay, func() { n.deliveries <- delivery })
+		return
+	}
+	select {
+	case n.deliveries <- delivery:
+	default:
+		go func() { n.deliveries <- delivery }()
+	}
+}
+
+// deliveryBackoff is how long to wait after the given number of failed attempts
+func deliveryBackoff(attempts int) time.Duration {
+	wait := deliveryBackoffBase
+	for i := 1; i < attempts && wait < deliveryBackoffMax; i++ {
+		wait *= 2
+	}
+	if wait > deliveryBackoffMax {
+		wait = deliveryBackoffMax
+	}
+	return wait
+}
+
+// deliveryID is the same each time an alert is matched to a subscription, so that
+// matching it again does not deliver it again
+func deliveryID(alertID piazza.Ident, subscriptionID piazza.Ident) piazza.Ident {
+	return piazza.Ident(alertID.String() + "_" + subscriptionID.String())
+}
+
+// matchAlert records a pending delivery of the alert to each of its subscriptions
+func (n *notifier) matchAlert(pending *pendingAlert) {
+	service := n.service
+	alert := pending.alert
+
+	retry := func(err error) {
+		pending.attempts++
+		if pending.attempts >= maxDeliveryAttempts {
+			service.syslogger.Error("Notifier: gave up matching alert %s to subscriptions: %s", alert.AlertID, err)
+			return
+		}
+		service.syslogger.Warning("Notifier: could not match alert %s to subscriptions: %s", alert.AlertID, err)
+		n.queueAlert(pending, deliveryBackoff(pending.attempts))
+	}
+
+	var eventTypeID piazza.Ident
+	trigger, found, err := service.triggerDB.GetOne(alert.TriggerID, "pz-workflow")
+	if err == nil && found {
+		eventTypeID = trigger.EventTypeID
+	}
+
+	dsl, err := subscriptionQuery(alert, eventTypeID)
+	if err != nil {
+		retry(err)
+		return
+	}
+	subscriptions, hits, err := service.subscriptionDB.GetSubscriptionsByDslQuery(dsl, "pz-workflow")
+	if err != nil {
+		retry(err)
+		return
+	}
+	if hits > int64(len(subscriptions)) {
+		service.syslogger.Warning("Notifier: alert %s matches %d subscriptions; only %d are delivered to", alert.AlertID, hits, len(subscriptions))
+	}
+
+	for i := range subscriptions {
+		subscription := &subscriptions[i]
+		id := deliveryID(alert.AlertID, subscription.SubscriptionID)
+		exists, err := service.deliveryDB.itemExists(id, "pz-workflow")
+		if err != nil {
+			retry(err)
+			return
+		}
+		if exists {
+			continue
+		}
+
+		now := piazza.NewTimeStamp()
+		delivery := &Delivery{
+			DeliveryID:     id,
+			AlertID:        alert.AlertID,
+			SubscriptionID: subscription.SubscriptionID,
+			Channel:        subscription.Channel.Type,
+			Status:         DeliveryPending,
+			Attempts:       []DeliveryAttempt{},
+			NextAttemptOn:  &now,
+			CreatedOn:      now,
+		}
+		if err = service.deliveryDB.PostData(delivery); err != nil {
+			retry(err)
+			return
+		}
+		n.queueDelivery(delivery, 0)
+	}
+}
+
+// subscriptionQuery finds the subscriptions an alert is delivered to: those made
+// before it, and whose criteria are either not given or match it
+func subscriptionQuery(alert *Alert, eventTypeID piazza.Ident) (string, error) {
+	createdOn, err := esTime(time.Time(alert.CreatedOn))
+	if err != nil {
+		return "", err
+	}
+	matchOrMissing := func(field string, value string) interface{} {
+		missing := map[string]interface{}{"bool": map[string]interface{}{
+			"must_not": map[string]interface{}{"exists": map[string]interface{}{"field": field}},
+		}}
+		if value == "" {
+			return missing
+		}
+		return map[string]interface{}{"bool": map[string]interface{}{
+			"should": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{field: value}},
+				missing,
+			},
+			"minimum_should_match": 1,
+		}}
+	}
+	dsl := map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"lte": createdOn}}},
+			matchOrMissing("triggerId", alert.TriggerID.String()),
+			matchOrMissing("eventTypeId", eventTypeID.String()),
+			matchOrMissing("alertCreatedBy", alert.CreatedBy),
+		}}},
+		"size": maxSubscriptionsPerAlert,
+	}
+	byts, err := json.Marshal(dsl)
+	if err != nil {
+		return "", err
+	}
+	return string(byts), nil
+}
+
+// undeliverableError is a failure that trying again would not fix
+type undeliverableError struct {
+	error
+}
+
+// attempt tries a delivery once, and schedules another try if it fails
+func (n *notifier) attempt(delivery *Delivery) {
+	service := n.service
+
+	err := n.send(delivery)
+	now := piazza.NewTimeStamp()
+	attempt := DeliveryAttempt{AttemptedOn: now}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	_, undeliverable := err.(undeliverableError)
+
+	var retryIn time.Duration
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.DeliveredOn = &now
+		delivery.NextAttemptOn = nil
+		service.syslogger.Audit("pz-workflow", "deliveredAlert", delivery.AlertID, "Notifier: delivered alert [%s] to subscription [%s]", delivery.AlertID, delivery.SubscriptionID)
+	case undeliverable || len(delivery.Attempts) >= maxDeliveryAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptOn = nil
+		service.syslogger.Audit("pz-workflow", "deliveringAlertFailure", delivery.AlertID, "Notifier: gave up delivering alert [%s] to subscription [%s]", delivery.AlertID, delivery.SubscriptionID)
+		service.syslogger.Warning("Notifier: gave up delivering alert %s to subscription %s after %d attempts: %s", delivery.AlertID, delivery.SubscriptionID, len(delivery.Attempts), err)
+	default:
+		retryIn = deliveryBackoff(len(delivery.Attempts))
+		next := piazza.TimeStamp(time.Time(now).Add(retryIn))
+		delivery.NextAttemptOn = &next
+	}
+
+	if err := service.deliveryDB.PutData(delivery); err != nil {
+		service.syslogger.Warning("Notifier: could not record delivery %s: %s", delivery.DeliveryID, err)
+	}
+	if retryIn > 0 {
+		n.queueDelivery(delivery, retryIn)
+	}
+}
+
+// send sends the delivery's alert through its subscription's channel. A delivery
+// whose subscription or alert has since been deleted, or whose channel this instance
+// has no sender for, fails at once.
+func (n *notifier) send(delivery *Delivery) error {
+	service := n.service
+
+	subscription, found, err := service.subscriptionDB.GetOne(delivery.SubscriptionID, "pz-workflow")
+	if !found {
+		return undeliverableError{fmt.Errorf("subscription %s no longer exists", delivery.SubscriptionID)}
+	}
+	if err != nil {
+		return err
+	}
+	alert, found, err := service.alertDB.GetOne(delivery.AlertID, "pz-workflow")
+	if !found {
+		return undeliverableError{fmt.Errorf("alert %s no longer exists", delivery.AlertID)}
+	}
+	if err != nil {
+		return err
+	}
+
+	sender := n.senders[subscription.Channel.Type]
+	if sender == nil {
+		return undeliverableError{fmt.Errorf("no %s channel is configured", subscription.Channel.Type)}
+	}
+	return sender.send(subscription, alert, delivery)
+}
+
+// recover resumes the pending deliveries, and matches the recent alerts again
+func (n *notifier) recover() {
+	service := n.service
+
+	after := ""
+	for {
+		deliveries, _, err := service.deliveryDB.GetDeliveriesByDslQuery(termPageQuery("status", piazza.Ident(DeliveryPending), "deliveryId", after, cascadePageSize), "pz-workflow")
+		if err != nil {
+			service.syslogger.Warning("Notifier: could not resume the pending deliveries: %s", err)
+			break
+		}
+		if len(deliveries) == 0 {
+			break
+		}
+		after = deliveries[len(deliveries)-1].DeliveryID.String()
+		for i := range deliveries {
+			delivery := &deliveries[i]
+			var wait time.Duration
+			if delivery.NextAttemptOn != nil {
+				wait = time.Time(*delivery.NextAttemptOn).Sub(time.Now())
+			}
+			n.queueDelivery(delivery, wait)
+		}
+	}
+
+	since, err := esTime(time.Now().Add(-notifyRecoveryWindow))
+	if err != nil {
+		return
+	}
+	after = ""
+	for {
+		must := []interface{}{
+			map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gte": since}}},
+		}
+		if after != "" {
+			must = append(must, map[string]interface{}{"range": map[string]interface{}{"alertId": map[string]interface{}{"gt": after}}})
+		}
+		dsl, err := json.Marshal(map[string]interface{}{
+			"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+			"sort":  []interface{}{map[string]interface{}{"alertId": "asc"}},
+			"size":  cascadePageSize,
+		})
+		if err != nil {
+			return
+		}
+		alerts, _, err := service.alertDB.GetAlertsByDslQuery(string(dsl), "pz-workflow")
+		if err != nil {
+			service.syslogger.Warning("Notifier: could not match the recent alerts again: %s", err)
+			return
+		}
+		if len(alerts) == 0 {
+			return
+		}
+		after = alerts[len(alerts)-1].AlertID.String()
+		for i := range alerts {
+			n.queueAlert(&pendingAlert{alert: &alerts[i]}, 0)
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+
+// webhookSender POSTs the alert to the subscription's URL. Since an alert may be
+// delivered more than once, the delivery id is sent for the receiver to drop repeats.
+type webhookSender struct {
+	client *http.Client
+}
+
+// WebhookNotification is the body POSTed to a webhook
+type WebhookNotification struct {
+	DeliveryID     piazza.Ident `json:"deliveryId"`
+	SubscriptionID piazza.Ident `json:"subscriptionId"`
+	Alert          *Alert       `json:"alert"`
+}
+
+func (s *webhookSender) send(subscription *Subscription, alert *Alert, delivery *Delivery) error {
+	byts, err := json.Marshal(&WebhookNotification{
+		DeliveryID:     delivery.DeliveryID,
+		SubscriptionID: subscription.SubscriptionID,
+		Alert:          alert,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", subscription.Channel.URL, bytes.NewReader(byts))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Delivery-Id", delivery.DeliveryID.String())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpSender mails the alert to the subscription's addresses
+type smtpSender struct {
+	addr string
+	from string
+}
+
+func (s *smtpSender) send(subscription *Subscription, alert *Alert, delivery *Delivery) error {
+	byts, err := json.MarshalIndent(alert, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(subscription.Channel.To, ", "))
+	fmt.Fprintf(&msg, "Subject: Alert %s from trigger %s\r\n", alert.AlertID, alert.TriggerID)
+	fmt.Fprintf(&msg, "X-Delivery-Id: %s\r\n", delivery.DeliveryID)
+	fmt.Fprintf(&msg, "Content-Type: application/json; charset=utf-8\r\n\r\n")
+	msg.Write(byts)
+	msg.WriteString("\r\n")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, nil, s.from, subscription.Channel.To, msg.Bytes())
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(deliveryTimeout):
+		return fmt.Errorf("mail server %s timed out", s.addr)
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestDeliveryBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(5*time.Second, deliveryBackoff(1))
+	assert.Equal(10*time.Second, deliveryBackoff(2))
+	assert.Equal(40*time.Second, deliveryBackoff(4))
+	assert.Equal(30*time.Minute, deliveryBackoff(maxDeliveryAttempts))
+	assert.Equal(30*time.Minute, deliveryBackoff(100))
+
+	assert.Equal(piazza.Ident("a1_s1"), deliveryID("a1", "s1"))
+}
+
+func TestValidateSubscription(t *testing.T) {
+	assert := assert.New(t)
+
+	webhook := NotificationChannel{Type: ChannelWebhook, URL: "https://example.com/hook"}
+	mail := NotificationChannel{Type: ChannelSMTP, To: []string{"ops@example.com"}}
+
+	assert.NoError(validateSubscription(&Subscription{TriggerID: "t1", Channel: webhook}, false))
+	assert.NoError(validateSubscription(&Subscription{AlertCreatedBy: "someone", Channel: mail}, true))
+
+	assert.Error(validateSubscription(&Subscription{Channel: webhook}, false))
+	assert.Error(validateSubscription(&Subscription{TriggerID: "t1", Channel: mail}, false))
+	assert.Error(validateSubscription(&Subscription{TriggerID: "t1", Channel: NotificationChannel{Type: ChannelWebhook, URL: "ftp://example.com"}}, false))
+	assert.Error(validateSubscription(&Subscription{TriggerID: "t1", Channel: NotificationChannel{Type: ChannelWebhook, URL: "http:///nohost"}}, false))
+	assert.Error(validateSubscription(&Subscription{TriggerID: "t1", Channel: NotificationChannel{Type: ChannelSMTP}}, true))
+	assert.Error(validateSubscription(&Subscription{TriggerID: "t1", Channel: NotificationChannel{Type: ChannelSMTP, To: []string{"not an address"}}}, true))
+	assert.Error(validateSubscription(&Subscription{TriggerID: "t1", Channel: NotificationChannel{Type: "pigeon"}}, true))
+}
+
+func TestSubscriptionQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	alert := &Alert{AlertID: "a1", TriggerID: "t1", CreatedOn: piazza.NewTimeStamp()}
+	dsl, err := subscriptionQuery(alert, "et1")
+	assert.NoError(err)
+
+	var query map[string]interface{}
+	assert.NoError(json.Unmarshal([]byte(dsl), &query))
+	must := query["query"].(map[string]interface{})["bool"].(map[string]interface{})["must"].([]interface{})
+	assert.Len(must, 4)
+	assert.Contains(dsl, `"triggerId":"t1"`)
+	assert.Contains(dsl, `"eventTypeId":"et1"`)
+	assert.Contains(must[0], "range")
+
+	// an alert with no creator only matches subscriptions that do not ask for one
+	assert.NotContains(dsl, `"term":{"alertCreatedBy"`)
+}
+
+func TestWebhookSender(t *testing.T) {
+	assert := assert.New(t)
+
+	var got WebhookNotification
+	var header string
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get("X-Delivery-Id")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	sender := &webhookSender{client: &http.Client{Timeout: deliveryTimeout}}
+	subscription := &Subscription{SubscriptionID: "s1", Channel: NotificationChannel{Type: ChannelWebhook, URL: ts.URL}}
+	alert := &Alert{AlertID: "a1", TriggerID: "t1"}
+	delivery := &Delivery{DeliveryID: deliveryID("a1", "s1")}
+
+	assert.NoError(sender.send(subscription, alert, delivery))
+	assert.Equal("a1_s1", header)
+	assert.Equal(piazza.Ident("s1"), got.SubscriptionID)
+	assert.Equal(piazza.Ident("a1"), got.Alert.AlertID)
+
+	status = http.StatusServiceUnavailable
+	assert.Error(sender.send(subscription, alert, delivery))
+}
+
+// smtpStandIn accepts one message the way a mail server would and hands back what
+// it was sent
+func smtpStandIn(t *testing.T) (string, chan string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make(chan string, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+		reply("220 localhost")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var msg []string
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					msg = append(msg, line)
+				}
+				msgs <- strings.Join(msg, "")
+				reply("250 ok")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), msgs
+}
+
+func TestSMTPSender(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, msgs := smtpStandIn(t)
+	sender := &smtpSender{addr: addr, from: defaultNotifySMTPFrom}
+	subscription := &Subscription{SubscriptionID: "s1", Channel: NotificationChannel{Type: ChannelSMTP, To: []string{"ops@example.com"}}}
+	alert := &Alert{AlertID: "a1", TriggerID: "t1"}
+	delivery := &Delivery{DeliveryID: deliveryID("a1", "s1")}
+
+	assert.NoError(sender.send(subscription, alert, delivery))
+	msg := <-msgs
+	assert.Contains(msg, "To: ops@example.com\r\n")
+	assert.Contains(msg, "X-Delivery-Id: a1_s1\r\n")
+	assert.Contains(msg, `"alertId": "a1"`)
+}
+
+// flakyWebhook fails the first time each delivery is POSTed to it, then succeeds
+type flakyWebhook struct {
+	sync.Mutex
+	posts map[string]int
+}
+
+func (h *flakyWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	id := r.Header.Get("X-Delivery-Id")
+	h.posts[id]++
+	if h.posts[id] == 1 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *flakyWebhook) postsOf(id piazza.Ident) int {
+	h.Lock()
+	defer h.Unlock()
+	return h.posts[id.String()]
+}
+
+func TestNotifierDelivers(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(base time.Duration) { deliveryBackoffBase = base }(deliveryBackoffBase)
+	deliveryBackoffBase = 10 * time.Millisecond
+
+	hook := &flakyWebhook{posts: map[string]int{}}
+	ts := httptest.NewServer(hook)
+	defer ts.Close()
+
+	service := newTestService(t, nil)
+	created := func(resp *piazza.JsonResponse) interface{} {
+		if resp.IsError() {
+			t.Fatal(resp.Message)
+		}
+		return resp.Data
+	}
+	eventType := created(service.PostEventType(makeTestEventType(makeTestEventTypeName()))).(*EventType)
+	event := created(service.PostEvent(makeTestEvent(eventType.EventTypeID))).(*Event)
+	trigger := created(service.PostTrigger(makeTestTrigger([]piazza.Ident{eventType.EventTypeID}))).(*Trigger)
+	subscription := created(service.PostSubscription(&Subscription{
+		TriggerID: trigger.TriggerID,
+		Channel:   NotificationChannel{Type: ChannelWebhook, URL: ts.URL},
+	})).(*Subscription)
+
+	// the service's notifier matches the alert, fails once, and retries
+	alert := created(service.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID})).(*Alert)
+	id := deliveryID(alert.AlertID, subscription.SubscriptionID)
+	var deliveries []Delivery
+	for i := 0; i < 200; i++ {
+		deliveries = created(service.GetAlertDeliveries(alert.AlertID)).([]Delivery)
+		if len(deliveries) == 1 && deliveries[0].Status != DeliveryPending {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(deliveries, 1)
+	delivery := deliveries[0]
+	assert.Equal(id, delivery.DeliveryID)
+	assert.Equal(DeliveryDelivered, delivery.Status)
+	assert.Len(delivery.Attempts, 2)
+	assert.Contains(delivery.Attempts[0].Error, "503")
+	assert.Empty(delivery.Attempts[1].Error)
+	assert.NotNil(delivery.DeliveredOn)
+	assert.Nil(delivery.NextAttemptOn)
+	assert.Equal(2, hook.postsOf(id))
+
+	// at restart, the pending deliveries are resumed and the recent alerts matched
+	// again, but the deliveries already made are not repeated
+	stored := func(id piazza.Ident) *Alert {
+		alert := &Alert{AlertID: id, TriggerID: trigger.TriggerID, EventID: event.EventID, CreatedOn: piazza.NewTimeStamp()}
+		assert.NoError(service.alertDB.PostData(alert))
+		return alert
+	}
+	pending := stored("pending")
+	pendingID := deliveryID(pending.AlertID, subscription.SubscriptionID)
+	now := piazza.NewTimeStamp()
+	assert.NoError(service.deliveryDB.PostData(&Delivery{
+		DeliveryID:     pendingID,
+		AlertID:        pending.AlertID,
+		SubscriptionID: subscription.SubscriptionID,
+		Channel:        ChannelWebhook,
+		Status:         DeliveryPending,
+		Attempts:       []DeliveryAttempt{},
+		NextAttemptOn:  &now,
+		CreatedOn:      now,
+	}))
+	unmatched := stored("unmatched")
+	unmatchedID := deliveryID(unmatched.AlertID, subscription.SubscriptionID)
+
+	n := newNotifier(service)
+	n.recover()
+	assert.Equal(1, len(n.deliveries))
+	recovered := map[piazza.Ident]bool{}
+	for len(n.alerts) > 0 {
+		queued := <-n.alerts
+		recovered[queued.alert.AlertID] = true
+		n.matchAlert(queued)
+	}
+	assert.Equal(map[piazza.Ident]bool{alert.AlertID: true, pending.AlertID: true, unmatched.AlertID: true}, recovered)
+
+	// each fails once, and is retried
+	delivered := map[piazza.Ident]bool{}
+	for len(delivered) < 2 {
+		select {
+		case delivery := <-n.deliveries:
+			n.attempt(delivery)
+			if delivery.Status == DeliveryDelivered {
+				delivered[delivery.DeliveryID] = true
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %v were delivered", delivered)
+		}
+	}
+	assert.Equal(map[piazza.Ident]bool{pendingID: true, unmatchedID: true}, delivered)
+	assert.Equal(2, hook.postsOf(id))
+	assert.Equal(2, hook.postsOf(pendingID))
+	assert.Equal(2, hook.postsOf(unmatchedID))
+
+	deliveries = created(service.GetAlertDeliveries(unmatched.AlertID)).([]Delivery)
+	assert.Len(deliveries, 1)
+	assert.Equal(DeliveryDelivered, deliveries[0].Status)
+	assert.Len(deliveries[0].Attempts, 2)
+}
+
+func TestNotifierWithoutSender(t *testing.T) {
+	assert := assert.New(t)
+	service := newTestService(t, nil)
+
+	subscription := &Subscription{
+		SubscriptionID: "s1",
+		AlertCreatedBy: "someone",
+		Channel:        NotificationChannel{Type: ChannelSMTP, To: []string{"ops@example.com"}},
+		CreatedOn:      piazza.NewTimeStamp(),
+	}
+	assert.NoError(service.subscriptionDB.PostData(subscription))
+	alert := &Alert{AlertID: "a1", TriggerID: "t1", CreatedBy: "someone", CreatedOn: piazza.NewTimeStamp()}
+	assert.NoError(service.alertDB.PostData(alert))
+
+	// an instance with no mail server gives up on the delivery rather than retrying
+	n := newNotifier(service)
+	delete(n.senders, ChannelSMTP)
+	delivery := &Delivery{DeliveryID: deliveryID("a1", "s1"), AlertID: "a1", SubscriptionID: "s1", Channel: ChannelSMTP, Status: DeliveryPending}
+	_, undeliverable := n.send(delivery).(undeliverableError)
+	assert.True(undeliverable)
+
+	n.attempt(delivery)
+	assert.Equal(DeliveryFailed, delivery.Status)
+	assert.Len(delivery.Attempts, 1)
+	assert.Nil(delivery.NextAttemptOn)
+	assert.Equal(0, len(n.deliveries))
+}
@@ -0,0 +1,370 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+const rawIndexTimeout = 30 * time.Second
+
+// errVersionConflict is returned by PutVersioned when the document has been written
+// since it was read
+var errVersionConflict = errors.New("the document was changed by another update; read it again and retry")
+
+// rawIndex makes the Elasticsearch requests that elasticsearch.IIndex has no method
+// for, straight to the REST API. Without an Elasticsearch URL, as when the indices are
+// mocks, each request falls back to what IIndex can do, and searches are run in
+// process.
+type rawIndex struct {
+	esi    elasticsearch.IIndex
+	index  string
+	url    string
+	client *http.Client
+
+	// the versions of the documents written with PutVersioned, when mocking
+	sync.Mutex
+	versions map[string]int64
+}
+
+func newRawIndex(sys *piazza.SystemConfig, esi elasticsearch.IIndex) *rawIndex {
+	raw := &rawIndex{
+		esi:      esi,
+		index:    esi.IndexName(),
+		client:   &http.Client{Timeout: rawIndexTimeout},
+		versions: map[string]int64{},
+	}
+	if sys != nil {
+		if esURL, err := sys.GetURL(piazza.PzElasticSearch); err == nil { //Mocking
+			raw.url = strings.TrimSuffix(esURL, "/")
+		}
+	}
+	return raw
+}
+
+// MultiGet fetches the sources of those of the documents that exist, in one request.
+// Unlike a search, it sees documents as soon as they are written. With typ "", the
+// documents may be of any type.
+func (raw *rawIndex) MultiGet(typ string, ids []string) ([]*json.RawMessage, error) {
+	sources := []*json.RawMessage{}
+	if len(ids) == 0 {
+		return sources, nil
+	}
+	if raw.url == "" {
+		types := []string{typ}
+		if typ == "" {
+			var err error
+			if types, err = raw.esi.GetTypes(); err != nil {
+				return nil, err
+			}
+		}
+		for _, id := range ids {
+			for _, t := range types {
+				if ok, err := raw.esi.ItemExists(t, id); err != nil || !ok {
+					continue
+				}
+				getResult, err := raw.esi.GetByID(t, id)
+				if err != nil {
+					return nil, err
+				}
+				if getResult != nil && getResult.Found {
+					sources = append(sources, getResult.Source)
+					break
+				}
+			}
+		}
+		return sources, nil
+	}
+
+	path := "/" + raw.index
+	if typ != "" {
+		path += "/" + typ
+	}
+	body, err := json.Marshal(map[string]interface{}{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Docs []struct {
+			Found  bool             `json:"found"`
+			Source *json.RawMessage `json:"_source"`
+		} `json:"docs"`
+	}
+	if _, err = raw.do("POST", path+"/_mget", bytes.NewReader(body), &result); err != nil {
+		return nil, err
+	}
+	for _, doc := range result.Docs {
+		if doc.Found && doc.Source != nil {
+			sources = append(sources, doc.Source)
+		}
+	}
+	return sources, nil
+}
+
+// rawSearchResult is the part of a search response that Search decodes
+type rawSearchResult struct {
+	Hits struct {
+		Total int64 `json:"total"`
+		Hits  []struct {
+			Source *json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Aggregations map[string]*json.RawMessage `json:"aggregations"`
+}
+
+// aggregation is the result of a bucket aggregation, such as terms or
+// date_histogram, or of a single bucket one, such as filter
+type aggregation struct {
+	DocCount int64 `json:"doc_count"`
+	Buckets  []struct {
+		Key      interface{} `json:"key"`
+		DocCount int64       `json:"doc_count"`
+	} `json:"buckets"`
+}
+
+// Search runs a search whose body may hold aggregations. A type of "" searches every
+// type.
+func (raw *rawIndex) Search(typ string, body map[string]interface{}) (*rawSearchResult, error) {
+	if raw.url == "" {
+		return raw.mockSearch(typ, body)
+	}
+	path := "/" + raw.index
+	if typ != "" {
+		path += "/" + typ
+	}
+	byts, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	result := &rawSearchResult{}
+	if _, err = raw.do("POST", path+"/_search", bytes.NewReader(byts), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Aggregation returns the named aggregation, naming each enclosing one first
+func (r *rawSearchResult) Aggregation(path ...string) (*aggregation, error) {
+	aggs := r.Aggregations
+	for i, name := range path {
+		byts, ok := aggs[name]
+		if !ok || byts == nil {
+			return nil, fmt.Errorf("the search result has no aggregation %s", strings.Join(path[:i+1], "."))
+		}
+		if i == len(path)-1 {
+			agg := &aggregation{}
+			return agg, json.Unmarshal(*byts, agg)
+		}
+		aggs = map[string]*json.RawMessage{}
+		if err := json.Unmarshal(*byts, &aggs); err != nil {
+			return nil, err
+		}
+	}
+	return nil, errors.New("no aggregation was named")
+}
+
+// dateHistogramAgg is a date_histogram on field with a bucket for every interval
+// from min to max, empty or not, the first starting at min. Keys are milliseconds
+// since the epoch. The interval must be a whole number of milliseconds.
+func dateHistogramAgg(field string, interval time.Duration, min time.Time, max time.Time) map[string]interface{} {
+	width := int64(interval / time.Millisecond)
+	agg := map[string]interface{}{
+		"field":         field,
+		"interval":      fmt.Sprintf("%dms", width),
+		"min_doc_count": 0,
+		"extended_bounds": map[string]interface{}{
+			"min": epochMillis(min),
+			"max": epochMillis(max),
+		},
+	}
+	// buckets are aligned to the epoch unless offset
+	if offset := (epochMillis(min)%width + width) % width; offset != 0 {
+		agg["offset"] = fmt.Sprintf("%dms", offset)
+	}
+	return map[string]interface{}{"date_histogram": agg}
+}
+
+// bucketCounts returns the doc count of each bucket of a date_histogram, by the
+// start of the bucket in milliseconds since the epoch
+func (agg *aggregation) bucketCounts() map[int64]int64 {
+	counts := map[int64]int64{}
+	for _, bucket := range agg.Buckets {
+		if key, ok := bucket.Key.(float64); ok {
+			counts[int64(key)] = bucket.DocCount
+		}
+	}
+	return counts
+}
+
+func epochMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// GetVersioned fetches a document in real time, with the version that PutVersioned
+// checks
+func (raw *rawIndex) GetVersioned(typ string, id string) (*json.RawMessage, int64, bool, error) {
+	if raw.url == "" {
+		// the version is read first, so that a write racing the read makes the
+		// put conflict rather than be lost
+		raw.Lock()
+		version, ok := raw.versions[typ+"/"+id]
+		raw.Unlock()
+		if !ok {
+			version = 1
+		}
+		getResult, err := raw.esi.GetByID(typ, id)
+		if err != nil || getResult == nil || !getResult.Found {
+			return nil, 0, false, err
+		}
+		return getResult.Source, version, true, nil
+	}
+
+	var result struct {
+		Found   bool             `json:"found"`
+		Version int64            `json:"_version"`
+		Source  *json.RawMessage `json:"_source"`
+	}
+	status, err := raw.do("GET", "/"+raw.index+"/"+url.PathEscape(typ)+"/"+url.PathEscape(id), nil, &result)
+	if status == http.StatusNotFound {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return result.Source, result.Version, result.Found, nil
+}
+
+// PutVersioned replaces a document only if it is still at the version it was read
+// at, returning errVersionConflict if not
+func (raw *rawIndex) PutVersioned(typ string, id string, doc interface{}, version int64) error {
+	if raw.url == "" {
+		raw.Lock()
+		defer raw.Unlock()
+		key := typ + "/" + id
+		current, ok := raw.versions[key]
+		if !ok {
+			current = 1
+		}
+		if current != version {
+			return errVersionConflict
+		}
+		if _, err := raw.esi.PutData(typ, id, doc); err != nil {
+			return err
+		}
+		raw.versions[key] = current + 1
+		return nil
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	path := "/" + raw.index + "/" + url.PathEscape(typ) + "/" + url.PathEscape(id) + "?version=" + strconv.FormatInt(version, 10)
+	status, err := raw.do("PUT", path, bytes.NewReader(body), nil)
+	if status == http.StatusConflict {
+		return errVersionConflict
+	}
+	return err
+}
+
+// BulkDelete deletes the documents in one request. Documents already gone are not
+// an error, so that an interrupted delete can be repeated.
+func (raw *rawIndex) BulkDelete(typ string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if raw.url == "" {
+		for _, id := range ids {
+			if _, err := raw.esi.DeleteByID(typ, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, id := range ids {
+		action := map[string]interface{}{
+			"delete": map[string]interface{}{"_index": raw.index, "_type": typ, "_id": id},
+		}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []struct {
+			Delete struct {
+				ID     string          `json:"_id"`
+				Status int             `json:"status"`
+				Error  json.RawMessage `json:"error"`
+			} `json:"delete"`
+		} `json:"items"`
+	}
+	if _, err := raw.do("POST", "/_bulk", &body, &result); err != nil {
+		return err
+	}
+	if result.Errors {
+		for _, item := range result.Items {
+			if d := item.Delete; d.Status >= 300 && d.Status != http.StatusNotFound {
+				return fmt.Errorf("deleting %s failed with status %d: %s", d.ID, d.Status, d.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// do sends the request and decodes a successful response into out. Error statuses
+// are returned as errors, along with the status.
+func (raw *rawIndex) do(method string, path string, body io.Reader, out interface{}) (int, error) {
+	req, err := http.NewRequest(method, raw.url+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := raw.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	byts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("%s %s failed with status %d: %s", method, path, resp.StatusCode, byts)
+	}
+	if out == nil {
+		return resp.StatusCode, nil
+	}
+	return resp.StatusCode, json.Unmarshal(byts, out)
+}
@@ -0,0 +1,182 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRawIndex is a rawIndex on an index called "events" of a stand-in server
+func newTestRawIndex(handler http.HandlerFunc) (*rawIndex, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	return &rawIndex{index: "events", url: server.URL, client: &http.Client{}}, server
+}
+
+func TestRawIndexBulkDelete(t *testing.T) {
+	assert := assert.New(t)
+
+	var actions []map[string]map[string]string
+	status := http.StatusNotFound
+	raw, server := newTestRawIndex(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("POST", r.Method)
+		assert.Equal("/_bulk", r.URL.Path)
+		actions = nil
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			assert.NoError(json.Unmarshal(scanner.Bytes(), &action))
+			actions = append(actions, action)
+		}
+		_, _ = w.Write([]byte(`{"errors": true, "items": [
+			{"delete": {"_id": "e1", "status": 200}},
+			{"delete": {"_id": "e2", "status": ` + strconv.Itoa(status) + `, "error": {"type": "x"}}}]}`))
+	})
+	defer server.Close()
+
+	assert.NoError(raw.BulkDelete("T", nil))
+	assert.Nil(actions)
+
+	// documents already gone are not an error
+	assert.NoError(raw.BulkDelete("T", []string{"e1", "e2"}))
+	assert.Equal([]map[string]map[string]string{
+		{"delete": {"_index": "events", "_type": "T", "_id": "e1"}},
+		{"delete": {"_index": "events", "_type": "T", "_id": "e2"}},
+	}, actions)
+
+	status = http.StatusTooManyRequests
+	err := raw.BulkDelete("T", []string{"e1", "e2"})
+	assert.Error(err)
+	assert.Contains(err.Error(), "e2")
+}
+
+func TestRawIndexMultiGet(t *testing.T) {
+	assert := assert.New(t)
+
+	var paths []string
+	raw, server := newTestRawIndex(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("POST", r.Method)
+		paths = append(paths, r.URL.Path)
+		var body map[string][]string
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal([]string{"e1", "e2"}, body["ids"])
+		_, _ = w.Write([]byte(`{"docs": [
+			{"_id": "e1", "found": true, "_source": {"eventId": "e1"}},
+			{"_id": "e2", "found": false}]}`))
+	})
+	defer server.Close()
+
+	sources, err := raw.MultiGet("T", nil)
+	assert.NoError(err)
+	assert.Len(sources, 0)
+	assert.Nil(paths)
+
+	sources, err = raw.MultiGet("T", []string{"e1", "e2"})
+	assert.NoError(err)
+	assert.Len(sources, 1)
+	assert.JSONEq(`{"eventId": "e1"}`, string(*sources[0]))
+
+	// without a type, documents of any type are found
+	_, err = raw.MultiGet("", []string{"e1", "e2"})
+	assert.NoError(err)
+	assert.Equal([]string{"/events/T/_mget", "/events/_mget"}, paths)
+}
+
+func TestRawIndexSearch(t *testing.T) {
+	assert := assert.New(t)
+
+	raw, server := newTestRawIndex(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/events/T/_search", r.URL.Path)
+		var body map[string]interface{}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		assert.Contains(body, "aggs")
+		_, _ = w.Write([]byte(`{"hits": {"total": 7, "hits": [{"_source": {"eventId": "e1"}}]},
+			"aggregations": {"recent": {"doc_count": 5, "byUser": {"buckets": [{"key": "alice", "doc_count": 5}]}}}}`))
+	})
+	defer server.Close()
+
+	result, err := raw.Search("T", map[string]interface{}{"size": 1, "aggs": map[string]interface{}{}})
+	assert.NoError(err)
+	assert.Equal(int64(7), result.Hits.Total)
+	assert.Len(result.Hits.Hits, 1)
+
+	recent, err := result.Aggregation("recent")
+	assert.NoError(err)
+	assert.Equal(int64(5), recent.DocCount)
+	byUser, err := result.Aggregation("recent", "byUser")
+	assert.NoError(err)
+	assert.Len(byUser.Buckets, 1)
+	assert.Equal("alice", byUser.Buckets[0].Key)
+
+	_, err = result.Aggregation("recent", "missing")
+	assert.Error(err)
+}
+
+func TestDateHistogramAgg(t *testing.T) {
+	assert := assert.New(t)
+
+	min := time.Date(2016, 8, 10, 0, 0, 0, 0, time.UTC)
+	agg := dateHistogramAgg("createdOn", 24*time.Hour, min, min.Add(24*time.Hour))
+	byts, err := json.Marshal(agg)
+	assert.NoError(err)
+	assert.JSONEq(`{"date_histogram": {"field": "createdOn", "interval": "86400000ms", "min_doc_count": 0,
+		"extended_bounds": {"min": 1470787200000, "max": 1470873600000}}}`, string(byts))
+
+	// buckets not aligned to the epoch are offset
+	agg = dateHistogramAgg("createdOn", 24*time.Hour, min.Add(90*time.Minute), min.Add(90*time.Minute))
+	assert.Equal("5400000ms", agg["date_histogram"].(map[string]interface{})["offset"])
+}
+
+func TestRawIndexVersioned(t *testing.T) {
+	assert := assert.New(t)
+
+	stored := int64(3)
+	raw, server := newTestRawIndex(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/events/T/e1":
+			_, _ = w.Write([]byte(`{"found": true, "_version": ` + strconv.FormatInt(stored, 10) + `, "_source": {"eventId": "e1"}}`))
+		case r.Method == "GET":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"found": false}`))
+		case r.Method == "PUT" && r.URL.Query().Get("version") == strconv.FormatInt(stored, 10):
+			stored++
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusConflict)
+		}
+	})
+	defer server.Close()
+
+	src, version, found, err := raw.GetVersioned("T", "e1")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(int64(3), version)
+	assert.JSONEq(`{"eventId": "e1"}`, string(*src))
+
+	_, _, found, err = raw.GetVersioned("T", "e2")
+	assert.NoError(err)
+	assert.False(found)
+
+	assert.NoError(raw.PutVersioned("T", "e1", map[string]string{"eventId": "e1"}, version))
+	// the document has moved on from the version read
+	assert.Equal(errVersionConflict, raw.PutVersioned("T", "e1", map[string]string{"eventId": "e1"}, version))
+}
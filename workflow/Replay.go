@@ -0,0 +1,348 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+const replayPageSize = 100
+const maxReplayErrors = 100
+const maxFinishedReplays = 100
+const maxReplaySaveAttempts = 3
+
+var errReplayCancelled = errors.New("replay cancelled")
+
+type replayRun struct {
+	job        *ReplayJob
+	cancel     chan struct{}
+	cancelOnce sync.Once
+}
+
+// replayRegistry holds the replays run by this instance. Finished replays are kept,
+// up to a limit, so that their final counts can still be read without a lookup. The
+// replays are also stored, so that other instances can report on and cancel them.
+type replayRegistry struct {
+	sync.Mutex
+	runs     map[piazza.Ident]*replayRun
+	finished []piazza.Ident
+}
+
+func newReplayRegistry() *replayRegistry {
+	return &replayRegistry{runs: map[piazza.Ident]*replayRun{}}
+}
+
+// snapshot copies the job so it can be returned while the replay keeps running
+func (reg *replayRegistry) snapshot(run *replayRun) *ReplayJob {
+	reg.Lock()
+	defer reg.Unlock()
+	job := *run.job
+	job.Matches = map[piazza.Ident]int{}
+	for k, v := range run.job.Matches {
+		job.Matches[k] = v
+	}
+	job.Errors = append([]string{}, run.job.Errors...)
+	return &job
+}
+
+func (reg *replayRegistry) update(run *replayRun, fn func(job *ReplayJob)) {
+	reg.Lock()
+	defer reg.Unlock()
+	fn(run.job)
+}
+
+func (reg *replayRegistry) finish(run *replayRun, status string, message string) {
+	reg.Lock()
+	defer reg.Unlock()
+	now := piazza.NewTimeStamp()
+	run.job.Status = status
+	run.job.Message = message
+	run.job.CompletedOn = &now
+
+	reg.finished = append(reg.finished, run.job.ReplayID)
+	if len(reg.finished) > maxFinishedReplays {
+		delete(reg.runs, reg.finished[0])
+		reg.finished = reg.finished[1:]
+	}
+}
+
+func (reg *replayRegistry) add(run *replayRun) {
+	reg.Lock()
+	defer reg.Unlock()
+	reg.runs[run.job.ReplayID] = run
+}
+
+func (reg *replayRegistry) get(id piazza.Ident) *replayRun {
+	reg.Lock()
+	defer reg.Unlock()
+	return reg.runs[id]
+}
+
+//------------------------------------------------------------------------------
+
+// PostReplay starts re-percolating stored events through the current triggers. A
+// trigger is not fired again for an event it already has an alert for, unless Refire
+// is set. The replay runs in the background; its progress is read with GetReplay.
+func (service *Service) PostReplay(req *ReplayRequest) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	eventType, found, err := service.eventTypeDB.GetOne(req.EventTypeID, req.CreatedBy)
+	if !found {
+		return service.statusNotFound(fmt.Errorf("Service.PostReplay failed: eventType %s could not be found", req.EventTypeID))
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	if req.Until.IsZero() {
+		req.Until = time.Now()
+	}
+	if !req.Since.Before(req.Until) {
+		return service.statusBadRequest(errors.New("Service.PostReplay failed: since must be before until"))
+	}
+
+	for _, triggerID := range req.TriggerIDs {
+		trigger, found, err := service.triggerDB.GetOne(triggerID, req.CreatedBy)
+		if err != nil || !found {
+			return service.statusBadRequest(fmt.Errorf("Service.PostReplay failed: trigger %s could not be found", triggerID))
+		}
+		if trigger.EventTypeID != eventType.EventTypeID {
+			return service.statusBadRequest(fmt.Errorf("Service.PostReplay failed: trigger %s is not on eventType %s", triggerID, eventType.EventTypeID))
+		}
+	}
+
+	query, err := eventTimeRangeQuery(eventType.EventTypeID, req.Since, req.Until)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	total, err := service.eventDB.CountEvents(eventType.Name, query, req.CreatedBy)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+
+	run := &replayRun{
+		job: &ReplayJob{
+			ReplayID:    service.newIdent(),
+			Request:     *req,
+			Status:      ReplayStatusRunning,
+			TotalEvents: total,
+			Matches:     map[piazza.Ident]int{},
+			Errors:      []string{},
+			CreatedOn:   piazza.NewTimeStamp(),
+		},
+		cancel: make(chan struct{}),
+	}
+
+	if err = service.replayDB.PostData(run.job); err != nil {
+		return service.statusInternalError(err)
+	}
+	service.replays.add(run)
+
+	service.syslogger.Audit(req.CreatedBy, "startingReplay", run.job.ReplayID, "Service.PostReplay: User [%s] is replaying %d events of eventType [%s] (dryRun=%t)", req.CreatedBy, total, eventType.EventTypeID, req.DryRun)
+
+	go service.runReplay(run, eventType, query)
+
+	return service.statusCreated(service.replays.snapshot(run))
+}
+
+// GetReplay reports the progress of a replay. One run by another instance is read from
+// the index, where its progress is saved after every page of events.
+func (service *Service) GetReplay(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if run := service.replays.get(id); run != nil {
+		return service.statusOK(service.replays.snapshot(run))
+	}
+	job, _, found, err := service.replayDB.GetOneVersioned(id)
+	if !found {
+		return service.statusNotFound(fmt.Errorf("Replay %s does not exist", id))
+	}
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	return service.statusOK(job)
+}
+
+// CancelReplay stops a running replay after the event it is currently processing. One
+// run by another instance is marked as cancelled in the index, and stops when that
+// instance next saves its progress.
+func (service *Service) CancelReplay(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	run := service.replays.get(id)
+	if run == nil {
+		return service.requestReplayCancel(id)
+	}
+	job := service.replays.snapshot(run)
+	if job.Status != ReplayStatusRunning {
+		return service.statusBadRequest(fmt.Errorf("Replay %s is not running", id))
+	}
+
+	service.syslogger.Audit("pz-workflow", "cancellingReplay", id, "Service.CancelReplay: User is cancelling replay [%s]", id)
+	service.replays.update(run, func(job *ReplayJob) { job.CancelRequested = true })
+	run.cancelOnce.Do(func() { close(run.cancel) })
+
+	return service.statusOK(job)
+}
+
+func (service *Service) requestReplayCancel(id piazza.Ident) *piazza.JsonResponse {
+	for attempt := 1; ; attempt++ {
+		job, version, found, err := service.replayDB.GetOneVersioned(id)
+		if !found {
+			return service.statusNotFound(fmt.Errorf("Replay %s does not exist", id))
+		}
+		if err != nil {
+			return service.statusInternalError(err)
+		}
+		if job.Status != ReplayStatusRunning {
+			return service.statusBadRequest(fmt.Errorf("Replay %s is not running", id))
+		}
+
+		service.syslogger.Audit("pz-workflow", "cancellingReplay", id, "Service.CancelReplay: User is cancelling replay [%s] run by another instance", id)
+
+		job.CancelRequested = true
+		// the instance running it saves its progress, racing this
+		err = service.replayDB.PutVersioned(job, version)
+		if err == errVersionConflict && attempt < maxReplaySaveAttempts {
+			continue
+		}
+		if err != nil {
+			return service.statusWriteFailed(err)
+		}
+		return service.statusOK(job)
+	}
+}
+
+// saveReplay stores the progress of a replay, and stops it if another instance has
+// asked for it to be cancelled
+func (service *Service) saveReplay(run *replayRun) {
+	id := run.job.ReplayID
+	for attempt := 1; ; attempt++ {
+		stored, version, _, err := service.replayDB.GetOneVersioned(id)
+		if err == nil {
+			if stored.CancelRequested {
+				service.replays.update(run, func(job *ReplayJob) { job.CancelRequested = true })
+				run.cancelOnce.Do(func() { close(run.cancel) })
+			}
+			err = service.replayDB.PutVersioned(service.replays.snapshot(run), version)
+		}
+		if err == errVersionConflict && attempt < maxReplaySaveAttempts {
+			continue
+		}
+		if err != nil {
+			service.syslogger.Warning("Service.saveReplay: could not save the progress of replay %s: %s", id, err)
+		}
+		return
+	}
+}
+
+func (service *Service) runReplay(run *replayRun, eventType *EventType, query map[string]interface{}) {
+	defer service.handlePanic()
+
+	req := run.job.Request
+	allowed := map[piazza.Ident]bool{}
+	for _, triggerID := range req.TriggerIDs {
+		allowed[triggerID] = true
+	}
+
+	processed := 0
+	err := service.eventDB.ScanEvents(eventType.Name, query, replayPageSize, req.CreatedBy, func(event *Event) error {
+		select {
+		case <-run.cancel:
+			return errReplayCancelled
+		default:
+		}
+		service.replayEvent(run, eventType, event, allowed)
+		if processed++; processed%replayPageSize == 0 {
+			service.saveReplay(run)
+		}
+		return nil
+	})
+
+	switch err {
+	case nil:
+		service.replays.finish(run, ReplayStatusCompleted, "")
+		service.syslogger.Audit(req.CreatedBy, "completedReplay", run.job.ReplayID, "Service.runReplay: replay [%s] completed", run.job.ReplayID)
+	case errReplayCancelled:
+		service.replays.finish(run, ReplayStatusCancelled, "")
+		service.syslogger.Audit(req.CreatedBy, "cancelledReplay", run.job.ReplayID, "Service.runReplay: replay [%s] cancelled", run.job.ReplayID)
+	default:
+		service.replays.finish(run, ReplayStatusFailed, err.Error())
+		service.syslogger.Audit(req.CreatedBy, "replayFailure", run.job.ReplayID, "Service.runReplay: replay [%s] failed: %s", run.job.ReplayID, err)
+	}
+	service.saveReplay(run)
+}
+
+func (service *Service) replayEvent(run *replayRun, eventType *EventType, event *Event, allowed map[piazza.Ident]bool) {
+	req := run.job.Request
+
+	addError := func(job *ReplayJob, format string, args ...interface{}) {
+		if len(job.Errors) < maxReplayErrors {
+			job.Errors = append(job.Errors, fmt.Sprintf(format, args...))
+		}
+	}
+
+	triggerIDs, err := service.eventDB.PercolateEventData(eventType.Name, event.Data, event.EventID, req.CreatedBy)
+	if err != nil {
+		service.replays.update(run, func(job *ReplayJob) {
+			job.EventsProcessed++
+			addError(job, "event %s: %s", event.EventID, err)
+		})
+		return
+	}
+
+	// unless asked to, a trigger is not fired again for an event it already has an
+	// alert for
+	alerted := map[piazza.Ident]bool{}
+	if !req.Refire && len(*triggerIDs) > 0 {
+		if alerted, err = service.alertDB.GetTriggerIDsByEventID(event.EventID, req.CreatedBy); err != nil {
+			service.replays.update(run, func(job *ReplayJob) {
+				job.EventsProcessed++
+				addError(job, "event %s: %s", event.EventID, err)
+			})
+			return
+		}
+	}
+
+	for _, triggerID := range *triggerIDs {
+		if len(allowed) > 0 && !allowed[triggerID] {
+			continue
+		}
+		if alerted[triggerID] {
+			service.replays.update(run, func(job *ReplayJob) { job.AlertsSkipped++ })
+			continue
+		}
+		trigger, resp := service.lookupFireableTrigger(triggerID, eventType, req.CreatedBy)
+		if resp == nil && trigger != nil {
+			service.replays.update(run, func(job *ReplayJob) { job.Matches[triggerID]++ })
+			if !req.DryRun {
+				resp = service.fireTrigger(trigger, event, eventType)
+				if resp == nil {
+					service.replays.update(run, func(job *ReplayJob) { job.JobsSubmitted++ })
+				}
+			}
+		}
+		if resp != nil {
+			service.replays.update(run, func(job *ReplayJob) {
+				addError(job, "event %s, trigger %s: %s", event.EventID, triggerID, resp.Message)
+			})
+		}
+	}
+
+	service.replays.update(run, func(job *ReplayJob) { job.EventsProcessed++ })
+}
@@ -0,0 +1,76 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// ReplayDB stores the replays, so that any instance can report on or cancel one
+type ReplayDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewReplayDB(service *Service, esi elasticsearch.IIndex) (*ReplayDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	rpdb := ReplayDB{ResourceDB: rdb, mapping: ReplayDBMapping}
+	return &rpdb, nil
+}
+
+func (db *ReplayDB) PostData(job *ReplayJob) error {
+	indexResult, err := db.Esi.PostData(db.mapping, job.ReplayID.String(), job)
+	if err != nil {
+		return LoggedError("ReplayDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("ReplayDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+// GetOneVersioned returns a replay in real time, with the version PutVersioned needs
+func (db *ReplayDB) GetOneVersioned(id piazza.Ident) (*ReplayJob, int64, bool, error) {
+	src, version, found, err := db.raw.GetVersioned(db.mapping, id.String())
+	if err != nil {
+		return nil, 0, false, LoggedError("ReplayDB.GetOneVersioned failed: %s", err)
+	}
+	if !found {
+		return nil, 0, false, fmt.Errorf("replay %s could not be found", id)
+	}
+	var job ReplayJob
+	if err = json.Unmarshal(*src, &job); err != nil {
+		return nil, 0, true, err
+	}
+	return &job, version, true, nil
+}
+
+// PutVersioned replaces a stored replay, unless it has been written since it was read
+// at version, when it returns errVersionConflict
+func (db *ReplayDB) PutVersioned(job *ReplayJob, version int64) error {
+	err := db.raw.PutVersioned(db.mapping, job.ReplayID.String(), job, version)
+	if err != nil && err != errVersionConflict {
+		return LoggedError("ReplayDB.PutVersioned failed: %s", err)
+	}
+	return err
+}
@@ -0,0 +1,274 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// percolateAll matches every document to every trigger, as if all their conditions
+// held. Once gated, each percolation signals on entered, then waits for gate to close.
+type percolateAll struct {
+	elasticsearch.IIndex
+	sync.Mutex
+	queries map[string]bool
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (p *percolateAll) AddPercolationQuery(id string, query piazza.JsonString) (*elasticsearch.IndexResponse, error) {
+	p.Lock()
+	p.queries[id] = true
+	p.Unlock()
+	return p.IIndex.AddPercolationQuery(id, query)
+}
+
+func (p *percolateAll) DeletePercolationQuery(id string) (*elasticsearch.DeleteResponse, error) {
+	p.Lock()
+	delete(p.queries, id)
+	p.Unlock()
+	return p.IIndex.DeletePercolationQuery(id)
+}
+
+func (p *percolateAll) AddPercolationDocument(typ string, doc interface{}) (*elasticsearch.PercolateResponse, error) {
+	p.Lock()
+	entered, gate := p.entered, p.gate
+	ids := []string{}
+	for id := range p.queries {
+		ids = append(ids, id)
+	}
+	p.Unlock()
+	if gate != nil {
+		entered <- struct{}{}
+		<-gate
+	}
+	sort.Strings(ids)
+	resp := &elasticsearch.PercolateResponse{}
+	for _, id := range ids {
+		resp.Matches = append(resp.Matches, &elasticsearch.PercolateResponseMatch{Id: id})
+	}
+	return resp, nil
+}
+
+type replayFixture struct {
+	service     *Service
+	percolator  *percolateAll
+	eventType   *EventType
+	triggerA    *Trigger
+	triggerB    *Trigger
+	alreadyDone *Event
+	notYetDone  *Event
+}
+
+// newReplayFixture makes two events and two triggers; trigger A already has an alert
+// for the first event
+func newReplayFixture(t *testing.T) *replayFixture {
+	fx := &replayFixture{}
+	fx.service = newTestService(t, func(esi elasticsearch.IIndex) elasticsearch.IIndex {
+		if esi.IndexName() != keyEvents {
+			return esi
+		}
+		fx.percolator = &percolateAll{IIndex: esi, queries: map[string]bool{}}
+		return fx.percolator
+	})
+	created := func(resp *piazza.JsonResponse) interface{} {
+		if resp.IsError() {
+			t.Fatal(resp.Message)
+		}
+		return resp.Data
+	}
+	fx.eventType = created(fx.service.PostEventType(makeTestEventType(makeTestEventTypeName()))).(*EventType)
+	fx.alreadyDone = created(fx.service.PostEvent(makeTestEvent(fx.eventType.EventTypeID))).(*Event)
+	fx.notYetDone = created(fx.service.PostEvent(makeTestEvent(fx.eventType.EventTypeID))).(*Event)
+	fx.triggerA = created(fx.service.PostTrigger(makeTestTrigger([]piazza.Ident{fx.eventType.EventTypeID}))).(*Trigger)
+	fx.triggerB = created(fx.service.PostTrigger(makeTestTrigger([]piazza.Ident{fx.eventType.EventTypeID}))).(*Trigger)
+	created(fx.service.PostAlert(&Alert{TriggerID: fx.triggerA.TriggerID, EventID: fx.alreadyDone.EventID}))
+	return fx
+}
+
+func (fx *replayFixture) request() *ReplayRequest {
+	now := time.Now()
+	return &ReplayRequest{EventTypeID: fx.eventType.EventTypeID, Since: now.Add(-time.Hour), Until: now.Add(time.Hour)}
+}
+
+// waitForReplay returns the replay once it is no longer running
+func waitForReplay(t *testing.T, service *Service, id piazza.Ident) *ReplayJob {
+	for i := 0; i < 200; i++ {
+		resp := service.GetReplay(id)
+		if resp.IsError() {
+			t.Fatal(resp.Message)
+		}
+		job := resp.Data.(*ReplayJob)
+		if job.Status != ReplayStatusRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replay %s did not finish", id)
+	return nil
+}
+
+func TestReplayDryRun(t *testing.T) {
+	assert := assert.New(t)
+	fx := newReplayFixture(t)
+
+	req := fx.request()
+	req.DryRun = true
+	resp := fx.service.PostReplay(req)
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	job := waitForReplay(t, fx.service, resp.Data.(*ReplayJob).ReplayID)
+
+	assert.Equal(ReplayStatusCompleted, job.Status)
+	assert.EqualValues(2, job.TotalEvents)
+	assert.EqualValues(2, job.EventsProcessed)
+	assert.EqualValues(0, job.JobsSubmitted)
+	assert.EqualValues(1, job.AlertsSkipped)
+	assert.Equal(map[piazza.Ident]int{fx.triggerA.TriggerID: 1, fx.triggerB.TriggerID: 2}, job.Matches)
+	assert.NotNil(job.CompletedOn)
+
+	// refire counts the pair that already has an alert
+	req.Refire = true
+	resp = fx.service.PostReplay(req)
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	job = waitForReplay(t, fx.service, resp.Data.(*ReplayJob).ReplayID)
+	assert.EqualValues(0, job.AlertsSkipped)
+	assert.Equal(map[piazza.Ident]int{fx.triggerA.TriggerID: 2, fx.triggerB.TriggerID: 2}, job.Matches)
+
+	// only the triggers asked for
+	req.Refire = false
+	req.TriggerIDs = []piazza.Ident{fx.triggerA.TriggerID}
+	resp = fx.service.PostReplay(req)
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	job = waitForReplay(t, fx.service, resp.Data.(*ReplayJob).ReplayID)
+	assert.Equal(map[piazza.Ident]int{fx.triggerA.TriggerID: 1}, job.Matches)
+}
+
+func TestReplayFiresOnce(t *testing.T) {
+	assert := assert.New(t)
+	fx := newReplayFixture(t)
+
+	resp := fx.service.PostReplay(fx.request())
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	job := waitForReplay(t, fx.service, resp.Data.(*ReplayJob).ReplayID)
+	assert.Equal(ReplayStatusCompleted, job.Status)
+	assert.EqualValues(1, job.AlertsSkipped)
+	assert.Equal(map[piazza.Ident]int{fx.triggerA.TriggerID: 1, fx.triggerB.TriggerID: 2}, job.Matches)
+	// there is no Kafka to send the jobs to, but their alerts are stored first
+	assert.Len(job.Errors, 3)
+
+	// a second replay finds every pair already alerted
+	resp = fx.service.PostReplay(fx.request())
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	job = waitForReplay(t, fx.service, resp.Data.(*ReplayJob).ReplayID)
+	assert.EqualValues(4, job.AlertsSkipped)
+	assert.Empty(job.Matches)
+	assert.Empty(job.Errors)
+}
+
+func TestPostReplayErrors(t *testing.T) {
+	assert := assert.New(t)
+	fx := newReplayFixture(t)
+
+	req := fx.request()
+	req.EventTypeID = "nosuchtype"
+	assert.Equal(http.StatusNotFound, fx.service.PostReplay(req).StatusCode)
+
+	req = fx.request()
+	req.Until = req.Since.Add(-time.Hour)
+	assert.Equal(http.StatusBadRequest, fx.service.PostReplay(req).StatusCode)
+
+	req = fx.request()
+	req.TriggerIDs = []piazza.Ident{"nosuchtrigger"}
+	assert.Equal(http.StatusBadRequest, fx.service.PostReplay(req).StatusCode)
+
+	assert.Equal(http.StatusNotFound, fx.service.GetReplay("nosuchreplay").StatusCode)
+	assert.Equal(http.StatusNotFound, fx.service.CancelReplay("nosuchreplay").StatusCode)
+}
+
+func TestCancelReplay(t *testing.T) {
+	assert := assert.New(t)
+	fx := newReplayFixture(t)
+
+	entered, gate := make(chan struct{}), make(chan struct{})
+	fx.percolator.Lock()
+	fx.percolator.entered, fx.percolator.gate = entered, gate
+	fx.percolator.Unlock()
+
+	req := fx.request()
+	req.DryRun = true
+	resp := fx.service.PostReplay(req)
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	id := resp.Data.(*ReplayJob).ReplayID
+
+	// cancelled while the first event is being percolated
+	<-entered
+	resp = fx.service.CancelReplay(id)
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	close(gate)
+
+	job := waitForReplay(t, fx.service, id)
+	assert.Equal(ReplayStatusCancelled, job.Status)
+	assert.True(job.CancelRequested)
+	assert.EqualValues(1, job.EventsProcessed)
+
+	// the final counts are saved for the other instances
+	stored, _, found, err := fx.service.replayDB.GetOneVersioned(id)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(ReplayStatusCancelled, stored.Status)
+
+	assert.Equal(http.StatusBadRequest, fx.service.CancelReplay(id).StatusCode)
+}
+
+func TestReplayOnAnotherInstance(t *testing.T) {
+	assert := assert.New(t)
+	service := newTestService(t, nil)
+
+	// a replay another instance is running is only in the index
+	job := &ReplayJob{
+		ReplayID:  "r1",
+		Status:    ReplayStatusRunning,
+		Matches:   map[piazza.Ident]int{},
+		Errors:    []string{},
+		CreatedOn: piazza.NewTimeStamp(),
+	}
+	assert.NoError(service.replayDB.PostData(job))
+
+	resp := service.GetReplay("r1")
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	assert.Equal(ReplayStatusRunning, resp.Data.(*ReplayJob).Status)
+
+	resp = service.CancelReplay("r1")
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+	assert.True(resp.Data.(*ReplayJob).CancelRequested)
+
+	// the instance running it stops when it next saves its progress
+	run := &replayRun{job: job, cancel: make(chan struct{})}
+	service.saveReplay(run)
+	select {
+	case <-run.cancel:
+	default:
+		t.Error("the replay was not cancelled")
+	}
+	assert.True(service.replays.snapshot(run).CancelRequested)
+}
@@ -19,12 +19,14 @@ import "github.com/venicegeo/dg-pz-gocommon/elasticsearch"
 type ResourceDB struct {
 	service *Service
 	Esi     elasticsearch.IIndex
+	raw     *rawIndex
 }
 
 func NewResourceDB(service *Service, esi elasticsearch.IIndex) (*ResourceDB, error) {
 	db := &ResourceDB{
 		service: service,
 		Esi:     esi,
+		raw:     newRawIndex(service.sys, esi),
 	}
 
 	if err := esi.Create(""); err != nil {
@@ -15,7 +15,11 @@
 package workflow
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"bytes"
 
@@ -35,6 +39,8 @@ type Server struct {
 
 const Version = "1.0.0"
 
+const streamKeepAlive = 15 * time.Second
+
 //---------------------------------------------------------------------------
 
 func (server *Server) Init(service *Service) error {
@@ -47,20 +53,32 @@ func (server *Server) Init(service *Service) error {
 
 		{Verb: "GET", Path: "/eventType", Handler: server.handleGetAllEventTypes},
 		{Verb: "GET", Path: "/eventType/:id", Handler: server.handleGetEventType},
+		{Verb: "GET", Path: "/eventType/:id/versions", Handler: server.handleGetEventTypeVersions},
+		{Verb: "GET", Path: "/eventType/:id/schema", Handler: server.handleGetEventTypeSchema},
+		{Verb: "GET", Path: "/eventType/:id/stats", Handler: server.handleGetEventTypeStats},
 		{Verb: "POST", Path: "/eventType", Handler: server.handlePostEventType},
 		{Verb: "POST", Path: "/eventType/query", Handler: server.handleEventTypeQuery},
+		{Verb: "POST", Path: "/eventType/import", Handler: server.handleImportEventType},
+		{Verb: "POST", Path: "/eventType/infer", Handler: server.handleInferEventType},
+		{Verb: "PUT", Path: "/eventType/:id", Handler: server.handlePutEventType},
 		{Verb: "DELETE", Path: "/eventType/:id", Handler: server.handleDeleteEventType},
 
 		{Verb: "GET", Path: "/event/:id", Handler: server.handleGetEvent},
 		{Verb: "GET", Path: "/event", Handler: server.handleGetAllEvents},
 		{Verb: "POST", Path: "/event", Handler: server.handlePostEvent},
 		{Verb: "POST", Path: "/event/query", Handler: server.handleEventQuery},
+		{Verb: "POST", Path: "/event/replay", Handler: server.handlePostReplay},
+		{Verb: "PUT", Path: "/event/:id", Handler: server.handlePutEvent},
 		{Verb: "DELETE", Path: "/event/:id", Handler: server.handleDeleteEvent},
 
+		{Verb: "GET", Path: "/replay/:id", Handler: server.handleGetReplay},
+		{Verb: "DELETE", Path: "/replay/:id", Handler: server.handleCancelReplay},
+
 		{Verb: "GET", Path: "/trigger/:id", Handler: server.handleGetTrigger},
 		{Verb: "GET", Path: "/trigger", Handler: server.handleGetAllTriggers},
 		{Verb: "POST", Path: "/trigger", Handler: server.handlePostTrigger},
 		{Verb: "POST", Path: "/trigger/query", Handler: server.handleTriggerQuery},
+		{Verb: "POST", Path: "/trigger/backtest", Handler: server.handleBacktestTrigger},
 		{Verb: "PUT", Path: "/trigger/:id", Handler: server.handlePutTrigger},
 		{Verb: "DELETE", Path: "/trigger/:id", Handler: server.handleDeleteTrigger},
 
@@ -68,9 +86,29 @@ func (server *Server) Init(service *Service) error {
 		{Verb: "GET", Path: "/alert", Handler: server.handleGetAllAlerts},
 		{Verb: "POST", Path: "/alert", Handler: server.handlePostAlert},
 		{Verb: "POST", Path: "/alert/query", Handler: server.handleAlertQuery},
+		{Verb: "PUT", Path: "/alert/:id", Handler: server.handlePutAlert},
+		{Verb: "PUT", Path: "/alert/:id/state", Handler: server.handlePutAlertState},
+		{Verb: "GET", Path: "/alert/:id/deliveries", Handler: server.handleGetAlertDeliveries},
 		{Verb: "DELETE", Path: "/alert/:id", Handler: server.handleDeleteAlert},
 
+		{Verb: "GET", Path: "/incident/:id", Handler: server.handleGetIncident},
+		{Verb: "GET", Path: "/incident", Handler: server.handleGetAllIncidents},
+		{Verb: "POST", Path: "/incident/query", Handler: server.handleIncidentQuery},
+
+		{Verb: "GET", Path: "/trace/:id", Handler: server.handleGetTrace},
+
+		{Verb: "GET", Path: "/areaOfInterest/:id", Handler: server.handleGetAreaOfInterest},
+		{Verb: "GET", Path: "/areaOfInterest", Handler: server.handleGetAllAreasOfInterest},
+		{Verb: "POST", Path: "/areaOfInterest", Handler: server.handlePostAreaOfInterest},
+		{Verb: "DELETE", Path: "/areaOfInterest/:id", Handler: server.handleDeleteAreaOfInterest},
+
+		{Verb: "GET", Path: "/subscription/:id", Handler: server.handleGetSubscription},
+		{Verb: "GET", Path: "/subscription", Handler: server.handleGetAllSubscriptions},
+		{Verb: "POST", Path: "/subscription", Handler: server.handlePostSubscription},
+		{Verb: "DELETE", Path: "/subscription/:id", Handler: server.handleDeleteSubscription},
+
 		{Verb: "GET", Path: "/admin/stats", Handler: server.handleGetStats},
+		{Verb: "GET", Path: "/admin/systemEventTypes", Handler: server.handleGetSystemEventTypes},
 
 		{Verb: "GET", Path: "/_test/elasticsearch/version", Handler: server.handleTestElasticsearchVersion},
 		{Verb: "GET", Path: "/_test/elasticsearch/data/:id", Handler: server.handleTestElasticsearchGetOne},
@@ -101,6 +139,11 @@ func (server *Server) handleGetStats(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetSystemEventTypes(c *gin.Context) {
+	resp := server.service.GetSystemEventTypes()
+	piazza.GinReturnJson(c, resp)
+}
+
 //---------------------------------------------------------------------------
 
 func (server *Server) handleGetEventType(c *gin.Context) {
@@ -150,15 +193,109 @@ func (server *Server) handleEventTypeQuery(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleImportEventType(c *gin.Context) {
+	schema := map[string]interface{}{}
+	err := c.BindJSON(&schema)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.ImportEventType(schema, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleInferEventType(c *gin.Context) {
+	req := &EventTypeInferenceRequest{}
+	err := c.BindJSON(req)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.InferEventType(req)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetEventTypeSchema(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetEventTypeSchema(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetEventTypeStats(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetEventTypeStats(id, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetEventTypeVersions(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetEventTypeVersions(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutEventType(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	update := &EventTypeUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutEventType(id, update)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleDeleteEventType(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
-	resp := server.service.DeleteEventType(id)
+	params := piazza.NewQueryParams(c.Request)
+	cascade, err := params.GetAsString("cascade", "false")
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	var resp *piazza.JsonResponse
+	if cascade == "true" {
+		resp = server.service.CascadeDeleteEventType(id, params)
+	} else {
+		resp = server.service.DeleteEventType(id)
+	}
 	piazza.GinReturnJson(c, resp)
 }
 
 //---------------------------------------------------------------------------
 
 func (server *Server) handleGetEvent(c *gin.Context) {
+	// httprouter will not register "/event/stream" or "/event/export" next to "/event/:id"
+	switch c.Param("id") {
+	case "stream":
+		server.handleEventStream(c)
+		return
+	case "export":
+		server.handleEventExport(c)
+		return
+	}
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.GetEvent(id)
 	piazza.GinReturnJson(c, resp)
@@ -166,10 +303,37 @@ func (server *Server) handleGetEvent(c *gin.Context) {
 
 func (server *Server) handleGetAllEvents(c *gin.Context) {
 	params := piazza.NewQueryParams(c.Request)
-	resp := server.service.GetAllEvents(params)
+	resp := server.service.GetAllEvents(params, dataQueryParams(c))
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleEventExport(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	export, resp := server.service.NewEventExport(params, dataQueryParams(c))
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	c.Header("Content-Type", export.ContentType())
+	c.Status(http.StatusOK)
+	// the status has been sent, so a failure part way through can only cut the export short
+	if err := export.Write(c.Writer, c.Writer.Flush); err != nil {
+		LoggedError("Server.handleEventExport failed: %s", err)
+	}
+}
+
+// dataQueryParams collects the data.<field> query parameters, without the prefix
+func dataQueryParams(c *gin.Context) map[string]string {
+	out := map[string]string{}
+	for k, v := range c.Request.URL.Query() {
+		if strings.HasPrefix(k, "data.") && len(v) > 0 {
+			out[strings.TrimPrefix(k, "data.")] = v[0]
+		}
+	}
+	return out
+}
+
 func (server *Server) handlePostEvent(c *gin.Context) {
 	event := &Event{}
 	err := c.BindJSON(event)
@@ -211,12 +375,57 @@ func (server *Server) handleEventQuery(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutEvent(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	update := &EventUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutEvent(id, update)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleDeleteEvent(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.DeleteEvent(id)
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePostReplay(c *gin.Context) {
+	req := &ReplayRequest{}
+	err := c.BindJSON(req)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostReplay(req)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetReplay(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetReplay(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleCancelReplay(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.CancelReplay(id)
+	piazza.GinReturnJson(c, resp)
+}
+
 //---------------------------------------------------------------------------
 
 func (server *Server) handleGetTrigger(c *gin.Context) {
@@ -266,6 +475,22 @@ func (server *Server) handleTriggerQuery(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleBacktestTrigger(c *gin.Context) {
+	req := &BacktestRequest{}
+	err := c.BindJSON(req)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.BacktestTrigger(req)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handlePutTrigger(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	update := &TriggerUpdate{}
@@ -292,6 +517,20 @@ func (server *Server) handleDeleteTrigger(c *gin.Context) {
 //---------------------------------------------------------------------------
 
 func (server *Server) handleGetAlert(c *gin.Context) {
+	// httprouter will not register "/alert/stream", "/alert/summary" or "/alert/feed.atom"
+	// next to "/alert/:id"
+	if c.Param("id") == "stream" {
+		server.handleAlertStream(c)
+		return
+	}
+	if c.Param("id") == "summary" {
+		server.handleGetAlertSummary(c)
+		return
+	}
+	if c.Param("id") == "feed.atom" {
+		server.handleAlertFeed(c)
+		return
+	}
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.GetAlert(id)
 	piazza.GinReturnJson(c, resp)
@@ -303,6 +542,41 @@ func (server *Server) handleGetAllAlerts(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handleGetAlertSummary(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAlertSummary(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleAlertFeed(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	feed, resp := server.service.NewAlertFeed(params)
+	if resp != nil {
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+
+	c.Header("ETag", feed.ETag())
+	if modified := feed.LastModified(); !modified.IsZero() {
+		c.Header("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if feed.NotModified(c.Request.Header.Get("If-None-Match"), c.Request.Header.Get("If-Modified-Since")) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil || c.Request.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	byts, err := feed.Render(scheme + "://" + c.Request.Host + c.Request.URL.RequestURI())
+	if err != nil {
+		piazza.GinReturnJson(c, server.service.statusInternalError(err))
+		return
+	}
+	c.Data(http.StatusOK, "application/atom+xml; charset=utf-8", byts)
+}
+
 func (server *Server) handleAlertQuery(c *gin.Context) {
 	buf := new(bytes.Buffer)
 	_, err := buf.ReadFrom(c.Request.Body)
@@ -338,6 +612,40 @@ func (server *Server) handlePostAlert(c *gin.Context) {
 	piazza.GinReturnJson(c, resp)
 }
 
+func (server *Server) handlePutAlert(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	update := &AlertUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutAlert(id, update)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePutAlertState(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	update := &AlertStateUpdate{}
+	err := c.BindJSON(update)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PutAlertState(id, update)
+	piazza.GinReturnJson(c, resp)
+}
+
 func (server *Server) handleDeleteAlert(c *gin.Context) {
 	id := piazza.Ident(c.Param("id"))
 	resp := server.service.DeleteAlert(id)
@@ -346,6 +654,248 @@ func (server *Server) handleDeleteAlert(c *gin.Context) {
 
 //---------------------------------------------------------------------
 
+func (server *Server) handleGetTrace(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetTrace(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------------
+
+func (server *Server) handleGetAreaOfInterest(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetAreaOfInterest(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAllAreasOfInterest(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAllAreasOfInterest(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostAreaOfInterest(c *gin.Context) {
+	area := &AreaOfInterest{}
+	err := c.BindJSON(area)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostAreaOfInterest(area)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteAreaOfInterest(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteAreaOfInterest(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------------
+
+func (server *Server) handleGetIncident(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetIncident(id, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAllIncidents(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAllIncidents(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleIncidentQuery(c *gin.Context) {
+	buf := new(bytes.Buffer)
+	_, err := buf.ReadFrom(c.Request.Body)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	jsonString := buf.String()
+	params := piazza.NewQueryParams(c.Request)
+
+	resp := server.service.QueryIncidents(jsonString, params)
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------------
+
+func (server *Server) handleGetSubscription(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetSubscription(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAllSubscriptions(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	resp := server.service.GetAllSubscriptions(params)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handlePostSubscription(c *gin.Context) {
+	subscription := &Subscription{}
+	err := c.BindJSON(subscription)
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	resp := server.service.PostSubscription(subscription)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleDeleteSubscription(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.DeleteSubscription(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+func (server *Server) handleGetAlertDeliveries(c *gin.Context) {
+	id := piazza.Ident(c.Param("id"))
+	resp := server.service.GetAlertDeliveries(id)
+	piazza.GinReturnJson(c, resp)
+}
+
+//---------------------------------------------------------------------
+
+func (server *Server) handleEventStream(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	eventTypeID, err := params.GetAsID("eventTypeId", "")
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	server.serveStream(c, server.service.eventStream, "event", eventTypeID, server.service.backfillEvents)
+}
+
+func (server *Server) handleAlertStream(c *gin.Context) {
+	params := piazza.NewQueryParams(c.Request)
+	triggerID, err := params.GetAsID("triggerId", "")
+	if err != nil {
+		resp := &piazza.JsonResponse{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+			Origin:     server.origin,
+		}
+		piazza.GinReturnJson(c, resp)
+		return
+	}
+	server.serveStream(c, server.service.alertStream, "alert", triggerID, server.service.backfillAlerts)
+}
+
+// serveStream writes a Server-Sent Events stream until the client goes away or falls
+// too far behind. Clients resume with the standard Last-Event-ID header, or with the
+// lastEventId query parameter if their client library can't set headers. What they
+// missed is read back from Elasticsearch once it has left the broker's history; if
+// it can't all be found there, they are sent a "reset" event, after which they
+// should fetch what they need afresh.
+func (server *Server) serveStream(c *gin.Context, broker *streamBroker, name string, key piazza.Ident, backfill streamBackfill) {
+	lastID := piazza.Ident(c.Request.Header.Get("Last-Event-ID"))
+	if lastID == "" {
+		lastID = piazza.Ident(c.Query("lastEventId"))
+	}
+
+	sub, backlog, resumed := broker.Subscribe(key, lastID)
+	defer broker.Unsubscribe(sub)
+
+	// the subscriber was registered first, so what is published while the backlog is
+	// read can be in both; it is sent once
+	reset := false
+	backfilled := map[piazza.Ident]bool{}
+	if !resumed {
+		var err error
+		if backlog, err = backfill(lastID, key); err != nil {
+			if err != errStreamGap {
+				server.service.syslogger.Warning("Server.serveStream: could not backfill the %s stream after %s: %s", name, lastID, err)
+			}
+			backlog, reset = nil, true
+		}
+		for _, msg := range backlog {
+			backfilled[msg.ID] = true
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	write := func(msg *streamMessage) bool {
+		dat, err := json.Marshal(msg.Data)
+		if err != nil {
+			return false
+		}
+		if _, err = fmt.Fprintf(c.Writer, "id: %s\nevent: %s\ndata: %s\n\n", msg.ID, name, dat); err != nil {
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+
+	if reset {
+		if _, err := fmt.Fprint(c.Writer, "event: reset\ndata: {}\n\n"); err != nil {
+			return
+		}
+	}
+	for _, msg := range backlog {
+		if !write(msg) {
+			return
+		}
+	}
+	c.Writer.Flush()
+
+	ticker := time.NewTicker(streamKeepAlive)
+	defer ticker.Stop()
+	gone := c.Writer.CloseNotify()
+
+	for {
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				// dropped for being too slow: the client reconnects with Last-Event-ID
+				return
+			}
+			if backfilled[msg.ID] {
+				delete(backfilled, msg.ID)
+				continue
+			}
+			if !write(msg) {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-gone:
+			return
+		}
+	}
+}
+
+//---------------------------------------------------------------------
+
 func (server *Server) handleTestElasticsearchVersion(c *gin.Context) {
 	resp := server.service.TestElasticsearchVersion()
 	piazza.GinReturnJson(c, resp)
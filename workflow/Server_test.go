@@ -16,10 +16,13 @@ package workflow
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"math/rand"
+	"net/http"
 	"strconv"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -897,6 +900,322 @@ func (suite *ServerTester) Test09Elasticsearch() {
 	assert.Equal(17, data.Value)
 }
 
+func (suite *ServerTester) Test10CascadeDelete() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	trigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	_, err = client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID})
+	assert.NoError(err)
+
+	cascade, err := client.CascadeDeleteEventType(eventTypeID, true, true)
+	assert.NoError(err)
+	assert.True(cascade.DryRun)
+	assert.Equal([]piazza.Ident{trigger.TriggerID}, cascade.TriggerIDs)
+	assert.EqualValues(1, cascade.Events)
+	assert.EqualValues(1, cascade.Alerts)
+	_, err = client.GetEventType(eventTypeID)
+	assert.NoError(err)
+
+	cascade, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+	assert.NoError(err)
+	assert.True(cascade.Complete)
+	assert.Equal([]piazza.Ident{trigger.TriggerID}, cascade.TriggerIDs)
+	assert.EqualValues(1, cascade.Events)
+	assert.EqualValues(1, cascade.Alerts)
+	_, err = client.GetEventType(eventTypeID)
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test11EventTypeStats() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	defer func() {
+		_, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+		assert.NoError(err)
+	}()
+	trigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	var eventID piazza.Ident
+	for i := 0; i < 2; i++ {
+		event, err := client.PostEvent(makeTestEvent(eventTypeID))
+		assert.NoError(err)
+		eventID = event.EventID
+	}
+	_, err = client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: eventID})
+	assert.NoError(err)
+
+	stats, err := client.GetEventTypeStats(eventTypeID, 7)
+	assert.NoError(err)
+	assert.EqualValues(2, stats.Events)
+	assert.NotNil(stats.LastEventOn)
+	assert.Len(stats.Hourly, statsHours)
+	assert.EqualValues(2, stats.Hourly[len(stats.Hourly)-1].Count)
+	assert.Len(stats.Daily, 7)
+	assert.EqualValues(2, stats.Daily[len(stats.Daily)-1].Count)
+	assert.EqualValues(1, stats.Triggers)
+	assert.EqualValues(1, stats.EnabledTriggers)
+	assert.EqualValues(0, stats.DisabledTriggers)
+	assert.EqualValues(1, stats.Alerts)
+}
+
+func (suite *ServerTester) Test12AlertSummary() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	defer func() {
+		_, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+		assert.NoError(err)
+	}()
+	trigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	for _, createdBy := range []string{"alice", "alice", "bob"} {
+		_, err = client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID, CreatedBy: createdBy})
+		assert.NoError(err)
+	}
+
+	until := time.Now().Add(time.Hour)
+	summary, err := client.GetAlertSummary(until.Add(-3*time.Hour), until, "1h")
+	assert.NoError(err)
+	assert.EqualValues(3, summary.Total)
+	assert.Equal([]AlertGroupCount{{Key: trigger.TriggerID.String(), Name: trigger.Name, Count: 3}}, summary.ByTrigger)
+	assert.Len(summary.ByEventType, 1)
+	assert.Equal(eventTypeID.String(), summary.ByEventType[0].Key)
+	assert.Equal([]AlertGroupCount{{Key: "alice", Count: 2}, {Key: "bob", Count: 1}}, summary.ByCreatedBy)
+	assert.Len(summary.Histogram, 3)
+	var total int64
+	for _, bucket := range summary.Histogram {
+		total += bucket.Count
+	}
+	assert.EqualValues(3, total)
+
+	_, err = client.GetAlertSummary(until, until.Add(-time.Hour), "1h")
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test13Backtest() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	defer func() {
+		_, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+		assert.NoError(err)
+	}()
+	matching := []piazza.Ident{}
+	for _, num := range []int{17, 31, 17} {
+		event := makeTestEvent(eventTypeID)
+		event.Data["num"] = num
+		event, err = client.PostEvent(event)
+		assert.NoError(err)
+		if num == 17 {
+			matching = append(matching, event.EventID)
+		}
+	}
+
+	since := time.Now().Add(-time.Hour)
+	result, err := client.BacktestTrigger(&BacktestRequest{
+		EventTypeID: eventTypeID,
+		Condition:   map[string]interface{}{"match": map[string]interface{}{"data.num": 17}},
+		Since:       since,
+		Until:       since.Add(2 * time.Hour),
+		Interval:    "1h",
+	})
+	assert.NoError(err)
+	assert.EqualValues(3, result.TotalEvents)
+	assert.EqualValues(2, result.MatchCount)
+	assert.Len(result.SampleEventIDs, 2)
+	for _, id := range matching {
+		assert.Contains(result.SampleEventIDs, id)
+	}
+	assert.Len(result.Histogram, 2)
+	assert.EqualValues(2, result.Histogram[0].Count+result.Histogram[1].Count)
+
+	_, err = client.BacktestTrigger(&BacktestRequest{
+		EventTypeID: eventTypeID,
+		Condition:   map[string]interface{}{"match": map[string]interface{}{"data.num": 17}},
+		Since:       since,
+		Until:       since.Add(-time.Hour),
+	})
+	assert.Error(err)
+}
+
+func (suite *ServerTester) Test14PutEventType() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	defer func() {
+		_, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+		assert.NoError(err)
+	}()
+
+	mapping := map[string]interface{}{"num": "integer", "name": "string"}
+	fields := []FieldSpec{{Name: "name", Optional: true}}
+	updated, err := client.PutEventType(eventTypeID, &EventTypeUpdate{Mapping: mapping, Fields: fields, Revision: eventType.Revision})
+	assert.NoError(err)
+	assert.Equal(eventType.Revision+1, updated.Revision)
+	assert.Equal(mapping, updated.Mapping)
+	assert.Equal(fields, updated.Fields)
+
+	event := makeTestEvent(eventTypeID)
+	event.Data["name"] = "bob"
+	_, err = client.PostEvent(event)
+	assert.NoError(err)
+
+	// stale revision
+	_, err = client.PutEventType(eventTypeID, &EventTypeUpdate{Mapping: mapping, Fields: fields, Revision: eventType.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+
+	// incompatible mapping changes
+	_, err = client.PutEventType(eventTypeID, &EventTypeUpdate{Mapping: map[string]interface{}{"num": "string", "name": "string"}, Fields: fields, Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+	_, err = client.PutEventType(eventTypeID, &EventTypeUpdate{Mapping: map[string]interface{}{"name": "string"}, Fields: fields, Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	// field specs that do not fit the mapping
+	_, err = client.PutEventType(eventTypeID, &EventTypeUpdate{Mapping: mapping, Fields: []FieldSpec{{Name: "nosuchfield"}}, Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	current, err := client.GetEventType(eventTypeID)
+	assert.NoError(err)
+	assert.Equal(updated.Revision, current.Revision)
+	assert.Equal(mapping, current.Mapping)
+}
+
+func (suite *ServerTester) Test15PutEvent() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	defer func() {
+		_, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+		assert.NoError(err)
+	}()
+	event, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+
+	updated, err := client.PutEvent(event.EventID, &EventUpdate{Data: map[string]interface{}{"num": 31}, Revision: event.Revision})
+	assert.NoError(err)
+	assert.Equal(event.Revision+1, updated.Revision)
+	assert.EqualValues(31, updated.Data["num"])
+
+	// stale revision
+	_, err = client.PutEvent(event.EventID, &EventUpdate{Data: map[string]interface{}{"num": 43}, Revision: event.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+
+	// data failing validation
+	_, err = client.PutEvent(event.EventID, &EventUpdate{Data: map[string]interface{}{"num": "seventeen"}, Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+	_, err = client.PutEvent(event.EventID, &EventUpdate{Data: map[string]interface{}{"num": 43, "nosuchfield": 1}, Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	current, err := client.GetEvent(event.EventID)
+	assert.NoError(err)
+	assert.Equal(updated.Revision, current.Revision)
+	assert.EqualValues(31, current.Data["num"])
+}
+
+func (suite *ServerTester) Test16PutAlert() {
+	t := suite.T()
+	assert := assert.New(t)
+	client := suite.client
+
+	assertNoData(suite.T(), suite.client)
+	defer assertNoData(suite.T(), suite.client)
+
+	eventType, err := client.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.NoError(err)
+	eventTypeID := eventType.EventTypeID
+	defer func() {
+		_, err = client.CascadeDeleteEventType(eventTypeID, false, true)
+		assert.NoError(err)
+	}()
+	trigger, err := client.PostTrigger(makeTestTrigger([]piazza.Ident{eventTypeID}))
+	assert.NoError(err)
+	event, err := client.PostEvent(makeTestEvent(eventTypeID))
+	assert.NoError(err)
+	alert, err := client.PostAlert(&Alert{TriggerID: trigger.TriggerID, EventID: event.EventID})
+	assert.NoError(err)
+
+	notes := "looking into it"
+	updated, err := client.PutAlert(alert.AlertID, &AlertUpdate{Status: AlertStatusResolved, Notes: &notes, Revision: alert.Revision})
+	assert.NoError(err)
+	assert.Equal(alert.Revision+1, updated.Revision)
+	assert.Equal(AlertStatusResolved, updated.Status)
+	assert.Equal(notes, updated.Notes)
+
+	// stale revision
+	_, err = client.PutAlert(alert.AlertID, &AlertUpdate{Status: AlertStatusOpen, Revision: alert.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "409")
+
+	// a resolved alert can only be reopened
+	_, err = client.PutAlert(alert.AlertID, &AlertUpdate{Status: AlertStatusAcknowledged, Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+	_, err = client.PutAlert(alert.AlertID, &AlertUpdate{Status: "bogus", Revision: updated.Revision})
+	assert.Error(err)
+	assert.Contains(err.Error(), "400")
+
+	current, err := client.GetAlert(alert.AlertID)
+	assert.NoError(err)
+	assert.Equal(updated.Revision, current.Revision)
+	assert.Equal(AlertStatusResolved, current.Status)
+}
+
 func printJSON(msg string, input interface{}) {
 	if input != nil {
 		results, err := json.Marshal(input)
@@ -908,3 +1227,56 @@ func printJSON(msg string, input interface{}) {
 		log.Printf("\t%s: null\n", msg)
 	}
 }
+
+// mappingFailer refuses to change an index's mappings once fail is set
+type mappingFailer struct {
+	elasticsearch.IIndex
+	fail *bool
+}
+
+func (f *mappingFailer) SetMapping(typename string, jsn piazza.JsonString) error {
+	if *f.fail {
+		return errors.New("mapping refused")
+	}
+	return f.IIndex.SetMapping(typename, jsn)
+}
+
+func TestPutEventTypeRestoresOnMappingFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	fail := false
+	service := newTestService(t, func(esi elasticsearch.IIndex) elasticsearch.IIndex {
+		if esi.IndexName() != keyEvents {
+			return esi
+		}
+		return &mappingFailer{IIndex: esi, fail: &fail}
+	})
+	resp := service.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.False(resp.IsError(), resp.Message)
+	eventType := resp.Data.(*EventType)
+
+	fail = true
+	resp = service.PutEventType(eventType.EventTypeID, &EventTypeUpdate{
+		Mapping:  map[string]interface{}{"num": "integer", "name": "string"},
+		Fields:   []FieldSpec{{Name: "name", Optional: true}},
+		Revision: eventType.Revision,
+	})
+	assert.Equal(http.StatusInternalServerError, resp.StatusCode)
+
+	// the eventType is as it was, and can still be updated at its old revision
+	current, version, found, err := service.eventTypeDB.GetOneVersioned(eventType.EventTypeID)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(eventType.Revision, current.Revision)
+	assert.Empty(current.Fields)
+	assert.Equal(makeTestEventType("").Mapping, service.removeUniqueParams(current.Name, current.Mapping))
+	assert.EqualValues(3, version)
+
+	fail = false
+	resp = service.PutEventType(eventType.EventTypeID, &EventTypeUpdate{
+		Mapping:  map[string]interface{}{"num": "integer", "name": "string"},
+		Fields:   []FieldSpec{{Name: "name", Optional: true}},
+		Revision: eventType.Revision,
+	})
+	assert.Equal(http.StatusOK, resp.StatusCode, resp.Message)
+}
@@ -20,12 +20,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"os"
 	"reflect"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
@@ -44,6 +46,11 @@ const keyEvents = "events"
 const keyTriggers = "triggers"
 const keyAlerts = "alerts"
 const keyCrons = "crons"
+const keyAreas = "areas"
+const keySubscriptions = "subscriptions"
+const keyDeliveries = "deliveries"
+const keyIncidents = "incidents"
+const keyReplays = "replays"
 const keyTestElasticsearch = "testElasticsearch"
 
 type Service struct {
@@ -52,6 +59,11 @@ type Service struct {
 	triggerDB           *TriggerDB
 	alertDB             *AlertDB
 	cronDB              *CronDB
+	areaDB              *AreaOfInterestDB
+	subscriptionDB      *SubscriptionDB
+	deliveryDB          *DeliveryDB
+	incidentDB          *IncidentDB
+	replayDB            *ReplayDB
 	testElasticsearchDB *TestElasticsearchDB
 
 	stats Stats
@@ -63,6 +75,19 @@ type Service struct {
 
 	cron *cron.Cron
 
+	eventStream *streamBroker
+	alertStream *streamBroker
+
+	replays *replayRegistry
+
+	notifier *notifier
+
+	incidents *incidentGrouper
+
+	// the system EventTypes by name, and how each was reconciled at startup
+	systemEventTypes      map[string]*SystemEventType
+	systemEventTypeStatus []SystemEventTypeStatus
+
 	origin string
 }
 
@@ -81,6 +106,11 @@ func (service *Service) Init(
 	triggersIndex := (*indices)[keyTriggers]
 	alertsIndex := (*indices)[keyAlerts]
 	cronIndex := (*indices)[keyCrons]
+	areasIndex := (*indices)[keyAreas]
+	subscriptionsIndex := (*indices)[keySubscriptions]
+	deliveriesIndex := (*indices)[keyDeliveries]
+	incidentsIndex := (*indices)[keyIncidents]
+	replaysIndex := (*indices)[keyReplays]
 	testElasticsearchIndex := (*indices)[keyTestElasticsearch]
 
 	var err error
@@ -112,6 +142,26 @@ func (service *Service) Init(
 		return err
 	}
 
+	if service.areaDB, err = NewAreaOfInterestDB(service, areasIndex); err != nil {
+		return err
+	}
+
+	if service.subscriptionDB, err = NewSubscriptionDB(service, subscriptionsIndex); err != nil {
+		return err
+	}
+
+	if service.deliveryDB, err = NewDeliveryDB(service, deliveriesIndex); err != nil {
+		return err
+	}
+
+	if service.incidentDB, err = NewIncidentDB(service, incidentsIndex); err != nil {
+		return err
+	}
+
+	if service.replayDB, err = NewReplayDB(service, replaysIndex); err != nil {
+		return err
+	}
+
 	if service.testElasticsearchDB, err = NewTestElasticsearchDB(service, testElasticsearchIndex); err != nil {
 		return err
 	}
@@ -119,6 +169,15 @@ func (service *Service) Init(
 	service.cron = cron.New()
 	service.origin = string(sys.Name)
 
+	service.eventStream = newStreamBroker(streamHistorySize, streamBufferSize)
+	service.alertStream = newStreamBroker(streamHistorySize, streamBufferSize)
+
+	service.replays = newReplayRegistry()
+
+	service.notifier = newNotifier(service)
+
+	service.incidents = newIncidentGrouper()
+
 	// allow the database time to settle
 	//time.Sleep(time.Second * 5)
 	pollingFn := elasticsearch.GetData(func() (bool, error) {
@@ -151,43 +210,12 @@ func (service *Service) Init(
 	}
 	//log.Printf("SETUP INDEX: %t", ok)
 
-	// Ingest event type
-	ingestEventType := &EventType{Name: ingestTypeName, CreatedBy: sys.PiazzaSystem}
-	ingestEventTypeMapping := map[string]interface{}{
-		"dataId":   "string",
-		"dataType": "string",
-		"epsg":     "integer",
-		"minX":     "double",
-		"minY":     "double",
-		"maxX":     "double",
-		"maxY":     "double",
-		"hosted":   "boolean",
-	}
-	ingestEventType.Mapping = ingestEventTypeMapping
-	//log.Println("  Creating piazza:ingest eventtype")
-	postedIngestEventType := service.PostEventType(ingestEventType)
-	//log.Printf("  Created piazza:ingest eventtype: %d", postedIngestEventType.StatusCode)
-	if postedIngestEventType.StatusCode == 201 { // everything is ok
-		service.syslogger.Info("  SUCCESS Created piazza:ingest eventtype: %s", postedIngestEventType.StatusCode)
-	} else { // something is wrong
-		service.syslogger.Info("  ERROR creating piazza:ingest eventtype: %s", postedIngestEventType.StatusCode)
-	}
-
-	// Execution Completed event type
-	executionCompletedType := &EventType{Name: executeTypeName, CreatedBy: sys.PiazzaSystem}
-	executionCompletedTypeMapping := map[string]interface{}{
-		"jobId":  "string",
-		"status": "string",
-		"dataId": "string",
-	}
-	executionCompletedType.Mapping = executionCompletedTypeMapping
-	postedExecutionCompletedType := service.PostEventType(executionCompletedType)
-	if postedExecutionCompletedType.StatusCode == 201 { // everything is ok
-		service.syslogger.Info("  SUCCESS Created piazza:executionComplete eventtype: %s", postedExecutionCompletedType.StatusCode)
-	} else { // something is wrong or it was already there
-		service.syslogger.Info("  ERROR creating piazza:excutionComplete eventtype: %s", postedExecutionCompletedType.StatusCode)
+	if err = service.reconcileSystemEventTypes(); err != nil {
+		return err
 	}
 
+	service.notifier.start()
+
 	return nil
 }
 
@@ -291,6 +319,23 @@ func (service *Service) statusInternalError(err error) *piazza.JsonResponse {
 	}
 }
 
+func (service *Service) statusConflict(err error) *piazza.JsonResponse {
+	return &piazza.JsonResponse{
+		StatusCode: http.StatusConflict,
+		Message:    err.Error(),
+		Origin:     service.origin,
+	}
+}
+
+// statusWriteFailed is a 409 if a versioned write lost a race with another update,
+// else a 500
+func (service *Service) statusWriteFailed(err error) *piazza.JsonResponse {
+	if err == errVersionConflict {
+		return service.statusConflict(err)
+	}
+	return service.statusInternalError(err)
+}
+
 func (service *Service) statusNotFound(err error) *piazza.JsonResponse {
 	return &piazza.JsonResponse{
 		StatusCode: http.StatusNotFound,
@@ -454,16 +499,17 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 
 	eventType.EventTypeID = service.newIdent()
 	eventType.CreatedOn = piazza.NewTimeStamp()
+	eventType.Version = 1
+	eventType.History = nil
 
-	vars, err := piazza.GetVarsFromStruct(eventType.Mapping)
-	if err != nil {
-		return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: %s", err))
-	}
-	for k := range vars {
+	for k := range mappingVars(eventType.Mapping) {
 		if strings.Contains(k, "~") {
 			return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: Variable names cannot contain '%s~': [%s]", eventType.Name, k))
 		}
 	}
+	if err = validateFieldSpecs(eventType.Mapping, eventType.Fields); err != nil {
+		return service.statusBadRequest(LoggedError("EventTypeDB.PostData failed: %s", err))
+	}
 
 	response := *eventType
 
@@ -492,11 +538,211 @@ func (service *Service) PostEventType(eventType *EventType) *piazza.JsonResponse
 	return service.statusCreated(&response)
 }
 
-// IsSystemEvent returns true if the event was generated within Piazza.
-//
-// TODO: Instead, check if createdBy=system
-func IsSystemEvent(name string) bool {
-	return name == ingestTypeName || name == executeTypeName
+// PutEventType updates an EventType's mapping and field specs, extending the events'
+// Elasticsearch mapping in place. Changes that existing events would not satisfy
+// are refused, as are updates made against an old revision.
+func (service *Service) PutEventType(id piazza.Ident, update *EventTypeUpdate) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, version, found, err := service.eventTypeDB.GetOneVersioned(id)
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if system := service.systemEventType(eventType.Name); system != nil && system.ProtectUpdate {
+		return service.statusBadRequest(errors.New("Updating system eventTypes is prohibited"))
+	}
+	if eventType.Revision != update.Revision {
+		return service.statusConflict(fmt.Errorf("eventType %s is at revision %d, not %d", id, eventType.Revision, update.Revision))
+	}
+	return service.updateEventType(eventType, version, update)
+}
+
+// updateEventType checks an update against an EventType read at version and applies
+// it, keeping the schema it replaces in the EventType's history.
+func (service *Service) updateEventType(eventType *EventType, version int64, update *EventTypeUpdate) *piazza.JsonResponse {
+	id := eventType.EventTypeID
+	var err error
+
+	for k := range mappingVars(update.Mapping) {
+		if strings.Contains(k, "~") {
+			return service.statusBadRequest(LoggedError("Service.PutEventType failed: Variable names cannot contain '%s~': [%s]", eventType.Name, k))
+		}
+	}
+	if err = validateFieldSpecs(update.Mapping, update.Fields); err != nil {
+		return service.statusBadRequest(LoggedError("Service.PutEventType failed: %s", err))
+	}
+	oldMapping := service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	violations, retyped := checkMappingCompatible(oldMapping, update.Mapping, fieldSpecsByPath(update.Fields))
+	if len(retyped) > 0 {
+		return service.statusBadRequest(fmt.Errorf("the type of an existing field cannot change, even with force; create a new eventType instead: %s", strings.Join(retyped, "; ")))
+	}
+	if len(violations) > 0 && !update.Force {
+		return service.statusBadRequest(fmt.Errorf("incompatible mapping change, which force would allow: %s", strings.Join(violations, "; ")))
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatingEventType", id, "Service.PutEventType: User is updating eventType [%s] (force=%t)", id, update.Force)
+
+	if !reflect.DeepEqual(oldMapping, update.Mapping) || !reflect.DeepEqual(eventType.Fields, update.Fields) {
+		now := piazza.NewTimeStamp()
+		eventType.History = append(eventType.History, EventTypeSchema{
+			Version:    eventTypeVersion(eventType),
+			Mapping:    oldMapping,
+			Fields:     eventType.Fields,
+			ReplacedOn: &now,
+		})
+		eventType.Version = eventTypeVersion(eventType) + 1
+	}
+	previous := *eventType
+	eventType.Mapping = service.addUniqueParams(eventType.Name, update.Mapping)
+	eventType.Fields = update.Fields
+	eventType.Revision++
+
+	// save the eventType first, so that an update racing this one fails before the
+	// events' mapping is touched; Elasticsearch mappings cannot be taken back, so if
+	// extending it fails the saved eventType is put back as it was
+	if err = service.eventTypeDB.PutVersioned(eventType, version); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingEventTypeFailure", id, "Service.PutEventType: User failed to update eventType [%s]", id)
+		return service.statusWriteFailed(err)
+	}
+	if err = service.eventDB.AddMapping(eventType.Name, eventType.Mapping, "pz-workflow"); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingEventTypeFailure", id, "Service.PutEventType: User failed to update eventType [%s]", id)
+		// the write above moved the document on by one version
+		if restoreErr := service.eventTypeDB.PutVersioned(&previous, version+1); restoreErr != nil {
+			_ = LoggedError("Service.PutEventType: restoring eventType [%s] failed: %s", id, restoreErr)
+		}
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatedEventType", id, "Service.PutEventType: User successfully updated eventType [%s] to version %d, revision %d", id, eventType.Version, eventType.Revision)
+
+	eventType.Mapping = update.Mapping
+	return service.statusOK(eventType)
+}
+
+// ImportEventType creates an EventType from a JSON Schema of its events' data. The
+// name is the "name" query parameter, else the schema's title. With dryRun=true the
+// EventType is returned without being created.
+func (service *Service) ImportEventType(schema map[string]interface{}, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	name, err := params.GetAsString("name", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if name == "" {
+		name, _ = schema["title"].(string)
+	}
+	if name == "" {
+		return service.statusBadRequest(errors.New("the eventType needs a name: give a name parameter or a schema title"))
+	}
+	createdBy, err := params.GetAsString("createdBy", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	dryRun, err := params.GetAsString("dryRun", "false")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	mapping, fields, err := eventTypeFromJSONSchema(schema)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	eventType := &EventType{Name: name, Mapping: mapping, Fields: fields, CreatedBy: createdBy}
+
+	if dryRun == "true" {
+		if err = validateFieldSpecs(mapping, fields); err != nil {
+			return service.statusBadRequest(err)
+		}
+		return service.statusOK(eventType)
+	}
+	return service.PostEventType(eventType)
+}
+
+// InferEventType proposes a mapping for the samples' data and, if asked, creates the
+// EventType. Creation is refused while the samples conflict, since the proposal would
+// reject some of them.
+func (service *Service) InferEventType(req *EventTypeInferenceRequest) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if len(req.Samples) == 0 {
+		return service.statusBadRequest(errors.New("at least one sample is needed"))
+	}
+	if len(req.Samples) > maxInferenceSamples {
+		return service.statusBadRequest(fmt.Errorf("at most %d samples are allowed", maxInferenceSamples))
+	}
+
+	inference := inferEventType(req.Samples)
+	if !req.Create {
+		return service.statusOK(inference)
+	}
+
+	if req.Name == "" {
+		return service.statusBadRequest(errors.New("creating the eventType needs a name"))
+	}
+	if len(inference.Conflicts) > 0 {
+		fields := make([]string, len(inference.Conflicts))
+		for i, c := range inference.Conflicts {
+			fields[i] = c.Field
+		}
+		return service.statusBadRequest(fmt.Errorf("the samples conflict, so the eventType was not created: %s", strings.Join(fields, ", ")))
+	}
+
+	resp := service.PostEventType(&EventType{
+		Name:      req.Name,
+		Mapping:   inference.Mapping,
+		Fields:    inference.Fields,
+		CreatedBy: req.CreatedBy,
+	})
+	if resp.StatusCode != http.StatusCreated {
+		return resp
+	}
+	inference.EventType = resp.Data.(*EventType)
+	return service.statusCreated(inference)
+}
+
+// GetEventTypeSchema describes an EventType's event data as a JSON Schema
+func (service *Service) GetEventTypeSchema(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	mapping := service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	schema := jsonSchemaFromEventType(eventType.Name, mapping, eventType.Fields)
+	return service.statusOK(schema)
+}
+
+// GetEventTypeVersions lists every version of an EventType's schema, oldest first
+func (service *Service) GetEventTypeVersions(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	eventType, found, err := service.eventTypeDB.GetOne(id, "pz-workflow")
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	versions := append([]EventTypeSchema{}, eventType.History...)
+	versions = append(versions, EventTypeSchema{
+		Version: eventTypeVersion(eventType),
+		Mapping: service.removeUniqueParams(eventType.Name, eventType.Mapping),
+		Fields:  eventType.Fields,
+	})
+	return service.statusOK(versions)
+}
+
+// eventTypeVersion treats EventTypes from before versioning as version 1
+func eventTypeVersion(eventType *EventType) int {
+	if eventType.Version < 1 {
+		return 1
+	}
+	return eventType.Version
 }
 
 // DeleteEventType TODO
@@ -513,7 +759,7 @@ func (service *Service) DeleteEventType(id piazza.Ident) *piazza.JsonResponse {
 	}
 	// Only check for system events or "in use" if found
 	if found {
-		if eventType != nil && IsSystemEvent(eventType.Name) {
+		if system := service.systemEventType(eventType.Name); system != nil && system.ProtectDelete {
 			return service.statusBadRequest(errors.New("Deleting system eventTypes is prohibited"))
 		}
 
@@ -581,51 +827,98 @@ func (service *Service) GetEvent(id piazza.Ident) *piazza.JsonResponse {
 	return service.statusOK(event)
 }
 
-// GetAllEvents TODO
-func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.JsonResponse {
-	defer service.handlePanic()
-	format, err := piazza.NewJsonPagination(params)
-	if err != nil {
-		return service.statusBadRequest(err)
-	}
-
-	// if both specified, "by id"" wins
+// eventTypeFromParams resolves the eventTypeId or eventTypeName query parameter; if both
+// are given, "by id" wins. It returns the Elasticsearch type to search ("" for all) and
+// the EventType itself, which is only looked up by name if load is set.
+func (service *Service) eventTypeFromParams(params *piazza.HttpQueryParams, load bool) (string, *EventType, *piazza.JsonResponse) {
 	eventTypeID, err := params.GetAsString("eventTypeId", "")
 	if err != nil {
-		return service.statusBadRequest(err)
+		return "", nil, service.statusBadRequest(err)
 	}
 	eventTypeName, err := params.GetAsString("eventTypeName", "")
 	if err != nil {
-		return service.statusBadRequest(err)
+		return "", nil, service.statusBadRequest(err)
 	}
 
-	var query string
-
-	// Get the eventTypeName corresponding to the eventTypeId
 	if eventTypeID != "" {
-		var eventType *EventType
-		var found bool
-		eventType, found, err = service.eventTypeDB.GetOne(piazza.Ident(eventTypeID), "pz-workflow")
+		eventType, found, err := service.eventTypeDB.GetOne(piazza.Ident(eventTypeID), "pz-workflow")
 		if !found {
-			return service.statusNotFound(err)
+			return "", nil, service.statusNotFound(err)
 		}
 		if err != nil {
-			return service.statusBadRequest(err)
+			return "", nil, service.statusBadRequest(err)
 		}
-		query = eventType.Name
-	} else if eventTypeName != "" {
-		query = eventTypeName
-	} else {
+		return eventType.Name, eventType, nil
+	}
+	if eventTypeName == "" {
 		// no query param specified, get 'em all
-		query = ""
+		return "", nil, nil
+	}
+	if !load {
+		return eventTypeName, nil, nil
 	}
 
-	service.syslogger.Audit("pz-workflow", "gettingAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User is getting all events")
+	id, found, err := service.eventTypeDB.GetIDByName(nil, eventTypeName, "pz-workflow")
+	if err != nil {
+		return "", nil, service.statusBadRequest(err)
+	}
+	if !found {
+		return "", nil, service.statusNotFound(fmt.Errorf("EventType %s does not exist", eventTypeName))
+	}
+	eventType, _, err := service.eventTypeDB.GetOne(*id, "pz-workflow")
+	if err != nil {
+		return "", nil, service.statusBadRequest(err)
+	}
+	return eventTypeName, eventType, nil
+}
 
-	events, totalHits, err := service.eventDB.GetAll(query, format, "pz-workflow")
+// GetAllEvents lists events, optionally narrowed by an EventFilter. dataFilters holds
+// the data.* query parameters, which HttpQueryParams has no way to enumerate.
+func (service *Service) GetAllEvents(params *piazza.HttpQueryParams, dataFilters map[string]string) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
 	if err != nil {
-		service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
-		return service.statusInternalError(err)
+		return service.statusBadRequest(err)
+	}
+	filter, err := parseEventFilter(params, dataFilters)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	// the filter needs the EventType's mapping
+	query, eventType, resp := service.eventTypeFromParams(params, !filter.IsEmpty())
+	if resp != nil {
+		return resp
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User is getting all events")
+
+	var events []Event
+	var totalHits int64
+	if filter.IsEmpty() {
+		events, totalHits, err = service.eventDB.GetAll(query, format, "pz-workflow")
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
+			return service.statusInternalError(err)
+		}
+	} else {
+		filterQuery, err := service.eventFilterQuery(filter, eventType)
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		dsl, err := json.Marshal(map[string]interface{}{"query": filterQuery})
+		if err != nil {
+			return service.statusInternalError(err)
+		}
+		jsonString, err := syncPagination(string(dsl), *format)
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		events, totalHits, err = service.eventDB.GetEventsByDslQuery(query, jsonString, "pz-workflow")
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", "gettingAllEventsFailure", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User failed to get all events")
+			return service.statusBadRequest(err)
+		}
 	}
 	for i := 0; i < len(events); i++ {
 		eventType, found, err := service.eventTypeDB.GetOne(events[i].EventTypeID, "pz-workflow")
@@ -635,7 +928,7 @@ func (service *Service) GetAllEvents(params *piazza.HttpQueryParams) *piazza.Jso
 		}
 		events[i].Data = service.removeUniqueParams(eventType.Name, events[i].Data)
 	}
-	resp := service.statusOK(events)
+	resp = service.statusOK(events)
 
 	service.syslogger.Audit("pz-workflow", "gotAllEvents", service.eventDB.Esi.IndexName(), "Service.GetAllEvents: User successfully got all events")
 
@@ -668,10 +961,23 @@ func (service *Service) PostRepeatingEvent(event *Event) *piazza.JsonResponse {
 	event.EventID = service.newIdent()
 	event.CreatedOn = piazza.NewTimeStamp()
 
+	if event.Data, err = applyFieldSpecs(eventType.Fields, event.Data, event.CreatedOn); err != nil {
+		return service.statusInternalError(err)
+	}
+	if resp := service.correlateEvent(event, eventType); resp != nil {
+		return resp
+	}
+	event.EventTypeVersion = eventTypeVersion(eventType)
+
 	response := *event
 
 	event.Data = service.addUniqueParams(eventType.Name, event.Data)
 
+	// Check the data now, rather than after the job has been scheduled
+	if err = service.eventDB.verifyEventReadyToPost(event); err != nil {
+		return service.statusBadRequest(err)
+	}
+
 	service.syslogger.Audit(event.CreatedBy, "creatingCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] is creating cron event [%s]", event.CreatedBy, event.EventID)
 
 	if err = service.cron.AddJob(event.CronSchedule, cronEvent{event, eventType.Name, service}); err != nil {
@@ -696,6 +1002,8 @@ func (service *Service) PostRepeatingEvent(event *Event) *piazza.JsonResponse {
 
 	service.syslogger.Audit(event.CreatedBy, "createdCronEvent", event.EventID, "Service.PostRepeatingEvent: User [%s] successfully created cron event [%s] on schedule [%s]", event.CreatedBy, event.EventID, event.CronSchedule)
 
+	service.eventStream.Publish(&streamMessage{ID: response.EventID, Key: response.EventTypeID, Data: &response})
+
 	service.stats.IncrEvents()
 
 	return service.statusCreated(&response)
@@ -712,6 +1020,14 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 	event.EventID = service.newIdent()
 	event.CreatedOn = piazza.NewTimeStamp()
 
+	if event.Data, err = applyFieldSpecs(eventType.Fields, event.Data, event.CreatedOn); err != nil {
+		return service.statusInternalError(err)
+	}
+	if resp := service.correlateEvent(event, eventType); resp != nil {
+		return resp
+	}
+	event.EventTypeVersion = eventTypeVersion(eventType)
+
 	response := *event
 
 	event.Data = service.addUniqueParams(eventType.Name, event.Data)
@@ -725,6 +1041,12 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 
 	service.syslogger.Audit(event.CreatedBy, "createdEvent", event.EventID, "Service.PostEvent: User [%s] successfully created event [%s]", event.CreatedBy, event.EventID)
 
+	service.eventStream.Publish(&streamMessage{ID: response.EventID, Key: response.EventTypeID, Data: &response})
+
+	if eventType.Name == executeTypeName {
+		service.recordJobOutcome(event, response.Data)
+	}
+
 	{
 		// Find triggers associated with event
 		triggerIDs, err1 := service.eventDB.PercolateEventData(eventType.Name, event.Data, event.EventID, event.CreatedBy)
@@ -734,6 +1056,7 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 
 		// For each trigger,  apply the event data and submit job
 		var waitGroup sync.WaitGroup
+		var resultsLock sync.Mutex
 
 		results := make(map[piazza.Ident]*piazza.JsonResponse)
 
@@ -742,82 +1065,15 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 			go func(triggerID piazza.Ident) {
 				defer waitGroup.Done()
 
-				trigger, found, err2 := service.triggerDB.GetOne(triggerID, event.CreatedBy)
-				if err2 != nil {
-					results[triggerID] = service.statusBadRequest(err2)
-					return
-				}
-				if !found {
-					// Don't fail for this, just log something and continue to the next trigger id
-					service.syslogger.Warning("Percolation error: Trigger %s does not exist", string(triggerID))
-					return
-				}
-				if !trigger.Enabled {
-					//results[triggerID] = statusOK(triggerID)
-					return
-				}
-
-				// Not the best way to do this, but should disallow Triggers from firing if they
-				// don't have the same Eventtype as the Event
-				// Would rather have this done via the percolation itself ...
-				if eventType.EventTypeID != trigger.EventTypeID {
-					return
-				}
-
-				// jobID gets sent through Kafka as the key
-				job := trigger.Job
-				jobID := service.newIdent()
-
-				jobInstance, err4 := json.Marshal(job)
-				if err4 != nil {
-					results[triggerID] = service.statusInternalError(err4)
-					return
-				}
-				jobString := string(jobInstance)
-
-				idamURL, err5 := service.sys.GetURL(piazza.PzIdam)
-				service.syslogger.Info("Requesting pz-idam url: %s", idamURL)
-				if err5 == nil { //Mocking
-					service.syslogger.Audit("pz-workflow", "createJobRequestAccess", "pz-idam", "User [%s] POSTed event [%s] requesting access to trigger [%s] created by [%s]", event.CreatedBy, event.EventID, trigger.TriggerID, trigger.CreatedBy)
-					auth, err6 := piazza.RequestAuthZAccess(idamURL, eventType.CreatedBy)
-					service.syslogger.Info("Pz-idam authoriazation for user [%s]: %t", eventType.CreatedBy, auth)
-					if err6 != nil {
-						results[triggerID] = service.statusInternalError(err6)
-						service.syslogger.Audit("pz-workflow", "createJobRequestAccessFailure", "pz-idam", "Event [%s] firing trigger [%s] could not get access to create job", event.EventID, trigger.TriggerID)
-						return
-					} else if !auth {
-						results[triggerID] = service.statusForbidden(errors.New("Access to create job denied"))
-						service.syslogger.Audit("pz-workflow", "createJobRequestAccessDenied", "pz-idam", "Event [%s] firing trigger [%s] was denied access to create job", event.EventID, trigger.TriggerID)
-						return
-					}
-				}
-
-				service.syslogger.Audit("pz-workflow", "createJobRequestAccessGranted", "pz-idam", "Event [%s] firing trigger [%s] was granted access to create job", event.EventID, trigger.TriggerID)
-				service.syslogger.Info("job [%s] submission by event [%s] using trigger [%s]: %s\n", jobID, event.EventID, triggerID, jobString)
-
-				// Not very robust,  need to find a better way
-				for key, value := range event.Data[eventType.Name].(map[string]interface{}) {
-					jobString = strings.Replace(jobString, "$"+key, fmt.Sprintf("%v", value), -1)
+				trigger, resp := service.lookupFireableTrigger(triggerID, eventType, event.CreatedBy)
+				if resp == nil && trigger != nil {
+					resp = service.fireTrigger(trigger, event, eventType)
 				}
-
-				//log.Printf("JOB ID: %s", jobID)
-				//log.Printf("JOB STRING: %s", jobString)
-
-				err7 := service.sendToKafka(jobString, jobID, trigger.CreatedBy)
-				if err7 != nil {
-					results[triggerID] = service.statusInternalError(err7)
-					return
-				}
-
-				service.stats.IncrTriggerJobs()
-
-				alert := Alert{EventID: event.EventID, TriggerID: triggerID, JobID: jobID, CreatedBy: trigger.CreatedBy}
-				if resp := service.PostAlert(&alert); resp.IsError() {
-					// resp will be a statusInternalError or statusBadRequest
+				if resp != nil {
+					resultsLock.Lock()
 					results[triggerID] = resp
-					return
+					resultsLock.Unlock()
 				}
-
 			}(triggerID)
 		}
 
@@ -835,28 +1091,199 @@ func (service *Service) PostEvent(event *Event) *piazza.JsonResponse {
 	return service.statusCreated(&response)
 }
 
-func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
-	defer service.handlePanic()
-	format, err := piazza.NewJsonPagination(params)
-	if err != nil {
-		return service.statusBadRequest(err)
+// correlateEvent fills in the event's CorrelationID and ParentEventID, which the poster
+// may have left empty. An executionComplete event is the child of the event whose
+// trigger started its job; any other event without a parent starts a new chain.
+// Finding that job's alert is best-effort: if it fails, the event starts its own chain
+// rather than being lost. The event's data must not yet be wrapped in its EventType
+// name. A non-nil response is an error.
+func (service *Service) correlateEvent(event *Event, eventType *EventType) *piazza.JsonResponse {
+	if event.ParentEventID == "" && eventType.Name == executeTypeName {
+		if jobID, ok := event.Data["jobId"].(string); ok && jobID != "" {
+			alert, err := service.alertDB.GetOneByJobID(piazza.Ident(jobID), event.CreatedBy)
+			if err != nil {
+				service.syslogger.Warning("Service.correlateEvent: could not look up the alert of job %s, so event %s is not correlated with it: %s", jobID, event.EventID, err)
+			}
+			if alert != nil {
+				event.ParentEventID = alert.EventID
+				if event.CorrelationID == "" {
+					event.CorrelationID = alert.CorrelationID
+				}
+			}
+		}
 	}
 
-	// if both specified, "by id"" wins
-	eventTypeID, err := params.GetAsString("eventTypeId", "")
-	if err != nil {
-		return service.statusBadRequest(err)
+	if event.ParentEventID != "" && event.CorrelationID == "" {
+		parents, err := service.eventDB.GetByIDs([]piazza.Ident{event.ParentEventID}, event.CreatedBy)
+		if err != nil {
+			return service.statusInternalError(err)
+		}
+		if len(parents) == 0 || parents[0].EventID != event.ParentEventID {
+			return service.statusBadRequest(fmt.Errorf("parent event %s does not exist", event.ParentEventID))
+		}
+		// events from before correlation ids are their own chain
+		event.CorrelationID = parents[0].CorrelationID
+		if event.CorrelationID == "" {
+			event.CorrelationID = parents[0].EventID
+		}
 	}
-	eventTypeName, err := params.GetAsString("eventTypeName", "")
+
+	if event.CorrelationID == "" {
+		event.CorrelationID = event.EventID
+	}
+	return nil
+}
+
+// lookupFireableTrigger returns the trigger if it should fire for an event of the given
+// EventType, or nil if it should be skipped. A non-nil response is an error.
+func (service *Service) lookupFireableTrigger(triggerID piazza.Ident, eventType *EventType, actor string) (*Trigger, *piazza.JsonResponse) {
+	trigger, found, err := service.triggerDB.GetOne(triggerID, actor)
 	if err != nil {
-		return service.statusBadRequest(err)
+		return nil, service.statusBadRequest(err)
+	}
+	if !found {
+		// Don't fail for this, just log something and continue to the next trigger id
+		service.syslogger.Warning("Percolation error: Trigger %s does not exist", string(triggerID))
+		return nil, nil
+	}
+	if !trigger.Enabled {
+		return nil, nil
 	}
 
-	var query string
+	// Not the best way to do this, but should disallow Triggers from firing if they
+	// don't have the same Eventtype as the Event
+	// Would rather have this done via the percolation itself ...
+	if eventType.EventTypeID != trigger.EventTypeID {
+		return nil, nil
+	}
 
-	// Get the eventTypeName corresponding to the eventTypeId
-	if eventTypeID != "" {
-		var eventType *EventType
+	return trigger, nil
+}
+
+// fireTrigger applies the event data to the trigger's job, records an alert and
+// submits the job. The event's Data must still carry its unique params.
+func (service *Service) fireTrigger(trigger *Trigger, event *Event, eventType *EventType) *piazza.JsonResponse {
+	triggerID := trigger.TriggerID
+
+	// jobID gets sent through Kafka as the key
+	job := trigger.Job
+	jobID := service.newIdent()
+
+	jobInstance, err := json.Marshal(JobMessage{
+		JobRequest:    job,
+		CorrelationID: event.CorrelationID,
+		ParentEventID: event.EventID,
+	})
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	jobString := string(jobInstance)
+
+	idamURL, err := service.sys.GetURL(piazza.PzIdam)
+	service.syslogger.Info("Requesting pz-idam url: %s", idamURL)
+	if err == nil { //Mocking
+		service.syslogger.Audit("pz-workflow", "createJobRequestAccess", "pz-idam", "User [%s] POSTed event [%s] requesting access to trigger [%s] created by [%s]", event.CreatedBy, event.EventID, trigger.TriggerID, trigger.CreatedBy)
+		auth, err := piazza.RequestAuthZAccess(idamURL, eventType.CreatedBy)
+		service.syslogger.Info("Pz-idam authoriazation for user [%s]: %t", eventType.CreatedBy, auth)
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", "createJobRequestAccessFailure", "pz-idam", "Event [%s] firing trigger [%s] could not get access to create job", event.EventID, trigger.TriggerID)
+			return service.statusInternalError(err)
+		} else if !auth {
+			service.syslogger.Audit("pz-workflow", "createJobRequestAccessDenied", "pz-idam", "Event [%s] firing trigger [%s] was denied access to create job", event.EventID, trigger.TriggerID)
+			return service.statusForbidden(errors.New("Access to create job denied"))
+		}
+	}
+
+	service.syslogger.Audit("pz-workflow", "createJobRequestAccessGranted", "pz-idam", "Event [%s] firing trigger [%s] was granted access to create job", event.EventID, trigger.TriggerID)
+	service.syslogger.Info("job [%s] submission by event [%s] using trigger [%s]: %s\n", jobID, event.EventID, triggerID, jobString)
+
+	// Not very robust,  need to find a better way
+	for key, value := range event.Data[eventType.Name].(map[string]interface{}) {
+		jobString = strings.Replace(jobString, "$"+key, fmt.Sprintf("%v", value), -1)
+	}
+
+	// an alert that cannot be grouped is still raised, just outside any incident
+	claim, err := service.claimIncident(trigger, event, eventType)
+	if err != nil {
+		service.syslogger.Warning("Event [%s] firing trigger [%s] could not be grouped into an incident: %s", event.EventID, triggerID, err)
+	}
+
+	alert := Alert{
+		EventID:       event.EventID,
+		TriggerID:     triggerID,
+		JobID:         jobID,
+		JobStatus:     JobStatusPending,
+		IncidentID:    claim.IncidentID(),
+		CreatedBy:     trigger.CreatedBy,
+		CorrelationID: event.CorrelationID,
+		ParentEventID: event.ParentEventID,
+	}
+	resp := service.PostAlert(&alert)
+	if err = service.settleIncident(claim, !resp.IsError()); err != nil {
+		service.syslogger.Warning("Alert [%s] could not be counted in incident [%s]: %s", alert.AlertID, alert.IncidentID, err)
+	}
+	if resp.IsError() {
+		// resp will be a statusInternalError or statusBadRequest
+		return resp
+	}
+
+	// the alert is stored before the job is sent, so that the job's outcome can
+	// always be recorded on it
+	if err = service.sendToKafka(jobString, jobID, trigger.CreatedBy); err != nil {
+		service.failAlertJob(alert.AlertID, err)
+		return service.statusInternalError(err)
+	}
+
+	service.stats.IncrTriggerJobs()
+
+	return nil
+}
+
+// failAlertJob records on an alert that its job could not be sent
+func (service *Service) failAlertJob(id piazza.Ident, cause error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var alert *Alert
+		var version int64
+		alert, version, _, err = service.alertDB.GetOneVersioned(id)
+		if err != nil {
+			break
+		}
+		alert.JobStatus = JobStatusFailed
+		reviseAlert(alert)
+		// an update racing this one makes it read the alert again
+		err = service.alertDB.PutVersioned(alert, version)
+		if err != errVersionConflict || attempt >= maxJobOutcomeAttempts {
+			break
+		}
+	}
+	if err != nil {
+		service.syslogger.Warning("Alert [%s] could not be marked as having a failed job (%s): %s", id, cause, err)
+	}
+}
+
+func (service *Service) QueryEvents(jsonString string, params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	// if both specified, "by id"" wins
+	eventTypeID, err := params.GetAsString("eventTypeId", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	eventTypeName, err := params.GetAsString("eventTypeName", "")
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	var query string
+
+	// Get the eventTypeName corresponding to the eventTypeId
+	if eventTypeID != "" {
+		var eventType *EventType
 		var found bool
 		eventType, found, err = service.eventTypeDB.GetOne(piazza.Ident(eventTypeID), "pz-workflow")
 		if !found {
@@ -923,6 +1350,71 @@ func syncPagination(dslString string, format piazza.JsonPagination) (string, err
 	return string(byteArray), nil
 }
 
+// PutEvent corrects an event's data, which is checked against its EventType as on
+// posting. Triggers are not fired again. A repeating event's later runs use the new data.
+func (service *Service) PutEvent(id piazza.Ident, update *EventUpdate) *piazza.JsonResponse {
+	defer service.handlePanic()
+	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
+	if mapping == "" {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if system := service.systemEventType(mapping); system != nil && system.ProtectEvents {
+		return service.statusBadRequest(errors.New("Updating system events is prohibited"))
+	}
+	event, version, found, err := service.eventDB.GetOneVersioned(mapping, id)
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if event.Revision != update.Revision {
+		return service.statusConflict(fmt.Errorf("event %s is at revision %d, not %d", id, event.Revision, update.Revision))
+	}
+
+	eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, "pz-workflow")
+	if err != nil || !found {
+		return service.statusBadRequest(err)
+	}
+	data, err := applyFieldSpecs(eventType.Fields, update.Data, event.CreatedOn)
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	event.Data = service.addUniqueParams(eventType.Name, data)
+	event.Revision++
+	event.EventTypeVersion = eventTypeVersion(eventType)
+	if err = service.eventDB.verifyEventReadyToPost(event); err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatingEvent", id, "Service.PutEvent: User is updating event [%s]", id)
+
+	if err = service.eventDB.PutVersioned(event, mapping, version); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingEventFailure", id, "Service.PutEvent: User failed to update event [%s]", id)
+		return service.statusWriteFailed(err)
+	}
+	if event.CronSchedule != "" {
+		if err = service.cronDB.PutData(event); err != nil {
+			service.syslogger.Audit("pz-workflow", "updatingEventFailure", id, "Service.PutEvent: User failed to update cron event [%s]", id)
+			return service.statusInternalError(err)
+		}
+		service.cron.Remove(id.String())
+		if err = service.cron.AddJob(event.CronSchedule, cronEvent{event, eventType.Name, service}); err != nil {
+			service.syslogger.Audit("pz-workflow", "updatingEventFailure", id, "Service.PutEvent: User failed to reschedule cron event [%s]", id)
+			return service.statusInternalError(err)
+		}
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatedEvent", id, "Service.PutEvent: User successfully updated event [%s] to revision %d", id, event.Revision)
+
+	response := *event
+	response.Data = data
+	return service.statusOK(&response)
+}
+
 func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 	defer service.handlePanic()
 	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
@@ -933,7 +1425,7 @@ func (service *Service) DeleteEvent(id piazza.Ident) *piazza.JsonResponse {
 		return service.statusBadRequest(err)
 	}
 
-	if IsSystemEvent(mapping) {
+	if system := service.systemEventType(mapping); system != nil && system.ProtectEvents {
 		return service.statusBadRequest(errors.New("Deleting system events is prohibited"))
 	}
 
@@ -1091,12 +1583,28 @@ func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 		}
 		eventType = et
 	}
+	if violations := checkNestedCondition(service.removeUniqueParams(eventType.Name, eventType.Mapping), trigger.Condition); len(violations) > 0 {
+		return service.statusBadRequest(fmt.Errorf("TriggerDB.PostData failed: %s", strings.Join(violations, "; ")))
+	}
 	fixedQuery, ok := service.triggerDB.addUniqueParamsToQuery(trigger.Condition, eventType).(map[string]interface{})
 	if !ok {
 		return service.statusBadRequest(fmt.Errorf("TriggerEB.PostData failed: failed to parse query"))
 	}
+	var fixedFence *Geofence
+	if trigger.Geofence != nil {
+		if fixedFence, _, err = service.resolveGeofence(trigger.Geofence, eventType, trigger.CreatedBy); err != nil {
+			return service.statusBadRequest(err)
+		}
+	}
+	if trigger.Grouping != nil {
+		if err = checkGrouping(trigger.Grouping, service.removeUniqueParams(eventType.Name, eventType.Mapping), eventType.EventTypeID); err != nil {
+			return service.statusBadRequest(err)
+		}
+	}
+	trigger.EventTypeVersion = eventTypeVersion(eventType)
 	response := *trigger
 	trigger.Condition = fixedQuery
+	trigger.Geofence = fixedFence
 
 	service.syslogger.Audit(trigger.CreatedBy, "creatingTrigger", trigger.TriggerID, "Service.PostTrigger: User [%s] is creating trigger [%s]", trigger.CreatedBy, trigger.TriggerID)
 
@@ -1112,6 +1620,170 @@ func (service *Service) PostTrigger(trigger *Trigger) *piazza.JsonResponse {
 	return service.statusCreated(&response)
 }
 
+// resolveGeofence checks the fence against the EventType and returns a copy whose
+// field is rewritten to where the event data is stored, along with the clause that
+// fences the trigger's condition
+func (service *Service) resolveGeofence(fence *Geofence, eventType *EventType, actor string) (*Geofence, map[string]interface{}, error) {
+	switch fence.Relation {
+	case GeofenceIntersects, GeofenceWithin, GeofenceDisjoint:
+	default:
+		return nil, nil, fmt.Errorf("Geofence relation must be one of %s, %s or %s, not %q", GeofenceIntersects, GeofenceWithin, GeofenceDisjoint, fence.Relation)
+	}
+	mapping := service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	field := strings.TrimPrefix(fence.Field, "data.")
+	typ, ok := mappingTypeAt(mapping, field)
+	typ = elementType(typ)
+	if !ok || !strings.HasPrefix(fence.Field, "data.") || (typ != geoShapeMappingType && typ != geoPointMappingType) || len(nestedPathsOf(mapping, field)) > 0 {
+		return nil, nil, fmt.Errorf("Geofence field %s is not a geo_shape or geo_point field of eventType %s", fence.Field, eventType.EventTypeID)
+	}
+	area, found, err := service.areaDB.GetOne(fence.AreaID, actor)
+	if err != nil || !found {
+		return nil, nil, fmt.Errorf("Geofence areaOfInterest %s could not be found", fence.AreaID)
+	}
+	fixed := *fence
+	fixed.Field = service.triggerDB.getNewKeyName(eventType, fence.Field)
+	fixed.fieldType = typ
+	clause, err := geofenceClause(fixed.Field, fixed.fieldType, fixed.Relation, area.Geometry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Geofence field %s: %s", fence.Field, err)
+	}
+	return &fixed, clause, nil
+}
+
+const defaultBacktestSamples = 10
+
+const maxBacktestSamples = 1000
+
+// BacktestTrigger reports how often a condition would have fired over stored events,
+// without submitting jobs or creating alerts. The condition is run as a search over the
+// events index, which for the queries used in triggers matches what percolation does.
+// The matches are counted, then one search returns the samples and a date_histogram.
+func (service *Service) BacktestTrigger(req *BacktestRequest) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	eventType, found, err := service.eventTypeDB.GetOne(req.EventTypeID, "pz-workflow")
+	if !found || err != nil {
+		return service.statusBadRequest(fmt.Errorf("Service.BacktestTrigger failed: eventType %s could not be found", req.EventTypeID))
+	}
+
+	if req.Until.IsZero() {
+		req.Until = time.Now()
+	}
+	if !req.Since.Before(req.Until) {
+		return service.statusBadRequest(errors.New("Service.BacktestTrigger failed: since must be before until"))
+	}
+	interval, err := parseInterval(req.Interval)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if interval%time.Millisecond != 0 {
+		return service.statusBadRequest(errors.New("Service.BacktestTrigger failed: interval must be a whole number of milliseconds"))
+	}
+	hist, err := newHistogram(req.Since, req.Until, interval)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if req.MaxSamples <= 0 {
+		req.MaxSamples = defaultBacktestSamples
+	}
+	if req.MaxSamples > maxBacktestSamples {
+		return service.statusBadRequest(fmt.Errorf("Service.BacktestTrigger failed: maxSamples can be at most %d", maxBacktestSamples))
+	}
+
+	if violations := checkNestedCondition(service.removeUniqueParams(eventType.Name, eventType.Mapping), req.Condition); len(violations) > 0 {
+		return service.statusBadRequest(fmt.Errorf("Service.BacktestTrigger failed: %s", strings.Join(violations, "; ")))
+	}
+	condition, ok := service.triggerDB.addUniqueParamsToQuery(req.Condition, eventType).(map[string]interface{})
+	if !ok {
+		return service.statusBadRequest(errors.New("Service.BacktestTrigger failed: failed to parse query"))
+	}
+	if req.Geofence != nil {
+		_, fence, err := service.resolveGeofence(req.Geofence, eventType, "pz-workflow")
+		if err != nil {
+			return service.statusBadRequest(err)
+		}
+		condition = map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []interface{}{condition, fence},
+			},
+		}
+	}
+	rangeQuery, err := eventTimeRangeQuery(eventType.EventTypeID, req.Since, req.Until)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": []interface{}{rangeQuery, condition},
+		},
+	}
+
+	service.syslogger.Audit("pz-workflow", "backtestingTrigger", eventType.EventTypeID, "Service.BacktestTrigger: User is backtesting a trigger on eventType [%s]", eventType.EventTypeID)
+
+	result := &BacktestResult{
+		EventTypeID:    eventType.EventTypeID,
+		Since:          req.Since,
+		Until:          req.Until,
+		Interval:       interval.String(),
+		SampleEventIDs: []piazza.Ident{},
+	}
+
+	if err = service.backtestEvents(eventType.Name, rangeQuery, query, hist, req.MaxSamples, result); err != nil {
+		service.syslogger.Audit("pz-workflow", "backtestingTriggerFailure", eventType.EventTypeID, "Service.BacktestTrigger: User failed to backtest a trigger on eventType [%s]", eventType.EventTypeID)
+		return service.statusInternalError(err)
+	}
+	result.Histogram = hist.Buckets
+
+	service.syslogger.Audit("pz-workflow", "backtestedTrigger", eventType.EventTypeID, "Service.BacktestTrigger: User backtested a trigger on eventType [%s]: %d of %d events matched", eventType.EventTypeID, result.MatchCount, result.TotalEvents)
+
+	return service.statusOK(result)
+}
+
+// backtestEvents counts the events in range and those matching, and fills in the
+// histogram and the oldest matches as samples
+func (service *Service) backtestEvents(mapping string, rangeQuery map[string]interface{}, query map[string]interface{}, hist *histogram, maxSamples int, result *BacktestResult) error {
+	var err error
+	if result.TotalEvents, err = service.eventDB.CountEvents(mapping, rangeQuery, "pz-workflow"); err != nil {
+		return err
+	}
+	if result.MatchCount, err = service.eventDB.CountEvents(mapping, query, "pz-workflow"); err != nil {
+		return err
+	}
+
+	last := hist.since
+	if n := len(hist.Buckets); n > 0 {
+		last = hist.Buckets[n-1].Start
+	}
+	search, err := service.eventDB.raw.Search(mapping, map[string]interface{}{
+		"query":   query,
+		"sort":    []interface{}{map[string]interface{}{"createdOn": "asc"}, map[string]interface{}{"eventId": "asc"}},
+		"size":    maxSamples,
+		"_source": []string{"eventId"},
+		"aggs":    map[string]interface{}{"histogram": dateHistogramAgg("createdOn", hist.interval, hist.since, last)},
+	})
+	if err != nil {
+		return LoggedError("Service.BacktestTrigger failed to search events: %s", err)
+	}
+	for _, hit := range search.Hits.Hits {
+		if hit.Source == nil {
+			continue
+		}
+		var sample struct {
+			EventID piazza.Ident `json:"eventId"`
+		}
+		if err = json.Unmarshal(*hit.Source, &sample); err != nil {
+			return err
+		}
+		result.SampleEventIDs = append(result.SampleEventIDs, sample.EventID)
+	}
+	agg, err := search.Aggregation("histogram")
+	if err != nil {
+		return err
+	}
+	hist.fill(agg.bucketCounts())
+	return nil
+}
+
 func (service *Service) PutTrigger(id piazza.Ident, update *TriggerUpdate) *piazza.JsonResponse {
 	defer service.handlePanic()
 	trigger, found, err := service.triggerDB.GetOne(id, "pz-workflow")
@@ -1183,13 +1855,40 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	if err != nil {
 		return service.statusBadRequest(err)
 	}
+	filter, err := parseAlertFilter(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	inflate, err := parseInflateParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
 
 	var alerts []Alert
 	var totalHits int64
 
 	service.syslogger.Audit("pz-workflow", "gettingAllAlerts", service.alertDB.mapping, "Service.GetAllAlerts: User is getting all alerts")
 
-	if triggerID != "" && piazza.ValidUuid(triggerID.String()) {
+	if !filter.IsEmpty() {
+		if triggerID != "" && !piazza.ValidUuid(triggerID.String()) {
+			return service.statusBadRequest(errors.New("Malformed triggerId query parameter"))
+		}
+		dsl := `{}`
+		if triggerID != "" {
+			dsl = fmt.Sprintf(`{"query":{"term":{"triggerId":%q}}}`, triggerID.String())
+		}
+		if dsl, err = filterAlertQuery(dsl, filter); err != nil {
+			return service.statusBadRequest(err)
+		}
+		if dsl, err = syncPagination(dsl, *format); err != nil {
+			return service.statusBadRequest(err)
+		}
+		alerts, totalHits, err = service.alertDB.GetAlertsByDslQuery(dsl, "pz-workflow")
+		if err != nil {
+			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
+			return service.statusInternalError(err)
+		}
+	} else if triggerID != "" && piazza.ValidUuid(triggerID.String()) {
 		alerts, totalHits, err = service.alertDB.GetAllByTrigger(format, triggerID, "pz-workflow")
 		if err != nil {
 			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
@@ -1213,10 +1912,9 @@ func (service *Service) GetAllAlerts(params *piazza.HttpQueryParams) *piazza.Jso
 	}
 
 	var resp *piazza.JsonResponse
-	inflate := getInflateParam(params)
 
-	if inflate {
-		alertExts, err := service.inflateAlerts(alerts)
+	if inflate.any() {
+		alertExts, err := service.inflateAlerts(alerts, inflate)
 		if err != nil {
 			service.syslogger.Audit("pz-workflow", "gettingAllAlertsFailure", service.alertDB.mapping, "Service.GetAllAlerts: User failed to get all alerts")
 			return service.statusInternalError(err)
@@ -1246,6 +1944,17 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 
 	service.syslogger.Audit("pz-workflow", "queryingAlerts", service.alertDB.mapping, "Service.QueryAlerts: User is querying alerts")
 
+	filter, err := parseAlertFilter(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	inflate, err := parseInflateParam(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if dslString, err = filterAlertQuery(dslString, filter); err != nil {
+		return service.statusBadRequest(err)
+	}
 	dslString, err = syncPagination(dslString, *format)
 	if err != nil {
 		service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: syncPagination failed")
@@ -1261,10 +1970,9 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 	}
 
 	var resp *piazza.JsonResponse
-	inflate := getInflateParam(params)
 
-	if inflate {
-		alertExts, err := service.inflateAlerts(alerts)
+	if inflate.any() {
+		alertExts, err := service.inflateAlerts(alerts, inflate)
 		if err != nil {
 			service.syslogger.Audit("pz-workflow", "queryingAlertsFailure", service.alertDB.mapping, "Service.QueryAlerts: User failed to query alerts")
 			return service.statusInternalError(err)
@@ -1282,61 +1990,18 @@ func (service *Service) QueryAlerts(dslString string, params *piazza.HttpQueryPa
 	return resp
 }
 
-func getInflateParam(params *piazza.HttpQueryParams) bool {
-	inflateString, err := params.GetAsString("inflate", "false")
-	if err != nil {
-		inflateString = "false"
-	}
-	inflate, err := strconv.ParseBool(inflateString)
-	if err != nil {
-		inflate = false
-	}
-	return inflate
-}
-
-func (service *Service) inflateAlerts(alerts []Alert) (*[]AlertExt, error) {
-	alertExts := make([]AlertExt, len(alerts))
-	for index, alert := range alerts {
-		alertExt, err := service.inflateAlert(alert)
-		if err != nil {
-			return nil, err
-		}
-		alertExts[index] = *alertExt
-	}
-	return &alertExts, nil
-}
-
-func (service *Service) inflateAlert(alert Alert) (*AlertExt, error) {
-	trigger, found, err := service.triggerDB.GetOne(alert.TriggerID, "pz-workflow")
-	if err != nil || !found {
-		trigger = &Trigger{TriggerID: alert.TriggerID}
-	}
-
-	mapping, err := service.eventDB.lookupEventTypeNameByEventID(alert.EventID, alert.CreatedBy)
-	if mapping == "" || err != nil {
-		// Do nothing
-	}
-
-	event, found, err := service.eventDB.GetOne(mapping, alert.EventID, "pz-workflow")
-	if err != nil || !found {
-		event = &Event{EventID: alert.EventID}
-	}
-	alertExt := &AlertExt{
-		AlertID:   alert.AlertID,
-		Trigger:   *trigger,
-		Event:     *event,
-		JobID:     alert.JobID,
-		CreatedBy: alert.CreatedBy,
-		CreatedOn: alert.CreatedOn,
-	}
-	return alertExt, nil
-}
-
 // PostAlert TODO
 func (service *Service) PostAlert(alert *Alert) *piazza.JsonResponse {
 	defer service.handlePanic()
 	alert.AlertID = service.newIdent()
 	alert.CreatedOn = piazza.NewTimeStamp()
+	alert.History = nil
+	alert.UpdatedOn = nil
+	if alert.Status == "" {
+		alert.Status = AlertStatusOpen
+	} else if !isAlertStatus(alert.Status) {
+		return service.statusBadRequest(fmt.Errorf("%q is not an alert status", alert.Status))
+	}
 
 	service.syslogger.Audit(alert.CreatedBy, "creatingAlert", alert.AlertID, "Service.PostAlert: User [%s] is creating alert [%s]", alert.CreatedBy, alert.AlertID)
 
@@ -1347,11 +2012,52 @@ func (service *Service) PostAlert(alert *Alert) *piazza.JsonResponse {
 
 	service.syslogger.Audit(alert.CreatedBy, "createdAlert", alert.AlertID, "Service.PostAlert: User [%s] successfully created alert [%s]", alert.CreatedBy, alert.AlertID)
 
+	published := *alert
+	service.alertStream.Publish(&streamMessage{ID: published.AlertID, Key: published.TriggerID, Data: &published})
+
+	notified := *alert
+	service.notifier.alertPosted(&notified)
+
 	service.stats.IncrAlerts()
 
 	return service.statusCreated(alert)
 }
 
+// PutAlert updates an alert's status and notes
+func (service *Service) PutAlert(id piazza.Ident, update *AlertUpdate) *piazza.JsonResponse {
+	defer service.handlePanic()
+	alert, version, found, err := service.alertDB.GetOneVersioned(id)
+	if !found {
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+	if alert.Revision != update.Revision {
+		return service.statusConflict(fmt.Errorf("alert %s is at revision %d, not %d", id, alert.Revision, update.Revision))
+	}
+	if update.Status != "" && update.Status != alertStatus(alert) {
+		if err = changeAlertState(alert, update.Status, nil, "", ""); err != nil {
+			return service.statusBadRequest(err)
+		}
+	}
+	if update.Notes != nil {
+		alert.Notes = *update.Notes
+	}
+	reviseAlert(alert)
+
+	service.syslogger.Audit("pz-workflow", "updatingAlert", id, "Service.PutAlert: User is updating alert [%s]", id)
+
+	if err = service.alertDB.PutVersioned(alert, version); err != nil {
+		service.syslogger.Audit("pz-workflow", "updatingAlertFailure", id, "Service.PutAlert: User failed to update alert [%s]", id)
+		return service.statusWriteFailed(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "updatedAlert", id, "Service.PutAlert: User successfully updated alert [%s] with status=[%s]", id, alert.Status)
+
+	return service.statusOK(alert)
+}
+
 // DeleteAlert TODO
 func (service *Service) DeleteAlert(id piazza.Ident) *piazza.JsonResponse {
 	defer service.handlePanic()
@@ -1372,6 +2078,248 @@ func (service *Service) DeleteAlert(id piazza.Ident) *piazza.JsonResponse {
 	return service.statusOK(nil)
 }
 
+//---------------------------------------------------------------------
+
+// PostAreaOfInterest stores a polygon that triggers can be geofenced by
+func (service *Service) PostAreaOfInterest(area *AreaOfInterest) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	switch typ, _ := area.Geometry["type"].(string); strings.ToLower(typ) {
+	case "polygon", "multipolygon", "envelope", "circle":
+	default:
+		return service.statusBadRequest(fmt.Errorf("Service.PostAreaOfInterest failed: geometry must be a Polygon, MultiPolygon, envelope or circle, not %q", typ))
+	}
+	if msg := checkGeoShape(area.Geometry); msg != "" {
+		return service.statusBadRequest(fmt.Errorf("Service.PostAreaOfInterest failed: geometry: %s", msg))
+	}
+
+	area.AreaID = service.newIdent()
+	area.CreatedOn = piazza.NewTimeStamp()
+
+	service.syslogger.Audit(area.CreatedBy, "creatingAreaOfInterest", area.AreaID, "Service.PostAreaOfInterest: User [%s] is creating areaOfInterest [%s]", area.CreatedBy, area.AreaID)
+
+	if err := service.areaDB.PostData(area); err != nil {
+		service.syslogger.Audit(area.CreatedBy, "creatingAreaOfInterestFailure", area.AreaID, "Service.PostAreaOfInterest: User [%s] failed to create areaOfInterest [%s]", area.CreatedBy, area.AreaID)
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit(area.CreatedBy, "createdAreaOfInterest", area.AreaID, "Service.PostAreaOfInterest: User [%s] successfully created areaOfInterest [%s]", area.CreatedBy, area.AreaID)
+
+	return service.statusCreated(area)
+}
+
+func (service *Service) GetAreaOfInterest(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit("pz-workflow", "gettingAreaOfInterest", id, "Service.GetAreaOfInterest: User is getting areaOfInterest [%s]", id)
+	area, found, err := service.areaDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit("pz-workflow", "gettingAreaOfInterestFailure", id, "Service.GetAreaOfInterest: User failed to get areaOfInterest [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAreaOfInterestFailure", id, "Service.GetAreaOfInterest: User failed to get areaOfInterest [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotAreaOfInterest", id, "Service.GetAreaOfInterest: User successfully got areaOfInterest [%s]", id)
+
+	return service.statusOK(area)
+}
+
+func (service *Service) GetAllAreasOfInterest(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAllAreasOfInterest", service.areaDB.mapping, "Service.GetAllAreasOfInterest: User is getting all areasOfInterest")
+
+	areas, totalHits, err := service.areaDB.GetAll(format, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAllAreasOfInterestFailure", service.areaDB.mapping, "Service.GetAllAreasOfInterest: User failed to get all areasOfInterest")
+		return service.statusInternalError(err)
+	}
+	resp := service.statusOK(areas)
+
+	service.syslogger.Audit("pz-workflow", "gotAllAreasOfInterest", service.areaDB.mapping, "Service.GetAllAreasOfInterest: User successfully got all areasOfInterest")
+
+	format.Count = int(totalHits)
+	resp.Pagination = format
+
+	return resp
+}
+
+// DeleteAreaOfInterest refuses to delete an area while triggers are fenced by it
+func (service *Service) DeleteAreaOfInterest(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit("pz-workflow", "deletingAreaOfInterest", id, "Service.DeleteAreaOfInterest: User is deleting areaOfInterest [%s]", id)
+
+	count, err := service.triggerDB.CountByAreaID(id, "pz-workflow")
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if count > 0 {
+		service.syslogger.Audit("pz-workflow", "deletingAreaOfInterestFailure", id, "Service.DeleteAreaOfInterest: User failed to delete areaOfInterest [%s]", id)
+		return service.statusBadRequest(fmt.Errorf("AreaOfInterest %s is used by %d triggers", id, count))
+	}
+
+	ok, err := service.areaDB.DeleteByID(id, "pz-workflow")
+	if !ok {
+		service.syslogger.Audit("pz-workflow", "deletingAreaOfInterestFailure", id, "Service.DeleteAreaOfInterest: User failed to delete areaOfInterest [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingAreaOfInterestFailure", id, "Service.DeleteAreaOfInterest: User failed to delete areaOfInterest [%s]", id)
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "deletedAreaOfInterest", id, "Service.DeleteAreaOfInterest: User successfully deleted areaOfInterest [%s]", id)
+
+	return service.statusOK(nil)
+}
+
+//---------------------------------------------------------------------
+
+// PostSubscription starts sending the matching alerts created from now on through
+// the subscription's channel
+func (service *Service) PostSubscription(subscription *Subscription) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	if err := validateSubscription(subscription, service.notifier.senders[ChannelSMTP] != nil); err != nil {
+		return service.statusBadRequest(err)
+	}
+	if subscription.TriggerID != "" {
+		if _, found, err := service.triggerDB.GetOne(subscription.TriggerID, subscription.CreatedBy); err != nil || !found {
+			return service.statusBadRequest(fmt.Errorf("trigger %s does not exist", subscription.TriggerID))
+		}
+	}
+	if subscription.EventTypeID != "" {
+		if _, found, err := service.eventTypeDB.GetOne(subscription.EventTypeID, subscription.CreatedBy); err != nil || !found {
+			return service.statusBadRequest(fmt.Errorf("eventType %s does not exist", subscription.EventTypeID))
+		}
+	}
+
+	subscription.SubscriptionID = service.newIdent()
+	subscription.CreatedOn = piazza.NewTimeStamp()
+
+	service.syslogger.Audit(subscription.CreatedBy, "creatingSubscription", subscription.SubscriptionID, "Service.PostSubscription: User [%s] is creating subscription [%s]", subscription.CreatedBy, subscription.SubscriptionID)
+
+	if err := service.subscriptionDB.PostData(subscription); err != nil {
+		service.syslogger.Audit(subscription.CreatedBy, "creatingSubscriptionFailure", subscription.SubscriptionID, "Service.PostSubscription: User [%s] failed to create subscription [%s]", subscription.CreatedBy, subscription.SubscriptionID)
+		return service.statusInternalError(err)
+	}
+
+	service.syslogger.Audit(subscription.CreatedBy, "createdSubscription", subscription.SubscriptionID, "Service.PostSubscription: User [%s] successfully created subscription [%s]", subscription.CreatedBy, subscription.SubscriptionID)
+
+	return service.statusCreated(subscription)
+}
+
+// validateSubscription checks a subscription's criteria and channel. The smtp
+// channel can only be used if a mail server is configured.
+func validateSubscription(subscription *Subscription, smtpConfigured bool) error {
+	if subscription.TriggerID == "" && subscription.EventTypeID == "" && subscription.AlertCreatedBy == "" {
+		return errors.New("a subscription needs a triggerId, eventTypeId or alertCreatedBy")
+	}
+	channel := subscription.Channel
+	switch channel.Type {
+	case ChannelWebhook:
+		u, err := url.Parse(channel.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook url %q is not an http or https URL", channel.URL)
+		}
+	case ChannelSMTP:
+		if !smtpConfigured {
+			return errors.New("no mail server is configured, so the smtp channel cannot be used")
+		}
+		if len(channel.To) == 0 {
+			return errors.New("an smtp channel needs at least one address to send to")
+		}
+		for _, to := range channel.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("%q is not an email address", to)
+			}
+		}
+	default:
+		return fmt.Errorf("channel type must be %s or %s, not %q", ChannelWebhook, ChannelSMTP, channel.Type)
+	}
+	return nil
+}
+
+func (service *Service) GetSubscription(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit("pz-workflow", "gettingSubscription", id, "Service.GetSubscription: User is getting subscription [%s]", id)
+	subscription, found, err := service.subscriptionDB.GetOne(id, "pz-workflow")
+	if !found {
+		service.syslogger.Audit("pz-workflow", "gettingSubscriptionFailure", id, "Service.GetSubscription: User failed to get subscription [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingSubscriptionFailure", id, "Service.GetSubscription: User failed to get subscription [%s]", id)
+		return service.statusBadRequest(err)
+	}
+	service.syslogger.Audit("pz-workflow", "gotSubscription", id, "Service.GetSubscription: User successfully got subscription [%s]", id)
+
+	return service.statusOK(subscription)
+}
+
+func (service *Service) GetAllSubscriptions(params *piazza.HttpQueryParams) *piazza.JsonResponse {
+	defer service.handlePanic()
+	format, err := piazza.NewJsonPagination(params)
+	if err != nil {
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "gettingAllSubscriptions", service.subscriptionDB.mapping, "Service.GetAllSubscriptions: User is getting all subscriptions")
+
+	subscriptions, totalHits, err := service.subscriptionDB.GetAll(format, "pz-workflow")
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "gettingAllSubscriptionsFailure", service.subscriptionDB.mapping, "Service.GetAllSubscriptions: User failed to get all subscriptions")
+		return service.statusInternalError(err)
+	}
+	resp := service.statusOK(subscriptions)
+
+	service.syslogger.Audit("pz-workflow", "gotAllSubscriptions", service.subscriptionDB.mapping, "Service.GetAllSubscriptions: User successfully got all subscriptions")
+
+	format.Count = int(totalHits)
+	resp.Pagination = format
+
+	return resp
+}
+
+// DeleteSubscription stops a subscription; its pending deliveries fail
+func (service *Service) DeleteSubscription(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	service.syslogger.Audit("pz-workflow", "deletingSubscription", id, "Service.DeleteSubscription: User is deleting subscription [%s]", id)
+
+	ok, err := service.subscriptionDB.DeleteByID(id, "pz-workflow")
+	if !ok {
+		service.syslogger.Audit("pz-workflow", "deletingSubscriptionFailure", id, "Service.DeleteSubscription: User failed to delete subscription [%s]", id)
+		return service.statusNotFound(err)
+	}
+	if err != nil {
+		service.syslogger.Audit("pz-workflow", "deletingSubscriptionFailure", id, "Service.DeleteSubscription: User failed to delete subscription [%s]", id)
+		return service.statusBadRequest(err)
+	}
+
+	service.syslogger.Audit("pz-workflow", "deletedSubscription", id, "Service.DeleteSubscription: User successfully deleted subscription [%s]", id)
+
+	return service.statusOK(nil)
+}
+
+// GetAlertDeliveries returns the log of an alert's deliveries to its subscriptions
+func (service *Service) GetAlertDeliveries(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+	if _, found, err := service.alertDB.GetOne(id, "pz-workflow"); !found {
+		return service.statusNotFound(err)
+	}
+
+	deliveries, _, err := service.deliveryDB.GetAllByAlert(id, maxSubscriptionsPerAlert, "pz-workflow")
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	return service.statusOK(deliveries)
+}
+
 func (service *Service) addUniqueParams(uniqueKey string, inputObj map[string]interface{}) map[string]interface{} {
 	outputObj := map[string]interface{}{}
 	outputObj[uniqueKey] = inputObj
@@ -1427,10 +2375,12 @@ func (c cronEvent) Run() {
 		uniqueMap = make(map[string]interface{})
 	}
 	ev := &Event{
-		EventTypeID: c.EventTypeID,
-		Data:        uniqueMap.(map[string]interface{}),
-		CreatedOn:   piazza.NewTimeStamp(),
-		CreatedBy:   c.EventID.String(),
+		EventTypeID:   c.EventTypeID,
+		Data:          uniqueMap.(map[string]interface{}),
+		CreatedOn:     piazza.NewTimeStamp(),
+		CreatedBy:     c.EventID.String(),
+		CorrelationID: c.CorrelationID,
+		ParentEventID: c.EventID,
 	}
 	c.service.PostEvent(ev)
 }
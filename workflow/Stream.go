@@ -0,0 +1,246 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+const streamHistorySize = 1000
+const streamBufferSize = 100
+
+// streamMessage is one resource pushed to stream subscribers.
+// Key is what subscribers filter on: the eventTypeId for events, the triggerId for alerts.
+type streamMessage struct {
+	ID   piazza.Ident
+	Key  piazza.Ident
+	Data interface{}
+}
+
+// streamSubscriber receives messages on C until it unsubscribes or falls too far behind,
+// at which point C is closed and the client is expected to reconnect with its last-seen ID.
+type streamSubscriber struct {
+	key piazza.Ident
+	C   chan *streamMessage
+}
+
+func (sub *streamSubscriber) matches(msg *streamMessage) bool {
+	return sub.key == "" || sub.key == msg.Key
+}
+
+// streamBroker is an in-process pub/sub fed by PostEvent and PostAlert. It keeps a
+// short history so that subscribers can resume from the last ID they saw.
+type streamBroker struct {
+	sync.Mutex
+	subscribers map[*streamSubscriber]bool
+	history     []*streamMessage
+	historySize int
+	bufferSize  int
+}
+
+func newStreamBroker(historySize int, bufferSize int) *streamBroker {
+	return &streamBroker{
+		subscribers: map[*streamSubscriber]bool{},
+		history:     []*streamMessage{},
+		historySize: historySize,
+		bufferSize:  bufferSize,
+	}
+}
+
+// Subscribe registers a subscriber for the given key ("" for everything). If lastID is
+// still in the history, the messages published after it are returned as a backlog
+// that must be sent before anything read from the subscriber's channel. resumed is
+// false if lastID has already left the history, when the backlog must be found
+// elsewhere.
+func (b *streamBroker) Subscribe(key piazza.Ident, lastID piazza.Ident) (*streamSubscriber, []*streamMessage, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	sub := &streamSubscriber{key: key, C: make(chan *streamMessage, b.bufferSize)}
+	b.subscribers[sub] = true
+
+	backlog := []*streamMessage{}
+	if lastID == "" {
+		return sub, backlog, true
+	}
+	for i, msg := range b.history {
+		if msg.ID != lastID {
+			continue
+		}
+		for _, m := range b.history[i+1:] {
+			if sub.matches(m) {
+				backlog = append(backlog, m)
+			}
+		}
+		return sub, backlog, true
+	}
+	return sub, backlog, false
+}
+
+// Unsubscribe removes the subscriber; it is safe to call more than once.
+func (b *streamBroker) Unsubscribe(sub *streamSubscriber) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.C)
+	}
+}
+
+// Publish never blocks: a subscriber whose buffer is full is dropped rather than
+// allowed to slow down the caller.
+func (b *streamBroker) Publish(msg *streamMessage) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.history = append(b.history, msg)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for sub := range b.subscribers {
+		if !sub.matches(msg) {
+			continue
+		}
+		select {
+		case sub.C <- msg:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.C)
+		}
+	}
+}
+
+// NumSubscribers returns the number of live subscribers.
+func (b *streamBroker) NumSubscribers() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.subscribers)
+}
+
+//---------------------------------------------------------------------
+
+// errStreamGap is returned by a backfill when the messages a subscriber missed can
+// not all be found, so that it must be told to start afresh
+var errStreamGap = errors.New("the messages after the last event ID can no longer be found")
+
+// streamBackfill finds, in Elasticsearch, the messages for key published after lastID,
+// for a subscriber whose lastID has left the broker's history. They are oldest first.
+type streamBackfill func(lastID piazza.Ident, key piazza.Ident) ([]*streamMessage, error)
+
+// backfillQuery is the search for the documents created since createdOn, oldest first.
+// Documents created in the same millisecond as lastID are included, as the subscriber
+// may not have seen them; a subscriber gets each message at least once.
+func backfillQuery(createdOn piazza.TimeStamp, keyField string, key piazza.Ident) (map[string]interface{}, error) {
+	since, err := esTime(time.Time(createdOn))
+	if err != nil {
+		return nil, err
+	}
+	must := []interface{}{
+		map[string]interface{}{"range": map[string]interface{}{"createdOn": map[string]interface{}{"gte": since}}},
+	}
+	if key != "" {
+		must = append(must, map[string]interface{}{"term": map[string]interface{}{keyField: key}})
+	}
+	return map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"must": must}},
+		"sort":  []interface{}{map[string]interface{}{"createdOn": "asc"}},
+		// one more than can be sent, to tell that there are too many
+		"size": streamHistorySize + 1,
+	}, nil
+}
+
+// backfillEvents is the streamBackfill of the event stream
+func (service *Service) backfillEvents(lastID piazza.Ident, eventTypeID piazza.Ident) ([]*streamMessage, error) {
+	name, _ := service.eventDB.lookupEventTypeNameByEventID(lastID, "pz-workflow")
+	if name == "" {
+		return nil, errStreamGap
+	}
+	last, found, err := service.eventDB.GetOne(name, lastID, "pz-workflow")
+	if err != nil || !found {
+		return nil, errStreamGap
+	}
+	query, err := backfillQuery(last.CreatedOn, "eventTypeId", eventTypeID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := service.eventDB.raw.Search("", query)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Hits.Hits) > streamHistorySize {
+		return nil, errStreamGap
+	}
+
+	// events are stored with their data under their EventType's name
+	names := map[piazza.Ident]string{}
+	messages := []*streamMessage{}
+	for _, hit := range result.Hits.Hits {
+		event := &Event{}
+		if err = json.Unmarshal(*hit.Source, event); err != nil {
+			return nil, err
+		}
+		if event.EventID == lastID {
+			continue
+		}
+		if _, ok := names[event.EventTypeID]; !ok {
+			eventType, found, err := service.eventTypeDB.GetOne(event.EventTypeID, "pz-workflow")
+			if err != nil || !found {
+				return nil, errStreamGap
+			}
+			names[event.EventTypeID] = eventType.Name
+		}
+		event.Data = service.removeUniqueParams(names[event.EventTypeID], event.Data)
+		messages = append(messages, &streamMessage{ID: event.EventID, Key: event.EventTypeID, Data: event})
+	}
+	return messages, nil
+}
+
+// backfillAlerts is the streamBackfill of the alert stream
+func (service *Service) backfillAlerts(lastID piazza.Ident, triggerID piazza.Ident) ([]*streamMessage, error) {
+	last, found, err := service.alertDB.GetOne(lastID, "pz-workflow")
+	if err != nil || !found {
+		return nil, errStreamGap
+	}
+	query, err := backfillQuery(last.CreatedOn, "triggerId", triggerID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := service.alertDB.raw.Search(service.alertDB.mapping, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Hits.Hits) > streamHistorySize {
+		return nil, errStreamGap
+	}
+
+	messages := []*streamMessage{}
+	for _, hit := range result.Hits.Hits {
+		alert := &Alert{}
+		if err = json.Unmarshal(*hit.Source, alert); err != nil {
+			return nil, err
+		}
+		if alert.AlertID == lastID {
+			continue
+		}
+		messages = append(messages, &streamMessage{ID: alert.AlertID, Key: alert.TriggerID, Data: alert})
+	}
+	return messages, nil
+}
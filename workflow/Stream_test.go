@@ -0,0 +1,121 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestStreamBroker(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newStreamBroker(3, 2)
+
+	all, backlog, resumed := broker.Subscribe("", "")
+	assert.Len(backlog, 0)
+	assert.True(resumed)
+	onlyA, _, _ := broker.Subscribe("A", "")
+	assert.Equal(2, broker.NumSubscribers())
+
+	broker.Publish(&streamMessage{ID: "1", Key: "A"})
+	broker.Publish(&streamMessage{ID: "2", Key: "B"})
+
+	msg := <-all.C
+	assert.EqualValues("1", msg.ID)
+	msg = <-all.C
+	assert.EqualValues("2", msg.ID)
+	msg = <-onlyA.C
+	assert.EqualValues("1", msg.ID)
+	assert.Len(onlyA.C, 0)
+
+	// resume after "1": only what came later, and only what matches
+	onlyB, backlog, resumed := broker.Subscribe("B", "1")
+	assert.Len(backlog, 1)
+	assert.EqualValues("2", backlog[0].ID)
+	assert.True(resumed)
+	broker.Unsubscribe(onlyB)
+
+	// history is bounded, so an old ID yields no backlog, and says so
+	broker.Publish(&streamMessage{ID: "3", Key: "A"})
+	broker.Publish(&streamMessage{ID: "4", Key: "A"})
+	late, backlog, resumed := broker.Subscribe("", "1")
+	assert.Len(backlog, 0)
+	assert.False(resumed)
+	broker.Unsubscribe(late)
+
+	// "all" never drained 3 and 4, so its buffer is full and it's dropped on 5
+	broker.Publish(&streamMessage{ID: "5", Key: "A"})
+	<-all.C
+	<-all.C
+	_, ok := <-all.C
+	assert.False(ok)
+
+	broker.Unsubscribe(all)
+	broker.Unsubscribe(onlyA)
+}
+
+func TestStreamBackfill(t *testing.T) {
+	assert := assert.New(t)
+
+	service := newTestService(t, nil)
+	created := func(resp *piazza.JsonResponse) interface{} {
+		if resp.IsError() {
+			t.Fatal(resp.Message)
+		}
+		return resp.Data
+	}
+	eventType := created(service.PostEventType(makeTestEventType(makeTestEventTypeName()))).(*EventType)
+	other := created(service.PostEventType(makeTestEventType(makeTestEventTypeName()))).(*EventType)
+	events := []*Event{}
+	for _, id := range []piazza.Ident{eventType.EventTypeID, other.EventTypeID, eventType.EventTypeID} {
+		events = append(events, created(service.PostEvent(makeTestEvent(id))).(*Event))
+	}
+
+	// everything after the first event, or only its EventType's, with the data as posted
+	messages, err := service.backfillEvents(events[0].EventID, "")
+	assert.NoError(err)
+	assert.Len(messages, 2)
+	messages, err = service.backfillEvents(events[0].EventID, eventType.EventTypeID)
+	assert.NoError(err)
+	assert.Len(messages, 1)
+	assert.Equal(events[2].EventID, messages[0].ID)
+	assert.EqualValues(17, messages[0].Data.(*Event).Data["num"])
+
+	_, err = service.backfillEvents("nosuchevent", "")
+	assert.Equal(errStreamGap, err)
+
+	alerts := []*Alert{}
+	for _, triggerID := range []piazza.Ident{"t1", "t2", "t1"} {
+		alerts = append(alerts, created(service.PostAlert(&Alert{TriggerID: triggerID, EventID: events[0].EventID})).(*Alert))
+	}
+	messages, err = service.backfillAlerts(alerts[0].AlertID, "t1")
+	assert.NoError(err)
+	assert.Len(messages, 1)
+	assert.Equal(alerts[2].AlertID, messages[0].ID)
+	assert.EqualValues("t1", messages[0].Key)
+	// alerts made in the same millisecond as the last one may be sent again, but
+	// never the last one itself
+	messages, err = service.backfillAlerts(alerts[2].AlertID, "")
+	assert.NoError(err)
+	for _, msg := range messages {
+		assert.NotEqual(alerts[2].AlertID, msg.ID)
+	}
+
+	_, err = service.backfillAlerts("nosuchalert", "")
+	assert.Equal(errStreamGap, err)
+}
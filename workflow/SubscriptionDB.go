@@ -0,0 +1,147 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+type SubscriptionDB struct {
+	*ResourceDB
+	mapping string
+}
+
+func NewSubscriptionDB(service *Service, esi elasticsearch.IIndex) (*SubscriptionDB, error) {
+	rdb, err := NewResourceDB(service, esi)
+	if err != nil {
+		return nil, err
+	}
+	sdb := SubscriptionDB{ResourceDB: rdb, mapping: SubscriptionDBMapping}
+	return &sdb, nil
+}
+
+func (db *SubscriptionDB) PostData(subscription *Subscription) error {
+	indexResult, err := db.Esi.PostData(db.mapping, subscription.SubscriptionID.String(), subscription)
+	if err != nil {
+		return LoggedError("SubscriptionDB.PostData failed: %s", err)
+	}
+	if !indexResult.Created {
+		return LoggedError("SubscriptionDB.PostData failed: not created")
+	}
+
+	return nil
+}
+
+func (db *SubscriptionDB) GetAll(format *piazza.JsonPagination, actor string) ([]Subscription, int64, error) {
+	subscriptions := []Subscription{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return subscriptions, 0, err
+	}
+	if !exists {
+		return subscriptions, 0, nil
+	}
+
+	searchResult, err := db.Esi.FilterByMatchAll(db.mapping, format)
+	if err != nil {
+		return nil, 0, LoggedError("SubscriptionDB.GetAll failed: %s", err)
+	}
+	if searchResult == nil {
+		return nil, 0, LoggedError("SubscriptionDB.GetAll failed: no searchResult")
+	}
+
+	if searchResult.GetHits() != nil {
+		for _, hit := range *searchResult.GetHits() {
+			var subscription Subscription
+			if err := json.Unmarshal(*hit.Source, &subscription); err != nil {
+				return nil, 0, err
+			}
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+
+	return subscriptions, searchResult.TotalHits(), nil
+}
+
+func (db *SubscriptionDB) GetSubscriptionsByDslQuery(dslString string, actor string) ([]Subscription, int64, error) {
+	subscriptions := []Subscription{}
+
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil {
+		return subscriptions, 0, err
+	}
+	if !exists {
+		return subscriptions, 0, nil
+	}
+
+	// searched raw, so that mock indices honor the query too
+	var dsl map[string]interface{}
+	if err = json.Unmarshal([]byte(dslString), &dsl); err != nil {
+		return nil, 0, LoggedError("SubscriptionDB.GetSubscriptionsByDslQuery failed: %s", err)
+	}
+	searchResult, err := db.raw.Search(db.mapping, dsl)
+	if err != nil {
+		return nil, 0, LoggedError("SubscriptionDB.GetSubscriptionsByDslQuery failed: %s", err)
+	}
+
+	for _, hit := range searchResult.Hits.Hits {
+		var subscription Subscription
+		if err := json.Unmarshal(*hit.Source, &subscription); err != nil {
+			return nil, 0, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	return subscriptions, searchResult.Hits.Total, nil
+}
+
+func (db *SubscriptionDB) GetOne(id piazza.Ident, actor string) (*Subscription, bool, error) {
+	getResult, err := db.Esi.GetByID(db.mapping, id.String())
+	if err != nil {
+		return nil, false, fmt.Errorf("SubscriptionDB.GetOne failed: %s", err)
+	}
+	if getResult == nil {
+		return nil, true, fmt.Errorf("SubscriptionDB.GetOne failed: %s no getResult", id.String())
+	}
+
+	src := getResult.Source
+	var subscription Subscription
+	if err = json.Unmarshal(*src, &subscription); err != nil {
+		return nil, getResult.Found, err
+	}
+
+	return &subscription, getResult.Found, nil
+}
+
+func (db *SubscriptionDB) DeleteByID(id piazza.Ident, actor string) (bool, error) {
+	deleteResult, err := db.Esi.DeleteByID(db.mapping, string(id))
+	if err != nil {
+		return deleteResult.Found, fmt.Errorf("SubscriptionDB.DeleteById failed: %s", err)
+	}
+	if deleteResult == nil {
+		return false, fmt.Errorf("SubscriptionDB.DeleteById failed: no deleteResult")
+	}
+
+	if !deleteResult.Found {
+		return false, fmt.Errorf("SubscriptionDB.DeleteById failed: not found")
+	}
+
+	return deleteResult.Found, nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// systemEventTypesFileEnv names the file the system EventTypes are read from. If it
+// is not set, systemEventTypesFile is used if present, else the built-in defaults.
+const systemEventTypesFileEnv = "SYSTEM_EVENTTYPES_FILE"
+
+const systemEventTypesFile = "system-eventtypes.json"
+
+// the system EventTypes the service itself posts events of, which every
+// configuration must include
+var requiredSystemEventTypes = []string{ingestTypeName, executeTypeName}
+
+// defaultSystemEventTypes are used when there is no configuration file
+var defaultSystemEventTypes = []SystemEventType{
+	{
+		Name: ingestTypeName,
+		Mapping: map[string]interface{}{
+			"dataId":   "string",
+			"dataType": "string",
+			"epsg":     "integer",
+			"minX":     "double",
+			"minY":     "double",
+			"maxX":     "double",
+			"maxY":     "double",
+			"hosted":   "boolean",
+		},
+		ProtectUpdate: true,
+		ProtectDelete: true,
+		ProtectEvents: true,
+	},
+	{
+		Name: executeTypeName,
+		Mapping: map[string]interface{}{
+			"jobId":  "string",
+			"status": "string",
+			"dataId": "string",
+		},
+		ProtectUpdate: true,
+		ProtectDelete: true,
+		ProtectEvents: true,
+	},
+}
+
+// loadSystemEventTypes reads the system EventTypes from the configured file, or
+// returns the defaults if none is configured
+func loadSystemEventTypes() ([]SystemEventType, string, error) {
+	path := os.Getenv(systemEventTypesFileEnv)
+	if path == "" {
+		if _, err := os.Stat(systemEventTypesFile); err != nil {
+			return defaultSystemEventTypes, "", nil
+		}
+		path = systemEventTypesFile
+	}
+
+	byts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, path, err
+	}
+	config := &SystemEventTypeConfig{}
+	if err = json.Unmarshal(byts, config); err != nil {
+		return nil, path, fmt.Errorf("%s: %s", path, err)
+	}
+	if err = validateSystemEventTypes(config.EventTypes); err != nil {
+		return nil, path, fmt.Errorf("%s: %s", path, err)
+	}
+	return config.EventTypes, path, nil
+}
+
+func validateSystemEventTypes(eventTypes []SystemEventType) error {
+	violations := []string{}
+	seen := map[string]bool{}
+	for i, et := range eventTypes {
+		where := fmt.Sprintf("eventTypes[%d]", i)
+		if et.Name == "" {
+			violations = append(violations, where+": name is required")
+			continue
+		}
+		where = fmt.Sprintf("%s (%s)", where, et.Name)
+		if seen[et.Name] {
+			violations = append(violations, where+": listed more than once")
+		}
+		seen[et.Name] = true
+		if len(et.Mapping) == 0 {
+			violations = append(violations, where+": mapping is required")
+		}
+		for k, v := range mappingVars(et.Mapping) {
+			if strings.Contains(k, "~") {
+				violations = append(violations, fmt.Sprintf("%s: field names cannot contain '~': %s", where, k))
+			}
+			if !isValidEventMappingType(v) {
+				violations = append(violations, fmt.Sprintf("%s: %v is not a valid mapping type", where, v))
+			}
+		}
+		if err := validateFieldSpecs(et.Mapping, et.Fields); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %s", where, err))
+		}
+	}
+	for _, name := range requiredSystemEventTypes {
+		if !seen[name] {
+			violations = append(violations, fmt.Sprintf("%s is required, since the service posts its events", name))
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid system eventTypes: %s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// reconcileSystemEventTypes loads the system EventTypes and brings the stored ones
+// in line: missing ones are created, and ones whose configured mapping only adds
+// optional fields are extended. Any other difference is drift, which is reported and
+// left for an operator, since changing the stored mapping could invalidate events.
+// Running it again changes nothing.
+func (service *Service) reconcileSystemEventTypes() error {
+	eventTypes, path, err := loadSystemEventTypes()
+	if err != nil {
+		return LoggedError("Service.reconcileSystemEventTypes failed: %s", err)
+	}
+	if path == "" {
+		service.syslogger.Info("Using the default system eventTypes")
+	} else {
+		service.syslogger.Info("Using the system eventTypes from %s", path)
+	}
+
+	service.systemEventTypes = map[string]*SystemEventType{}
+	service.systemEventTypeStatus = []SystemEventTypeStatus{}
+	for i := range eventTypes {
+		et := &eventTypes[i]
+		service.systemEventTypes[et.Name] = et
+
+		status := service.reconcileSystemEventType(et)
+		status.CheckedOn = piazza.NewTimeStamp()
+		service.systemEventTypeStatus = append(service.systemEventTypeStatus, status)
+
+		switch status.Status {
+		case SystemEventTypeDrifted:
+			service.syslogger.Warning("System eventType %s has drifted from its configuration: %s", et.Name, status.Message)
+		case SystemEventTypeFailed:
+			service.syslogger.Error("System eventType %s could not be reconciled: %s", et.Name, status.Message)
+		default:
+			service.syslogger.Info("System eventType %s: %s", et.Name, status.Status)
+		}
+	}
+	return nil
+}
+
+func (service *Service) reconcileSystemEventType(et *SystemEventType) SystemEventTypeStatus {
+	status := SystemEventTypeStatus{Name: et.Name}
+	fail := func(format string, args ...interface{}) SystemEventTypeStatus {
+		status.Status = SystemEventTypeFailed
+		status.Message = fmt.Sprintf(format, args...)
+		return status
+	}
+
+	id, found, err := service.eventTypeDB.GetIDByName(nil, et.Name, service.sys.PiazzaSystem)
+	if err != nil {
+		return fail("%s", err)
+	}
+	if !found {
+		resp := service.PostEventType(&EventType{
+			Name:      et.Name,
+			Mapping:   copyData(et.Mapping),
+			Fields:    et.Fields,
+			CreatedBy: service.sys.PiazzaSystem,
+		})
+		if resp.StatusCode != http.StatusCreated {
+			return fail("%s", resp.Message)
+		}
+		status.EventTypeID = resp.Data.(*EventType).EventTypeID
+		status.Status = SystemEventTypeCreated
+		return status
+	}
+
+	status.EventTypeID = *id
+	eventType, version, found, err := service.eventTypeDB.GetOneVersioned(*id)
+	if err != nil || !found {
+		return fail("eventType %s could not be read: %v", *id, err)
+	}
+	current := service.removeUniqueParams(eventType.Name, eventType.Mapping)
+	if reflect.DeepEqual(current, et.Mapping) && sameFieldSpecs(eventType.Fields, et.Fields) {
+		status.Status = SystemEventTypeUnchanged
+		return status
+	}
+
+	violations, retyped := checkMappingCompatible(current, et.Mapping, fieldSpecsByPath(et.Fields))
+	if len(violations) > 0 || len(retyped) > 0 {
+		status.Status = SystemEventTypeDrifted
+		status.Message = strings.Join(append(retyped, violations...), "; ")
+		return status
+	}
+
+	resp := service.updateEventType(eventType, version, &EventTypeUpdate{Mapping: copyData(et.Mapping), Fields: et.Fields})
+	if resp.StatusCode != http.StatusOK {
+		return fail("%s", resp.Message)
+	}
+	status.Status = SystemEventTypeExtended
+	return status
+}
+
+// sameFieldSpecs treats no specs and an empty list as the same
+func sameFieldSpecs(a []FieldSpec, b []FieldSpec) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// systemEventType returns the configuration of the system EventType with the name,
+// or nil if it is not one
+func (service *Service) systemEventType(name string) *SystemEventType {
+	return service.systemEventTypes[name]
+}
+
+// GetSystemEventTypes reports how each system EventType was reconciled at startup
+func (service *Service) GetSystemEventTypes() *piazza.JsonResponse {
+	defer service.handlePanic()
+	return service.statusOK(service.systemEventTypeStatus)
+}
@@ -0,0 +1,73 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemEventTypesFile(t *testing.T) {
+	assert := assert.New(t)
+
+	// the file shipped with the service describes the built-in defaults
+	byts, err := ioutil.ReadFile("../" + systemEventTypesFile)
+	assert.NoError(err)
+	config := &SystemEventTypeConfig{}
+	assert.NoError(json.Unmarshal(byts, config))
+	assert.NoError(validateSystemEventTypes(config.EventTypes))
+	assert.Equal(defaultSystemEventTypes, config.EventTypes)
+}
+
+func TestValidateSystemEventTypes(t *testing.T) {
+	assert := assert.New(t)
+
+	eventTypes := append([]SystemEventType{}, defaultSystemEventTypes...)
+	eventTypes = append(eventTypes, SystemEventType{
+		Name:          "platform:audit",
+		Mapping:       map[string]interface{}{"who": "string", "when": "date"},
+		Fields:        []FieldSpec{{Name: "when", Optional: true}},
+		ProtectDelete: true,
+	})
+	assert.NoError(validateSystemEventTypes(eventTypes))
+
+	err := validateSystemEventTypes([]SystemEventType{
+		defaultSystemEventTypes[0],
+		{Name: "a", Mapping: map[string]interface{}{"x": "nonsense"}},
+		{Name: "a", Mapping: map[string]interface{}{"y": "string"}, Fields: []FieldSpec{{Name: "z"}}},
+		{Mapping: map[string]interface{}{"y": "string"}},
+	})
+	assert.Error(err)
+	for _, msg := range []string{
+		"eventTypes[1] (a): nonsense is not a valid mapping type",
+		"eventTypes[2] (a): listed more than once",
+		"eventTypes[2] (a): invalid field specs",
+		"eventTypes[3]: name is required",
+		"piazza:executionComplete is required",
+	} {
+		assert.Contains(err.Error(), msg)
+	}
+}
+
+func TestSameFieldSpecs(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(sameFieldSpecs(nil, []FieldSpec{}))
+	assert.True(sameFieldSpecs([]FieldSpec{{Name: "a", Optional: true}}, []FieldSpec{{Name: "a", Optional: true}}))
+	assert.False(sameFieldSpecs(nil, []FieldSpec{{Name: "a"}}))
+}
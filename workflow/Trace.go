@@ -0,0 +1,196 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+// a trace holds at most this many events, and as many alerts
+const maxTraceNodes = 1000
+
+var errTraceFull = errors.New("trace is full")
+
+// Kinds of TraceNode
+const (
+	TraceEvent = "event"
+	TraceAlert = "alert"
+)
+
+// TraceNode is an event or an alert in a Trace. An event's children are the alerts
+// it fired and the events it caused directly; an alert's children are the events
+// its job produced.
+type TraceNode struct {
+	Kind     string       `json:"kind"`
+	Event    *Event       `json:"event,omitempty"`
+	Alert    *Alert       `json:"alert,omitempty"`
+	Children []*TraceNode `json:"children,omitempty"`
+}
+
+// Trace is the causal tree of everything sharing a correlationId. There is normally
+// one root; there are more if a parent has been deleted.
+type Trace struct {
+	CorrelationID piazza.Ident `json:"correlationId"`
+	Roots         []*TraceNode `json:"roots"`
+	Truncated     bool         `json:"truncated,omitempty"`
+}
+
+// GetTrace returns the trace that the id is part of. The id may be a correlationId,
+// or the id of any event or alert in the chain.
+func (service *Service) GetTrace(id piazza.Ident) *piazza.JsonResponse {
+	defer service.handlePanic()
+
+	correlationID := service.traceCorrelationID(id)
+
+	service.syslogger.Audit("pz-workflow", "gettingTrace", correlationID, "Service.GetTrace: User is getting trace [%s]", correlationID)
+
+	trace := &Trace{CorrelationID: correlationID}
+	events := []Event{}
+	query := map[string]interface{}{"term": map[string]interface{}{"correlationId": correlationID.String()}}
+	err := service.eventDB.ScanEvents("", query, replayPageSize, "pz-workflow", func(event *Event) error {
+		if len(events) == maxTraceNodes {
+			return errTraceFull
+		}
+		event.Data = service.removeUniqueParams(storedEventTypeName(event), event.Data)
+		events = append(events, *event)
+		return nil
+	})
+	if err == errTraceFull {
+		trace.Truncated = true
+	} else if err != nil {
+		return service.statusInternalError(err)
+	}
+
+	// an event from before correlation ids is a chain of its own
+	if len(events) == 0 {
+		if event := service.traceEvent(correlationID); event != nil {
+			events = append(events, *event)
+		}
+	}
+
+	alerts, hits, err := service.alertDB.GetAllByCorrelationID(correlationID, maxTraceNodes, "pz-workflow")
+	if err != nil {
+		return service.statusInternalError(err)
+	}
+	if hits > int64(len(alerts)) {
+		trace.Truncated = true
+	}
+
+	if len(events) == 0 && len(alerts) == 0 {
+		return service.statusNotFound(fmt.Errorf("nothing to trace for %s", id))
+	}
+
+	trace.Roots = buildTrace(events, alerts)
+
+	service.syslogger.Audit("pz-workflow", "gotTrace", correlationID, "Service.GetTrace: User got trace [%s]", correlationID)
+
+	return service.statusOK(trace)
+}
+
+// traceCorrelationID finds the correlationId of the event or alert with the id; if it
+// is neither, the id is taken to be a correlationId
+func (service *Service) traceCorrelationID(id piazza.Ident) piazza.Ident {
+	if event := service.traceEvent(id); event != nil {
+		if event.CorrelationID != "" {
+			return event.CorrelationID
+		}
+		return event.EventID
+	}
+
+	alert, found, err := service.alertDB.GetOne(id, "pz-workflow")
+	if found && err == nil {
+		if alert.CorrelationID != "" {
+			return alert.CorrelationID
+		}
+		return alert.EventID
+	}
+
+	return id
+}
+
+// traceEvent returns the event with the id, with its data unwrapped, or nil
+func (service *Service) traceEvent(id piazza.Ident) *Event {
+	mapping, err := service.eventDB.lookupEventTypeNameByEventID(id, "pz-workflow")
+	if mapping == "" || err != nil {
+		return nil
+	}
+	event, found, err := service.eventDB.GetOne(mapping, id, "pz-workflow")
+	if !found || err != nil || event == nil {
+		return nil
+	}
+	event.Data = service.removeUniqueParams(mapping, event.Data)
+	return event
+}
+
+// buildTrace arranges the events and alerts of one chain into trees. An event whose
+// data names the job of one of the alerts hangs from that alert, otherwise from its
+// parent event; an alert hangs from its event. Siblings are in order of creation.
+func buildTrace(events []Event, alerts []Alert) []*TraceNode {
+	items := traceItems{}
+	eventNodes := map[piazza.Ident]*TraceNode{}
+	jobNodes := map[piazza.Ident]*TraceNode{}
+
+	for i := range events {
+		node := &TraceNode{Kind: TraceEvent, Event: &events[i]}
+		eventNodes[events[i].EventID] = node
+		items = append(items, traceItem{node, time.Time(events[i].CreatedOn)})
+	}
+	for i := range alerts {
+		node := &TraceNode{Kind: TraceAlert, Alert: &alerts[i]}
+		if alerts[i].JobID != "" {
+			jobNodes[alerts[i].JobID] = node
+		}
+		items = append(items, traceItem{node, time.Time(alerts[i].CreatedOn)})
+	}
+	sort.Stable(items)
+
+	roots := []*TraceNode{}
+	for _, it := range items {
+		var parent *TraceNode
+		if event := it.node.Event; event != nil {
+			if jobID, ok := event.Data["jobId"].(string); ok {
+				parent = jobNodes[piazza.Ident(jobID)]
+			}
+			if parent == nil && event.ParentEventID != "" {
+				parent = eventNodes[event.ParentEventID]
+			}
+		} else {
+			parent = eventNodes[it.node.Alert.EventID]
+		}
+
+		if parent == nil || parent == it.node {
+			roots = append(roots, it.node)
+		} else {
+			parent.Children = append(parent.Children, it.node)
+		}
+	}
+	return roots
+}
+
+type traceItem struct {
+	node      *TraceNode
+	createdOn time.Time
+}
+
+type traceItems []traceItem
+
+func (t traceItems) Len() int           { return len(t) }
+func (t traceItems) Less(i, j int) bool { return t[i].createdOn.Before(t[j].createdOn) }
+func (t traceItems) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
@@ -0,0 +1,122 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+)
+
+func TestBuildTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	at := func(s int) piazza.TimeStamp {
+		return piazza.TimeStamp(time.Date(2016, 8, 1, 0, 0, s, 0, time.UTC))
+	}
+	events := []Event{
+		{EventID: "root", CorrelationID: "root", CreatedOn: at(0)},
+		{EventID: "done", CorrelationID: "root", ParentEventID: "root", CreatedOn: at(2),
+			Data: map[string]interface{}{"jobId": "j1", "status": "Success"}},
+		{EventID: "run", CorrelationID: "root", ParentEventID: "root", CreatedOn: at(3)},
+		{EventID: "orphan", CorrelationID: "root", ParentEventID: "deleted", CreatedOn: at(4)},
+	}
+	alerts := []Alert{
+		{AlertID: "a1", EventID: "root", JobID: "j1", CorrelationID: "root", CreatedOn: at(1)},
+		{AlertID: "a2", EventID: "done", JobID: "j2", CorrelationID: "root", CreatedOn: at(3)},
+	}
+
+	roots := buildTrace(events, alerts)
+	assert.Len(roots, 2)
+
+	root := roots[0]
+	assert.Equal(TraceEvent, root.Kind)
+	assert.Equal(piazza.Ident("root"), root.Event.EventID)
+	assert.Len(root.Children, 2)
+	assert.Equal(TraceAlert, root.Children[0].Kind)
+	assert.Equal(piazza.Ident("a1"), root.Children[0].Alert.AlertID)
+	assert.Equal(piazza.Ident("run"), root.Children[1].Event.EventID)
+
+	// the executionComplete event hangs from the alert whose job it reports on
+	a1 := root.Children[0]
+	assert.Len(a1.Children, 1)
+	done := a1.Children[0]
+	assert.Equal(piazza.Ident("done"), done.Event.EventID)
+	assert.Len(done.Children, 1)
+	assert.Equal(piazza.Ident("a2"), done.Children[0].Alert.AlertID)
+
+	assert.Equal(piazza.Ident("orphan"), roots[1].Event.EventID)
+
+	assert.Len(buildTrace(nil, nil), 0)
+}
+
+// lookupFailer fails searches and type listings while fail is set
+type lookupFailer struct {
+	elasticsearch.IIndex
+	fail *bool
+}
+
+func (f *lookupFailer) SearchByJSON(typ string, jsn string) (*elasticsearch.SearchResult, error) {
+	if *f.fail {
+		return nil, errors.New("search refused")
+	}
+	return f.IIndex.SearchByJSON(typ, jsn)
+}
+
+func (f *lookupFailer) GetTypes() ([]string, error) {
+	if *f.fail {
+		return nil, errors.New("types refused")
+	}
+	return f.IIndex.GetTypes()
+}
+
+func TestCorrelateEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	fail := false
+	service := newTestService(t, func(esi elasticsearch.IIndex) elasticsearch.IIndex {
+		return &lookupFailer{IIndex: esi, fail: &fail}
+	})
+	resp := service.PostEventType(makeTestEventType(makeTestEventTypeName()))
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	eventType := resp.Data.(*EventType)
+	resp = service.PostEvent(makeTestEvent(eventType.EventTypeID))
+	assert.Equal(http.StatusCreated, resp.StatusCode, resp.Message)
+	parent := resp.Data.(*Event)
+
+	// a child joins its parent's chain
+	child := &Event{EventID: "child", ParentEventID: parent.EventID}
+	assert.Nil(service.correlateEvent(child, eventType))
+	assert.Equal(parent.CorrelationID, child.CorrelationID)
+
+	orphan := &Event{EventID: "orphan", ParentEventID: "nosuchevent"}
+	assert.Equal(http.StatusBadRequest, service.correlateEvent(orphan, eventType).StatusCode)
+
+	// a job's event is stored uncorrelated when its alert cannot be looked up
+	fail = true
+	done := &Event{EventID: "done", Data: map[string]interface{}{"jobId": "j1"}}
+	assert.Nil(service.correlateEvent(done, &EventType{Name: executeTypeName}))
+	assert.Empty(done.ParentEventID)
+	assert.Equal(piazza.Ident("done"), done.CorrelationID)
+
+	// but a parent that cannot be looked up is the service's fault, not the poster's
+	child = &Event{EventID: "child", ParentEventID: parent.EventID}
+	assert.Equal(http.StatusInternalServerError, service.correlateEvent(child, eventType).StatusCode)
+}
@@ -69,7 +69,11 @@ func (db *TriggerDB) PostData(trigger *Trigger) error {
 	}
 
 	//log.Printf("Query: %v", wrapper)
-	body, err := json.Marshal(trigger.Condition)
+	query, err := db.percolationQuery(trigger)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(query)
 	if err != nil {
 		return err
 	}
@@ -126,6 +130,26 @@ func (db *TriggerDB) PostData(trigger *Trigger) error {
 	return nil
 }
 
+// percolationQuery is the trigger's condition, narrowed by its geofence if it has one
+func (db *TriggerDB) percolationQuery(trigger *Trigger) (map[string]interface{}, error) {
+	if trigger.Geofence == nil {
+		return trigger.Condition, nil
+	}
+	area, found, err := db.service.areaDB.GetOne(trigger.Geofence.AreaID, trigger.CreatedBy)
+	if err != nil || !found {
+		return nil, LoggedError("TriggerDB.PostData failed: areaOfInterest %s could not be found", trigger.Geofence.AreaID)
+	}
+	fence, err := geofenceClause(trigger.Geofence.Field, trigger.Geofence.fieldType, trigger.Geofence.Relation, area.Geometry)
+	if err != nil {
+		return nil, LoggedError("TriggerDB.PostData failed: %s", err)
+	}
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": []interface{}{trigger.Condition, fence},
+		},
+	}, nil
+}
+
 func (db *TriggerDB) PutTrigger(trigger *Trigger, update *TriggerUpdate, actor string) (*Trigger, error) {
 	trigger.Enabled = update.Enabled
 	strTrigger, err := piazza.StructInterfaceToString(*trigger)
@@ -232,6 +256,25 @@ func (db *TriggerDB) GetOne(id piazza.Ident, actor string) (*Trigger, bool, erro
 	return &obj, getResult.Found, nil
 }
 
+// GetByIDs returns those of the triggers that exist, in no particular order. It is
+// real-time, so it finds triggers that a search would not yet.
+func (db *TriggerDB) GetByIDs(ids []piazza.Ident, actor string) ([]Trigger, error) {
+	sources, err := db.raw.MultiGet(db.mapping, identStrings(ids))
+	if err != nil {
+		return nil, LoggedError("TriggerDB.GetByIDs failed: %s", err)
+	}
+	triggers := make([]Trigger, len(sources))
+	for i, source := range sources {
+		if err = json.Unmarshal(*source, &triggers[i]); err != nil {
+			return nil, LoggedError("TriggerDB.GetByIDs failed: %s", err)
+		}
+		if condition, ok := replaceTilde(triggers[i].Condition).(map[string]interface{}); ok {
+			triggers[i].Condition = condition
+		}
+	}
+	return triggers, nil
+}
+
 func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id piazza.Ident, actor string) ([]Trigger, int64, error) {
 	triggers := []Trigger{}
 
@@ -263,6 +306,32 @@ func (db *TriggerDB) GetTriggersByEventTypeID(format *piazza.JsonPagination, id
 	return triggers, searchResult.TotalHits(), nil
 }
 
+// CountByAreaID returns the number of triggers fenced by the given area
+func (db *TriggerDB) CountByAreaID(id piazza.Ident, actor string) (int64, error) {
+	exists, err := db.Esi.TypeExists(db.mapping)
+	if err != nil || !exists {
+		return 0, err
+	}
+	dsl := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"geofence.areaId": id},
+		},
+		"size": 0,
+	}
+	jsn, err := json.Marshal(dsl)
+	if err != nil {
+		return 0, err
+	}
+	searchResult, err := db.Esi.SearchByJSON(db.mapping, string(jsn))
+	if err != nil {
+		return 0, LoggedError("TriggerDB.CountByAreaID failed: %s", err)
+	}
+	if searchResult == nil {
+		return 0, LoggedError("TriggerDB.CountByAreaID failed: no searchResult")
+	}
+	return searchResult.TotalHits(), nil
+}
+
 func (db *TriggerDB) DeleteTrigger(id piazza.Ident, actor string) (bool, error) {
 	trigger, found, err := db.GetOne(id, actor)
 	if err != nil {
@@ -390,7 +459,12 @@ func (db *TriggerDB) addUniqueParamsToQueryMap(inputObj map[string]interface{},
 		case []interface{}:
 			outputObj[db.getNewKeyName(eventType, k)] = db.addUniqueParamsToQueryArr(v.([]interface{}), eventType)
 		case map[string]interface{}:
-			outputObj[db.getNewKeyName(eventType, k)] = db.addUniqueParamsToQueryMap(v.(map[string]interface{}), eventType)
+			sub := db.addUniqueParamsToQueryMap(v.(map[string]interface{}), eventType)
+			// the path of a nested query names a field by value rather than by key
+			if path, ok := sub["path"].(string); ok && k == "nested" {
+				sub["path"] = db.getNewKeyName(eventType, path)
+			}
+			outputObj[db.getNewKeyName(eventType, k)] = sub
 		default:
 			outputObj[db.getNewKeyName(eventType, k)] = v
 		}
@@ -415,11 +489,13 @@ func (db *TriggerDB) addUniqueParamsToQueryArr(inputObj []interface{}, eventType
 
 func (db *TriggerDB) getNewKeyName(eventType *EventType, key string) string {
 	mapping := db.service.removeUniqueParams(eventType.Name, eventType.Mapping)
-	vars, _ := piazza.GetVarsFromStruct(mapping)
-	for varName := range vars {
+	for varName := range mappingVars(mapping) {
 		if "data."+varName == key {
 			return strings.Replace(key, "data.", "data."+eventType.Name+".", 1)
 		}
 	}
+	if strings.HasPrefix(key, "data.") && isNestedField(mapping, strings.TrimPrefix(key, "data.")) {
+		return strings.Replace(key, "data.", "data."+eventType.Name+".", 1)
+	}
 	return key
 }
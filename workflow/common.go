@@ -18,6 +18,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/venicegeo/dg-pz-gocommon/gocommon"
 )
@@ -32,6 +33,14 @@ type JobRequest struct {
 	JobType   JobType `json:"jobType" binding:"required"`
 }
 
+// JobMessage is what is sent to Kafka for a triggered job: the trigger's JobRequest
+// plus the ids that tie the job back to the event that caused it
+type JobMessage struct {
+	JobRequest
+	CorrelationID piazza.Ident `json:"correlationId,omitempty"`
+	ParentEventID piazza.Ident `json:"parentEventId,omitempty"`
+}
+
 type JobType struct {
 	Data map[string]interface{} `json:"data" binding:"required"`
 	Type string                 `json:"type" binding:"required"`
@@ -40,21 +49,80 @@ type JobType struct {
 // Trigger does something when the and'ed set of Conditions all are true
 // Events are the results of the Conditions queries
 // Job is the JobMessage to submit back to Pz
+// EventTypeVersion is the version of the EventType's schema the Condition was written against
 type Trigger struct {
-	TriggerID     piazza.Ident           `json:"triggerId"`
-	Name          string                 `json:"name" binding:"required"`
-	EventTypeID   piazza.Ident           `json:"eventTypeId" binding:"required"`
-	Condition     map[string]interface{} `json:"condition" binding:"required"`
-	Job           JobRequest             `json:"job" binding:"required"`
-	PercolationID piazza.Ident           `json:"percolationId"`
-	CreatedBy     string                 `json:"createdBy"`
-	CreatedOn     piazza.TimeStamp       `json:"createdOn"`
-	Enabled       bool                   `json:"enabled"`
+	TriggerID        piazza.Ident           `json:"triggerId"`
+	Name             string                 `json:"name" binding:"required"`
+	EventTypeID      piazza.Ident           `json:"eventTypeId" binding:"required"`
+	Condition        map[string]interface{} `json:"condition" binding:"required"`
+	Job              JobRequest             `json:"job" binding:"required"`
+	Geofence         *Geofence              `json:"geofence,omitempty"`
+	Grouping         *AlertGrouping         `json:"grouping,omitempty"`
+	EventTypeVersion int                    `json:"eventTypeVersion,omitempty"`
+	PercolationID    piazza.Ident           `json:"percolationId"`
+	CreatedBy        string                 `json:"createdBy"`
+	CreatedOn        piazza.TimeStamp       `json:"createdOn"`
+	Enabled          bool                   `json:"enabled"`
+}
+
+// Relations between an event's geometry and a Geofence's area
+const (
+	GeofenceIntersects = "intersects"
+	GeofenceWithin     = "within"
+	GeofenceDisjoint   = "disjoint"
+)
+
+// Geofence restricts a Trigger to events whose geo_shape or geo_point Field (e.g.
+// "data.footprint") has the given relation to an AreaOfInterest. The area's geometry
+// is copied into the percolation query when the trigger is created. A geo_point field
+// can only be fenced by a polygon, multipolygon, envelope or circle, and for a point
+// within is the same as intersects.
+type Geofence struct {
+	Field    string       `json:"field" binding:"required"`
+	Relation string       `json:"relation" binding:"required"`
+	AreaID   piazza.Ident `json:"areaId" binding:"required"`
+
+	// fieldType is the mapping type of Field, set when the fence is resolved
+	fieldType string
+}
+
+// AlertGrouping rolls a Trigger's alerts into an Incident: alerts whose events have the
+// same value of Field (e.g. "data.host") join the same incident for as long as each
+// comes within Window, a Go duration such as "15m", of the one before.
+type AlertGrouping struct {
+	Field  string `json:"field" binding:"required"`
+	Window string `json:"window" binding:"required"`
 }
 type TriggerUpdate struct {
 	Enabled bool `json:"enabled"`
 }
 
+// BacktestRequest evaluates a trigger's condition against the stored events of its
+// EventType created in [since, until). Any other trigger fields in the body are ignored.
+// Interval sets the histogram bucket size: "minute", "hour" (the default), "day", "week"
+// or a Go duration such as "15m". MaxSamples, 10 by default, is at most 1000.
+type BacktestRequest struct {
+	EventTypeID piazza.Ident           `json:"eventTypeId" binding:"required"`
+	Condition   map[string]interface{} `json:"condition" binding:"required"`
+	Geofence    *Geofence              `json:"geofence"`
+	Since       time.Time              `json:"since" binding:"required"`
+	Until       time.Time              `json:"until"`
+	Interval    string                 `json:"interval"`
+	MaxSamples  int                    `json:"maxSamples"`
+}
+
+// BacktestResult reports how often a condition would have fired
+type BacktestResult struct {
+	EventTypeID    piazza.Ident      `json:"eventTypeId"`
+	Since          time.Time         `json:"since"`
+	Until          time.Time         `json:"until"`
+	Interval       string            `json:"interval"`
+	TotalEvents    int64             `json:"totalEvents"`
+	MatchCount     int64             `json:"matchCount"`
+	Histogram      []HistogramBucket `json:"histogram"`
+	SampleEventIDs []piazza.Ident    `json:"sampleEventIds"`
+}
+
 // TriggerList is a list of triggers
 type TriggerList []Trigger
 
@@ -64,13 +132,29 @@ const EventDBMapping string = "_default_"
 
 // An Event is posted by some source (service, user, etc) to indicate Something Happened
 // Data is specific to the event type
+//
+// CorrelationID is shared by every event and alert descended from the same root
+// event, and is the root's EventID. ParentEventID is the event that caused this one:
+// the event whose job completed, or the repeating event that this is a run of.
+// EventTypeVersion is the version of the EventType's schema the data was checked against.
 type Event struct {
-	EventID      piazza.Ident           `json:"eventId"`
-	EventTypeID  piazza.Ident           `json:"eventTypeId" binding:"required"`
-	Data         map[string]interface{} `json:"data"`
-	CreatedBy    string                 `json:"createdBy"`
-	CreatedOn    piazza.TimeStamp       `json:"createdOn"`
-	CronSchedule string                 `json:"cronSchedule"`
+	EventID          piazza.Ident           `json:"eventId"`
+	EventTypeID      piazza.Ident           `json:"eventTypeId" binding:"required"`
+	Data             map[string]interface{} `json:"data"`
+	CreatedBy        string                 `json:"createdBy"`
+	CreatedOn        piazza.TimeStamp       `json:"createdOn"`
+	CronSchedule     string                 `json:"cronSchedule"`
+	CorrelationID    piazza.Ident           `json:"correlationId,omitempty"`
+	ParentEventID    piazza.Ident           `json:"parentEventId,omitempty"`
+	Revision         int64                  `json:"revision"`
+	EventTypeVersion int                    `json:"eventTypeVersion,omitempty"`
+}
+
+// EventUpdate corrects an event's data. Revision is that of the event as the caller
+// last read it; the update is refused if the event has changed since.
+type EventUpdate struct {
+	Data     map[string]interface{} `json:"data" binding:"required"`
+	Revision int64                  `json:"revision"`
 }
 
 // EventList is a list of events
@@ -82,12 +166,169 @@ type EventList []Event
 const EventTypeDBMapping string = "EventType"
 
 // EventType describes an Event that is to be sent to workflow by a client or service
+// Version counts changes to the schema (Mapping and Fields), starting at 1, and
+// History holds the schemas it has replaced.
 type EventType struct {
 	EventTypeID piazza.Ident           `json:"eventTypeId"`
 	Name        string                 `json:"name" binding:"required"`
 	Mapping     map[string]interface{} `json:"mapping" binding:"required"`
+	Fields      []FieldSpec            `json:"fields,omitempty"`
 	CreatedBy   string                 `json:"createdBy"`
 	CreatedOn   piazza.TimeStamp       `json:"createdOn"`
+	Revision    int64                  `json:"revision"`
+	Version     int                    `json:"version"`
+	History     []EventTypeSchema      `json:"history,omitempty"`
+}
+
+// EventTypeSchema is one version of an EventType's Mapping and Fields
+type EventTypeSchema struct {
+	Version    int                    `json:"version"`
+	Mapping    map[string]interface{} `json:"mapping"`
+	Fields     []FieldSpec            `json:"fields,omitempty"`
+	ReplacedOn *piazza.TimeStamp      `json:"replacedOn,omitempty"`
+}
+
+// EventTypeUpdate replaces an EventType's mapping and field specs. Normally only
+// changes that leave the existing events valid are allowed: fields may be added, if
+// they are optional, defaulted or computed, but not removed. Force allows the rest,
+// except that a field's type can never change, as the events' Elasticsearch mapping
+// cannot be changed in place.
+type EventTypeUpdate struct {
+	Mapping  map[string]interface{} `json:"mapping" binding:"required"`
+	Fields   []FieldSpec            `json:"fields"`
+	Revision int64                  `json:"revision"`
+	Force    bool                   `json:"force"`
+}
+
+// EventTypeInferenceRequest proposes a mapping for the data of the sample events.
+// With Create, the EventType is created under Name as well, unless the samples
+// conflict.
+type EventTypeInferenceRequest struct {
+	Samples   []map[string]interface{} `json:"samples" binding:"required"`
+	Name      string                   `json:"name"`
+	CreatedBy string                   `json:"createdBy"`
+	Create    bool                     `json:"create"`
+}
+
+// EventTypeInference is the mapping proposed for a set of samples. A field missing
+// from some samples is made optional. Conflicts lists the fields whose samples
+// disagree about their type; Warnings, the fields the samples say too little about.
+// EventType is set if it was created.
+type EventTypeInference struct {
+	Mapping   map[string]interface{} `json:"mapping"`
+	Fields    []FieldSpec            `json:"fields,omitempty"`
+	Samples   int                    `json:"samples"`
+	Conflicts []InferenceConflict    `json:"conflicts,omitempty"`
+	Warnings  []string               `json:"warnings,omitempty"`
+	EventType *EventType             `json:"eventType,omitempty"`
+}
+
+// InferenceConflict is a field whose samples disagree about its type, such as a
+// number in one sample and an object in another. Types maps each type seen to the
+// indexes of the samples it was seen in; Chosen is the type proposed, the one seen
+// in the most samples.
+type InferenceConflict struct {
+	Field  string           `json:"field"`
+	Types  map[string][]int `json:"types"`
+	Chosen string           `json:"chosen"`
+}
+
+// SystemEventTypeConfig is the file listing the system EventTypes
+type SystemEventTypeConfig struct {
+	EventTypes []SystemEventType `json:"eventTypes"`
+}
+
+// SystemEventType is an EventType the platform depends on, created by the service
+// at startup. ProtectUpdate and ProtectDelete stop users updating or deleting it;
+// ProtectEvents stops them updating or deleting its events.
+type SystemEventType struct {
+	Name          string                 `json:"name"`
+	Mapping       map[string]interface{} `json:"mapping"`
+	Fields        []FieldSpec            `json:"fields,omitempty"`
+	ProtectUpdate bool                   `json:"protectUpdate"`
+	ProtectDelete bool                   `json:"protectDelete"`
+	ProtectEvents bool                   `json:"protectEvents"`
+}
+
+// The outcomes of reconciling a system EventType
+const (
+	SystemEventTypeCreated   = "created"
+	SystemEventTypeExtended  = "extended"
+	SystemEventTypeUnchanged = "unchanged"
+	SystemEventTypeDrifted   = "drifted"
+	SystemEventTypeFailed    = "failed"
+)
+
+// SystemEventTypeStatus is how a system EventType was reconciled with its
+// configuration. Message says how it drifted or why it failed.
+type SystemEventTypeStatus struct {
+	Name        string           `json:"name"`
+	EventTypeID piazza.Ident     `json:"eventTypeId,omitempty"`
+	Status      string           `json:"status"`
+	Message     string           `json:"message,omitempty"`
+	CheckedOn   piazza.TimeStamp `json:"checkedOn"`
+}
+
+// EventTypeCascade is what a cascading delete of an EventType removed, or with
+// DryRun would remove. Alerts are only counted if IncludeAlerts was asked for.
+type EventTypeCascade struct {
+	EventTypeID   piazza.Ident   `json:"eventTypeId"`
+	DryRun        bool           `json:"dryRun"`
+	IncludeAlerts bool           `json:"includeAlerts"`
+	CronIDs       []piazza.Ident `json:"cronIds"`
+	TriggerIDs    []piazza.Ident `json:"triggerIds"`
+	Events        int64          `json:"events"`
+	Alerts        int64          `json:"alerts"`
+	Complete      bool           `json:"complete"`
+}
+
+// EventTypeStats is how much an EventType is used. Hourly covers the last day and
+// Daily the days asked for, both oldest first and ending with the current bucket.
+type EventTypeStats struct {
+	EventTypeID      piazza.Ident       `json:"eventTypeId"`
+	Name             string             `json:"name"`
+	Events           int64              `json:"events"`
+	LastEventOn      *piazza.TimeStamp  `json:"lastEventOn,omitempty"`
+	Hourly           []EventCountBucket `json:"hourly"`
+	Daily            []EventCountBucket `json:"daily"`
+	Triggers         int64              `json:"triggers"`
+	EnabledTriggers  int64              `json:"enabledTriggers"`
+	DisabledTriggers int64              `json:"disabledTriggers"`
+	Alerts           int64              `json:"alerts"`
+	CronSchedules    int                `json:"cronSchedules"`
+	ComputedOn       piazza.TimeStamp   `json:"computedOn"`
+}
+
+// EventCountBucket is the number of events created from Start to the next bucket
+type EventCountBucket struct {
+	Start piazza.TimeStamp `json:"start"`
+	Count int64            `json:"count"`
+}
+
+// FieldSpec refines how one field of the Mapping is treated when events are posted.
+// Name is the field's dotted path within the event data, e.g. "location.name".
+// Fields without a spec are required, as are fields whose spec doesn't say otherwise.
+type FieldSpec struct {
+	Name     string         `json:"name" binding:"required"`
+	Optional bool           `json:"optional,omitempty"`
+	Default  interface{}    `json:"default,omitempty"`
+	Enum     []interface{}  `json:"enum,omitempty"`
+	Computed *ComputedField `json:"computed,omitempty"`
+}
+
+// Kinds of ComputedField
+const (
+	ComputedIngestTimestamp = "ingestTimestamp"
+	ComputedConcat          = "concat"
+)
+
+// ComputedField values are filled in by the service when the event is posted,
+// replacing anything the poster sent. An ingestTimestamp is the event's createdOn
+// time; a concat joins the string forms of the named fields with the separator.
+type ComputedField struct {
+	Kind      string   `json:"kind" binding:"required"`
+	Fields    []string `json:"fields,omitempty"`
+	Separator string   `json:"separator,omitempty"`
 }
 
 // EventTypeList is a list of EventTypes
@@ -99,22 +340,254 @@ type EventTypeList []EventType
 const AlertDBMapping string = "Alert"
 
 // Alert is a notification, automatically created when a Trigger happens
+// CorrelationID and ParentEventID are copied from the alert's event.
+// Status, Assignee and Notes are for whoever handles the alert, and may be updated;
+// History records each change of status or assignee, oldest first.
+// The Job fields are the outcome of the alert's job, from its executionComplete event.
 type Alert struct {
-	AlertID   piazza.Ident     `json:"alertId"`
-	TriggerID piazza.Ident     `json:"triggerId"`
-	EventID   piazza.Ident     `json:"eventId"`
-	JobID     piazza.Ident     `json:"jobId"`
-	CreatedBy string           `json:"createdBy"`
-	CreatedOn piazza.TimeStamp `json:"createdOn"`
+	AlertID        piazza.Ident       `json:"alertId"`
+	TriggerID      piazza.Ident       `json:"triggerId"`
+	EventID        piazza.Ident       `json:"eventId"`
+	JobID          piazza.Ident       `json:"jobId"`
+	JobStatus      string             `json:"jobStatus,omitempty"`
+	JobDataID      piazza.Ident       `json:"jobDataId,omitempty"`
+	JobEventID     piazza.Ident       `json:"jobEventId,omitempty"`
+	JobCompletedOn *piazza.TimeStamp  `json:"jobCompletedOn,omitempty"`
+	IncidentID     piazza.Ident       `json:"incidentId,omitempty"`
+	CreatedBy      string             `json:"createdBy"`
+	CreatedOn      piazza.TimeStamp   `json:"createdOn"`
+	CorrelationID  piazza.Ident       `json:"correlationId,omitempty"`
+	ParentEventID  piazza.Ident       `json:"parentEventId,omitempty"`
+	Status         string             `json:"status"`
+	Assignee       string             `json:"assignee,omitempty"`
+	Notes          string             `json:"notes"`
+	History        []AlertStateChange `json:"history,omitempty"`
+	Revision       int64              `json:"revision"`
+	UpdatedOn      *piazza.TimeStamp  `json:"updatedOn,omitempty"`
 }
 
+// The statuses of an Alert. A suppressed alert is one judged not worth handling.
+const (
+	AlertStatusOpen         = "open"
+	AlertStatusAcknowledged = "acknowledged"
+	AlertStatusResolved     = "resolved"
+	AlertStatusSuppressed   = "suppressed"
+)
+
+// The statuses of an Alert's job
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// AlertStateChange is one step of an alert's lifecycle. Assignee is who the alert
+// was assigned to after it.
+type AlertStateChange struct {
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Assignee  string           `json:"assignee,omitempty"`
+	Note      string           `json:"note,omitempty"`
+	ChangedBy string           `json:"changedBy,omitempty"`
+	ChangedOn piazza.TimeStamp `json:"changedOn"`
+}
+
+// AlertStateUpdate moves an alert to Status, which may be its current status when
+// only reassigning it. A nil Assignee leaves it as it is; "" unassigns the alert.
+// Revision is that of the alert as the caller last read it.
+type AlertStateUpdate struct {
+	Status    string  `json:"status" binding:"required"`
+	Assignee  *string `json:"assignee"`
+	Note      string  `json:"note"`
+	ChangedBy string  `json:"changedBy"`
+	Revision  int64   `json:"revision"`
+}
+
+// AlertUpdate changes an alert's status and notes; empty fields are left as they are.
+// Revision is that of the alert as the caller last read it.
+type AlertUpdate struct {
+	Status   string  `json:"status"`
+	Notes    *string `json:"notes"`
+	Revision int64   `json:"revision"`
+}
+
+// AlertExt is an Alert with, as inflate= asks, its trigger, its event and its job's
+// executionComplete event once there is one, and the incident it was grouped into
 type AlertExt struct {
-	AlertID   piazza.Ident     `json:"alertId"`
-	Trigger   Trigger          `json:"trigger" binding:"required"`
-	Event     Event            `json:"event" binding:"required"`
-	JobID     piazza.Ident     `json:"jobId"`
-	CreatedBy string           `json:"createdBy"`
-	CreatedOn piazza.TimeStamp `json:"createdOn"`
+	Alert
+	Trigger   *Trigger  `json:"trigger,omitempty"`
+	Event     *Event    `json:"event,omitempty"`
+	JobResult *Event    `json:"jobResult,omitempty"`
+	Incident  *Incident `json:"incident,omitempty"`
+}
+
+// AlertSummary counts the alerts created in [Since, Until), in groups largest first,
+// and over time
+type AlertSummary struct {
+	Since       time.Time         `json:"since"`
+	Until       time.Time         `json:"until"`
+	Interval    string            `json:"interval"`
+	Total       int64             `json:"total"`
+	ByTrigger   []AlertGroupCount `json:"byTrigger"`
+	ByEventType []AlertGroupCount `json:"byEventType"`
+	ByCreatedBy []AlertGroupCount `json:"byCreatedBy"`
+	Histogram   []HistogramBucket `json:"histogram"`
+}
+
+// AlertGroupCount is the number of alerts sharing a trigger, EventType or creator,
+// named by Key, the id or user, with the trigger's or EventType's name if it has one
+type AlertGroupCount struct {
+	Key   string `json:"key"`
+	Name  string `json:"name,omitempty"`
+	Count int64  `json:"count"`
+}
+
+//-AREA OF INTEREST-------------------------------------------------------------
+
+// AreaOfInterestDBMapping is the name of the Elasticsearch type to which AreasOfInterest are added
+const AreaOfInterestDBMapping string = "AreaOfInterest"
+
+// AreaOfInterest is a named GeoJSON polygon (or multipolygon) that triggers can be fenced by
+type AreaOfInterest struct {
+	AreaID      piazza.Ident           `json:"areaId"`
+	Name        string                 `json:"name" binding:"required"`
+	Description string                 `json:"description"`
+	Geometry    map[string]interface{} `json:"geometry" binding:"required"`
+	CreatedBy   string                 `json:"createdBy"`
+	CreatedOn   piazza.TimeStamp       `json:"createdOn"`
+}
+
+//-INCIDENT--------------------------------------------------------------------
+
+// IncidentDBMapping is the name of the Elasticsearch type to which Incidents are added
+const IncidentDBMapping string = "Incident"
+
+// Incident is a roll-up of the alerts of one Trigger whose events share a value of
+// the trigger's grouping field. The representative event is the first one.
+type Incident struct {
+	IncidentID            piazza.Ident     `json:"incidentId"`
+	TriggerID             piazza.Ident     `json:"triggerId"`
+	GroupField            string           `json:"groupField"`
+	GroupValue            string           `json:"groupValue"`
+	AlertCount            int64            `json:"alertCount"`
+	FirstSeen             piazza.TimeStamp `json:"firstSeen"`
+	LastSeen              piazza.TimeStamp `json:"lastSeen"`
+	RepresentativeEventID piazza.Ident     `json:"representativeEventId"`
+	CreatedBy             string           `json:"createdBy"`
+}
+
+// IncidentExt is an Incident with, as inflate= asks, its trigger and representative event
+type IncidentExt struct {
+	Incident
+	Trigger             *Trigger `json:"trigger,omitempty"`
+	RepresentativeEvent *Event   `json:"representativeEvent,omitempty"`
+}
+
+//-SUBSCRIPTION-----------------------------------------------------------------
+
+// SubscriptionDBMapping is the name of the Elasticsearch type to which Subscriptions are added
+const SubscriptionDBMapping string = "Subscription"
+
+// DeliveryDBMapping is the name of the Elasticsearch type to which Deliveries are added
+const DeliveryDBMapping string = "Delivery"
+
+// Subscription sends the alerts of a trigger, of the triggers of an EventType, or
+// created by someone, through a channel. The criteria given must all match; at least
+// one must be given. Only alerts created after the subscription are sent.
+type Subscription struct {
+	SubscriptionID piazza.Ident        `json:"subscriptionId"`
+	TriggerID      piazza.Ident        `json:"triggerId,omitempty"`
+	EventTypeID    piazza.Ident        `json:"eventTypeId,omitempty"`
+	AlertCreatedBy string              `json:"alertCreatedBy,omitempty"`
+	Channel        NotificationChannel `json:"channel" binding:"required"`
+	CreatedBy      string              `json:"createdBy"`
+	CreatedOn      piazza.TimeStamp    `json:"createdOn"`
+}
+
+// The kinds of NotificationChannel
+const (
+	ChannelWebhook = "webhook"
+	ChannelSMTP    = "smtp"
+)
+
+// NotificationChannel is where a Subscription's alerts go: a webhook URL, which is
+// POSTed each alert as JSON, or the email addresses in To
+type NotificationChannel struct {
+	Type string   `json:"type" binding:"required"`
+	URL  string   `json:"url,omitempty"`
+	To   []string `json:"to,omitempty"`
+}
+
+// The statuses of a Delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is the sending of one alert to one Subscription. A pending delivery is
+// tried again at NextAttemptOn; one that fails too many times is failed.
+type Delivery struct {
+	DeliveryID     piazza.Ident      `json:"deliveryId"`
+	AlertID        piazza.Ident      `json:"alertId"`
+	SubscriptionID piazza.Ident      `json:"subscriptionId"`
+	Channel        string            `json:"channel"`
+	Status         string            `json:"status"`
+	Attempts       []DeliveryAttempt `json:"attempts"`
+	NextAttemptOn  *piazza.TimeStamp `json:"nextAttemptOn,omitempty"`
+	CreatedOn      piazza.TimeStamp  `json:"createdOn"`
+	DeliveredOn    *piazza.TimeStamp `json:"deliveredOn,omitempty"`
+}
+
+// DeliveryAttempt is one try at a Delivery; Error is empty if it succeeded
+type DeliveryAttempt struct {
+	AttemptedOn piazza.TimeStamp `json:"attemptedOn"`
+	Error       string           `json:"error,omitempty"`
+}
+
+//-REPLAY-----------------------------------------------------------------------
+
+// ReplayRequest asks for the stored events of one EventType, created in [since, until),
+// to be re-percolated through the current triggers. TriggerIDs, if given, limits which
+// triggers may fire. A DryRun counts matches without submitting jobs or creating alerts.
+type ReplayRequest struct {
+	EventTypeID piazza.Ident   `json:"eventTypeId" binding:"required"`
+	Since       time.Time      `json:"since" binding:"required"`
+	Until       time.Time      `json:"until"`
+	TriggerIDs  []piazza.Ident `json:"triggerIds"`
+	DryRun      bool           `json:"dryRun"`
+	Refire      bool           `json:"refire"`
+	CreatedBy   string         `json:"createdBy"`
+}
+
+const (
+	ReplayStatusRunning   = "running"
+	ReplayStatusCompleted = "completed"
+	ReplayStatusCancelled = "cancelled"
+	ReplayStatusFailed    = "failed"
+)
+
+// ReplayDBMapping is the name of the Elasticsearch type to which replays are added
+const ReplayDBMapping string = "Replay"
+
+// ReplayJob reports the progress of a replay. AlertsSkipped counts the matches that
+// were not fired because the trigger already had an alert for the event.
+type ReplayJob struct {
+	ReplayID        piazza.Ident         `json:"replayId"`
+	Request         ReplayRequest        `json:"request"`
+	Status          string               `json:"status"`
+	Message         string               `json:"message,omitempty"`
+	TotalEvents     int64                `json:"totalEvents"`
+	EventsProcessed int64                `json:"eventsProcessed"`
+	JobsSubmitted   int64                `json:"jobsSubmitted"`
+	AlertsSkipped   int64                `json:"alertsSkipped"`
+	Matches         map[piazza.Ident]int `json:"matches"`
+	Errors          []string             `json:"errors"`
+	CancelRequested bool                 `json:"cancelRequested,omitempty"`
+	CreatedOn       piazza.TimeStamp     `json:"createdOn"`
+	CompletedOn     *piazza.TimeStamp    `json:"completedOn,omitempty"`
 }
 
 //-CRON-------------------------------------------------------------------------
@@ -158,6 +631,67 @@ func (stats *Stats) IncrTriggerJobs() {
 
 //-UTILITY----------------------------------------------------------------------
 
+// HistogramBucket counts what happened in [Start, Start+interval)
+type HistogramBucket struct {
+	Start time.Time `json:"start"`
+	Count int64     `json:"count"`
+}
+
+const maxHistogramBuckets = 10000
+
+type histogram struct {
+	since    time.Time
+	interval time.Duration
+	Buckets  []HistogramBucket
+}
+
+func newHistogram(since time.Time, until time.Time, interval time.Duration) (*histogram, error) {
+	if interval <= 0 {
+		return nil, errors.New("histogram interval must be positive")
+	}
+	span := until.Sub(since)
+	n := int(span / interval)
+	if span%interval != 0 {
+		n++
+	}
+	if n > maxHistogramBuckets {
+		return nil, fmt.Errorf("histogram would have %d buckets, the limit is %d", n, maxHistogramBuckets)
+	}
+	h := &histogram{since: since, interval: interval, Buckets: make([]HistogramBucket, n)}
+	for i := range h.Buckets {
+		h.Buckets[i].Start = since.Add(time.Duration(i) * interval)
+	}
+	return h, nil
+}
+
+// fill sets each bucket's count from a date_histogram's, keyed by the start of the
+// bucket in milliseconds since the epoch
+func (h *histogram) fill(counts map[int64]int64) {
+	for i := range h.Buckets {
+		h.Buckets[i].Count = counts[epochMillis(h.Buckets[i].Start)]
+	}
+}
+
+// parseInterval accepts "minute", "hour", "day", "week" or a Go duration.
+// The empty string is an hour.
+func parseInterval(s string) (time.Duration, error) {
+	switch s {
+	case "minute":
+		return time.Minute, nil
+	case "", "hour":
+		return time.Hour, nil
+	case "day":
+		return 24 * time.Hour, nil
+	case "week":
+		return 7 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("Unrecognized interval: %s", s)
+	}
+	return d, nil
+}
+
 // LoggedError logs the error's message and creates an error
 func LoggedError(mssg string, args ...interface{}) error {
 	str := fmt.Sprintf(mssg, args...)
@@ -170,6 +704,19 @@ func LoggedError(mssg string, args ...interface{}) error {
 func init() {
 	piazza.JsonResponseDataTypes["*workflow.EventType"] = "eventtype"
 	piazza.JsonResponseDataTypes["[]workflow.EventType"] = "eventtype-list"
+	piazza.JsonResponseDataTypes["[]workflow.EventTypeSchema"] = "eventtypeschema-list"
+	piazza.JsonResponseDataTypes["*workflow.EventTypeInference"] = "eventtypeinference"
+	piazza.JsonResponseDataTypes["[]workflow.SystemEventTypeStatus"] = "systemeventtype-list"
+	piazza.JsonResponseDataTypes["*workflow.EventTypeCascade"] = "eventtypecascade"
+	piazza.JsonResponseDataTypes["*workflow.EventTypeStats"] = "eventtypestats"
+	piazza.JsonResponseDataTypes["*workflow.Incident"] = "incident"
+	piazza.JsonResponseDataTypes["[]workflow.Incident"] = "incident-list"
+	piazza.JsonResponseDataTypes["*workflow.IncidentExt"] = "incidentext"
+	piazza.JsonResponseDataTypes["[]workflow.IncidentExt"] = "incidentext-list"
+	piazza.JsonResponseDataTypes["*workflow.Subscription"] = "subscription"
+	piazza.JsonResponseDataTypes["[]workflow.Subscription"] = "subscription-list"
+	piazza.JsonResponseDataTypes["[]workflow.Delivery"] = "delivery-list"
+	piazza.JsonResponseDataTypes["workflow.JsonSchema"] = "jsonschema"
 	piazza.JsonResponseDataTypes["*workflow.Event"] = "event"
 	piazza.JsonResponseDataTypes["[]workflow.Event"] = "event-list"
 	piazza.JsonResponseDataTypes["*workflow.Trigger"] = "trigger"
@@ -177,6 +724,12 @@ func init() {
 	piazza.JsonResponseDataTypes["*workflow.Alert"] = "alert"
 	piazza.JsonResponseDataTypes["[]workflow.Alert"] = "alert-list"
 	piazza.JsonResponseDataTypes["[]workflow.AlertExt"] = "alertext-list"
+	piazza.JsonResponseDataTypes["*workflow.AlertSummary"] = "alertsummary"
+	piazza.JsonResponseDataTypes["*workflow.AreaOfInterest"] = "areaofinterest"
+	piazza.JsonResponseDataTypes["[]workflow.AreaOfInterest"] = "areaofinterest-list"
+	piazza.JsonResponseDataTypes["*workflow.BacktestResult"] = "backtest"
+	piazza.JsonResponseDataTypes["*workflow.Trace"] = "trace"
+	piazza.JsonResponseDataTypes["*workflow.ReplayJob"] = "replay"
 	piazza.JsonResponseDataTypes["workflow.Stats"] = "workflowstats"
 	piazza.JsonResponseDataTypes["*workflow.TestElasticsearchBody"] = "testelasticsearch"
 	piazza.JsonResponseDataTypes["[]workflow.TestElasticsearchBody"] = "testelasticsearch-list"
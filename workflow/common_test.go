@@ -0,0 +1,86 @@
+// Copyright 2016, RadiantBlue Technologies, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workflow
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/venicegeo/dg-pz-gocommon/elasticsearch"
+	"github.com/venicegeo/dg-pz-gocommon/gocommon"
+	pzsyslog "github.com/venicegeo/dg-pz-gocommon/syslog"
+)
+
+// newTestService starts a service on mock indices, as the test kit does. If wrap is
+// given, each index is used through what it returns.
+func newTestService(t *testing.T, wrap func(elasticsearch.IIndex) elasticsearch.IIndex) *Service {
+	sys, err := piazza.NewSystemConfig(piazza.PzWorkflow, []piazza.ServiceName{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indices := map[string]elasticsearch.IIndex{}
+	for key, esi := range *(&Kit{}).makeMockIndices() {
+		if wrap != nil {
+			esi = wrap(esi)
+		}
+		indices[key] = esi
+	}
+	service := &Service{}
+	if err = service.Init(sys, &pzsyslog.NilWriter{}, &pzsyslog.NilWriter{}, &indices); err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// testQueryParams returns the query parameters of the URL
+func testQueryParams(t *testing.T, url string) *piazza.HttpQueryParams {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return piazza.NewQueryParams(req)
+}
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := parseInterval("")
+	assert.NoError(err)
+	assert.Equal(time.Hour, d)
+	d, err = parseInterval("15m")
+	assert.NoError(err)
+	assert.Equal(15*time.Minute, d)
+	_, err = parseInterval("fortnight")
+	assert.Error(err)
+
+	since := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	h, err := newHistogram(since, since.Add(150*time.Minute), time.Hour)
+	assert.NoError(err)
+	assert.Len(h.Buckets, 3)
+
+	assert.Equal(since.Add(2*time.Hour), h.Buckets[2].Start)
+
+	h.fill(map[int64]int64{epochMillis(since.Add(time.Hour)): 4, epochMillis(since.Add(-time.Hour)): 9})
+	assert.EqualValues(0, h.Buckets[0].Count)
+	assert.EqualValues(4, h.Buckets[1].Count)
+	assert.EqualValues(0, h.Buckets[2].Count)
+
+	_, err = newHistogram(since, since.Add(time.Hour), 0)
+	assert.Error(err)
+	_, err = newHistogram(since, since.AddDate(10, 0, 0), time.Minute)
+	assert.Error(err)
+}